@@ -0,0 +1,801 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Clarkson backups. A backup is a zip holding backup.json and the attachment
+// files under attachments/. Records keep their original IDs, which are only
+// used to link records inside the backup; a restore creates new IDs.
+//
+// Version history:
+//   1 - {version: "1.0", vehicles: [{vehicle, fuel, expenses, reminders}]}
+//   2 - the Backup struct below
+
+const backupFormat = "clarkson-backup"
+const backupVersion = 2
+
+// Backup is the content of backup.json
+type Backup struct {
+	Format        string               `json:"format"`  // Always "clarkson-backup"
+	Version       int                  `json:"version"` // 2
+	ExportedAt    time.Time            `json:"exported_at"`
+	Vehicles      []BackupVehicle      `json:"vehicles"`
+	FuelEntries   []BackupFuelEntry    `json:"fuel_entries"`
+	Expenses      []BackupExpense      `json:"expenses"`
+	Reminders     []BackupReminder     `json:"reminders"`
+	Notifications []BackupNotification `json:"notifications"`
+	Shares        []BackupShare        `json:"shares"`
+	Attachments   []BackupAttachment   `json:"attachments"`
+}
+
+type BackupVehicle struct {
+	ID              uint      `json:"id"`
+	Make            string    `json:"make"`
+	Model           string    `json:"model"`
+	Year            int       `json:"year"`
+	Odometer        float64   `json:"odometer"`
+	MileageUnit     string    `json:"mileage_unit"`
+	FuelType        string    `json:"fuel_type"`
+	RemindersPaused bool      `json:"reminders_paused"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type BackupFuelEntry struct {
+	ID           uint      `json:"id"`
+	VehicleID    uint      `json:"vehicle_id"`
+	Date         time.Time `json:"date"`
+	Gallons      float64   `json:"gallons"`
+	Price        float64   `json:"price"` // Total cost of the fill-up
+	Odometer     float64   `json:"odometer"`
+	Location     string    `json:"location"`
+	Notes        string    `json:"notes"`
+	PartialFill  bool      `json:"partial_fill"`
+	MissedFillup bool      `json:"missed_fillup"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type BackupExpense struct {
+	ID        uint      `json:"id"`
+	VehicleID uint      `json:"vehicle_id"`
+	Category  string    `json:"category"`
+	Amount    float64   `json:"amount"`
+	Date      time.Time `json:"date"`
+	Notes     string    `json:"notes"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type BackupReminder struct {
+	ID                uint       `json:"id"`
+	VehicleID         uint       `json:"vehicle_id"`
+	Name              string     `json:"name"`
+	IntervalMiles     float64    `json:"interval_miles"`
+	IntervalDays      int        `json:"interval_days"`
+	LastServiceDate   time.Time  `json:"last_service_date"`
+	LastServiceMiles  float64    `json:"last_service_miles"`
+	DueDate           *time.Time `json:"due_date"`
+	DueMiles          float64    `json:"due_miles"`
+	SnoozedUntil      *time.Time `json:"snoozed_until"`
+	SnoozedUntilMiles float64    `json:"snoozed_until_miles"`
+	CompletedAt       *time.Time `json:"completed_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+type BackupNotification struct {
+	ID          uint       `json:"id"`
+	VehicleID   uint       `json:"vehicle_id"`
+	ReminderID  uint       `json:"reminder_id"`
+	Type        string     `json:"type"`
+	Title       string     `json:"title"`
+	Message     string     `json:"message"`
+	Status      string     `json:"status"`
+	Delivery    string     `json:"delivery"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DismissedAt *time.Time `json:"dismissed_at"`
+}
+
+// BackupShare grants another user access to a vehicle. Users are matched by
+// email on restore.
+type BackupShare struct {
+	VehicleID uint      `json:"vehicle_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type BackupAttachment struct {
+	ID        uint      `json:"id"`
+	EntryType string    `json:"entry_type"` // fuelentry (or fuel), expense, vehicle
+	EntryID   uint      `json:"entry_id"`
+	Filename  string    `json:"filename"`
+	File      string    `json:"file"` // Path inside the zip, empty if the file was missing
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BackupError describes a record that couldn't be restored
+type BackupError struct {
+	Type  string `json:"type"`
+	ID    uint   `json:"id"`
+	Error string `json:"error"`
+}
+
+func isFuelAttachment(entryType string) bool {
+	return entryType == "fuelentry" || entryType == "fuel"
+}
+
+// buildBackup collects everything the user owns
+func (app *Application) buildBackup(userID uint) (Backup, error) {
+	backup := Backup{
+		Format:     backupFormat,
+		Version:    backupVersion,
+		ExportedAt: time.Now().UTC(),
+	}
+
+	var vehicles []Vehicle
+	if err := app.db.Where("user_id = ?", userID).Order("id").Find(&vehicles).Error; err != nil {
+		return backup, err
+	}
+	var ids []uint
+	for _, v := range vehicles {
+		ids = append(ids, v.ID)
+		backup.Vehicles = append(backup.Vehicles, BackupVehicle{
+			ID: v.ID, Make: v.Make, Model: v.Model, Year: v.Year, Odometer: v.Odometer,
+			MileageUnit: v.MileageUnit, FuelType: v.FuelType, RemindersPaused: v.RemindersPaused,
+			CreatedAt: v.CreatedAt, UpdatedAt: v.UpdatedAt,
+		})
+	}
+	ids = append(ids, 0) // Keeps IN () valid when there are no vehicles
+
+	var fuelEntries []FuelEntry
+	if err := app.db.Where("vehicle_id IN ?", ids).Order("id").Find(&fuelEntries).Error; err != nil {
+		return backup, err
+	}
+	var fuelIDs []uint
+	for _, f := range fuelEntries {
+		fuelIDs = append(fuelIDs, f.ID)
+		backup.FuelEntries = append(backup.FuelEntries, BackupFuelEntry{
+			ID: f.ID, VehicleID: f.VehicleID, Date: f.Date, Gallons: f.Gallons, Price: f.Price,
+			Odometer: f.Odometer, Location: f.Location, Notes: f.Notes,
+			PartialFill: f.PartialFill, MissedFillup: f.MissedFillup,
+			CreatedAt: f.CreatedAt, UpdatedAt: f.UpdatedAt,
+		})
+	}
+
+	var expenses []Expense
+	if err := app.db.Where("vehicle_id IN ?", ids).Order("id").Find(&expenses).Error; err != nil {
+		return backup, err
+	}
+	var expenseIDs []uint
+	for _, e := range expenses {
+		expenseIDs = append(expenseIDs, e.ID)
+		backup.Expenses = append(backup.Expenses, BackupExpense{
+			ID: e.ID, VehicleID: e.VehicleID, Category: e.Category, Amount: e.Amount, Date: e.Date,
+			Notes: e.Notes, CreatedAt: e.CreatedAt, UpdatedAt: e.UpdatedAt,
+		})
+	}
+
+	var reminders []MaintenanceReminder
+	if err := app.db.Where("vehicle_id IN ?", ids).Order("id").Find(&reminders).Error; err != nil {
+		return backup, err
+	}
+	for _, r := range reminders {
+		backup.Reminders = append(backup.Reminders, BackupReminder{
+			ID: r.ID, VehicleID: r.VehicleID, Name: r.Name, IntervalMiles: r.IntervalMiles,
+			IntervalDays: r.IntervalDays, LastServiceDate: r.LastServiceDate, LastServiceMiles: r.LastServiceMiles,
+			DueDate: r.DueDate, DueMiles: r.DueMiles, SnoozedUntil: r.SnoozedUntil,
+			SnoozedUntilMiles: r.SnoozedUntilMiles, CompletedAt: r.CompletedAt,
+			CreatedAt: r.CreatedAt, UpdatedAt: r.UpdatedAt,
+		})
+	}
+
+	// Only notifications about the user's own vehicles: ones about vehicles
+	// shared with them would fail to restore
+	var notifications []Notification
+	if err := app.db.Where("user_id = ? AND vehicle_id IN ?", userID, ids).Order("id").Find(&notifications).Error; err != nil {
+		return backup, err
+	}
+	for _, n := range notifications {
+		backup.Notifications = append(backup.Notifications, BackupNotification{
+			ID: n.ID, VehicleID: n.VehicleID, ReminderID: n.ReminderID, Type: n.Type, Title: n.Title,
+			Message: n.Message, Status: n.Status, Delivery: n.Delivery,
+			CreatedAt: n.CreatedAt, DismissedAt: n.DismissedAt,
+		})
+	}
+
+	var shares []struct {
+		VehicleID uint
+		Email     string
+		CreatedAt time.Time
+	}
+	if err := app.db.Table("vehicle_users").
+		Select("vehicle_users.vehicle_id, users.email, vehicle_users.created_at").
+		Joins("JOIN users ON users.id = vehicle_users.user_id").
+		Where("vehicle_users.vehicle_id IN ?", ids).
+		Order("vehicle_users.id").
+		Scan(&shares).Error; err != nil {
+		return backup, err
+	}
+	for _, s := range shares {
+		backup.Shares = append(backup.Shares, BackupShare{VehicleID: s.VehicleID, Email: s.Email, CreatedAt: s.CreatedAt})
+	}
+
+	var attachments []Attachment
+	if err := app.db.
+		Where("(entry_type IN ? AND entry_id IN ?) OR (entry_type = ? AND entry_id IN ?) OR (entry_type = ? AND entry_id IN ?)",
+			[]string{"fuel", "fuelentry"}, append(fuelIDs, 0), "expense", append(expenseIDs, 0), "vehicle", ids).
+		Order("id").
+		Find(&attachments).Error; err != nil {
+		return backup, err
+	}
+	for _, a := range attachments {
+		ba := BackupAttachment{
+			ID: a.ID, EntryType: a.EntryType, EntryID: a.EntryID, Filename: a.Filename, CreatedAt: a.CreatedAt,
+		}
+		if _, err := os.Stat(a.Path); err == nil {
+			ba.File = fmt.Sprintf("attachments/%d-%s", a.ID, filepath.Base(a.Path))
+		}
+		backup.Attachments = append(backup.Attachments, ba)
+	}
+
+	return backup, nil
+}
+
+// exportBackup streams a zip of backup.json and the attachment files
+func (app *Application) exportBackup(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	backup, err := app.buildBackup(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to build backup"})
+		return
+	}
+
+	var attachments []Attachment
+	app.db.Where("id IN ?", backupAttachmentIDs(backup)).Find(&attachments)
+	paths := make(map[uint]string)
+	for _, a := range attachments {
+		paths[a.ID] = a.Path
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=clarkson-backup-%s.zip", time.Now().Format("2006-01-02")))
+	c.Header("Content-Type", "application/zip")
+	c.Status(200)
+
+	zw := zip.NewWriter(c.Writer)
+	w, err := zw.Create("backup.json")
+	if err == nil {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(backup)
+	}
+	for _, a := range backup.Attachments {
+		if err != nil {
+			break
+		}
+		if a.File == "" {
+			continue
+		}
+		err = copyFileToZip(zw, a.File, paths[a.ID])
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// Headers are already sent, so the download is left truncated
+		requestLogger(c).Error("backup export failed", "error", err)
+	}
+}
+
+func backupAttachmentIDs(backup Backup) []uint {
+	ids := []uint{0}
+	for _, a := range backup.Attachments {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func copyFileToZip(zw *zip.Writer, name, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// exportJSON returns backup.json on its own, without attachment files
+func (app *Application) exportJSON(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	backup, err := app.buildBackup(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to build backup"})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=clarkson-backup.json")
+	c.JSON(200, backup)
+}
+
+// legacyBackup is the version 1 JSON export
+type legacyBackup struct {
+	Vehicles []struct {
+		Vehicle   Vehicle               `json:"vehicle"`
+		Fuel      []FuelEntry           `json:"fuel"`
+		Expenses  []Expense             `json:"expenses"`
+		Reminders []MaintenanceReminder `json:"reminders"`
+	} `json:"vehicles"`
+}
+
+// parseBackupJSON reads backup.json, upgrading a version 1 export
+func parseBackupJSON(body []byte) (Backup, error) {
+	var probe struct {
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return Backup{}, fmt.Errorf("not a Clarkson backup: %v", err)
+	}
+
+	if probe.Format == backupFormat {
+		var backup Backup
+		if err := json.Unmarshal(body, &backup); err != nil {
+			return backup, fmt.Errorf("invalid backup: %v", err)
+		}
+		if backup.Version > backupVersion {
+			return backup, fmt.Errorf("backup version %d is newer than this server supports (%d)", backup.Version, backupVersion)
+		}
+		return backup, nil
+	}
+
+	var legacy legacyBackup
+	if err := json.Unmarshal(body, &legacy); err != nil {
+		return Backup{}, fmt.Errorf("invalid version 1 backup: %v", err)
+	}
+
+	backup := Backup{Format: backupFormat, Version: 1}
+	for _, lv := range legacy.Vehicles {
+		v := lv.Vehicle
+		backup.Vehicles = append(backup.Vehicles, BackupVehicle{
+			ID: v.ID, Make: v.Make, Model: v.Model, Year: v.Year, Odometer: v.Odometer,
+			MileageUnit: v.MileageUnit, FuelType: v.FuelType, RemindersPaused: v.RemindersPaused,
+			CreatedAt: v.CreatedAt, UpdatedAt: v.UpdatedAt,
+		})
+		for _, f := range lv.Fuel {
+			backup.FuelEntries = append(backup.FuelEntries, BackupFuelEntry{
+				ID: f.ID, VehicleID: v.ID, Date: f.Date, Gallons: f.Gallons, Price: f.Price,
+				Odometer: f.Odometer, Location: f.Location, Notes: f.Notes,
+				PartialFill: f.PartialFill, MissedFillup: f.MissedFillup,
+				CreatedAt: f.CreatedAt, UpdatedAt: f.UpdatedAt,
+			})
+		}
+		for _, e := range lv.Expenses {
+			backup.Expenses = append(backup.Expenses, BackupExpense{
+				ID: e.ID, VehicleID: v.ID, Category: e.Category, Amount: e.Amount, Date: e.Date,
+				Notes: e.Notes, CreatedAt: e.CreatedAt, UpdatedAt: e.UpdatedAt,
+			})
+		}
+		for _, r := range lv.Reminders {
+			backup.Reminders = append(backup.Reminders, BackupReminder{
+				ID: r.ID, VehicleID: v.ID, Name: r.Name, IntervalMiles: r.IntervalMiles,
+				IntervalDays: r.IntervalDays, LastServiceDate: r.LastServiceDate, LastServiceMiles: r.LastServiceMiles,
+				DueDate: r.DueDate, DueMiles: r.DueMiles, SnoozedUntil: r.SnoozedUntil,
+				SnoozedUntilMiles: r.SnoozedUntilMiles, CompletedAt: r.CompletedAt,
+				CreatedAt: r.CreatedAt, UpdatedAt: r.UpdatedAt,
+			})
+		}
+	}
+	return backup, nil
+}
+
+// backupRestore restores one backup inside a transaction, mapping the
+// backup's IDs to the newly created ones
+type backupRestore struct {
+	tx         *gorm.DB
+	userID     uint
+	files      map[string]*zip.File
+	assetsPath string
+	limits     *extractLimits
+
+	vehicles  map[uint]uint
+	fuel      map[uint]uint
+	expenses  map[uint]uint
+	reminders map[uint]uint
+
+	counts  map[string]int
+	errors  []BackupError
+	written []string // Attachment files to remove if the restore is rolled back
+}
+
+// create inserts one record under a savepoint, so a failing record is
+// reported without aborting the rest of the restore
+func (r *backupRestore) create(kind string, id uint, value interface{}) bool {
+	r.tx.SavePoint("record")
+	if err := r.tx.Create(value).Error; err != nil {
+		r.tx.RollbackTo("record")
+		r.fail(kind, id, err.Error())
+		return false
+	}
+	r.counts[kind]++
+	return true
+}
+
+func (r *backupRestore) fail(kind string, id uint, message string) {
+	r.errors = append(r.errors, BackupError{Type: kind, ID: id, Error: message})
+}
+
+func (r *backupRestore) restore(backup Backup) error {
+	for _, bv := range backup.Vehicles {
+		if strings.TrimSpace(bv.Make) == "" || strings.TrimSpace(bv.Model) == "" {
+			r.fail("vehicle", bv.ID, "make and model are required")
+			continue
+		}
+		v := Vehicle{
+			UserID: r.userID, Make: bv.Make, Model: bv.Model, Year: bv.Year, Odometer: bv.Odometer,
+			MileageUnit: bv.MileageUnit, FuelType: bv.FuelType, RemindersPaused: bv.RemindersPaused,
+			CreatedAt: bv.CreatedAt, UpdatedAt: bv.UpdatedAt,
+		}
+		if r.create("vehicle", bv.ID, &v) {
+			r.vehicles[bv.ID] = v.ID
+		}
+	}
+
+	for _, bf := range backup.FuelEntries {
+		vehicleID, ok := r.vehicles[bf.VehicleID]
+		if !ok {
+			r.fail("fuel_entry", bf.ID, fmt.Sprintf("vehicle %d was not restored", bf.VehicleID))
+			continue
+		}
+		if bf.Date.IsZero() {
+			r.fail("fuel_entry", bf.ID, "date is required")
+			continue
+		}
+		f := FuelEntry{
+			VehicleID: vehicleID, Date: bf.Date, Gallons: bf.Gallons, Price: bf.Price, Odometer: bf.Odometer,
+			Location: bf.Location, Notes: bf.Notes, PartialFill: bf.PartialFill, MissedFillup: bf.MissedFillup,
+			CreatedAt: bf.CreatedAt, UpdatedAt: bf.UpdatedAt,
+		}
+		if r.create("fuel_entry", bf.ID, &f) {
+			r.fuel[bf.ID] = f.ID
+		}
+	}
+
+	for _, be := range backup.Expenses {
+		vehicleID, ok := r.vehicles[be.VehicleID]
+		if !ok {
+			r.fail("expense", be.ID, fmt.Sprintf("vehicle %d was not restored", be.VehicleID))
+			continue
+		}
+		if be.Date.IsZero() {
+			r.fail("expense", be.ID, "date is required")
+			continue
+		}
+		e := Expense{
+			VehicleID: vehicleID, Category: be.Category, Amount: be.Amount, Date: be.Date, Notes: be.Notes,
+			CreatedAt: be.CreatedAt, UpdatedAt: be.UpdatedAt,
+		}
+		if r.create("expense", be.ID, &e) {
+			r.expenses[be.ID] = e.ID
+		}
+	}
+
+	for _, br := range backup.Reminders {
+		vehicleID, ok := r.vehicles[br.VehicleID]
+		if !ok {
+			r.fail("reminder", br.ID, fmt.Sprintf("vehicle %d was not restored", br.VehicleID))
+			continue
+		}
+		rem := MaintenanceReminder{
+			VehicleID: vehicleID, Name: br.Name, IntervalMiles: br.IntervalMiles, IntervalDays: br.IntervalDays,
+			LastServiceDate: br.LastServiceDate, LastServiceMiles: br.LastServiceMiles,
+			DueDate: br.DueDate, DueMiles: br.DueMiles, SnoozedUntil: br.SnoozedUntil,
+			SnoozedUntilMiles: br.SnoozedUntilMiles, CompletedAt: br.CompletedAt,
+			CreatedAt: br.CreatedAt, UpdatedAt: br.UpdatedAt,
+		}
+		if r.create("reminder", br.ID, &rem) {
+			r.reminders[br.ID] = rem.ID
+		}
+	}
+
+	for _, bn := range backup.Notifications {
+		vehicleID, ok := r.vehicles[bn.VehicleID]
+		if !ok {
+			r.fail("notification", bn.ID, fmt.Sprintf("vehicle %d was not restored", bn.VehicleID))
+			continue
+		}
+		// Notifications still waiting to go out when the backup was made
+		// are history now and mustn't be sent again
+		delivery := bn.Delivery
+		if delivery == "" || delivery == "pending" || delivery == "sending" {
+			delivery = "suppressed"
+		}
+		n := Notification{
+			UserID: r.userID, VehicleID: vehicleID, ReminderID: r.reminders[bn.ReminderID], Type: bn.Type,
+			Title: bn.Title, Message: bn.Message, Status: bn.Status, Delivery: delivery,
+			CreatedAt: bn.CreatedAt, DismissedAt: bn.DismissedAt,
+		}
+		r.create("notification", bn.ID, &n)
+	}
+
+	for _, bs := range backup.Shares {
+		vehicleID, ok := r.vehicles[bs.VehicleID]
+		if !ok {
+			r.fail("share", bs.VehicleID, fmt.Sprintf("vehicle %d was not restored", bs.VehicleID))
+			continue
+		}
+		var user User
+		if err := r.tx.Where("email = ?", bs.Email).First(&user).Error; err != nil {
+			r.fail("share", bs.VehicleID, fmt.Sprintf("no user with email %s", bs.Email))
+			continue
+		}
+		if user.ID == r.userID {
+			continue
+		}
+		r.create("share", bs.VehicleID, &VehicleUser{VehicleID: vehicleID, UserID: user.ID, CreatedAt: bs.CreatedAt})
+	}
+
+	for _, ba := range backup.Attachments {
+		r.restoreAttachment(ba)
+	}
+
+	return nil
+}
+
+func (r *backupRestore) restoreAttachment(ba BackupAttachment) {
+	var entryID uint
+	var ok bool
+	if isFuelAttachment(ba.EntryType) {
+		entryID, ok = r.fuel[ba.EntryID]
+	} else if ba.EntryType == "expense" {
+		entryID, ok = r.expenses[ba.EntryID]
+	} else if ba.EntryType == "vehicle" {
+		entryID, ok = r.vehicles[ba.EntryID]
+	} else {
+		r.fail("attachment", ba.ID, fmt.Sprintf("unknown entry type: %s", ba.EntryType))
+		return
+	}
+	if !ok {
+		r.fail("attachment", ba.ID, fmt.Sprintf("%s %d was not restored", ba.EntryType, ba.EntryID))
+		return
+	}
+
+	zf, found := r.files[ba.File]
+	if ba.File == "" || !found {
+		r.fail("attachment", ba.ID, "file is missing from the backup")
+		return
+	}
+
+	// Never trust names from the archive for paths on disk
+	path := filepath.Join(r.assetsPath, fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(ba.Filename)))
+	if err := extractZipFile(zf, path, r.limits); err != nil {
+		r.fail("attachment", ba.ID, err.Error())
+		return
+	}
+	r.written = append(r.written, path)
+
+	a := Attachment{
+		EntryID: entryID, EntryType: ba.EntryType, Filename: ba.Filename, Path: path, CreatedAt: ba.CreatedAt,
+	}
+	if !r.create("attachment", ba.ID, &a) {
+		os.Remove(path)
+	}
+}
+
+// maxZippedDataFile caps a backup.json, database or CSV file read into memory
+// from an uploaded zip
+const maxZippedDataFile = 256 << 20
+
+// readZipFile reads a zip entry into memory, refusing one over
+// maxZippedDataFile whatever its header says
+func readZipFile(zf *zip.File) ([]byte, error) {
+	if zf.UncompressedSize64 > maxZippedDataFile {
+		return nil, fmt.Errorf("%s is too large", zf.Name)
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxZippedDataFile+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxZippedDataFile {
+		return nil, fmt.Errorf("%s is too large", zf.Name)
+	}
+	return data, nil
+}
+
+// extractLimits caps what an uploaded archive may unpack: each file to the
+// attachment limit and all of them together to the import limit, so a small
+// zip can't fill the disk
+type extractLimits struct {
+	perFile   int64
+	remaining int64
+}
+
+func (app *Application) newExtractLimits() *extractLimits {
+	return &extractLimits{
+		perFile:   int64(app.config.MaxAttachmentMB) << 20,
+		remaining: int64(app.config.MaxImportMB) << 20,
+	}
+}
+
+// extractZipFile writes a zip entry to path. With limits, entries claiming
+// to be too big are refused and the rest are cut off at the limit, whatever
+// their header says; nil limits are for the server's own backups.
+func extractZipFile(zf *zip.File, path string, limits *extractLimits) error {
+	max := int64(-1)
+	if limits != nil {
+		max = limits.perFile
+		if limits.remaining < max {
+			max = limits.remaining
+		}
+		if zf.UncompressedSize64 > uint64(max) {
+			return fmt.Errorf("%s is larger than the upload limit", filepath.Base(zf.Name))
+		}
+	}
+
+	src, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var r io.Reader = src
+	if max >= 0 {
+		r = io.LimitReader(src, max+1)
+	}
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, r)
+	if err == nil && max >= 0 && n > max {
+		err = fmt.Errorf("%s is larger than the upload limit", filepath.Base(zf.Name))
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(path)
+		return err
+	}
+	if limits != nil {
+		limits.remaining -= n
+	}
+	return dst.Close()
+}
+
+// loadClarksonUpload reads a backup zip, or a bare backup.json, returning
+// the zip's files by name
+func loadClarksonUpload(body []byte) (Backup, map[string]*zip.File, error) {
+	files := make(map[string]*zip.File)
+	if bytes.HasPrefix(body, []byte("PK\x03\x04")) {
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			return Backup{}, nil, fmt.Errorf("invalid zip file")
+		}
+		for _, f := range zr.File {
+			files[f.Name] = f
+		}
+		manifest, ok := files["backup.json"]
+		if !ok {
+			return Backup{}, nil, fmt.Errorf("backup.json is missing from the zip")
+		}
+		body, err = readZipFile(manifest)
+		if err != nil {
+			return Backup{}, nil, fmt.Errorf("failed to read backup.json: %v", err)
+		}
+	}
+
+	backup, err := parseBackupJSON(body)
+	return backup, files, err
+}
+
+// restoreBackup restores a backup as new records owned by the user. With
+// strict any failed record rolls back the whole restore.
+func (app *Application) restoreBackup(c *gin.Context, userID uint, backup Backup, files map[string]*zip.File, strict bool) bool {
+	assetsPath := app.config.AssetsPath
+	os.MkdirAll(assetsPath, 0755)
+
+	restore := &backupRestore{
+		userID:     userID,
+		files:      files,
+		assetsPath: assetsPath,
+		limits:     app.newExtractLimits(),
+		vehicles:   make(map[uint]uint),
+		fuel:       make(map[uint]uint),
+		expenses:   make(map[uint]uint),
+		reminders:  make(map[uint]uint),
+		counts:     make(map[string]int),
+	}
+
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		restore.tx = tx
+		if err := restore.restore(backup); err != nil {
+			return err
+		}
+		if strict && len(restore.errors) > 0 {
+			return fmt.Errorf("%d records failed", len(restore.errors))
+		}
+		return nil
+	})
+	if err != nil {
+		for _, path := range restore.written {
+			os.Remove(path)
+		}
+		requestLogger(c).Warn("backup restore rolled back", "version", backup.Version, "error", err, "errors", len(restore.errors))
+		c.JSON(422, gin.H{
+			"error":  "Restore rolled back: " + err.Error(),
+			"errors": restore.errors,
+		})
+		return false
+	}
+
+	if restore.errors == nil {
+		restore.errors = []BackupError{}
+	}
+	requestLogger(c).Info("backup restored", "version", backup.Version, countsAttr("imported", restore.counts), "errors", len(restore.errors))
+	c.JSON(200, gin.H{
+		"version":  backup.Version,
+		"imported": restore.counts,
+		"errors":   restore.errors,
+	})
+	return true
+}
+
+// importClarkson restores a backup zip (or a bare backup.json) as new records
+// owned by the user. With ?strict=true any failed record rolls back the
+// whole restore.
+func (app *Application) importClarkson(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(400, gin.H{"error": "No file uploaded"})
+		return
+	}
+	if !app.importSizeOK(c, file.Size) {
+		return
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to open file"})
+		return
+	}
+	defer src.Close()
+
+	body, err := io.ReadAll(src)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	backup, files, err := loadClarksonUpload(body)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	app.restoreBackup(c, userID, backup, files, c.Query("strict") == "true")
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"hash/crc32"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportBackupZip runs the backup export for a user
+func exportBackupZip(t *testing.T, app *Application, userID uint) []byte {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/backup", nil)
+	c.Set("userID", userID)
+	app.exportBackup(c)
+	if w.Code != 200 {
+		t.Fatalf("export: %d %s", w.Code, w.Body.String())
+	}
+	return w.Body.Bytes()
+}
+
+// restoreBackupZip restores a backup zip for a user and returns the response
+func restoreBackupZip(t *testing.T, app *Application, userID uint, body []byte, strict bool) (int, map[string]interface{}) {
+	t.Helper()
+	backup, files, err := loadClarksonUpload(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/api/import/clarkson", nil)
+	app.restoreBackup(c, userID, backup, files, strict)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, response
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	app := newTestApp(t)
+	os.MkdirAll(app.config.AssetsPath, 0755)
+
+	owner := User{Email: "owner@example.com", Name: "Owner"}
+	friend := User{Email: "friend@example.com", Name: "Friend"}
+	restorer := User{Email: "restorer@example.com", Name: "Restorer"}
+	app.db.Create(&owner)
+	app.db.Create(&friend)
+	app.db.Create(&restorer)
+
+	date := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	golf := Vehicle{UserID: owner.ID, Year: 2019, Make: "VW", Model: "Golf", Odometer: 12000, MileageUnit: "km", RemindersPaused: true}
+	app.db.Create(&golf)
+	app.db.Create(&VehicleUser{VehicleID: golf.ID, UserID: friend.ID})
+	fiesta := Vehicle{UserID: friend.ID, Year: 2020, Make: "Ford", Model: "Fiesta"}
+	app.db.Create(&fiesta)
+	app.db.Create(&VehicleUser{VehicleID: fiesta.ID, UserID: owner.ID})
+
+	fuel := FuelEntry{VehicleID: golf.ID, Date: date, Gallons: 40, Price: 70.5, Odometer: 11900, Location: "Shell", PartialFill: true}
+	app.db.Create(&fuel)
+	expense := Expense{VehicleID: golf.ID, Date: date, Category: "Maintenance", Amount: 99.5, Notes: "Oil"}
+	app.db.Create(&expense)
+	reminder := MaintenanceReminder{VehicleID: golf.ID, Name: "Oil", IntervalMiles: 5000, LastServiceDate: date, LastServiceMiles: 10000, DueDate: &date}
+	app.db.Create(&reminder)
+	app.db.Create(&Notification{UserID: owner.ID, VehicleID: golf.ID, ReminderID: reminder.ID, Type: "reminder_due", Title: "Oil", Status: "read", Delivery: "sent"})
+	app.db.Create(&Notification{UserID: owner.ID, VehicleID: fiesta.ID, Type: "reminder_due", Title: "Shared", Status: "unread", Delivery: "sent"})
+
+	receipt := filepath.Join(app.config.AssetsPath, "receipt.jpg")
+	os.WriteFile(receipt, []byte("JPEG receipt"), 0644)
+	app.db.Create(&Attachment{EntryID: expense.ID, EntryType: "expense", Filename: "receipt.jpg", Path: receipt})
+
+	original, err := app.buildBackup(owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(original.Vehicles) != 1 || len(original.Notifications) != 1 || original.Notifications[0].VehicleID != golf.ID {
+		t.Fatalf("backup has %d vehicles and notifications %+v, want only the owner's", len(original.Vehicles), original.Notifications)
+	}
+
+	code, response := restoreBackupZip(t, app, restorer.ID, exportBackupZip(t, app, owner.ID), true)
+	if code != 200 {
+		t.Fatalf("strict restore: %d %v", code, response)
+	}
+	if errs := response["errors"].([]interface{}); len(errs) != 0 {
+		t.Fatalf("restore errors: %v", errs)
+	}
+
+	restored, err := app.buildBackup(restorer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Vehicles) != 1 {
+		t.Fatalf("restored %d vehicles, want 1", len(restored.Vehicles))
+	}
+	v, want := restored.Vehicles[0], original.Vehicles[0]
+	if v.Make != want.Make || v.Model != want.Model || v.Odometer != want.Odometer || v.MileageUnit != want.MileageUnit || !v.RemindersPaused {
+		t.Errorf("vehicle = %+v, want %+v", v, want)
+	}
+	if len(restored.FuelEntries) != 1 || restored.FuelEntries[0].Price != 70.5 || !restored.FuelEntries[0].PartialFill || !restored.FuelEntries[0].Date.Equal(date) {
+		t.Errorf("fuel = %+v", restored.FuelEntries)
+	}
+	if len(restored.Expenses) != 1 || restored.Expenses[0].Amount != 99.5 || restored.Expenses[0].Notes != "Oil" {
+		t.Errorf("expenses = %+v", restored.Expenses)
+	}
+	if len(restored.Reminders) != 1 || restored.Reminders[0].DueDate == nil || !restored.Reminders[0].DueDate.Equal(date) {
+		t.Errorf("reminders = %+v", restored.Reminders)
+	}
+	if len(restored.Notifications) != 1 || restored.Notifications[0].Title != "Oil" {
+		t.Errorf("notifications = %+v", restored.Notifications)
+	}
+	if len(restored.Shares) != 1 || restored.Shares[0].Email != friend.Email {
+		t.Errorf("shares = %+v", restored.Shares)
+	}
+
+	var attachment Attachment
+	if err := app.db.Where("path <> ?", receipt).First(&attachment).Error; err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(attachment.Path); string(data) != "JPEG receipt" {
+		t.Errorf("attachment file = %q", data)
+	}
+}
+
+func TestRestoreSuppressesUnsentNotifications(t *testing.T) {
+	app := newTestApp(t)
+	owner := User{Email: "owner@example.com"}
+	restorer := User{Email: "restorer@example.com"}
+	app.db.Create(&owner)
+	app.db.Create(&restorer)
+	vehicle := Vehicle{UserID: owner.ID, Make: "VW", Model: "Golf"}
+	app.db.Create(&vehicle)
+	for _, delivery := range []string{"pending", "sending", "sent", "failed"} {
+		app.db.Create(&Notification{UserID: owner.ID, VehicleID: vehicle.ID, Type: "reminder_due", Title: delivery, Status: "unread", Delivery: delivery})
+	}
+
+	if code, response := restoreBackupZip(t, app, restorer.ID, exportBackupZip(t, app, owner.ID), true); code != 200 {
+		t.Fatalf("restore: %d %v", code, response)
+	}
+
+	var restored []Notification
+	app.db.Where("user_id = ?", restorer.ID).Find(&restored)
+	want := map[string]string{"pending": "suppressed", "sending": "suppressed", "sent": "sent", "failed": "failed"}
+	if len(restored) != len(want) {
+		t.Fatalf("restored %d notifications, want %d", len(restored), len(want))
+	}
+	for _, n := range restored {
+		if n.Delivery != want[n.Title] {
+			t.Errorf("%s notification restored with delivery %q, want %q", n.Title, n.Delivery, want[n.Title])
+		}
+	}
+}
+
+// backupWithAttachment makes a backup zip of one vehicle with one attachment
+// holding size zero bytes. With lie the entry's header claims 10 bytes.
+func backupWithAttachment(t *testing.T, size int, lie bool) []byte {
+	t.Helper()
+	backup := Backup{
+		Format:   backupFormat,
+		Version:  backupVersion,
+		Vehicles: []BackupVehicle{{ID: 1, Make: "VW", Model: "Golf", Year: 2019}},
+		Attachments: []BackupAttachment{{
+			ID: 1, EntryType: "vehicle", EntryID: 1, Filename: "photo.jpg", File: "attachments/1-photo.jpg",
+		}},
+	}
+	manifest, _ := json.Marshal(backup)
+	content := make([]byte, size)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("backup.json")
+	w.Write(manifest)
+
+	if lie {
+		var deflated bytes.Buffer
+		fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+		fw.Write(content)
+		fw.Close()
+		raw, _ := zw.CreateRaw(&zip.FileHeader{
+			Name:               "attachments/1-photo.jpg",
+			Method:             zip.Deflate,
+			CRC32:              crc32.ChecksumIEEE(content),
+			CompressedSize64:   uint64(deflated.Len()),
+			UncompressedSize64: 10,
+		})
+		raw.Write(deflated.Bytes())
+	} else {
+		w, _ = zw.Create("attachments/1-photo.jpg")
+		w.Write(content)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestRestoreBackupCapsAttachments(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		lie     bool
+		wantErr string
+	}{
+		{"within the limit", 1000, false, ""},
+		{"over the limit", 2 << 20, false, "larger than the upload limit"},
+		// archive/zip itself stops reading past the claimed size
+		{"over the limit with a lying header", 2 << 20, true, "not a valid zip file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.config.MaxAttachmentMB = 1
+			user := User{Email: "driver@example.com"}
+			app.db.Create(&user)
+
+			code, response := restoreBackupZip(t, app, user.ID, backupWithAttachment(t, tt.size, tt.lie), false)
+			if code != 200 {
+				t.Fatalf("restore: %d %v", code, response)
+			}
+			errs := response["errors"].([]interface{})
+			if tt.wantErr != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0].(map[string]interface{})["error"].(string), tt.wantErr) {
+					t.Errorf("errors = %v, want the attachment refused", errs)
+				}
+			} else if len(errs) != 0 {
+				t.Errorf("errors = %v", errs)
+			}
+
+			files, _ := os.ReadDir(app.config.AssetsPath)
+			var want int
+			if tt.wantErr == "" {
+				want = 1
+			}
+			if len(files) != want {
+				t.Errorf("%d files left in assets, want %d", len(files), want)
+			}
+		})
+	}
+}
+
+func TestExtractLimitsTotal(t *testing.T) {
+	body := backupWithAttachment(t, 600<<10, false)
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var photo *zip.File
+	for _, f := range zr.File {
+		if f.Name == "attachments/1-photo.jpg" {
+			photo = f
+		}
+	}
+
+	dir := t.TempDir()
+	limits := &extractLimits{perFile: 1 << 20, remaining: 1 << 20}
+	if err := extractZipFile(photo, filepath.Join(dir, "first"), limits); err != nil {
+		t.Fatalf("first extraction: %v", err)
+	}
+	if err := extractZipFile(photo, filepath.Join(dir, "second"), limits); err == nil {
+		t.Fatal("second extraction went over the total limit")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "second")); !os.IsNotExist(err) {
+		t.Error("the refused file was left on disk")
+	}
+}
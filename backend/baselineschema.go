@@ -0,0 +1,191 @@
+package main
+
+import "time"
+
+// The tables as they were when versioned migrations were introduced, for
+// migration 1. These are frozen copies of the models: a change to a model
+// gets a migration step of its own and never touches these.
+
+type baselineUser struct {
+	ID                 uint   `gorm:"primaryKey"`
+	Email              string `gorm:"uniqueIndex;size:255"`
+	Name               string
+	Password           string
+	Role               string
+	Currency           string
+	Units              string
+	EmailNotifications bool
+	EmailDigest        bool
+	LastDigestAt       *time.Time
+	CalendarToken      string `gorm:"index"`
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+
+	Vehicles []baselineVehicle `gorm:"foreignKey:UserID"`
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+type baselineVehicle struct {
+	ID              uint `gorm:"primaryKey"`
+	UserID          uint
+	Make            string
+	Model           string
+	Year            int
+	Odometer        float64
+	MileageUnit     string
+	FuelType        string
+	RemindersPaused bool
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+
+	FuelEntries []baselineFuelEntry           `gorm:"foreignKey:VehicleID"`
+	Expenses    []baselineExpense             `gorm:"foreignKey:VehicleID"`
+	Reminders   []baselineMaintenanceReminder `gorm:"foreignKey:VehicleID"`
+	SharedUsers []baselineVehicleUser         `gorm:"foreignKey:VehicleID"`
+}
+
+func (baselineVehicle) TableName() string { return "vehicles" }
+
+type baselineVehicleUser struct {
+	ID        uint `gorm:"primaryKey"`
+	VehicleID uint
+	UserID    uint
+	CreatedAt time.Time
+}
+
+func (baselineVehicleUser) TableName() string { return "vehicle_users" }
+
+type baselineFuelEntry struct {
+	ID           uint `gorm:"primaryKey"`
+	VehicleID    uint
+	Date         time.Time
+	Gallons      float64
+	Price        float64
+	Odometer     float64
+	Location     string
+	Notes        string
+	PartialFill  bool
+	MissedFillup bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+
+	Vehicle     baselineVehicle      `gorm:"foreignKey:VehicleID"`
+	Attachments []baselineAttachment `gorm:"foreignKey:EntryID"`
+}
+
+func (baselineFuelEntry) TableName() string { return "fuel_entries" }
+
+type baselineExpense struct {
+	ID        uint `gorm:"primaryKey"`
+	VehicleID uint
+	Category  string
+	Amount    float64
+	Date      time.Time
+	Notes     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Vehicle     baselineVehicle      `gorm:"foreignKey:VehicleID"`
+	Attachments []baselineAttachment `gorm:"foreignKey:EntryID"`
+}
+
+func (baselineExpense) TableName() string { return "expenses" }
+
+type baselineMaintenanceReminder struct {
+	ID                uint `gorm:"primaryKey"`
+	VehicleID         uint
+	Name              string
+	IntervalMiles     float64
+	IntervalDays      int
+	LastServiceDate   time.Time
+	LastServiceMiles  float64
+	DueDate           *time.Time
+	DueMiles          float64
+	SnoozedUntil      *time.Time
+	SnoozedUntilMiles float64
+	CompletedAt       *time.Time
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+
+	Vehicle baselineVehicle `gorm:"foreignKey:VehicleID"`
+}
+
+func (baselineMaintenanceReminder) TableName() string { return "maintenance_reminders" }
+
+type baselineAttachment struct {
+	ID        uint `gorm:"primaryKey"`
+	EntryID   uint
+	EntryType string
+	Filename  string
+	Path      string
+	CreatedAt time.Time
+}
+
+func (baselineAttachment) TableName() string { return "attachments" }
+
+type baselineNotification struct {
+	ID          uint `gorm:"primaryKey"`
+	UserID      uint
+	VehicleID   uint
+	ReminderID  uint
+	Type        string
+	Title       string
+	Message     string
+	Status      string
+	CreatedAt   time.Time
+	DismissedAt *time.Time
+	Delivery    string
+}
+
+func (baselineNotification) TableName() string { return "notifications" }
+
+type baselineNotificationDelivery struct {
+	ID        uint `gorm:"primaryKey"`
+	UserID    uint `gorm:"index"`
+	Channel   string
+	Kind      string
+	Recipient string
+	Subject   string
+	Status    string
+	Attempts  int
+	Error     string
+	CreatedAt time.Time
+}
+
+func (baselineNotificationDelivery) TableName() string { return "notification_deliveries" }
+
+type baselineUserChannel struct {
+	ID          uint `gorm:"primaryKey"`
+	UserID      uint `gorm:"index"`
+	Type        string
+	Name        string
+	URL         string
+	Topic       string
+	Token       string
+	Secret      string
+	MinSeverity string
+	Enabled     bool
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (baselineUserChannel) TableName() string { return "user_channels" }
+
+type baselineNotificationPreference struct {
+	ID              uint `gorm:"primaryKey"`
+	UserID          uint `gorm:"uniqueIndex"`
+	TimeZone        string
+	QuietHoursStart string
+	QuietHoursEnd   string
+	Delivery        string
+	DigestHour      int
+	DigestWeekday   int
+	MinSeverity     string
+	TypeChannels    map[string][]string `gorm:"serializer:json"`
+	LastBatchAt     *time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+func (baselineNotificationPreference) TableName() string { return "notification_preferences" }
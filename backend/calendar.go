@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// iCalendar feeds of upcoming maintenance. Feeds are served without a JWT so
+// calendar apps can subscribe; the per-user token in the URL is the secret.
+// Reminders are the only source of events: there are no document or
+// scheduled-service records to draw expirations or bookings from.
+
+const icsDateFormat = "20060102"
+const icsTimestampFormat = "20060102T150405Z"
+
+// CalendarEvent is one all-day VEVENT in a feed
+type CalendarEvent struct {
+	UID         string
+	Date        time.Time
+	Summary     string
+	Description string
+	Projected   bool // Date estimated from driving rate rather than scheduled
+	Modified    time.Time
+}
+
+// averageDailyDistance estimates how far a vehicle is driven per day from its
+// fuel history. It returns 0 when there isn't enough history to tell.
+func (app *Application) averageDailyDistance(vehicleID uint) float64 {
+	var entries []FuelEntry
+	app.db.Where("vehicle_id = ?", vehicleID).Order("date ASC").Find(&entries)
+	if len(entries) < 2 {
+		return 0
+	}
+
+	first := entries[0]
+	last := entries[len(entries)-1]
+	days := last.Date.Sub(first.Date).Hours() / 24
+	if days < 7 || last.Odometer <= first.Odometer {
+		return 0
+	}
+
+	return (last.Odometer - first.Odometer) / days
+}
+
+// vehicleCalendarEvents builds an event for every active reminder on the
+// vehicle, at its scheduled date or the date its mileage is projected to
+// be reached, whichever comes first
+func (app *Application) vehicleCalendarEvents(v Vehicle, now time.Time) []CalendarEvent {
+	if v.RemindersPaused {
+		return nil
+	}
+
+	var reminders []MaintenanceReminder
+	app.db.Where("vehicle_id = ?", v.ID).Find(&reminders)
+
+	dailyDistance := app.averageDailyDistance(v.ID)
+	vehicleName := fmt.Sprintf("%d %s %s", v.Year, v.Make, v.Model)
+	unit := v.MileageUnit
+	if unit == "" {
+		unit = "mi"
+	}
+
+	var events []CalendarEvent
+	for _, r := range reminders {
+		state := evaluateReminder(r, false, v.Odometer, now)
+		if state.Status == "completed" {
+			continue
+		}
+
+		var date time.Time
+		projected := false
+		var details []string
+
+		if state.ByDays {
+			date = state.DueDate
+			details = append(details, "Due by date: "+state.DueDate.Format("Jan 2, 2006"))
+		}
+		if state.ByMiles {
+			details = append(details, fmt.Sprintf("Due at %.0f %s (%.0f %s to go)", state.DueMiles, unit, state.MilesToGo, unit))
+
+			var milesDate time.Time
+			if state.MilesToGo <= 0 {
+				milesDate = now
+			} else if dailyDistance > 0 {
+				milesDate = now.Add(time.Duration(state.MilesToGo / dailyDistance * 24 * float64(time.Hour)))
+			}
+			if !milesDate.IsZero() && (date.IsZero() || milesDate.Before(date)) {
+				date = milesDate
+				projected = true
+			}
+		}
+		if date.IsZero() {
+			continue
+		}
+
+		// A snoozed reminder shows up when the snooze ends
+		if r.SnoozedUntil != nil && r.IsSnoozed(v.Odometer, now) && r.SnoozedUntil.After(date) {
+			date = *r.SnoozedUntil
+			projected = false
+		}
+
+		if projected {
+			details = append(details, fmt.Sprintf("Date projected from about %.0f %s per day of driving", dailyDistance, unit))
+		}
+
+		events = append(events, CalendarEvent{
+			UID:         fmt.Sprintf("reminder-%d@clarkson", r.ID),
+			Date:        date,
+			Summary:     fmt.Sprintf("%s - %s", r.Name, vehicleName),
+			Description: strings.Join(details, "\n"),
+			Projected:   projected,
+			Modified:    r.UpdatedAt,
+		})
+	}
+
+	return events
+}
+
+// escapeICSText escapes a TEXT value per RFC 5545 section 3.3.11
+func escapeICSText(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// foldICSLine splits content lines longer than 75 octets, without breaking
+// UTF-8 sequences
+func foldICSLine(line string) string {
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > 75 {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func renderICS(name string, events []CalendarEvent, now time.Time) string {
+	var b strings.Builder
+	write := func(line string) {
+		b.WriteString(foldICSLine(line))
+	}
+
+	write("BEGIN:VCALENDAR")
+	write("VERSION:2.0")
+	write("PRODID:-//Clarkson//Maintenance Calendar//EN")
+	write("CALSCALE:GREGORIAN")
+	write("METHOD:PUBLISH")
+	write("X-WR-CALNAME:" + escapeICSText(name))
+	write("REFRESH-INTERVAL;VALUE=DURATION:PT6H")
+	write("X-PUBLISHED-TTL:PT6H")
+
+	stamp := now.UTC().Format(icsTimestampFormat)
+	for _, ev := range events {
+		write("BEGIN:VEVENT")
+		write("UID:" + ev.UID)
+		write("DTSTAMP:" + stamp)
+		if !ev.Modified.IsZero() {
+			write("LAST-MODIFIED:" + ev.Modified.UTC().Format(icsTimestampFormat))
+		}
+		write("DTSTART;VALUE=DATE:" + ev.Date.Format(icsDateFormat))
+		write("DTEND;VALUE=DATE:" + ev.Date.AddDate(0, 0, 1).Format(icsDateFormat))
+		write("SUMMARY:" + escapeICSText(ev.Summary))
+		if ev.Description != "" {
+			write("DESCRIPTION:" + escapeICSText(ev.Description))
+		}
+		write("TRANSP:TRANSPARENT")
+		if ev.Projected {
+			write("STATUS:TENTATIVE")
+		} else {
+			write("STATUS:CONFIRMED")
+		}
+		write("BEGIN:VALARM")
+		write("ACTION:DISPLAY")
+		write("DESCRIPTION:" + escapeICSText(ev.Summary))
+		write("TRIGGER:-P7D")
+		write("END:VALARM")
+		write("BEGIN:VALARM")
+		write("ACTION:DISPLAY")
+		write("DESCRIPTION:" + escapeICSText(ev.Summary))
+		write("TRIGGER:-PT15H")
+		write("END:VALARM")
+		write("END:VEVENT")
+	}
+
+	write("END:VCALENDAR")
+	return b.String()
+}
+
+func (app *Application) calendarUser(c *gin.Context) (User, bool) {
+	var user User
+	token := c.Param("token")
+	if len(token) < 32 {
+		c.String(404, "Not found")
+		return user, false
+	}
+	if err := app.db.Where("calendar_token = ?", token).First(&user).Error; err != nil {
+		c.String(404, "Not found")
+		return user, false
+	}
+	return user, true
+}
+
+func (app *Application) serveICS(c *gin.Context, filename, body string) {
+	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+	c.Header("Cache-Control", "private, max-age=900")
+	c.Data(200, "text/calendar; charset=utf-8", []byte(body))
+}
+
+// userCalendarFeed serves every accessible vehicle's reminders
+func (app *Application) userCalendarFeed(c *gin.Context) {
+	user, ok := app.calendarUser(c)
+	if !ok {
+		return
+	}
+
+	vehicles, err := app.accessibleVehicles(user.ID)
+	if err != nil {
+		c.String(500, "Failed to load vehicles")
+		return
+	}
+
+	now := time.Now()
+	var events []CalendarEvent
+	for _, v := range vehicles {
+		events = append(events, app.vehicleCalendarEvents(v, now)...)
+	}
+
+	app.serveICS(c, "clarkson.ics", renderICS("Clarkson Maintenance", events, now))
+}
+
+// vehicleCalendarFeed serves one vehicle's reminders; the route parameter is
+// "<vehicle id>.ics"
+func (app *Application) vehicleCalendarFeed(c *gin.Context) {
+	user, ok := app.calendarUser(c)
+	if !ok {
+		return
+	}
+
+	vehicleID := parseUint(strings.TrimSuffix(c.Param("file"), ".ics"))
+
+	vehicles, err := app.accessibleVehicles(user.ID)
+	if err != nil {
+		c.String(500, "Failed to load vehicles")
+		return
+	}
+
+	for _, v := range vehicles {
+		if v.ID != vehicleID {
+			continue
+		}
+		now := time.Now()
+		name := fmt.Sprintf("Clarkson: %d %s %s", v.Year, v.Make, v.Model)
+		app.serveICS(c, fmt.Sprintf("vehicle-%d.ics", v.ID), renderICS(name, app.vehicleCalendarEvents(v, now), now))
+		return
+	}
+
+	c.String(404, "Not found")
+}
+
+func calendarFeedURLs(c *gin.Context, token string, vehicles []Vehicle) gin.H {
+	scheme := "http"
+	if c.GetBool("https") {
+		scheme = "https"
+	}
+	base := fmt.Sprintf("%s://%s/calendar/%s", scheme, c.Request.Host, token)
+
+	vehicleFeeds := []gin.H{}
+	for _, v := range vehicles {
+		vehicleFeeds = append(vehicleFeeds, gin.H{
+			"vehicle_id": v.ID,
+			"url":        fmt.Sprintf("%s/vehicles/%d.ics", base, v.ID),
+		})
+	}
+
+	return gin.H{
+		"url":      base + "/clarkson.ics",
+		"vehicles": vehicleFeeds,
+	}
+}
+
+// getCalendarFeeds returns the user's feed URLs, creating a token on first use
+func (app *Application) getCalendarFeeds(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := app.db.First(&user, userID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.CalendarToken == "" {
+		user.CalendarToken = randomToken(24)
+		if err := app.db.Model(&user).Update("calendar_token", user.CalendarToken).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create calendar token"})
+			return
+		}
+	}
+
+	vehicles, _ := app.accessibleVehicles(userID)
+	c.JSON(200, calendarFeedURLs(c, user.CalendarToken, vehicles))
+}
+
+// rotateCalendarToken invalidates the old feed URLs
+func (app *Application) rotateCalendarToken(c *gin.Context) {
+	userID := c.GetUint("userID")
+	token := randomToken(24)
+
+	if err := app.db.Model(&User{}).Where("id = ?", userID).Update("calendar_token", token).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to rotate calendar token"})
+		return
+	}
+
+	vehicles, _ := app.accessibleVehicles(userID)
+	c.JSON(200, calendarFeedURLs(c, token, vehicles))
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NotificationChannel delivers a notification to an external service
+type NotificationChannel interface {
+	Send(n Notification) error
+}
+
+// Notification severities, lowest first
+var severityLevels = map[string]int{
+	"info":     0,
+	"warning":  1,
+	"critical": 2,
+}
+
+func notificationSeverity(n Notification) string {
+	switch n.Type {
+	case "reminder_overdue":
+		return "critical"
+	case "reminder_due":
+		return "warning"
+	}
+	return "info"
+}
+
+// UserChannel is a push channel configured by a user
+type UserChannel struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      uint      `gorm:"index" json:"user_id"`
+	Type        string    `json:"type"` // ntfy, gotify, webhook
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`          // Server URL, or the endpoint for webhooks
+	Topic       string    `json:"topic"`        // ntfy only
+	Token       string    `json:"-"`            // ntfy access token or Gotify app token
+	Secret      string    `json:"-"`            // Webhook HMAC signing secret
+	MinSeverity string    `json:"min_severity"` // info, warning, critical
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Accepts reports whether a notification meets the channel's severity filter
+func (uc *UserChannel) Accepts(n Notification) bool {
+	return severityLevels[notificationSeverity(n)] >= severityLevels[uc.MinSeverity]
+}
+
+func (uc *UserChannel) Channel() (NotificationChannel, error) {
+	switch uc.Type {
+	case "ntfy":
+		return &NtfyChannel{ServerURL: uc.URL, Topic: uc.Topic, Token: uc.Token}, nil
+	case "gotify":
+		return &GotifyChannel{ServerURL: uc.URL, Token: uc.Token}, nil
+	case "webhook":
+		return &WebhookChannel{URL: uc.URL, Secret: uc.Secret}, nil
+	}
+	return nil, fmt.Errorf("unknown channel type: %s", uc.Type)
+}
+
+// Validate checks that the channel has everything its type needs
+func (uc *UserChannel) Validate() error {
+	if _, ok := severityLevels[uc.MinSeverity]; !ok {
+		return fmt.Errorf("min_severity must be info, warning or critical")
+	}
+
+	u, err := url.Parse(uc.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+
+	switch uc.Type {
+	case "ntfy":
+		if uc.Topic == "" {
+			return fmt.Errorf("ntfy channels need a topic")
+		}
+	case "gotify":
+		if uc.Token == "" {
+			return fmt.Errorf("gotify channels need an application token")
+		}
+	case "webhook":
+		if uc.Secret == "" {
+			return fmt.Errorf("webhook channels need a signing secret")
+		}
+	default:
+		return fmt.Errorf("type must be ntfy, gotify or webhook")
+	}
+
+	return nil
+}
+
+// channelHTTPClient sends push notifications. Unless
+// notifications.allow_private_channels is set, it refuses to connect to
+// loopback, link-local and private addresses, so channel URLs can't be used
+// to reach the server itself or the network it runs in.
+var channelHTTPClient = newChannelHTTPClient(false)
+
+func newChannelHTTPClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		// Checked on the resolved address of every connection, redirects
+		// included, so DNS can't be used to get around it
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+				return fmt.Errorf("%s is not a public address", host)
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		// No proxy: the address check has to see the real destination
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// publicAddress reports whether ip is outside the loopback, link-local,
+// private and other special-purpose ranges
+func publicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	// Carrier-grade NAT, 100.64.0.0/10
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return false
+	}
+	return true
+}
+
+// postChannelRequest sends a request to a push service. Failures report the
+// status code only; the response body is never passed back to the user.
+func postChannelRequest(req *http.Request) error {
+	resp, err := channelHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %d", req.URL.Host, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// NtfyChannel publishes to an ntfy topic
+type NtfyChannel struct {
+	ServerURL string
+	Topic     string
+	Token     string
+}
+
+func (ch *NtfyChannel) Send(n Notification) error {
+	endpoint := strings.TrimRight(ch.ServerURL, "/") + "/" + url.PathEscape(ch.Topic)
+
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(n.Message))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Title", n.Title)
+	switch notificationSeverity(n) {
+	case "critical":
+		req.Header.Set("Priority", "urgent")
+		req.Header.Set("Tags", "rotating_light,car")
+	case "warning":
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "wrench,car")
+	default:
+		req.Header.Set("Tags", "car")
+	}
+	if ch.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+ch.Token)
+	}
+
+	return postChannelRequest(req)
+}
+
+// GotifyChannel posts a message to a Gotify server using an application token
+type GotifyChannel struct {
+	ServerURL string
+	Token     string
+}
+
+func (ch *GotifyChannel) Send(n Notification) error {
+	priority := 2
+	switch notificationSeverity(n) {
+	case "critical":
+		priority = 8
+	case "warning":
+		priority = 5
+	}
+
+	body, err := json.Marshal(gin.H{
+		"title":    n.Title,
+		"message":  n.Message,
+		"priority": priority,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimRight(ch.ServerURL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", ch.Token)
+
+	return postChannelRequest(req)
+}
+
+// WebhookChannel posts the notification as JSON. The request carries an
+// X-Clarkson-Signature header of the form "sha256=<hex>", an HMAC-SHA256 of
+// "<X-Clarkson-Timestamp>.<body>" keyed with the channel secret.
+type WebhookChannel struct {
+	URL    string
+	Secret string
+}
+
+func (ch *WebhookChannel) Send(n Notification) error {
+	body, err := json.Marshal(gin.H{
+		"event":        "notification",
+		"severity":     notificationSeverity(n),
+		"notification": n,
+	})
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest("POST", ch.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Clarkson-Webhook/1.0")
+	req.Header.Set("X-Clarkson-Timestamp", timestamp)
+	req.Header.Set("X-Clarkson-Signature", "sha256="+signWebhook(ch.Secret, timestamp, body))
+
+	return postChannelRequest(req)
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retry calls fn up to attempts times, sleeping a growing delay between
+// failures. It returns the number of attempts made and the last error.
+func retry(attempts int, delay time.Duration, fn func() error) (int, error) {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil {
+			return attempt, nil
+		}
+		if attempt < attempts {
+			time.Sleep(delay * time.Duration(attempt))
+		}
+	}
+	return attempts, err
+}
+
+// pushNotifications sends notifications through every enabled channel of the
+// user that their preferences and the channel's severity filter allow. Batched
+// deliveries go out as one combined message per channel. Each channel's
+// result is added to outcomes.
+func (app *Application) pushNotifications(userID uint, notifications []Notification, prefs NotificationPreference, batched bool, outcomes deliveryOutcomes) {
+	var channels []UserChannel
+	if err := app.db.Where("user_id = ? AND enabled = ?", userID, true).Find(&channels).Error; err != nil {
+		slog.Error("loading channels failed", "user_id", userID, "error", err)
+		return
+	}
+
+	for _, uc := range channels {
+		var accepted []Notification
+		for _, n := range notifications {
+			if uc.Accepts(n) && prefs.AllowsChannel(n.Type, uc.Type) {
+				accepted = append(accepted, n)
+			}
+		}
+
+		if batched && len(accepted) > 1 {
+			err := app.sendLoggedChannel(uc, "digest", combineNotifications(accepted), notificationIDs(accepted))
+			outcomes.add(accepted, err)
+			continue
+		}
+		for _, n := range accepted {
+			err := app.sendLoggedChannel(uc, "reminder", n, []uint{n.ID})
+			outcomes.add([]Notification{n}, err)
+		}
+	}
+}
+
+// notificationIDs returns the IDs of notifications
+func notificationIDs(notifications []Notification) []uint {
+	ids := make([]uint, 0, len(notifications))
+	for _, n := range notifications {
+		ids = append(ids, n.ID)
+	}
+	return ids
+}
+
+// combineNotifications folds several notifications into one summary message,
+// typed after the most severe of them
+func combineNotifications(notifications []Notification) Notification {
+	combined := Notification{
+		UserID:    notifications[0].UserID,
+		Type:      notifications[0].Type,
+		Title:     fmt.Sprintf("%d maintenance reminders", len(notifications)),
+		Status:    "unread",
+		CreatedAt: time.Now(),
+	}
+
+	var lines []string
+	for _, n := range notifications {
+		if severityLevels[notificationSeverity(n)] > severityLevels[notificationSeverity(combined)] {
+			combined.Type = n.Type
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", n.Title, n.Message))
+	}
+	combined.Message = strings.Join(lines, "\n")
+
+	return combined
+}
+
+// sendLoggedChannel sends one notification and records the outcome in the
+// delivery log against the notifications it stands for
+func (app *Application) sendLoggedChannel(uc UserChannel, kind string, n Notification, ids []uint) error {
+	delivery := NotificationDelivery{
+		UserID:          uc.UserID,
+		Channel:         uc.Type,
+		Kind:            kind,
+		Recipient:       uc.Name,
+		Subject:         n.Title,
+		NotificationIDs: ids,
+		Status:          "sent",
+	}
+
+	ch, err := uc.Channel()
+	if err == nil {
+		delivery.Attempts, err = retry(3, 5*time.Second, func() error {
+			return ch.Send(n)
+		})
+	}
+	if err != nil {
+		delivery.Status = "failed"
+		delivery.Error = err.Error()
+		slog.Warn("notification delivery failed", "channel", uc.Type, "kind", kind, "user_id", uc.UserID, "attempts", delivery.Attempts, "error", err)
+	}
+	app.metrics.delivered(uc.Type, kind, delivery.Status)
+
+	if dbErr := app.db.Create(&delivery).Error; dbErr != nil {
+		slog.Error("recording delivery failed", "channel", uc.Type, "error", dbErr)
+	}
+
+	return err
+}
+
+// Channel Handlers
+
+type channelRequest struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Topic       string `json:"topic"`
+	Token       string `json:"token"`
+	Secret      string `json:"secret"`
+	MinSeverity string `json:"min_severity"`
+	Enabled     *bool  `json:"enabled"`
+}
+
+func (app *Application) listChannels(c *gin.Context) {
+	userID := c.GetUint("userID")
+	var channels []UserChannel
+
+	if err := app.db.Where("user_id = ?", userID).Order("created_at").Find(&channels).Error; err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, channels)
+}
+
+func (app *Application) createChannel(c *gin.Context) {
+	userID := c.GetUint("userID")
+	var req channelRequest
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	channel := UserChannel{
+		UserID:      userID,
+		Type:        req.Type,
+		Name:        req.Name,
+		URL:         req.URL,
+		Topic:       req.Topic,
+		Token:       req.Token,
+		Secret:      req.Secret,
+		MinSeverity: req.MinSeverity,
+		Enabled:     req.Enabled == nil || *req.Enabled,
+	}
+	if channel.Name == "" {
+		channel.Name = channel.Type
+	}
+	if channel.MinSeverity == "" {
+		channel.MinSeverity = "warning"
+	}
+
+	// Generate a signing secret if the user didn't pick one; it is only
+	// shown in this response
+	generated := false
+	if channel.Type == "webhook" && channel.Secret == "" {
+		channel.Secret = randomToken(32)
+		generated = true
+	}
+
+	if err := channel.Validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := app.db.Create(&channel).Error; err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if generated {
+		c.JSON(201, gin.H{"channel": channel, "secret": channel.Secret})
+		return
+	}
+	c.JSON(201, gin.H{"channel": channel})
+}
+
+func (app *Application) updateChannel(c *gin.Context) {
+	userID := c.GetUint("userID")
+	channelID := c.Param("id")
+	var req channelRequest
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	var channel UserChannel
+	if err := app.db.Where("id = ? AND user_id = ?", channelID, userID).First(&channel).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Channel not found"})
+		return
+	}
+
+	if req.Name != "" {
+		channel.Name = req.Name
+	}
+	if req.URL != "" {
+		channel.URL = req.URL
+	}
+	if req.Topic != "" {
+		channel.Topic = req.Topic
+	}
+	if req.Token != "" {
+		channel.Token = req.Token
+	}
+	if req.Secret != "" {
+		channel.Secret = req.Secret
+	}
+	if req.MinSeverity != "" {
+		channel.MinSeverity = req.MinSeverity
+	}
+	if req.Enabled != nil {
+		channel.Enabled = *req.Enabled
+	}
+
+	if err := channel.Validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := app.db.Save(&channel).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Update failed"})
+		return
+	}
+
+	c.JSON(200, channel)
+}
+
+func (app *Application) deleteChannel(c *gin.Context) {
+	userID := c.GetUint("userID")
+	channelID := c.Param("id")
+
+	result := app.db.Where("id = ? AND user_id = ?", channelID, userID).Delete(&UserChannel{})
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Delete failed"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Channel not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Deleted"})
+}
+
+func (app *Application) testChannel(c *gin.Context) {
+	userID := c.GetUint("userID")
+	channelID := c.Param("id")
+
+	var channel UserChannel
+	if err := app.db.Where("id = ? AND user_id = ?", channelID, userID).First(&channel).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Channel not found"})
+		return
+	}
+
+	test := Notification{
+		UserID:    userID,
+		Type:      "test",
+		Title:     "Clarkson test notification",
+		Message:   fmt.Sprintf("If you can read this, your %s channel \"%s\" is working.", channel.Type, channel.Name),
+		Status:    "unread",
+		CreatedAt: time.Now(),
+	}
+
+	ch, err := channel.Channel()
+	if err == nil {
+		err = ch.Send(test)
+	}
+
+	delivery := NotificationDelivery{
+		UserID:    userID,
+		Channel:   channel.Type,
+		Kind:      "test",
+		Recipient: channel.Name,
+		Subject:   test.Title,
+		Status:    "sent",
+		Attempts:  1,
+	}
+	if err != nil {
+		delivery.Status = "failed"
+		delivery.Error = err.Error()
+	}
+	app.db.Create(&delivery)
+
+	if err != nil {
+		c.JSON(502, gin.H{"error": "Test failed: " + err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Test notification sent"})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.10", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"100.128.0.1", true},
+	}
+
+	for _, tt := range tests {
+		if got := publicAddress(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("publicAddress(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// withChannelClient swaps the push channel HTTP client for a test
+func withChannelClient(t *testing.T, client *http.Client) {
+	t.Helper()
+	previous := channelHTTPClient
+	channelHTTPClient = client
+	t.Cleanup(func() { channelHTTPClient = previous })
+}
+
+func TestChannelsRefusePrivateAddresses(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+	withChannelClient(t, newChannelHTTPClient(false))
+
+	ch := &WebhookChannel{URL: server.URL, Secret: "secret"}
+	err := ch.Send(Notification{Type: "reminder_due", Title: "Oil"})
+	if err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Fatalf("err = %v, want the loopback address refused", err)
+	}
+	if called {
+		t.Error("the request reached the server")
+	}
+}
+
+func TestChannelErrorsOmitResponseBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		io.WriteString(w, "internal admin panel: password=hunter2")
+	}))
+	defer server.Close()
+	withChannelClient(t, newChannelHTTPClient(true))
+
+	ch := &NtfyChannel{ServerURL: server.URL, Topic: "car"}
+	err := ch.Send(Notification{Type: "reminder_due", Title: "Oil"})
+	if err == nil {
+		t.Fatal("Send succeeded on a 500")
+	}
+	if !strings.Contains(err.Error(), "returned 500") || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("err = %q, want the status code only", err)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	var timestamp, signature string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timestamp = r.Header.Get("X-Clarkson-Timestamp")
+		signature = r.Header.Get("X-Clarkson-Signature")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	withChannelClient(t, newChannelHTTPClient(true))
+
+	ch := &WebhookChannel{URL: server.URL, Secret: "secret"}
+	if err := ch.Send(Notification{Type: "reminder_overdue", Title: "Oil"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "sha256=" + signWebhook("secret", timestamp, body); signature != want {
+		t.Errorf("signature = %q, want %q", signature, want)
+	}
+	if !strings.Contains(string(body), `"severity":"critical"`) {
+		t.Errorf("body = %s", body)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings come from an optional YAML or TOML file, CONFIG_FILE or else the
+// first of clarkson.yaml, clarkson.yml and clarkson.toml in CONFIG_PATH,
+// and then the environment, which wins. Each setting has a dotted key in the
+// file and an environment variable; see configSettings. The result is
+// checked once at startup and the server refuses to start on a bad value
+// rather than quietly using a default.
+
+// Config is the server configuration
+type Config struct {
+	Port                  string
+	JWTSecret             string
+	AllowInsecureSecret   bool     // Accept the old default or a short JWT secret
+	CORSOrigins           []string // Empty allows same-origin requests only
+	TrustedProxies        []string // Reverse proxies allowed to set X-Forwarded-*
+	ContentSecurityPolicy string
+	ReadTimeout           time.Duration // Whole request, including uploads; 0 is no limit
+	WriteTimeout          time.Duration // Whole response except event streams; 0 is no limit
+	IdleTimeout           time.Duration // Keep-alive connections between requests
+	ShutdownTimeout       time.Duration // Drain period for requests and workers on shutdown
+	ConfigPath            string
+	AssetsPath            string
+	LogLevel              string // debug, info, warn or error
+	LogFormat             string // text or json
+	MetricsEnabled        bool   // Serve /metrics
+	MetricsToken          string // Bearer token /metrics requires, if set
+
+	MaxAttachmentMB  int // Largest receipt or photo upload
+	MaxImportMB      int // Largest import or backup upload
+	ImportSessionTTL time.Duration
+
+	ReminderInterval          time.Duration
+	NotificationRetentionDays int  // 0 keeps dismissed notifications forever
+	AllowPrivateChannels      bool // Let push channels reach loopback and private addresses
+
+	Database DatabaseConfig
+	SMTP     SMTPConfig
+	Backups  ServerBackupConfig
+	File     string // The configuration file read, if any
+}
+
+// defaultJWTSecret is what older releases signed tokens with when JWT_SECRET
+// wasn't set
+const defaultJWTSecret = "your-default-secret-change-in-production"
+
+// minJWTSecretLength is the shortest JWT secret accepted without
+// allow_insecure_secret
+const minJWTSecretLength = 32
+
+// defaultConfig returns the settings used when nothing is configured
+func defaultConfig() Config {
+	return Config{
+		Port:                      "3000",
+		ContentSecurityPolicy:     defaultContentSecurityPolicy,
+		ReadTimeout:               5 * time.Minute,
+		WriteTimeout:              5 * time.Minute,
+		IdleTimeout:               2 * time.Minute,
+		ShutdownTimeout:           25 * time.Second,
+		ConfigPath:                "/config",
+		AssetsPath:                "/assets",
+		LogLevel:                  "info",
+		LogFormat:                 "text",
+		MetricsEnabled:            true,
+		MaxAttachmentMB:           10,
+		MaxImportMB:               50,
+		ImportSessionTTL:          30 * time.Minute,
+		ReminderInterval:          time.Hour,
+		NotificationRetentionDays: 90,
+		Database:                  DatabaseConfig{Driver: "sqlite"},
+		SMTP:                      SMTPConfig{Port: 587, TLSMode: "starttls"},
+		Backups: ServerBackupConfig{
+			Interval:    24 * time.Hour,
+			KeepDaily:   7,
+			KeepWeekly:  4,
+			KeepMonthly: 6,
+		},
+	}
+}
+
+// configSetting ties a file key and an environment variable to a field.
+// target is a *string, *int, *bool, *time.Duration or *[]string.
+type configSetting struct {
+	key    string
+	env    string
+	target interface{}
+}
+
+// configSettings lists every setting of cfg
+func configSettings(cfg *Config) []configSetting {
+	return []configSetting{
+		{"server.port", "PORT", &cfg.Port},
+		{"server.jwt_secret", "JWT_SECRET", &cfg.JWTSecret},
+		{"server.allow_insecure_secret", "ALLOW_INSECURE_JWT_SECRET", &cfg.AllowInsecureSecret},
+		{"server.cors_origins", "CORS_ORIGINS", &cfg.CORSOrigins},
+		{"server.trusted_proxies", "TRUSTED_PROXIES", &cfg.TrustedProxies},
+		{"server.content_security_policy", "CONTENT_SECURITY_POLICY", &cfg.ContentSecurityPolicy},
+		{"server.read_timeout", "HTTP_READ_TIMEOUT", &cfg.ReadTimeout},
+		{"server.write_timeout", "HTTP_WRITE_TIMEOUT", &cfg.WriteTimeout},
+		{"server.idle_timeout", "HTTP_IDLE_TIMEOUT", &cfg.IdleTimeout},
+		{"server.shutdown_timeout", "SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout},
+		{"paths.config", "CONFIG_PATH", &cfg.ConfigPath},
+		{"paths.assets", "ASSETS_PATH", &cfg.AssetsPath},
+		{"log.level", "LOG_LEVEL", &cfg.LogLevel},
+		{"log.format", "LOG_FORMAT", &cfg.LogFormat},
+		{"metrics.enabled", "METRICS_ENABLED", &cfg.MetricsEnabled},
+		{"metrics.token", "METRICS_TOKEN", &cfg.MetricsToken},
+		{"database.driver", "DB_DRIVER", &cfg.Database.Driver},
+		{"database.dsn", "DB_DSN", &cfg.Database.DSN},
+		{"uploads.max_attachment_mb", "UPLOAD_MAX_MB", &cfg.MaxAttachmentMB},
+		{"uploads.max_import_mb", "IMPORT_MAX_MB", &cfg.MaxImportMB},
+		{"uploads.import_session_ttl", "IMPORT_SESSION_TTL", &cfg.ImportSessionTTL},
+		{"scheduler.reminder_interval", "REMINDER_CHECK_INTERVAL", &cfg.ReminderInterval},
+		{"notifications.retention_days", "NOTIFICATION_RETENTION_DAYS", &cfg.NotificationRetentionDays},
+		{"notifications.allow_private_channels", "ALLOW_PRIVATE_CHANNELS", &cfg.AllowPrivateChannels},
+		{"notifications.smtp.host", "SMTP_HOST", &cfg.SMTP.Host},
+		{"notifications.smtp.port", "SMTP_PORT", &cfg.SMTP.Port},
+		{"notifications.smtp.tls", "SMTP_TLS", &cfg.SMTP.TLSMode},
+		{"notifications.smtp.username", "SMTP_USERNAME", &cfg.SMTP.Username},
+		{"notifications.smtp.password", "SMTP_PASSWORD", &cfg.SMTP.Password},
+		{"notifications.smtp.from", "SMTP_FROM", &cfg.SMTP.From},
+		{"backups.path", "BACKUP_PATH", &cfg.Backups.Dir},
+		{"backups.interval", "BACKUP_INTERVAL", &cfg.Backups.Interval},
+		{"backups.keep_daily", "BACKUP_KEEP_DAILY", &cfg.Backups.KeepDaily},
+		{"backups.keep_weekly", "BACKUP_KEEP_WEEKLY", &cfg.Backups.KeepWeekly},
+		{"backups.keep_monthly", "BACKUP_KEEP_MONTHLY", &cfg.Backups.KeepMonthly},
+		{"backups.assets", "BACKUP_ASSETS", &cfg.Backups.IncludeAssets},
+	}
+}
+
+// set parses raw into the setting's field
+func (s configSetting) set(raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch target := s.target.(type) {
+	case *string:
+		*target = raw
+	case *int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", raw)
+		}
+		*target = n
+	case *bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		*target = b
+	case *time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 30m or 24h", raw)
+		}
+		*target = d
+	case *[]string:
+		var values []string
+		for _, v := range strings.Split(raw, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		*target = values
+	}
+	return nil
+}
+
+// loadConfig reads the configuration file and the environment and checks
+// the result. The JWT secret is settled separately by resolveJWTSecret.
+func loadConfig() (Config, error) {
+	cfg := defaultConfig()
+	settings := configSettings(&cfg)
+
+	file, err := configFile()
+	if err != nil {
+		return cfg, err
+	}
+	if file != "" {
+		values, err := readConfigFile(file)
+		if err != nil {
+			return cfg, fmt.Errorf("reading %s: %v", file, err)
+		}
+		var problems []string
+		for _, s := range settings {
+			if raw, ok := values[s.key]; ok {
+				if err := s.set(raw); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", s.key, err))
+				}
+				delete(values, s.key)
+			}
+		}
+		for key := range values {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting", key))
+		}
+		if len(problems) > 0 {
+			sort.Strings(problems)
+			return cfg, fmt.Errorf("invalid settings in %s:\n  %s", file, strings.Join(problems, "\n  "))
+		}
+		cfg.File = file
+	}
+
+	var problems []string
+	for _, s := range settings {
+		if raw := os.Getenv(s.env); raw != "" {
+			if err := s.set(raw); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", s.env, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return cfg, fmt.Errorf("invalid environment:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	cfg.fillDefaults()
+	if err := cfg.validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// configFile returns the configuration file to read, or "" if there is none
+func configFile() (string, error) {
+	if file := os.Getenv("CONFIG_FILE"); file != "" {
+		if _, err := os.Stat(file); err != nil {
+			return "", fmt.Errorf("CONFIG_FILE: %v", err)
+		}
+		return file, nil
+	}
+	dir := os.Getenv("CONFIG_PATH")
+	if dir == "" {
+		dir = "/config"
+	}
+	for _, name := range []string{"clarkson.yaml", "clarkson.yml", "clarkson.toml"} {
+		file := filepath.Join(dir, name)
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", nil
+}
+
+// readConfigFile reads a YAML or TOML file, by its extension, into values
+// by dotted key. Lists become comma-separated.
+func readConfigFile(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		return nil, fmt.Errorf("unknown file type %q: use .yaml, .yml or .toml", filepath.Ext(file))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	var flatten func(prefix string, node map[string]interface{})
+	flatten = func(prefix string, node map[string]interface{}) {
+		for key, value := range node {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				flatten(prefix+key+".", v)
+			case []interface{}:
+				items := make([]string, len(v))
+				for i, item := range v {
+					items[i] = fmt.Sprint(item)
+				}
+				values[prefix+key] = strings.Join(items, ",")
+			case nil:
+			default:
+				values[prefix+key] = fmt.Sprint(v)
+			}
+		}
+	}
+	flatten("", tree)
+	return values, nil
+}
+
+// fillDefaults fills in settings that default to others
+func (cfg *Config) fillDefaults() {
+	cfg.Database.Driver = strings.ToLower(cfg.Database.Driver)
+	switch cfg.Database.Driver {
+	case "", "sqlite3":
+		cfg.Database.Driver = "sqlite"
+	case "postgresql":
+		cfg.Database.Driver = "postgres"
+	case "mariadb":
+		cfg.Database.Driver = "mysql"
+	}
+	if cfg.Database.Driver == "sqlite" && cfg.Database.DSN == "" {
+		cfg.Database.DSN = filepath.Join(cfg.ConfigPath, "clarkson.db")
+	}
+
+	for i, origin := range cfg.CORSOrigins {
+		cfg.CORSOrigins[i] = strings.TrimSuffix(origin, "/")
+	}
+
+	cfg.LogLevel = strings.ToLower(cfg.LogLevel)
+	cfg.LogFormat = strings.ToLower(cfg.LogFormat)
+
+	cfg.SMTP.TLSMode = strings.ToLower(cfg.SMTP.TLSMode)
+	if cfg.SMTP.From == "" {
+		cfg.SMTP.From = cfg.SMTP.Username
+	}
+
+	if cfg.Backups.Dir == "" {
+		cfg.Backups.Dir = filepath.Join(cfg.ConfigPath, "backups")
+	}
+	cfg.Backups.AssetsPath = cfg.AssetsPath
+}
+
+// validate reports every bad setting at once
+func (cfg *Config) validate() error {
+	var problems []string
+	bad := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		bad("server.port (PORT) must be a port number, not %q", cfg.Port)
+	}
+	for _, origin := range cfg.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			bad("server.cors_origins (CORS_ORIGINS): %q is not an origin like https://cars.example.com", origin)
+		}
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		bad("server.trusted_proxies (TRUSTED_PROXIES): %v", err)
+	}
+	if cfg.ContentSecurityPolicy == "" {
+		bad("server.content_security_policy (CONTENT_SECURITY_POLICY) is empty")
+	}
+	if cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.IdleTimeout < 0 {
+		bad("server.read_timeout, write_timeout and idle_timeout can't be negative; 0 is no limit")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		bad("server.shutdown_timeout (SHUTDOWN_TIMEOUT) must be positive")
+	}
+	if cfg.ConfigPath == "" {
+		bad("paths.config (CONFIG_PATH) is empty")
+	}
+	if cfg.AssetsPath == "" {
+		bad("paths.assets (ASSETS_PATH) is empty")
+	}
+	if _, ok := logLevels[cfg.LogLevel]; !ok {
+		bad("log.level (LOG_LEVEL) must be debug, info, warn or error, not %q", cfg.LogLevel)
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		bad("log.format (LOG_FORMAT) must be text or json, not %q", cfg.LogFormat)
+	}
+
+	switch cfg.Database.Driver {
+	case "sqlite", "postgres", "mysql":
+		if cfg.Database.DSN == "" {
+			bad("database.dsn (DB_DSN) is required with the %s driver", cfg.Database.Driver)
+		}
+	default:
+		bad("database.driver (DB_DRIVER) must be sqlite, postgres or mysql, not %q", cfg.Database.Driver)
+	}
+
+	if cfg.MaxAttachmentMB < 1 {
+		bad("uploads.max_attachment_mb (UPLOAD_MAX_MB) must be at least 1")
+	}
+	if cfg.MaxImportMB < 1 {
+		bad("uploads.max_import_mb (IMPORT_MAX_MB) must be at least 1")
+	}
+	if cfg.ImportSessionTTL <= 0 {
+		bad("uploads.import_session_ttl (IMPORT_SESSION_TTL) must be positive")
+	}
+	if cfg.ReminderInterval <= 0 {
+		bad("scheduler.reminder_interval (REMINDER_CHECK_INTERVAL) must be positive")
+	}
+	if cfg.NotificationRetentionDays < 0 {
+		bad("notifications.retention_days (NOTIFICATION_RETENTION_DAYS) can't be negative")
+	}
+
+	if cfg.SMTP.TLSMode != "none" && cfg.SMTP.TLSMode != "starttls" && cfg.SMTP.TLSMode != "tls" {
+		bad("notifications.smtp.tls (SMTP_TLS) must be none, starttls or tls, not %q", cfg.SMTP.TLSMode)
+	}
+	if cfg.SMTP.Host != "" {
+		if cfg.SMTP.Port < 1 || cfg.SMTP.Port > 65535 {
+			bad("notifications.smtp.port (SMTP_PORT) must be a port number")
+		}
+		if cfg.SMTP.From == "" {
+			bad("notifications.smtp.from (SMTP_FROM) is required when there is no SMTP username")
+		}
+	}
+
+	if cfg.Backups.Interval < 0 {
+		bad("backups.interval (BACKUP_INTERVAL) can't be negative; 0 turns scheduled backups off")
+	}
+	if cfg.Backups.KeepDaily < 0 || cfg.Backups.KeepWeekly < 0 || cfg.Backups.KeepMonthly < 0 {
+		bad("backups.keep_daily, keep_weekly and keep_monthly can't be negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// resolveJWTSecret settles the JWT secret. Without one, a random secret is
+// generated and kept in CONFIG_PATH/jwt_secret so sessions survive restarts.
+// The old built-in default and short secrets are refused unless
+// allow_insecure_secret is set.
+func (cfg *Config) resolveJWTSecret() error {
+	if cfg.JWTSecret == "" {
+		file := filepath.Join(cfg.ConfigPath, "jwt_secret")
+		if data, err := os.ReadFile(file); err == nil && strings.TrimSpace(string(data)) != "" {
+			cfg.JWTSecret = strings.TrimSpace(string(data))
+			return nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("reading %s: %v", file, err)
+		}
+
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		secret := base64.StdEncoding.EncodeToString(buf)
+		if err := os.MkdirAll(cfg.ConfigPath, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, []byte(secret+"\n"), 0600); err != nil {
+			return fmt.Errorf("saving a generated JWT secret: %v", err)
+		}
+		slog.Info("generated a JWT secret", "file", file)
+		cfg.JWTSecret = secret
+		return nil
+	}
+
+	if cfg.AllowInsecureSecret {
+		return nil
+	}
+	if cfg.JWTSecret == defaultJWTSecret {
+		return fmt.Errorf("JWT_SECRET is the old built-in default, which anyone can use to sign in: set a random one, unset it to have one generated, or set ALLOW_INSECURE_JWT_SECRET=true")
+	}
+	if len(cfg.JWTSecret) < minJWTSecretLength {
+		return fmt.Errorf("JWT_SECRET is shorter than %d characters: use `openssl rand -base64 32`, or set ALLOW_INSECURE_JWT_SECRET=true", minJWTSecretLength)
+	}
+	return nil
+}
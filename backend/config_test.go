@@ -0,0 +1,217 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configEnv clears every setting from the environment and points CONFIG_PATH
+// at an empty temporary directory, which it returns
+func configEnv(t *testing.T) string {
+	t.Helper()
+	var cfg Config
+	for _, s := range configSettings(&cfg) {
+		t.Setenv(s.env, "")
+	}
+	t.Setenv("CONFIG_FILE", "")
+	dir := t.TempDir()
+	t.Setenv("CONFIG_PATH", dir)
+	return dir
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	dir := configEnv(t)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.File != "" || cfg.Database.Driver != "sqlite" || cfg.Database.DSN != filepath.Join(dir, "clarkson.db") {
+		t.Errorf("config = %+v", cfg)
+	}
+	if cfg.Backups.Dir != filepath.Join(dir, "backups") {
+		t.Errorf("backups dir = %q", cfg.Backups.Dir)
+	}
+}
+
+func TestLoadConfigFileAndEnvironment(t *testing.T) {
+	dir := configEnv(t)
+	os.WriteFile(filepath.Join(dir, "clarkson.yaml"), []byte(`
+server:
+  port: 8080
+  cors_origins: [https://a.example.com, "http://b.local:8080/"]
+uploads:
+  import_session_ttl: 1h
+notifications:
+  smtp:
+    host: mail.example.com
+    username: me@example.com
+    tls: STARTTLS
+backups:
+  interval: 0
+  assets: true
+`), 0644)
+	t.Setenv("PORT", "9090")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.File != filepath.Join(dir, "clarkson.yaml") {
+		t.Errorf("file = %q", cfg.File)
+	}
+	if cfg.Port != "9090" {
+		t.Errorf("port = %q, want the environment to win", cfg.Port)
+	}
+	if len(cfg.CORSOrigins) != 2 || cfg.CORSOrigins[1] != "http://b.local:8080" {
+		t.Errorf("cors origins = %q", cfg.CORSOrigins)
+	}
+	if cfg.ImportSessionTTL != time.Hour || !cfg.Backups.IncludeAssets || cfg.Backups.Interval != 0 {
+		t.Errorf("config = %+v", cfg)
+	}
+	if cfg.SMTP.From != "me@example.com" || cfg.SMTP.TLSMode != "starttls" {
+		t.Errorf("smtp = %+v, want the sender from the username and the TLS mode lowercased", cfg.SMTP)
+	}
+
+	toml := filepath.Join(dir, "other.toml")
+	os.WriteFile(toml, []byte("[server]\nport = 7000\n[backups]\ninterval = \"12h\"\nkeep_daily = 3\n"), 0644)
+	t.Setenv("PORT", "")
+	t.Setenv("CONFIG_FILE", toml)
+	cfg, err = loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "7000" || cfg.Backups.Interval != 12*time.Hour || cfg.Backups.KeepDaily != 3 {
+		t.Errorf("toml config = %+v", cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		want []string
+	}{
+		{
+			name: "unknown and unreadable settings",
+			file: "server:\n  prot: 1\n  port: 80\nuploads:\n  import_session_ttl: soon\n",
+			want: []string{"server.prot: unknown setting", "uploads.import_session_ttl: \"soon\" is not a duration"},
+		},
+		{
+			name: "bad environment",
+			env:  map[string]string{"ALLOW_INSECURE_JWT_SECRET": "yes", "UPLOAD_MAX_MB": "lots"},
+			want: []string{"ALLOW_INSECURE_JWT_SECRET: \"yes\" is not true or false", "UPLOAD_MAX_MB: \"lots\" is not a whole number"},
+		},
+		{
+			name: "bad values reported together",
+			file: "server:\n  port: 0\n  cors_origins: [example.com]\ndatabase:\n  driver: oracle\n",
+			want: []string{"server.port (PORT)", "\"example.com\" is not an origin", "database.driver (DB_DRIVER)"},
+		},
+		{
+			name: "smtp tls mode",
+			env:  map[string]string{"SMTP_TLS": "ssl"},
+			want: []string{"notifications.smtp.tls (SMTP_TLS) must be none, starttls or tls, not \"ssl\""},
+		},
+		{
+			name: "smtp tls mode without a host",
+			env:  map[string]string{"SMTP_TLS": "yes", "SMTP_HOST": ""},
+			want: []string{"notifications.smtp.tls (SMTP_TLS)"},
+		},
+		{
+			name: "smtp sender",
+			env:  map[string]string{"SMTP_HOST": "mail.example.com"},
+			want: []string{"notifications.smtp.from (SMTP_FROM) is required"},
+		},
+		{
+			name: "log level",
+			env:  map[string]string{"LOG_LEVEL": "verbose", "LOG_FORMAT": "xml"},
+			want: []string{"log.level (LOG_LEVEL) must be debug, info, warn or error, not \"verbose\"", "log.format (LOG_FORMAT)"},
+		},
+		{
+			name: "database without a dsn",
+			env:  map[string]string{"DB_DRIVER": "postgres"},
+			want: []string{"database.dsn (DB_DSN) is required with the postgres driver"},
+		},
+		{
+			name: "negative durations and counts",
+			env:  map[string]string{"BACKUP_INTERVAL": "-1h", "BACKUP_KEEP_DAILY": "-1", "NOTIFICATION_RETENTION_DAYS": "-5"},
+			want: []string{"backups.interval", "keep_daily", "notifications.retention_days"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := configEnv(t)
+			if tt.file != "" {
+				os.WriteFile(filepath.Join(dir, "clarkson.yaml"), []byte(tt.file), 0644)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := loadConfig()
+			if err == nil {
+				t.Fatal("loaded without an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("err = %v\nwant it to mention %q", err, want)
+				}
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		dir := configEnv(t)
+		t.Setenv("CONFIG_FILE", filepath.Join(dir, "missing.yaml"))
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "CONFIG_FILE") {
+			t.Errorf("err = %v", err)
+		}
+	})
+}
+
+func TestResolveJWTSecret(t *testing.T) {
+	dir := t.TempDir()
+
+	generated := Config{ConfigPath: dir}
+	if err := generated.resolveJWTSecret(); err != nil {
+		t.Fatal(err)
+	}
+	if len(generated.JWTSecret) < minJWTSecretLength {
+		t.Errorf("generated secret %q is too short", generated.JWTSecret)
+	}
+	info, err := os.Stat(filepath.Join(dir, "jwt_secret"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("secret file = %v, %v, want mode 0600", info, err)
+	}
+
+	reloaded := Config{ConfigPath: dir}
+	reloaded.resolveJWTSecret()
+	if reloaded.JWTSecret != generated.JWTSecret {
+		t.Error("the saved secret wasn't reused")
+	}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{"old default", Config{JWTSecret: defaultJWTSecret}, "old built-in default"},
+		{"short", Config{JWTSecret: "short"}, "shorter than"},
+		{"short but allowed", Config{JWTSecret: "short", AllowInsecureSecret: true}, ""},
+		{"long enough", Config{JWTSecret: strings.Repeat("x", minJWTSecretLength)}, ""},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.resolveJWTSecret()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Clarkson stores its data in SQLite by default, in CONFIG_PATH/clarkson.db.
+// DB_DRIVER=postgres or DB_DRIVER=mysql with a DB_DSN uses a server instead
+// (database.driver and database.dsn in the configuration file, config.go).
+// Queries stick to SQL all three understand; the few SQLite-only features
+// (server backups in serverbackup.go) are switched off on the others.
+
+// DatabaseConfig says which database to use
+type DatabaseConfig struct {
+	Driver string // sqlite, postgres or mysql
+	DSN    string // File path for sqlite, connection string otherwise
+}
+
+// openDatabase connects to the configured database
+func openDatabase(cfg DatabaseConfig) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch cfg.Driver {
+	case "sqlite":
+		dialector = sqlite.Open(cfg.DSN)
+	case "postgres":
+		dialector = postgres.Open(cfg.DSN)
+	case "mysql":
+		// Dates are scanned into time.Time only with parseTime
+		dsn := cfg.DSN
+		if !strings.Contains(dsn, "parseTime=") {
+			if strings.Contains(dsn, "?") {
+				dsn += "&parseTime=true"
+			} else {
+				dsn += "?parseTime=true"
+			}
+		}
+		dialector = mysql.Open(dsn)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", cfg.Driver)
+	}
+	return gorm.Open(dialector, &gorm.Config{})
+}
+
+// isSQLite reports whether db is a SQLite database
+func isSQLite(db *gorm.DB) bool {
+	return db.Dialector.Name() == "sqlite"
+}
+
+// likePattern matches text containing s, for `LOWER(column) LIKE ? ESCAPE '!'`.
+// The wildcards in s are escaped and it is lowercased.
+func likePattern(s string) string {
+	s = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(s))
+	return "%" + s + "%"
+}
+
+// copyTable copies every row of one model's table from src to dst in
+// batches, keeping the IDs
+func copyTable[T any](src, dst *gorm.DB) (int, error) {
+	var batch []T
+	copied := 0
+	err := src.FindInBatches(&batch, 500, func(_ *gorm.DB, _ int) error {
+		copied += len(batch)
+		return dst.Omit(clause.Associations).Create(&batch).Error
+	}).Error
+	return copied, err
+}
+
+// databaseCopy lists the tables copied by copyDatabase, parents first so
+// foreign keys resolve
+var databaseCopy = []struct {
+	table string
+	copy  func(src, dst *gorm.DB) (int, error)
+}{
+	{"users", copyTable[User]},
+	{"vehicles", copyTable[Vehicle]},
+	{"vehicle_users", copyTable[VehicleUser]},
+	{"fuel_entries", copyTable[FuelEntry]},
+	{"expenses", copyTable[Expense]},
+	{"maintenance_reminders", copyTable[MaintenanceReminder]},
+	{"attachments", copyTable[Attachment]},
+	{"notifications", copyTable[Notification]},
+	{"notification_deliveries", copyTable[NotificationDelivery]},
+	{"user_channels", copyTable[UserChannel]},
+	{"notification_preferences", copyTable[NotificationPreference]},
+}
+
+// copyDatabase copies all data from src into dst in one transaction. Both
+// must be at the latest schema version and dst must be empty.
+func copyDatabase(src, dst *gorm.DB) (map[string]int, error) {
+	for _, t := range databaseCopy {
+		var count int64
+		if err := dst.Table(t.table).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, fmt.Errorf("the target database already has data in %s", t.table)
+		}
+	}
+
+	copied := make(map[string]int)
+	err := dst.Transaction(func(tx *gorm.DB) error {
+		for _, t := range databaseCopy {
+			n, err := t.copy(src, tx)
+			if err != nil {
+				return fmt.Errorf("copying %s: %v", t.table, err)
+			}
+			copied[t.table] = n
+
+			// Rows keep their IDs, so Postgres sequences have to catch up
+			if tx.Dialector.Name() == "postgres" {
+				err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 1), MAX(id) IS NOT NULL) FROM %s", t.table, t.table)).Error
+				if err != nil {
+					return fmt.Errorf("resetting the %s sequence: %v", t.table, err)
+				}
+			}
+		}
+		return nil
+	})
+	return copied, err
+}
+
+// runCopyCommand handles `clarkson-server migrate copy <sqlite file>`: it
+// copies an existing SQLite database into the database configured with
+// DB_DRIVER and DB_DSN. Both are migrated to the latest schema first, the
+// SQLite file after a backup as usual.
+func runCopyCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: clarkson-server migrate copy <sqlite file>")
+		return 2
+	}
+	if _, err := os.Stat(args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't read %s: %v\n", args[0], err)
+		return 1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		return 1
+	}
+	setupLogging(config)
+	cfg := config.Database
+	if cfg.Driver == "sqlite" {
+		fmt.Fprintln(os.Stderr, "Set DB_DRIVER and DB_DSN to the database to copy into")
+		return 2
+	}
+
+	src, err := openDatabase(DatabaseConfig{Driver: "sqlite", DSN: args[0]})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Opening %s failed: %v\n", args[0], err)
+		return 1
+	}
+	dst, err := openDatabase(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Connecting to %s failed: %v\n", cfg.Driver, err)
+		return 1
+	}
+
+	for _, app := range []*Application{{db: src, backups: config.Backups}, {db: dst, backups: config.Backups}} {
+		if err := app.migrate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+			return 1
+		}
+	}
+
+	copied, err := copyDatabase(src, dst)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Copy failed, nothing was written: %v\n", err)
+		return 1
+	}
+	for _, t := range databaseCopy {
+		fmt.Printf("%-26s %d\n", t.table, copied[t.table])
+	}
+	fmt.Printf("Copied %s into %s\n", args[0], cfg.Driver)
+	return 0
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Drivvo's CSV export covers one vehicle in sections, each starting with a
+// line naming it (Refuelling, Expense, Service, Reminder, ...) followed by
+// its header. Column names are in the language the app was set to, so
+// English and Portuguese names are both recognised. Kilometres and litres
+// are assumed unless the header says otherwise.
+
+// drivvoVehicle is the key of the one vehicle in a Drivvo import
+const drivvoVehicle = "Drivvo"
+
+// drivvoSections maps section names to the kind of record in them. Empty
+// kinds are sections that aren't imported.
+var drivvoSections = map[string]string{
+	"refuelling": "fuel", "refuellings": "fuel", "refueling": "fuel", "refuelings": "fuel",
+	"abastecimento": "fuel", "abastecimentos": "fuel",
+	"expense": "expense", "expenses": "expense", "despesa": "expense", "despesas": "expense",
+	"service": "service", "services": "service", "serviço": "service", "serviços": "service",
+	"servico": "service", "servicos": "service",
+	"reminder": "reminder", "reminders": "reminder", "lembrete": "reminder", "lembretes": "reminder",
+	"income": "", "incomes": "", "receita": "", "receitas": "",
+	"route": "", "routes": "", "percurso": "", "percursos": "",
+	"checklist": "", "checklists": "",
+}
+
+// drivvoColumns are the column keys (see csvColumnKey) read for each field
+var drivvoColumns = map[string][]string{
+	"odometer": {"odometer", "odômetro", "odometro"},
+	"date":     {"date", "data"},
+	"volume":   {"volume", "quantity", "liters", "litres", "gallons", "quantidade", "litros"},
+	"total":    {"totalcost", "total", "valortotal", "custototal", "cost", "value", "valor"},
+	"price":    {"price", "pricel", "pricegal", "fuelprice", "priceperunit", "preço", "preco", "preçol", "precol"},
+	"full":     {"fulltank", "full", "tanquecheio", "completouotanque"},
+	"missed":   {"missedpreviousrefuelling", "missedpreviousrefueling", "missedrefuelling", "missed", "esqueceuderegistraroabastecimentoanterior"},
+	"station":  {"gasstation", "station", "place", "posto", "postodecombustível", "local"},
+	"type":     {"expensetype", "servicetype", "type", "tipodedespesa", "tipodeserviço", "tipodeservico", "tipo"},
+	"name":     {"description", "name", "descrição", "descricao", "expensetype", "servicetype", "type", "tipo"},
+	"notes":    {"notes", "note", "observation", "observação", "observacao", "observações", "observacoes"},
+	"every":    {"repeatdistance", "repeatodometer", "repeatevery", "repeateverykm", "repeateverymi", "repeatkm", "repetiracada", "repetiracadakm"},
+	"months":   {"repeatmonths", "repeateverymonths", "repetiracadameses"},
+}
+
+func drivvoSection(record []string) (string, bool) {
+	for _, field := range record[1:] {
+		if strings.TrimSpace(field) != "" {
+			return "", false
+		}
+	}
+	name := strings.ToLower(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(record[0]), "#")))
+	if _, ok := drivvoSections[name]; !ok {
+		return "", false
+	}
+	return name, true
+}
+
+// drivvoImporter reads Drivvo CSV exports
+type drivvoImporter struct{}
+
+func (drivvoImporter) Name() string { return "drivvo" }
+
+func (drivvoImporter) Detect(body []byte) bool {
+	_, ok := drivvoSections[strings.ToLower(strings.TrimSpace(strings.TrimLeft(firstCSVLine(body), "#")))]
+	return ok
+}
+
+// Parse reads refuellings as fill-ups, expenses and services as expenses,
+// and reminders. Income, routes and checklists are skipped with a warning.
+func (drivvoImporter) Parse(body []byte, opts ImportOptions) (*ImportBatch, error) {
+	tables, err := readCSVTables(body, drivvoSection)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV: %v", err)
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no Drivvo sections in the file")
+	}
+
+	iv := ImportVehicle{Key: drivvoVehicle, Make: "Imported", Model: "Vehicle", DistanceUnit: "km", VolumeUnit: "l"}
+	for _, t := range tables {
+		for _, name := range t.Header {
+			lower := strings.ToLower(name)
+			if strings.Contains(lower, "(mi") || strings.Contains(lower, "/mi") {
+				iv.DistanceUnit = "mi"
+			}
+			if strings.Contains(lower, "gal") {
+				iv.VolumeUnit = "gal"
+			}
+		}
+	}
+	batch := &ImportBatch{Vehicles: []ImportVehicle{iv}}
+
+	var numbers []string
+	for _, t := range tables {
+		for _, field := range []string{"odometer", "volume", "total", "price", "every"} {
+			numbers = append(numbers, t.column(drivvoColumns[field]...)...)
+		}
+	}
+	decimal := opts.decimalFor(numbers)
+
+	for _, t := range tables {
+		kind := drivvoSections[t.Name]
+		if kind == "" {
+			if len(t.Rows) > 0 {
+				batch.Warnings = append(batch.Warnings, ImportWarning{
+					Type:    t.Name,
+					Message: fmt.Sprintf("%d %s records aren't imported", len(t.Rows), t.Name),
+				})
+			}
+			continue
+		}
+
+		for i, record := range t.Rows {
+			line := t.Lines[i]
+			get := func(field string) string {
+				return t.get(record, drivvoColumns[field]...)
+			}
+
+			switch kind {
+			case "fuel":
+				f := ImportFuel{
+					Row:          line,
+					Vehicle:      drivvoVehicle,
+					PartialFill:  t.has(drivvoColumns["full"]...) && !parseImportFlag(get("full")),
+					MissedFillup: parseImportFlag(get("missed")),
+					Location:     get("station"),
+					Notes:        get("notes"),
+				}
+				var price float64
+				var parseErr error
+				if f.Date, parseErr = parseImportDate(get("date"), opts.DateFormat); parseErr == nil {
+					if f.Odometer, parseErr = parseImportNumber(get("odometer"), decimal); parseErr == nil {
+						if f.Volume, parseErr = parseImportNumber(get("volume"), decimal); parseErr == nil {
+							if f.Cost, parseErr = parseImportNumber(get("total"), decimal); parseErr == nil {
+								price, parseErr = parseImportNumber(get("price"), decimal)
+							}
+						}
+					}
+				}
+				if parseErr == nil {
+					switch {
+					case f.Volume == 0 && price > 0:
+						f.Volume = math.Round(f.Cost/price*1000) / 1000
+					case f.Cost == 0:
+						f.Cost = math.Round(f.Volume*price*100) / 100
+					}
+				}
+				if parseErr == nil && f.Volume <= 0 {
+					parseErr = fmt.Errorf("fuel volume must be positive")
+				}
+				if parseErr == nil && f.Odometer <= 0 {
+					parseErr = fmt.Errorf("needs an odometer reading")
+				}
+				if parseErr != nil {
+					batch.Warnings = append(batch.Warnings, ImportWarning{Row: line, Type: "fuel", Message: parseErr.Error()})
+					continue
+				}
+				batch.Fuel = append(batch.Fuel, f)
+
+			case "expense", "service":
+				kindName := get("type")
+				e := ImportExpense{
+					Row:      line,
+					Vehicle:  drivvoVehicle,
+					Category: expenseCategory(kindName),
+				}
+				if kind == "service" {
+					e.Category = "Maintenance"
+				}
+				var notes []string
+				for _, note := range []string{kindName, get("station"), get("notes")} {
+					if note != "" && note != e.Category {
+						notes = append(notes, note)
+					}
+				}
+				e.Notes = strings.Join(notes, "\n")
+
+				var parseErr error
+				if e.Date, parseErr = parseImportDate(get("date"), opts.DateFormat); parseErr == nil {
+					if e.Odometer, parseErr = parseImportNumber(get("odometer"), decimal); parseErr == nil {
+						e.Amount, parseErr = parseImportNumber(get("total"), decimal)
+					}
+				}
+				if parseErr != nil {
+					batch.Warnings = append(batch.Warnings, ImportWarning{Row: line, Type: "expense", Message: parseErr.Error()})
+					continue
+				}
+				batch.Expenses = append(batch.Expenses, e)
+
+			case "reminder":
+				r := ImportReminder{Row: line, Vehicle: drivvoVehicle, Name: get("name")}
+				var due *time.Time
+				var dueOdometer float64
+				var parseErr error
+				if raw := get("date"); raw != "" {
+					var d time.Time
+					if d, parseErr = parseImportDate(raw, opts.DateFormat); parseErr == nil {
+						due = &d
+					}
+				}
+				if parseErr == nil {
+					dueOdometer, parseErr = parseImportNumber(get("odometer"), decimal)
+				}
+				switch {
+				case parseErr != nil:
+				case r.Name == "":
+					parseErr = fmt.Errorf("reminder has no description")
+				case due == nil && dueOdometer <= 0:
+					parseErr = fmt.Errorf("reminder has no date or odometer")
+				}
+				if parseErr != nil {
+					batch.Warnings = append(batch.Warnings, ImportWarning{Row: line, Type: "reminder", Message: parseErr.Error()})
+					continue
+				}
+				every, _ := parseImportNumber(get("every"), decimal)
+				months, _ := strconv.Atoi(get("months"))
+				batch.Reminders = append(batch.Reminders, dueReminder(r, due, dueOdometer, every, months))
+			}
+		}
+	}
+
+	return batch, nil
+}
+
+// importDrivvo imports a Drivvo CSV export into one vehicle, created unless
+// vehicle_map maps "Drivvo" to an existing one
+func (app *Application) importDrivvo(c *gin.Context) {
+	body, _, opts, ok := app.readImportUpload(c)
+	if !ok {
+		return
+	}
+	app.runImport(c, "drivvo", body, opts)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const drivvoExport = "Refuelling\n" +
+	"Odometer (km),Date,Fuel,Price / L,Total cost,Volume (L),Full tank?,Missed previous refuelling?,Gas station,Reason,Notes\n" +
+	"10000,2024-01-02 08:00,Gasoline,5.50,220.00,40,Yes,No,Shell,,\n" +
+	"10500,2024-01-20 08:00,Gasoline,5.60,112,,No,No,Ipiranga,,half\n" +
+	"\n" +
+	"Expense\n" +
+	"Odometer,Date,Expense type,Total cost,Place,Notes\n" +
+	"10100,2024-01-05,Insurance,1200,,annual\n" +
+	"10150,2024-01-06,Parking,15,Mall,\n" +
+	"\n" +
+	"Service\n" +
+	"Odometer,Date,Service type,Total cost,Place,Notes\n" +
+	"10200,2024-01-10,Oil change,300,Garage,\n" +
+	"\n" +
+	"Income\n" +
+	"Odometer,Date,Income type,Total\n" +
+	"10300,2024-01-11,Uber,50\n" +
+	"\n" +
+	"Reminder\n" +
+	"Type,Description,Date,Odometer,Repeat every (km),Repeat months\n" +
+	"Service,Oil change,2024-07-10,20200,10000,6\n" +
+	"Expense,IPVA,2025-01-05,,,\n"
+
+func TestDrivvoParse(t *testing.T) {
+	if format := detectImportFormat([]byte(drivvoExport)); format != "drivvo" {
+		t.Fatalf("detected %q, want drivvo", format)
+	}
+
+	batch, err := parseImport("drivvo", []byte(drivvoExport), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Vehicles) != 1 || batch.Vehicles[0].DistanceUnit != "km" || batch.Vehicles[0].VolumeUnit != "l" {
+		t.Fatalf("vehicles = %+v", batch.Vehicles)
+	}
+
+	if len(batch.Fuel) != 2 {
+		t.Fatalf("%d fill-ups, want 2", len(batch.Fuel))
+	}
+	first, second := batch.Fuel[0], batch.Fuel[1]
+	if first.Odometer != 10000 || first.Volume != 40 || first.Cost != 220 || first.PartialFill || first.Location != "Shell" {
+		t.Errorf("first fill-up = %+v", first)
+	}
+	if !first.Date.Equal(time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("date = %v", first.Date)
+	}
+	if second.Volume != 20 || !second.PartialFill || second.Notes != "half" {
+		t.Errorf("second fill-up = %+v, want the volume from cost and price", second)
+	}
+
+	if len(batch.Expenses) != 3 {
+		t.Fatalf("%d expenses, want 3", len(batch.Expenses))
+	}
+	categories := []string{"Insurance", "Parking", "Maintenance"}
+	for i, e := range batch.Expenses {
+		if e.Category != categories[i] {
+			t.Errorf("expense %d category = %q, want %q", i, e.Category, categories[i])
+		}
+	}
+	if service := batch.Expenses[2]; service.Amount != 300 || service.Odometer != 10200 || service.Notes != "Oil change\nGarage" {
+		t.Errorf("service = %+v", service)
+	}
+
+	if len(batch.Reminders) != 2 {
+		t.Fatalf("%d reminders, want 2", len(batch.Reminders))
+	}
+	repeat, once := batch.Reminders[0], batch.Reminders[1]
+	if repeat.Name != "Oil change" || repeat.IntervalDistance != 10000 || repeat.IntervalDays != 182 || repeat.LastOdometer != 10200 {
+		t.Errorf("repeating reminder = %+v", repeat)
+	}
+	if once.Name != "IPVA" || once.DueDate == nil || !once.DueDate.Equal(time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("one-off reminder = %+v", once)
+	}
+
+	if len(batch.Warnings) != 1 || batch.Warnings[0].Type != "income" {
+		t.Errorf("warnings = %+v, want the income skipped", batch.Warnings)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Duplicate detection. Two fuel entries for the same vehicle within a day of
+// each other are the same fill-up if they have the same odometer reading, or
+// the same volume and cost. Expenses are duplicates when the category and
+// amount match within a day. Imports skip or merge duplicates, new entries
+// come back with a warning, and /duplicates lists the suspects for review.
+// An imported reminder is a duplicate of an open one with the same name.
+
+// duplicateWindow is how far apart two entries can be and still be the same
+const duplicateWindow = 24 * time.Hour
+
+func withinDuplicateWindow(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d <= duplicateWindow && d >= -duplicateWindow
+}
+
+func fuelEntriesMatch(a, b FuelEntry) bool {
+	if a.VehicleID != b.VehicleID || !withinDuplicateWindow(a.Date, b.Date) {
+		return false
+	}
+	sameOdometer := a.Odometer > 0 && math.Abs(a.Odometer-b.Odometer) < 1
+	sameFill := math.Abs(a.Gallons-b.Gallons) < 0.01 && math.Abs(a.Price-b.Price) < 0.005
+	return sameOdometer || sameFill
+}
+
+func expensesMatch(a, b Expense) bool {
+	return a.VehicleID == b.VehicleID && withinDuplicateWindow(a.Date, b.Date) &&
+		strings.EqualFold(strings.TrimSpace(a.Category), strings.TrimSpace(b.Category)) &&
+		math.Abs(a.Amount-b.Amount) < 0.005
+}
+
+// findFuelDuplicate returns an existing entry that looks like the same
+// fill-up. The entry itself is ignored if it has been saved.
+func findFuelDuplicate(db *gorm.DB, entry FuelEntry) (FuelEntry, bool) {
+	var candidates []FuelEntry
+	db.Where("vehicle_id = ? AND id <> ? AND date BETWEEN ? AND ?",
+		entry.VehicleID, entry.ID, entry.Date.Add(-duplicateWindow), entry.Date.Add(duplicateWindow)).
+		Order("id").
+		Find(&candidates)
+	for _, candidate := range candidates {
+		if fuelEntriesMatch(candidate, entry) {
+			return candidate, true
+		}
+	}
+	return FuelEntry{}, false
+}
+
+func findExpenseDuplicate(db *gorm.DB, expense Expense) (Expense, bool) {
+	var candidates []Expense
+	db.Where("vehicle_id = ? AND id <> ? AND date BETWEEN ? AND ?",
+		expense.VehicleID, expense.ID, expense.Date.Add(-duplicateWindow), expense.Date.Add(duplicateWindow)).
+		Order("id").
+		Find(&candidates)
+	for _, candidate := range candidates {
+		if expensesMatch(candidate, expense) {
+			return candidate, true
+		}
+	}
+	return Expense{}, false
+}
+
+// findReminderDuplicate returns an open reminder on the vehicle with the
+// same name
+func findReminderDuplicate(db *gorm.DB, reminder MaintenanceReminder) (MaintenanceReminder, bool) {
+	var candidates []MaintenanceReminder
+	db.Where("vehicle_id = ? AND id <> ? AND LOWER(name) = LOWER(?) AND completed_at IS NULL",
+		reminder.VehicleID, reminder.ID, reminder.Name).
+		Order("id").
+		Limit(1).
+		Find(&candidates)
+	if len(candidates) == 0 {
+		return MaintenanceReminder{}, false
+	}
+	return candidates[0], true
+}
+
+// mergeNotes appends notes the kept entry doesn't already have
+func mergeNotes(keep, other string) string {
+	keep, other = strings.TrimSpace(keep), strings.TrimSpace(other)
+	switch {
+	case other == "" || strings.Contains(keep, other):
+		return keep
+	case keep == "":
+		return other
+	}
+	return keep + "\n" + other
+}
+
+// mergeFuelEntries fills in what the kept entry is missing from a duplicate
+func mergeFuelEntries(keep *FuelEntry, other FuelEntry) {
+	if keep.Odometer == 0 {
+		keep.Odometer = other.Odometer
+	}
+	if keep.Gallons == 0 {
+		keep.Gallons = other.Gallons
+	}
+	if keep.Price == 0 {
+		keep.Price = other.Price
+	}
+	if keep.Location == "" {
+		keep.Location = other.Location
+	}
+	keep.Notes = mergeNotes(keep.Notes, other.Notes)
+	keep.PartialFill = keep.PartialFill || other.PartialFill
+	keep.MissedFillup = keep.MissedFillup || other.MissedFillup
+}
+
+func mergeExpenses(keep *Expense, other Expense) {
+	if keep.Category == "" {
+		keep.Category = other.Category
+	}
+	keep.Notes = mergeNotes(keep.Notes, other.Notes)
+}
+
+// mergeReminders fills in intervals and due points the kept reminder is
+// missing, and moves the last service forward if the other's is later
+func mergeReminders(keep *MaintenanceReminder, other MaintenanceReminder) {
+	if keep.IntervalMiles == 0 {
+		keep.IntervalMiles = other.IntervalMiles
+	}
+	if keep.IntervalDays == 0 {
+		keep.IntervalDays = other.IntervalDays
+	}
+	if keep.DueDate == nil {
+		keep.DueDate = other.DueDate
+	}
+	if keep.DueMiles == 0 {
+		keep.DueMiles = other.DueMiles
+	}
+	if other.LastServiceDate.After(keep.LastServiceDate) {
+		keep.LastServiceDate = other.LastServiceDate
+	}
+	if other.LastServiceMiles > keep.LastServiceMiles {
+		keep.LastServiceMiles = other.LastServiceMiles
+	}
+}
+
+// DuplicateGroup is a set of entries that look like the same fill-up or
+// expense, oldest record first
+type DuplicateGroup struct {
+	Kind      string      `json:"kind"` // fuel or expense
+	VehicleID uint        `json:"vehicle_id"`
+	Fuel      []FuelEntry `json:"fuel,omitempty"`
+	Expenses  []Expense   `json:"expenses,omitempty"`
+}
+
+// groupDuplicates clusters items, sorted by date, that match a neighbour
+// within the duplicate window. It returns the indexes of each group of two
+// or more.
+func groupDuplicates(n int, date func(i int) time.Time, match func(i, j int) bool) [][]int {
+	parent := make([]int, n)
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n && date(j).Sub(date(i)) <= duplicateWindow; j++ {
+			if match(i, j) {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	members := make(map[int][]int)
+	var roots []int
+	for i := 0; i < n; i++ {
+		root := find(i)
+		if _, seen := members[root]; !seen {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], i)
+	}
+
+	var groups [][]int
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			groups = append(groups, members[root])
+		}
+	}
+	return groups
+}
+
+// listDuplicates lists suspected duplicate fuel entries and expenses on the
+// user's vehicles, or one vehicle with ?vehicle_id=
+func (app *Application) listDuplicates(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	vehicles, err := app.accessibleVehicles(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load vehicles"})
+		return
+	}
+	var ids []uint
+	for _, v := range vehicles {
+		if raw := c.Query("vehicle_id"); raw == "" || raw == strconv.FormatUint(uint64(v.ID), 10) {
+			ids = append(ids, v.ID)
+		}
+	}
+	if len(ids) == 0 && c.Query("vehicle_id") != "" {
+		c.JSON(404, gin.H{"error": "Vehicle not found"})
+		return
+	}
+
+	groups := []DuplicateGroup{}
+	for _, vehicleID := range ids {
+		var fuel []FuelEntry
+		if err := app.db.Where("vehicle_id = ?", vehicleID).Order("date, id").Find(&fuel).Error; err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		for _, group := range groupDuplicates(len(fuel),
+			func(i int) time.Time { return fuel[i].Date },
+			func(i, j int) bool { return fuelEntriesMatch(fuel[i], fuel[j]) }) {
+			g := DuplicateGroup{Kind: "fuel", VehicleID: vehicleID}
+			for _, i := range group {
+				g.Fuel = append(g.Fuel, fuel[i])
+			}
+			sort.Slice(g.Fuel, func(i, j int) bool { return g.Fuel[i].ID < g.Fuel[j].ID })
+			groups = append(groups, g)
+		}
+
+		var expenses []Expense
+		if err := app.db.Where("vehicle_id = ?", vehicleID).Order("date, id").Find(&expenses).Error; err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		for _, group := range groupDuplicates(len(expenses),
+			func(i int) time.Time { return expenses[i].Date },
+			func(i, j int) bool { return expensesMatch(expenses[i], expenses[j]) }) {
+			g := DuplicateGroup{Kind: "expense", VehicleID: vehicleID}
+			for _, i := range group {
+				g.Expenses = append(g.Expenses, expenses[i])
+			}
+			sort.Slice(g.Expenses, func(i, j int) bool { return g.Expenses[i].ID < g.Expenses[j].ID })
+			groups = append(groups, g)
+		}
+	}
+
+	c.JSON(200, groups)
+}
+
+// mergeDuplicates folds duplicate entries into the one being kept: missing
+// details and notes are copied over, attachments are moved to it and the
+// duplicates are deleted.
+func (app *Application) mergeDuplicates(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req struct {
+		Kind     string `json:"kind" binding:"required"` // fuel or expense
+		KeepID   uint   `json:"keep_id" binding:"required"`
+		MergeIDs []uint `json:"merge_ids" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	for _, id := range req.MergeIDs {
+		if id == req.KeepID {
+			c.JSON(400, gin.H{"error": "merge_ids can't include keep_id"})
+			return
+		}
+	}
+
+	vehicles, err := app.accessibleVehicles(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load vehicles"})
+		return
+	}
+	accessible := make(map[uint]bool)
+	for _, v := range vehicles {
+		accessible[v.ID] = true
+	}
+
+	var vehicleID uint
+	var kept interface{}
+	var entryTypes []string
+
+	err = app.db.Transaction(func(tx *gorm.DB) error {
+		switch req.Kind {
+		case "fuel":
+			var keep FuelEntry
+			var others []FuelEntry
+			if err := tx.First(&keep, req.KeepID).Error; err != nil || !accessible[keep.VehicleID] {
+				return fmt.Errorf("fuel entry %d not found", req.KeepID)
+			}
+			tx.Where("id IN ?", req.MergeIDs).Order("id").Find(&others)
+			if len(others) != len(req.MergeIDs) {
+				return fmt.Errorf("fuel entries not found")
+			}
+			for _, other := range others {
+				if other.VehicleID != keep.VehicleID {
+					return fmt.Errorf("fuel entry %d belongs to another vehicle", other.ID)
+				}
+				mergeFuelEntries(&keep, other)
+			}
+			if err := tx.Save(&keep).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&FuelEntry{}, req.MergeIDs).Error; err != nil {
+				return err
+			}
+			vehicleID, kept, entryTypes = keep.VehicleID, keep, []string{"fuel", "fuelentry"}
+
+		case "expense":
+			var keep Expense
+			var others []Expense
+			if err := tx.First(&keep, req.KeepID).Error; err != nil || !accessible[keep.VehicleID] {
+				return fmt.Errorf("expense %d not found", req.KeepID)
+			}
+			tx.Where("id IN ?", req.MergeIDs).Order("id").Find(&others)
+			if len(others) != len(req.MergeIDs) {
+				return fmt.Errorf("expenses not found")
+			}
+			for _, other := range others {
+				if other.VehicleID != keep.VehicleID {
+					return fmt.Errorf("expense %d belongs to another vehicle", other.ID)
+				}
+				mergeExpenses(&keep, other)
+			}
+			if err := tx.Save(&keep).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&Expense{}, req.MergeIDs).Error; err != nil {
+				return err
+			}
+			vehicleID, kept, entryTypes = keep.VehicleID, keep, []string{"expense"}
+
+		default:
+			return fmt.Errorf("kind must be fuel or expense")
+		}
+
+		return tx.Model(&Attachment{}).
+			Where("entry_type IN ? AND entry_id IN ?", entryTypes, req.MergeIDs).
+			Update("entry_id", req.KeepID).Error
+	})
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	app.publishVehicleEvent(vehicleID, "entry.updated", gin.H{"kind": req.Kind, "entry": kept})
+	for _, id := range req.MergeIDs {
+		app.publishVehicleEvent(vehicleID, "entry.deleted", gin.H{"kind": req.Kind, "id": id})
+	}
+
+	c.JSON(200, gin.H{
+		"entry":  kept,
+		"merged": len(req.MergeIDs),
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFuelEntriesMatch(t *testing.T) {
+	date := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	base := FuelEntry{VehicleID: 1, Date: date, Odometer: 1300, Gallons: 10, Price: 30}
+
+	tests := []struct {
+		name  string
+		other FuelEntry
+		want  bool
+	}{
+		{"same odometer", FuelEntry{VehicleID: 1, Date: date.Add(20 * time.Hour), Odometer: 1300.4, Gallons: 9, Price: 27}, true},
+		{"same fill", FuelEntry{VehicleID: 1, Date: date.Add(-3 * time.Hour), Odometer: 1250, Gallons: 10, Price: 30}, true},
+		{"different fill", FuelEntry{VehicleID: 1, Date: date, Odometer: 1250, Gallons: 10, Price: 31}, false},
+		{"two days apart", FuelEntry{VehicleID: 1, Date: date.Add(48 * time.Hour), Odometer: 1300, Gallons: 10, Price: 30}, false},
+		{"other vehicle", FuelEntry{VehicleID: 2, Date: date, Odometer: 1300, Gallons: 10, Price: 30}, false},
+	}
+
+	for _, tt := range tests {
+		if got := fuelEntriesMatch(base, tt.other); got != tt.want {
+			t.Errorf("%s: match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	expense := Expense{VehicleID: 1, Date: date, Category: "Maintenance", Amount: 50}
+	if !expensesMatch(expense, Expense{VehicleID: 1, Date: date.Add(8 * time.Hour), Category: " maintenance", Amount: 50}) {
+		t.Error("expenses differing in category case didn't match")
+	}
+	if expensesMatch(expense, Expense{VehicleID: 1, Date: date, Category: "Maintenance", Amount: 50.5}) {
+		t.Error("expenses with different amounts matched")
+	}
+}
+
+func TestImportDuplicates(t *testing.T) {
+	const first = "car_name,model,odometer,gallons,price,fuelup_date,notes,brand\n" +
+		"Civic,2015 Honda Civic,1000,10,3,2024-01-01,first,Shell\n" +
+		"Civic,2015 Honda Civic,1300,9,3,2024-01-10,,BP\n"
+	const again = "car_name,model,odometer,gallons,price,fuelup_date,notes,brand\n" +
+		"Civic,2015 Honda Civic,1000,10,3,2024-01-01,second note,\n"
+
+	tests := []struct {
+		mode       string
+		wantCount  int
+		wantNotes  string
+		wantResult int
+	}{
+		{"skip", 2, "first", 1},
+		{"merge", 2, "first\nsecond note", 1},
+		{"keep", 3, "first", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			app := newTestApp(t)
+			user := User{Email: "driver@example.com"}
+			app.db.Create(&user)
+			civic := Vehicle{UserID: user.ID, Year: 2015, Make: "Honda", Model: "Civic"}
+			app.db.Create(&civic)
+
+			run := func(body string, opts ImportOptions) ImportResult {
+				t.Helper()
+				opts.VehicleMap = map[string]uint{"Civic": civic.ID}
+				batch, err := parseImport("fuelly", []byte(body), opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				vehicles, _ := app.accessibleVehicles(user.ID)
+				result, err := app.writeImport(user.ID, batch, vehicles, opts.VehicleMap, opts, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return result
+			}
+
+			run(first, ImportOptions{})
+			result := run(again, ImportOptions{Duplicates: tt.mode})
+			if len(result.Duplicates) != tt.wantResult {
+				t.Errorf("%d duplicates reported, want %d", len(result.Duplicates), tt.wantResult)
+			}
+
+			var entries []FuelEntry
+			app.db.Order("id").Find(&entries)
+			if len(entries) != tt.wantCount {
+				t.Fatalf("%d entries, want %d", len(entries), tt.wantCount)
+			}
+			if entries[0].Notes != tt.wantNotes || entries[0].Location != "Shell" {
+				t.Errorf("first entry notes = %q at %q, want %q at Shell", entries[0].Notes, entries[0].Location, tt.wantNotes)
+			}
+		})
+	}
+}
+
+func TestListAndMergeDuplicates(t *testing.T) {
+	app := newTestApp(t)
+	app.events = NewEventHub(10, 10)
+	user := User{Email: "driver@example.com"}
+	other := User{Email: "other@example.com"}
+	app.db.Create(&user)
+	app.db.Create(&other)
+	civic := Vehicle{UserID: user.ID, Make: "Honda", Model: "Civic"}
+	app.db.Create(&civic)
+	theirs := Vehicle{UserID: other.ID, Make: "Kia", Model: "Ceed"}
+	app.db.Create(&theirs)
+
+	date := time.Date(2024, 2, 1, 10, 0, 0, 0, time.UTC)
+	keep := Expense{VehicleID: civic.ID, Date: date, Category: "Maintenance", Amount: 50}
+	dup := Expense{VehicleID: civic.ID, Date: date.Add(8 * time.Hour), Category: "maintenance", Amount: 50, Notes: "dup"}
+	app.db.Create(&keep)
+	app.db.Create(&dup)
+	app.db.Create(&Expense{VehicleID: civic.ID, Date: date, Category: "Parking", Amount: 5})
+	app.db.Create(&Expense{VehicleID: theirs.ID, Date: date, Category: "Maintenance", Amount: 50})
+	app.db.Create(&Expense{VehicleID: theirs.ID, Date: date, Category: "Maintenance", Amount: 50})
+	receipt := Attachment{EntryType: "expense", EntryID: dup.ID, Filename: "receipt.pdf"}
+	app.db.Create(&receipt)
+
+	list := func(query string) (int, []DuplicateGroup) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/api/duplicates?"+query, nil)
+		c.Set("userID", user.ID)
+		app.listDuplicates(c)
+		var groups []DuplicateGroup
+		json.Unmarshal(w.Body.Bytes(), &groups)
+		return w.Code, groups
+	}
+
+	code, groups := list("")
+	if code != 200 || len(groups) != 1 {
+		t.Fatalf("list: %d %+v, want one group on the user's own vehicle", code, groups)
+	}
+	if g := groups[0]; g.Kind != "expense" || len(g.Expenses) != 2 || g.Expenses[0].ID != keep.ID {
+		t.Errorf("group = %+v", g)
+	}
+	if code, _ := list("vehicle_id=99"); code != 404 {
+		t.Errorf("unknown vehicle: %d, want 404", code)
+	}
+
+	if w := callHandler(app.mergeDuplicates, user.ID, "", gin.H{"kind": "expense", "keep_id": keep.ID, "merge_ids": []uint{keep.ID}}); w.Code != 400 {
+		t.Errorf("merging an entry into itself: %d, want 400", w.Code)
+	}
+	if w := callHandler(app.mergeDuplicates, other.ID, "", gin.H{"kind": "expense", "keep_id": keep.ID, "merge_ids": []uint{dup.ID}}); w.Code != 400 {
+		t.Errorf("merging someone else's entries: %d, want 400", w.Code)
+	}
+
+	if w := callHandler(app.mergeDuplicates, user.ID, "", gin.H{"kind": "expense", "keep_id": keep.ID, "merge_ids": []uint{dup.ID}}); w.Code != 200 {
+		t.Fatalf("merge: %d %s", w.Code, w.Body.String())
+	}
+	app.db.First(&keep, keep.ID)
+	if keep.Notes != "dup" {
+		t.Errorf("kept notes = %q, want the duplicate's", keep.Notes)
+	}
+	if err := app.db.First(&Expense{}, dup.ID).Error; err == nil {
+		t.Error("the duplicate wasn't deleted")
+	}
+	app.db.First(&receipt, receipt.ID)
+	if receipt.EntryID != keep.ID {
+		t.Errorf("attachment is on entry %d, want %d", receipt.EntryID, keep.ID)
+	}
+	if _, groups := list(""); len(groups) != 0 {
+		t.Errorf("groups after merging = %+v", groups)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// SMTPConfig holds the outgoing mail server settings
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	TLSMode  string // none, starttls, tls
+}
+
+// EmailMessage is a rendered email ready to send
+type EmailMessage struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends email through an SMTP server, retrying transient failures
+type Mailer struct {
+	config     SMTPConfig
+	tlsConfig  *tls.Config
+	maxRetries int
+	retryDelay time.Duration
+}
+
+func NewMailer(config SMTPConfig) *Mailer {
+	if config.Host == "" {
+		return nil
+	}
+	return &Mailer{
+		config:     config,
+		tlsConfig:  &tls.Config{ServerName: config.Host},
+		maxRetries: 3,
+		retryDelay: 5 * time.Second,
+	}
+}
+
+// Send delivers the message, retrying with a growing delay. It returns the
+// number of attempts made and the last error, if every attempt failed.
+func (m *Mailer) Send(msg EmailMessage) (int, error) {
+	return retry(m.maxRetries, m.retryDelay, func() error {
+		return m.send(msg)
+	})
+}
+
+func (m *Mailer) send(msg EmailMessage) error {
+	addr := net.JoinHostPort(m.config.Host, strconv.Itoa(m.config.Port))
+	tlsConfig := m.tlsConfig
+
+	var client *smtp.Client
+	if m.config.TLSMode == "tls" {
+		conn, err := tls.Dial("tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		client, err = smtp.NewClient(conn, m.config.Host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		var err error
+		client, err = smtp.Dial(addr)
+		if err != nil {
+			return err
+		}
+	}
+	defer client.Close()
+
+	if m.config.TLSMode == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+
+	if m.config.Username != "" {
+		auth := smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+
+	body, err := buildMIMEMessage(m.config.From, msg)
+	if err != nil {
+		return err
+	}
+
+	if err := client.Mail(m.config.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// headerValue makes text safe for a header: line breaks, which would start
+// a new header, are dropped
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// buildMIMEMessage renders a multipart/alternative message with text and HTML
+// parts. The subject comes from reminder names, so it is RFC 2047 encoded.
+func buildMIMEMessage(from string, msg EmailMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(&buf, "To: %s\r\n", headerValue(msg.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(msg.Subject)))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@clarkson>\r\n", randomToken(16))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	}
+
+	for _, p := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", p.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(p.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Email templates
+
+type reminderEmailData struct {
+	Name          string
+	Notifications []Notification
+}
+
+type digestEmailData struct {
+	Name     string
+	Vehicles []digestVehicle
+}
+
+type digestVehicle struct {
+	Name   string
+	Alerts []Notification
+}
+
+var reminderTextTemplate = texttemplate.Must(texttemplate.New("reminder").Parse(
+	`Hi {{.Name}},
+
+The following maintenance needs your attention:
+{{range .Notifications}}
+* {{.Title}}
+  {{.Message}}
+{{end}}
+-- Clarkson
+`))
+
+var reminderHTMLTemplate = htmltemplate.Must(htmltemplate.New("reminder").Parse(
+	`<html><body style="font-family: sans-serif">
+<p>Hi {{.Name}},</p>
+<p>The following maintenance needs your attention:</p>
+<ul>
+{{range .Notifications}}<li><strong>{{.Title}}</strong><br>{{.Message}}</li>
+{{end}}</ul>
+<p style="color: #888">&mdash; Clarkson</p>
+</body></html>
+`))
+
+var digestTextTemplate = texttemplate.Must(texttemplate.New("digest").Parse(
+	`Hi {{.Name}},
+
+Here is your weekly maintenance summary.
+{{range .Vehicles}}
+{{.Name}}
+{{range .Alerts}}  * {{.Title}}: {{.Message}}
+{{end}}{{else}}
+Nothing is due. Drive safe!
+{{end}}
+-- Clarkson
+`))
+
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digest").Parse(
+	`<html><body style="font-family: sans-serif">
+<p>Hi {{.Name}},</p>
+<p>Here is your weekly maintenance summary.</p>
+{{range .Vehicles}}<h3>{{.Name}}</h3>
+<ul>
+{{range .Alerts}}<li><strong>{{.Title}}</strong>: {{.Message}}</li>
+{{end}}</ul>
+{{else}}<p>Nothing is due. Drive safe!</p>
+{{end}}<p style="color: #888">&mdash; Clarkson</p>
+</body></html>
+`))
+
+func renderReminderEmail(user User, notifications []Notification) (EmailMessage, error) {
+	data := reminderEmailData{Name: user.Name, Notifications: notifications}
+	msg := EmailMessage{To: user.Email}
+
+	overdue := false
+	for _, n := range notifications {
+		if n.Type == "reminder_overdue" {
+			overdue = true
+		}
+	}
+	if len(notifications) == 1 {
+		msg.Subject = "Clarkson: " + notifications[0].Title
+	} else if overdue {
+		msg.Subject = fmt.Sprintf("Clarkson: %d maintenance items need attention (some overdue)", len(notifications))
+	} else {
+		msg.Subject = fmt.Sprintf("Clarkson: %d maintenance items due soon", len(notifications))
+	}
+
+	var text, html bytes.Buffer
+	if err := reminderTextTemplate.Execute(&text, data); err != nil {
+		return msg, err
+	}
+	if err := reminderHTMLTemplate.Execute(&html, data); err != nil {
+		return msg, err
+	}
+	msg.Text = text.String()
+	msg.HTML = html.String()
+
+	return msg, nil
+}
+
+func renderDigestEmail(user User, vehicles []digestVehicle) (EmailMessage, error) {
+	data := digestEmailData{Name: user.Name, Vehicles: vehicles}
+	msg := EmailMessage{
+		To:      user.Email,
+		Subject: "Clarkson: your weekly maintenance digest",
+	}
+
+	var text, html bytes.Buffer
+	if err := digestTextTemplate.Execute(&text, data); err != nil {
+		return msg, err
+	}
+	if err := digestHTMLTemplate.Execute(&html, data); err != nil {
+		return msg, err
+	}
+	msg.Text = text.String()
+	msg.HTML = html.String()
+
+	return msg, nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpStub is a minimal SMTP server for the mailer tests. It speaks just
+// enough of the protocol for net/smtp: EHLO, STARTTLS, AUTH PLAIN, MAIL,
+// RCPT, DATA and QUIT.
+type smtpStub struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	implicit  bool   // TLS from the first byte, for the tls mode
+	failFirst int    // Connections refused with a 421 before accepting mail
+	onData    func() // Called as each message arrives, if set
+
+	mu          sync.Mutex
+	connections int
+	startTLS    bool
+	auth        string
+	messages    []string
+}
+
+// newSMTPStub starts a stub on a random local port. The returned pool
+// trusts its certificate.
+func newSMTPStub(t *testing.T, implicit bool, failFirst int) (*smtpStub, *x509.CertPool) {
+	t.Helper()
+	cert, pool := stubCertificate(t)
+	s := &smtpStub{
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		implicit:  implicit,
+		failFirst: failFirst,
+	}
+
+	var err error
+	if implicit {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.listener.Close() })
+
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, pool
+}
+
+func (s *smtpStub) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	s.mu.Lock()
+	s.connections++
+	refuse := s.connections <= s.failFirst
+	s.mu.Unlock()
+	if refuse {
+		io.WriteString(conn, "421 try again later\r\n")
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 stub ESMTP")
+	secure := s.implicit
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			if secure {
+				reply("250-stub")
+				reply("250 AUTH PLAIN")
+			} else {
+				reply("250-stub")
+				reply("250-STARTTLS")
+				reply("250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			reply("220 ready")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r, secure = tlsConn, bufio.NewReader(tlsConn), true
+			s.mu.Lock()
+			s.startTLS = true
+			s.mu.Unlock()
+		case "AUTH":
+			s.mu.Lock()
+			s.auth = line
+			s.mu.Unlock()
+			reply("235 ok")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			reply("250 ok")
+		case "DATA":
+			if s.onData != nil {
+				s.onData()
+			}
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpStub) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+// stubCertificate makes a self-signed certificate for 127.0.0.1
+func stubCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smtp stub"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// testMailer points a mailer at the stub
+func testMailer(s *smtpStub, pool *x509.CertPool, mode string) *Mailer {
+	m := NewMailer(SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     s.port(),
+		Username: "clarkson",
+		Password: "secret",
+		From:     "clarkson@example.com",
+		TLSMode:  mode,
+	})
+	m.tlsConfig.RootCAs = pool
+	m.retryDelay = time.Millisecond
+	return m
+}
+
+// parseMessage splits a received message into its headers and decoded parts
+func parseMessage(t *testing.T, raw string) (*mail.Message, map[string]string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, want multipart/alternative", msg.Header.Get("Content-Type"))
+	}
+
+	parts := make(map[string]string)
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc := part.Header.Get("Content-Transfer-Encoding"); enc != "quoted-printable" {
+			t.Errorf("Content-Transfer-Encoding = %q, want quoted-printable", enc)
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[partType] = string(body)
+	}
+	return msg, parts
+}
+
+func TestMailerModes(t *testing.T) {
+	tests := []struct {
+		mode     string
+		implicit bool
+		startTLS bool
+	}{
+		{"none", false, false},
+		{"starttls", false, true},
+		{"tls", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			stub, pool := newSMTPStub(t, tt.implicit, 0)
+			m := testMailer(stub, pool, tt.mode)
+
+			attempts, err := m.Send(EmailMessage{
+				To:      "driver@example.com",
+				Subject: "Oil change - OVERDUE",
+				Text:    "Due now",
+				HTML:    "<p>Due now</p>",
+			})
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if attempts != 1 {
+				t.Errorf("attempts = %d, want 1", attempts)
+			}
+			if got := len(stub.received()); got != 1 {
+				t.Fatalf("received %d messages, want 1", got)
+			}
+			if stub.startTLS != tt.startTLS {
+				t.Errorf("STARTTLS used = %v, want %v", stub.startTLS, tt.startTLS)
+			}
+			if !strings.HasPrefix(stub.auth, "AUTH PLAIN") {
+				t.Errorf("auth = %q, want AUTH PLAIN", stub.auth)
+			}
+		})
+	}
+}
+
+func TestMailerStartTLSRejectsUntrustedCertificate(t *testing.T) {
+	stub, _ := newSMTPStub(t, false, 0)
+	m := testMailer(stub, x509.NewCertPool(), "starttls")
+	m.maxRetries = 1
+
+	if _, err := m.Send(EmailMessage{To: "driver@example.com", Subject: "x"}); err == nil {
+		t.Fatal("Send succeeded with an untrusted certificate")
+	}
+	if got := len(stub.received()); got != 0 {
+		t.Errorf("received %d messages, want 0", got)
+	}
+}
+
+func TestMailerRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failFirst    int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"first try", 0, 1, false},
+		{"after two failures", 2, 3, false},
+		{"gives up", 5, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, pool := newSMTPStub(t, false, tt.failFirst)
+			m := testMailer(stub, pool, "none")
+
+			attempts, err := m.Send(EmailMessage{To: "driver@example.com", Subject: "x", Text: "x"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			want := 1
+			if tt.wantErr {
+				want = 0
+			}
+			if got := len(stub.received()); got != want {
+				t.Errorf("received %d messages, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildMIMEMessage(t *testing.T) {
+	long := strings.Repeat("Wheel alignment ", 10)
+	raw, err := buildMIMEMessage("clarkson@example.com", EmailMessage{
+		To:      "driver@example.com",
+		Subject: "Clarkson: Pneus d'hiver – dû",
+		Text:    "Prix: 120 €\n" + long,
+		HTML:    `<p style="color: red">Prix: 120 €</p>`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Quoted-printable keeps body lines within 76 characters
+	_, body, _ := strings.Cut(string(raw), "\r\n\r\n")
+	for _, line := range strings.Split(body, "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("body line longer than 76 characters: %q", line)
+		}
+	}
+
+	msg, parts := parseMessage(t, string(raw))
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Clarkson: Pneus d'hiver – dû" {
+		t.Errorf("Subject = %q", subject)
+	}
+	if msg.Header.Get("MIME-Version") != "1.0" {
+		t.Errorf("MIME-Version = %q", msg.Header.Get("MIME-Version"))
+	}
+	if got := parts["text/plain"]; got != "Prix: 120 €\r\n"+long {
+		t.Errorf("text part = %q", got)
+	}
+	if got := parts["text/html"]; got != `<p style="color: red">Prix: 120 €</p>` {
+		t.Errorf("html part = %q", got)
+	}
+}
+
+func TestBuildMIMEMessageHeaderInjection(t *testing.T) {
+	raw, err := buildMIMEMessage("clarkson@example.com", EmailMessage{
+		To:      "driver@example.com",
+		Subject: "Oil\r\nBcc: victim@example.com\r\n\r\nspoofed",
+		Text:    "x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, _ := parseMessage(t, string(raw))
+	if bcc := msg.Header.Get("Bcc"); bcc != "" {
+		t.Fatalf("injected Bcc header %q", bcc)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "OilBcc: victim@example.comspoofed" {
+		t.Errorf("Subject = %q", subject)
+	}
+}
+
+func TestRenderReminderEmailSubject(t *testing.T) {
+	user := User{Name: "Sam", Email: "sam@example.com"}
+	tests := []struct {
+		notifications []Notification
+		want          string
+	}{
+		{[]Notification{{Type: "reminder_due", Title: "Oil - DUE SOON"}}, "Clarkson: Oil - DUE SOON"},
+		{[]Notification{{Type: "reminder_due"}, {Type: "reminder_due"}}, "Clarkson: 2 maintenance items due soon"},
+		{[]Notification{{Type: "reminder_due"}, {Type: "reminder_overdue"}}, "Clarkson: 2 maintenance items need attention (some overdue)"},
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			msg, err := renderReminderEmail(user, tt.notifications)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Subject != tt.want {
+				t.Errorf("Subject = %q, want %q", msg.Subject, tt.want)
+			}
+			if msg.To != user.Email || !strings.Contains(msg.Text, "Hi Sam") || !strings.Contains(msg.HTML, "Hi Sam") {
+				t.Errorf("unexpected message %+v", msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Event is a change pushed to a user's live stream. IDs look like
+// "<boot>-<seq>" so a client reconnecting after a restart is told to resync
+// instead of silently missing events.
+type Event struct {
+	ID     string      `json:"id"`
+	Seq    uint64      `json:"-"`
+	UserID uint        `json:"-"`
+	Type   string      `json:"type"` // notification.created, notification.updated, entry.created, entry.updated, entry.deleted
+	Data   interface{} `json:"data"`
+}
+
+type eventSubscriber struct {
+	userID uint
+	ch     chan Event
+}
+
+// EventHub fans events out to connected streams. Each connection has a
+// bounded buffer; a client that falls behind is disconnected and catches up
+// from the replay history when it reconnects with Last-Event-ID.
+type EventHub struct {
+	mu          sync.Mutex
+	boot        string
+	seq         uint64
+	history     []Event
+	historySize int
+	bufferSize  int
+	subscribers map[*eventSubscriber]struct{}
+	closed      bool
+}
+
+func NewEventHub(historySize, bufferSize int) *EventHub {
+	return &EventHub{
+		boot:        strconv.FormatInt(time.Now().Unix(), 36),
+		historySize: historySize,
+		bufferSize:  bufferSize,
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+}
+
+// Publish queues an event for every stream the user has open
+func (h *EventHub) Publish(userID uint, eventType string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	ev := Event{
+		ID:     fmt.Sprintf("%s-%d", h.boot, h.seq),
+		Seq:    h.seq,
+		UserID: userID,
+		Type:   eventType,
+		Data:   data,
+	}
+
+	h.history = append(h.history, ev)
+	if len(h.history) > h.historySize {
+		h.history = h.history[len(h.history)-h.historySize:]
+	}
+
+	for sub := range h.subscribers {
+		if sub.userID != userID {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			// Buffer full: drop the connection so the client reconnects and replays
+			close(sub.ch)
+			delete(h.subscribers, sub)
+		}
+	}
+}
+
+// Subscribe registers a stream for the user. Events after lastEventID are
+// returned for replay; resync is true when they can't all be replayed.
+func (h *EventHub) Subscribe(userID uint, lastEventID string) (sub *eventSubscriber, replay []Event, resync bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub = &eventSubscriber{userID: userID, ch: make(chan Event, h.bufferSize)}
+	if h.closed {
+		close(sub.ch)
+		return sub, nil, false
+	}
+	h.subscribers[sub] = struct{}{}
+
+	if lastEventID == "" {
+		return sub, nil, false
+	}
+
+	boot, seqStr, found := strings.Cut(lastEventID, "-")
+	lastSeq, err := strconv.ParseUint(seqStr, 10, 64)
+	if !found || err != nil || boot != h.boot {
+		return sub, nil, true
+	}
+
+	// Events between lastSeq and the oldest one we kept are gone
+	if len(h.history) > 0 && h.history[0].Seq > lastSeq+1 {
+		resync = true
+	}
+
+	for _, ev := range h.history {
+		if ev.Seq > lastSeq && ev.UserID == userID {
+			replay = append(replay, ev)
+		}
+	}
+
+	return sub, replay, resync
+}
+
+func (h *EventHub) Unsubscribe(sub *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[sub]; ok {
+		close(sub.ch)
+		delete(h.subscribers, sub)
+	}
+}
+
+// Close ends every open stream, and any opened later, for shutdown
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subscribers {
+		close(sub.ch)
+		delete(h.subscribers, sub)
+	}
+}
+
+// publishVehicleEvent notifies the owner and everyone a vehicle is shared with
+func (app *Application) publishVehicleEvent(vehicleID uint, eventType string, data interface{}) {
+	var vehicle Vehicle
+	if err := app.db.First(&vehicle, vehicleID).Error; err != nil {
+		return
+	}
+
+	for _, userID := range app.vehicleUserIDs(vehicle) {
+		app.events.Publish(userID, eventType, data)
+	}
+}
+
+const sseHeartbeatInterval = 25 * time.Second
+
+func writeSSEEvent(c *gin.Context, ev Event) error {
+	payload, err := json.Marshal(ev.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, payload)
+	return err
+}
+
+// streamEvents is a Server-Sent Events stream of the user's live updates
+func (app *Application) streamEvents(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+
+	sub, replay, resync := app.events.Subscribe(userID, lastEventID)
+	defer app.events.Unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+
+	// The stream outlives the server's write timeout
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	fmt.Fprintf(c.Writer, "retry: 5000\n\n")
+	if resync {
+		fmt.Fprintf(c.Writer, "event: resync\ndata: {}\n\n")
+	}
+	for _, ev := range replay {
+		if err := writeSSEEvent(c, ev); err != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if err := writeSSEEvent(c, ev); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// Browsers' EventSource can't set headers, and a JWT in the URL ends up in
+// access logs and browser history. Instead the client asks for a stream
+// ticket with its JWT and opens the stream with ?ticket=. A ticket has to
+// be used within streamTicketTTL and backs one open stream at a time.
+// EventSource reconnects with the same URL, so once that stream closes the
+// ticket opens it again for streamTicketReconnect.
+
+const (
+	streamTicketTTL       = 30 * time.Second
+	streamTicketReconnect = time.Minute
+)
+
+type streamTicket struct {
+	userID    uint
+	expiresAt time.Time
+	open      bool // A stream is open with the ticket
+}
+
+// StreamTickets holds the tickets that can still open a stream
+type StreamTickets struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	reconnect time.Duration
+	tickets   map[string]streamTicket
+}
+
+func NewStreamTickets(ttl, reconnect time.Duration) *StreamTickets {
+	return &StreamTickets{ttl: ttl, reconnect: reconnect, tickets: make(map[string]streamTicket)}
+}
+
+// Issue returns a new ticket for the user
+func (t *StreamTickets) Issue(userID uint) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for ticket, st := range t.tickets {
+		if !st.open && now.After(st.expiresAt) {
+			delete(t.tickets, ticket)
+		}
+	}
+
+	ticket := randomToken(32)
+	t.tickets[ticket] = streamTicket{userID: userID, expiresAt: now.Add(t.ttl)}
+	return ticket
+}
+
+// Redeem opens a stream with a ticket and returns the user it was issued
+// to. It fails while another stream is open with the ticket.
+func (t *StreamTickets) Redeem(ticket string) (uint, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, ok := t.tickets[ticket]
+	if !ok || st.open || time.Now().After(st.expiresAt) {
+		return 0, false
+	}
+	st.open = true
+	t.tickets[ticket] = st
+	return st.userID, true
+}
+
+// Release closes the ticket's stream, leaving the ticket to reconnect with
+// for the reconnect window
+func (t *StreamTickets) Release(ticket string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if st, ok := t.tickets[ticket]; ok {
+		st.open = false
+		st.expiresAt = time.Now().Add(t.reconnect)
+		t.tickets[ticket] = st
+	}
+}
+
+// issueStreamTicket hands an authenticated user a ticket for /api/events
+func (app *Application) issueStreamTicket(c *gin.Context) {
+	ticket := app.streamTickets.Issue(c.GetUint("userID"))
+	c.JSON(200, gin.H{"ticket": ticket, "expires_in": int(streamTicketTTL.Seconds())})
+}
+
+// streamAuth authenticates the event stream by ?ticket=, or by the
+// Authorization header for clients that can set it
+func (app *Application) streamAuth() gin.HandlerFunc {
+	jwtAuth := authMiddleware(app.jwtSecret)
+	return func(c *gin.Context) {
+		ticket := c.Query("ticket")
+		if ticket == "" || c.GetHeader("Authorization") != "" {
+			jwtAuth(c)
+			return
+		}
+
+		userID, ok := app.streamTickets.Redeem(ticket)
+		if !ok {
+			c.JSON(401, gin.H{"error": "Invalid or expired ticket"})
+			c.Abort()
+			return
+		}
+		defer app.streamTickets.Release(ticket)
+		c.Set("userID", userID)
+		c.Next()
+	}
+}
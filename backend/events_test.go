@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStreamTickets(t *testing.T) {
+	tickets := NewStreamTickets(time.Minute, time.Minute)
+	ticket := tickets.Issue(7)
+
+	if userID, ok := tickets.Redeem(ticket); !ok || userID != 7 {
+		t.Fatalf("Redeem = %d, %v, want 7, true", userID, ok)
+	}
+	if _, ok := tickets.Redeem(ticket); ok {
+		t.Error("a ticket opened two streams at once")
+	}
+	tickets.Release(ticket)
+	if userID, ok := tickets.Redeem(ticket); !ok || userID != 7 {
+		t.Errorf("reconnect: Redeem = %d, %v, want 7, true", userID, ok)
+	}
+	if _, ok := tickets.Redeem("made-up"); ok {
+		t.Error("an unknown ticket was redeemed")
+	}
+
+	expired := NewStreamTickets(-time.Second, time.Minute)
+	if _, ok := expired.Redeem(expired.Issue(7)); ok {
+		t.Error("an expired ticket was redeemed")
+	}
+
+	// Past the reconnect window the client needs a new ticket
+	closed := NewStreamTickets(time.Minute, -time.Second)
+	ticket = closed.Issue(7)
+	if _, ok := closed.Redeem(ticket); !ok {
+		t.Fatal("a new ticket wasn't redeemed")
+	}
+	closed.Release(ticket)
+	if _, ok := closed.Redeem(ticket); ok {
+		t.Error("a ticket reconnected after the reconnect window")
+	}
+}
+
+func TestStreamAuth(t *testing.T) {
+	app := newTestApp(t)
+	app.jwtSecret = "secret"
+	app.streamTickets = NewStreamTickets(time.Minute, time.Minute)
+
+	router := gin.New()
+	router.POST("/api/events/ticket", func(c *gin.Context) {
+		c.Set("userID", uint(7))
+		app.issueStreamTicket(c)
+	})
+	router.GET("/api/events", app.streamAuth(), func(c *gin.Context) {
+		c.String(200, "%d", c.GetUint("userID"))
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/events/ticket", nil))
+	var issued struct {
+		Ticket string `json:"ticket"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &issued)
+	if issued.Ticket == "" {
+		t.Fatalf("no ticket issued: %s", w.Body.String())
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{"ticket", "ticket=" + issued.Ticket, 200},
+		{"reconnect with the ticket", "ticket=" + issued.Ticket, 200},
+		{"jwt in the query", "token=" + issued.Ticket, 401},
+		{"nothing", "", 401},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/api/events?%s", tt.query), nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if tt.code == 200 && w.Body.String() != "7" {
+			t.Errorf("%s: user = %s, want 7", tt.name, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CSV export. Each dataset is its own RFC 4180 file, streamed row by row
+// from the database; several datasets are bundled into a zip.
+
+// csvDataset writes one CSV file for the selected vehicles
+type csvDataset struct {
+	header []string
+	write  func(app *Application, w *csv.Writer, vehicles map[uint]Vehicle, filter reportFilter) error
+}
+
+var csvDatasets = map[string]csvDataset{
+	"fuel": {
+		header: []string{"Vehicle ID", "Vehicle", "Date", "Odometer", "Distance Unit", "Volume", "Cost", "Cost Per Unit", "Partial Fill", "Missed Fillup", "Location", "Notes"},
+		write:  (*Application).writeFuelCSV,
+	},
+	"expenses": {
+		header: []string{"Vehicle ID", "Vehicle", "Date", "Category", "Amount", "Notes"},
+		write:  (*Application).writeExpensesCSV,
+	},
+	"reminders": {
+		header: []string{"Vehicle ID", "Vehicle", "Name", "Interval Distance", "Interval Days", "Last Service Date", "Last Service Odometer", "Due Date", "Due Odometer", "Status"},
+		write:  (*Application).writeRemindersCSV,
+	},
+	"services": {
+		header: []string{"Vehicle ID", "Vehicle", "Date", "Amount", "Notes"},
+		write:  (*Application).writeServicesCSV,
+	},
+}
+
+// csvDatasetOrder is the order datasets appear in when all are requested
+var csvDatasetOrder = []string{"fuel", "expenses", "reminders", "services"}
+
+func formatCSVFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatCSVMoney(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+func formatCSVDate(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+func vehicleIDs(vehicles map[uint]Vehicle) []uint {
+	ids := make([]uint, 0, len(vehicles))
+	for id := range vehicles {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// streamRows runs the query and calls fn with each row scanned into dest,
+// without loading the whole result
+func (app *Application) streamRows(query *gorm.DB, dest interface{}, fn func() error) error {
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := app.db.ScanRows(rows, dest); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (app *Application) writeFuelCSV(w *csv.Writer, vehicles map[uint]Vehicle, filter reportFilter) error {
+	query := filter.dateRange(app.db.Model(&FuelEntry{}).Where("vehicle_id IN ?", vehicleIDs(vehicles))).
+		Order("vehicle_id, date")
+
+	var f FuelEntry
+	return app.streamRows(query, &f, func() error {
+		v := vehicles[f.VehicleID]
+		unit := v.MileageUnit
+		if unit == "" {
+			unit = "mi"
+		}
+		perUnit := ""
+		if f.Gallons > 0 {
+			perUnit = strconv.FormatFloat(f.Price/f.Gallons, 'f', 3, 64)
+		}
+		record := []string{
+			strconv.FormatUint(uint64(f.VehicleID), 10),
+			vehicleName(v),
+			formatCSVDate(&f.Date),
+			formatCSVFloat(f.Odometer),
+			unit,
+			formatCSVFloat(f.Gallons),
+			formatCSVMoney(f.Price),
+			perUnit,
+			strconv.FormatBool(f.PartialFill),
+			strconv.FormatBool(f.MissedFillup),
+			f.Location,
+			f.Notes,
+		}
+		f = FuelEntry{}
+		return w.Write(record)
+	})
+}
+
+func (app *Application) writeExpensesCSV(w *csv.Writer, vehicles map[uint]Vehicle, filter reportFilter) error {
+	query := filter.dateRange(app.db.Model(&Expense{}).Where("vehicle_id IN ?", vehicleIDs(vehicles))).
+		Order("vehicle_id, date")
+
+	var e Expense
+	return app.streamRows(query, &e, func() error {
+		record := []string{
+			strconv.FormatUint(uint64(e.VehicleID), 10),
+			vehicleName(vehicles[e.VehicleID]),
+			formatCSVDate(&e.Date),
+			e.Category,
+			formatCSVMoney(e.Amount),
+			e.Notes,
+		}
+		e = Expense{}
+		return w.Write(record)
+	})
+}
+
+// writeServicesCSV is the maintenance history: expenses in the Maintenance
+// category
+func (app *Application) writeServicesCSV(w *csv.Writer, vehicles map[uint]Vehicle, filter reportFilter) error {
+	query := filter.dateRange(app.db.Model(&Expense{}).
+		Where("vehicle_id IN ? AND category = ?", vehicleIDs(vehicles), "Maintenance")).
+		Order("vehicle_id, date")
+
+	var e Expense
+	return app.streamRows(query, &e, func() error {
+		record := []string{
+			strconv.FormatUint(uint64(e.VehicleID), 10),
+			vehicleName(vehicles[e.VehicleID]),
+			formatCSVDate(&e.Date),
+			formatCSVMoney(e.Amount),
+			e.Notes,
+		}
+		e = Expense{}
+		return w.Write(record)
+	})
+}
+
+// writeRemindersCSV lists reminders with their current status. The date range
+// doesn't apply, reminders describe what is due next.
+func (app *Application) writeRemindersCSV(w *csv.Writer, vehicles map[uint]Vehicle, filter reportFilter) error {
+	query := app.db.Model(&MaintenanceReminder{}).Where("vehicle_id IN ?", vehicleIDs(vehicles)).
+		Order("vehicle_id, name")
+
+	now := time.Now()
+	var r MaintenanceReminder
+	return app.streamRows(query, &r, func() error {
+		v := vehicles[r.VehicleID]
+		state := evaluateReminder(r, v.RemindersPaused, v.Odometer, now)
+
+		dueDate := ""
+		if state.ByDays {
+			dueDate = formatCSVDate(&state.DueDate)
+		}
+		dueMiles := ""
+		if state.ByMiles {
+			dueMiles = formatCSVFloat(state.DueMiles)
+		}
+
+		record := []string{
+			strconv.FormatUint(uint64(r.VehicleID), 10),
+			vehicleName(v),
+			r.Name,
+			formatCSVFloat(r.IntervalMiles),
+			strconv.Itoa(r.IntervalDays),
+			formatCSVDate(&r.LastServiceDate),
+			formatCSVFloat(r.LastServiceMiles),
+			dueDate,
+			dueMiles,
+			state.Status,
+		}
+		r = MaintenanceReminder{}
+		return w.Write(record)
+	})
+}
+
+func writeCSVDataset(app *Application, w *csv.Writer, dataset csvDataset, vehicles map[uint]Vehicle, filter reportFilter) error {
+	w.UseCRLF = true
+	if err := w.Write(dataset.header); err != nil {
+		return err
+	}
+	if err := dataset.write(app, w, vehicles, filter); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// exportCSV streams the selected datasets. Query: dataset (fuel, expenses,
+// reminders, services; comma-separated, default all), vehicle_id, from, to
+// and format=zip. A single dataset is sent as a CSV file unless a zip is
+// asked for; several are always zipped.
+func (app *Application) exportCSV(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	filter, err := parseReportFilter(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var names []string
+	for _, name := range strings.Split(c.Query("dataset"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := csvDatasets[name]; !ok {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("unknown dataset: %s (use fuel, expenses, reminders or services)", name)})
+			return
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		names = csvDatasetOrder
+	}
+
+	selected, err := app.filteredVehicles(userID, filter)
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	vehicles := make(map[uint]Vehicle)
+	for _, v := range selected {
+		vehicles[v.ID] = v
+	}
+
+	date := time.Now().Format("2006-01-02")
+
+	if len(names) == 1 && c.Query("format") != "zip" {
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=clarkson-%s-%s.csv", names[0], date))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(200)
+
+		if err := writeCSVDataset(app, csv.NewWriter(c.Writer), csvDatasets[names[0]], vehicles, filter); err != nil {
+			// Headers are already sent, so the download is left truncated
+			requestLogger(c).Error("CSV export failed", "error", err)
+		}
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=clarkson-export-%s.zip", date))
+	c.Header("Content-Type", "application/zip")
+	c.Status(200)
+
+	zw := zip.NewWriter(c.Writer)
+	for _, name := range names {
+		f, err := zw.Create(name + ".csv")
+		if err != nil {
+			requestLogger(c).Error("CSV export failed", "error", err)
+			return
+		}
+		if err := writeCSVDataset(app, csv.NewWriter(f), csvDatasets[name], vehicles, filter); err != nil {
+			requestLogger(c).Error("CSV export failed", "dataset", name, "error", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		requestLogger(c).Error("CSV export failed", "error", err)
+	}
+}
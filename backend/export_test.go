@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportCSVResponse runs the CSV export for a user with the query string
+func exportCSVResponse(app *Application, userID uint, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/export/csv?"+query, nil)
+	c.Set("userID", userID)
+	app.exportCSV(c)
+	return w
+}
+
+func TestExportCSV(t *testing.T) {
+	app := newTestApp(t)
+	owner := User{Email: "owner@example.com"}
+	friend := User{Email: "friend@example.com"}
+	app.db.Create(&owner)
+	app.db.Create(&friend)
+
+	date := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	golf := Vehicle{UserID: owner.ID, Year: 2019, Make: "VW", Model: "Golf", MileageUnit: "km"}
+	app.db.Create(&golf)
+	fiesta := Vehicle{UserID: friend.ID, Year: 2020, Make: "Ford", Model: "Fiesta"}
+	app.db.Create(&fiesta)
+	app.db.Create(&VehicleUser{VehicleID: fiesta.ID, UserID: owner.ID})
+	hidden := Vehicle{UserID: friend.ID, Year: 2021, Make: "Kia", Model: "Ceed"}
+	app.db.Create(&hidden)
+
+	app.db.Create(&FuelEntry{VehicleID: golf.ID, Date: date, Gallons: 10, Price: 40, Odometer: 1000, Notes: "said \"hi\", ok\nline2"})
+	app.db.Create(&FuelEntry{VehicleID: fiesta.ID, Date: date.AddDate(0, 1, 0), Gallons: 8, Price: 30, Odometer: 500, PartialFill: true})
+	app.db.Create(&FuelEntry{VehicleID: hidden.ID, Date: date, Gallons: 5, Price: 10, Odometer: 100})
+	app.db.Create(&Expense{VehicleID: golf.ID, Date: date, Category: "Maintenance", Amount: 99.5, Notes: "oil"})
+
+	t.Run("single dataset", func(t *testing.T) {
+		w := exportCSVResponse(app, owner.ID, "dataset=fuel")
+		if w.Code != 200 || w.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+			t.Fatalf("export: %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		records, err := csv.NewReader(bytes.NewReader(w.Body.Bytes())).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 3 {
+			t.Fatalf("%d rows, want the header and both accessible vehicles' fill-ups", len(records))
+		}
+		golfRow := records[1]
+		if golfRow[1] != "2019 VW Golf" || golfRow[2] != "2025-03-01" || golfRow[4] != "km" || golfRow[6] != "40.00" || golfRow[7] != "4.000" {
+			t.Errorf("row = %q", golfRow)
+		}
+		if golfRow[11] != "said \"hi\", ok\nline2" {
+			t.Errorf("notes = %q, want them quoted intact", golfRow[11])
+		}
+		if fiestaRow := records[2]; fiestaRow[4] != "mi" || fiestaRow[8] != "true" {
+			t.Errorf("shared vehicle row = %q", fiestaRow)
+		}
+	})
+
+	t.Run("date filter", func(t *testing.T) {
+		w := exportCSVResponse(app, owner.ID, "dataset=fuel&to=2025-03-01")
+		records, _ := csv.NewReader(bytes.NewReader(w.Body.Bytes())).ReadAll()
+		if len(records) != 2 {
+			t.Errorf("%d rows, want the header and the March fill-up", len(records))
+		}
+	})
+
+	t.Run("all datasets", func(t *testing.T) {
+		w := exportCSVResponse(app, owner.ID, "")
+		if w.Code != 200 {
+			t.Fatalf("export: %d", w.Code)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		want := []string{"fuel.csv", "expenses.csv", "reminders.csv", "services.csv"}
+		if len(names) != len(want) {
+			t.Fatalf("files = %v, want %v", names, want)
+		}
+		for i := range want {
+			if names[i] != want[i] {
+				t.Errorf("files = %v, want %v", names, want)
+				break
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if w := exportCSVResponse(app, owner.ID, "dataset=bogus"); w.Code != 400 {
+			t.Errorf("unknown dataset: %d, want 400", w.Code)
+		}
+		if w := exportCSVResponse(app, owner.ID, "vehicle_id="+strconv.Itoa(int(hidden.ID))); w.Code != 404 {
+			t.Errorf("someone else's vehicle: %d, want 404", w.Code)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Fuelio backups are a CSV file per vehicle made of sections, each starting
+// with a "## Name" line followed by its header: the vehicle, the fuel log,
+// cost categories and costs. A cost can carry a reminder by date or
+// odometer reading, and repeat every so many months or kilometres.
+
+// fuelioImporter reads Fuelio backup CSV files
+type fuelioImporter struct{}
+
+func (fuelioImporter) Name() string { return "fuelio" }
+
+func (fuelioImporter) Detect(body []byte) bool {
+	return strings.HasPrefix(strings.ToLower(firstCSVLine(body)), "## vehicle")
+}
+
+func fuelioSection(record []string) (string, bool) {
+	first := strings.TrimSpace(record[0])
+	if !strings.HasPrefix(first, "##") {
+		return "", false
+	}
+	return strings.ToLower(strings.TrimSpace(strings.TrimLeft(first, "#"))), true
+}
+
+// fuelioVolumeUnits are Fuelio's FuelUnit values
+var fuelioVolumeUnits = map[string]string{"0": "l", "1": "gal", "2": "imp_gal"}
+
+// Parse reads the vehicle, fill-ups, costs and their reminders. Income and
+// recurring cost templates are skipped.
+func (fuelioImporter) Parse(body []byte, opts ImportOptions) (*ImportBatch, error) {
+	tables, err := readCSVTables(body, fuelioSection)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV: %v", err)
+	}
+	sections := make(map[string]*csvTable)
+	for _, t := range tables {
+		if _, seen := sections[t.Name]; !seen {
+			sections[t.Name] = t
+		}
+	}
+	vehicleTable, ok := sections["vehicle"]
+	if !ok || len(vehicleTable.Rows) == 0 {
+		return nil, fmt.Errorf("no vehicle section")
+	}
+
+	batch := &ImportBatch{}
+	record := vehicleTable.Rows[0]
+	name := vehicleTable.get(record, "name")
+	iv := ImportVehicle{
+		Key:          name,
+		Make:         vehicleTable.get(record, "make"),
+		Model:        vehicleTable.get(record, "model"),
+		DistanceUnit: "km",
+		VolumeUnit:   "l",
+		Match:        []string{name},
+	}
+	if iv.Key == "" {
+		iv.Key = "Fuelio"
+	}
+	if year, err := strconv.Atoi(vehicleTable.get(record, "year")); err == nil && year > 1885 {
+		iv.Year = year
+	}
+	if iv.Make == "" {
+		v := vehicleFromModel(name)
+		iv.Make, iv.Model, iv.Year = v.Make, v.Model, max(iv.Year, v.Year)
+	} else {
+		iv.Match = append(iv.Match, strings.TrimSpace(iv.Make+" "+iv.Model))
+	}
+	if vehicleTable.get(record, "distunit") == "1" {
+		iv.DistanceUnit = "mi"
+	}
+	if unit, ok := fuelioVolumeUnits[vehicleTable.get(record, "fuelunit")]; ok {
+		iv.VolumeUnit = unit
+	}
+	batch.Vehicles = append(batch.Vehicles, iv)
+
+	// Fuelio records the date format the vehicle's dates are written in,
+	// in Java's notation
+	fileFormat := strings.NewReplacer("y", "Y", "d", "D").Replace(vehicleTable.get(record, "importcsvdateformat"))
+	parseDate := func(s string) (time.Time, error) {
+		t, err := parseImportDate(s, opts.DateFormat)
+		if err != nil && opts.DateFormat == "" && fileFormat != "" {
+			if date, _, _ := strings.Cut(strings.TrimSpace(s), " "); date != "" {
+				if t, ferr := parseImportDate(date, fileFormat); ferr == nil {
+					return t, nil
+				}
+			}
+		}
+		return t, err
+	}
+
+	var numbers []string
+	if log, ok := sections["log"]; ok {
+		for _, keys := range [][]string{{"odo", "odometer"}, {"fuel"}, {"price"}, {"volumeprice"}} {
+			numbers = append(numbers, log.column(keys...)...)
+		}
+	}
+	if costs, ok := sections["costs"]; ok {
+		for _, keys := range [][]string{{"odo", "odometer"}, {"cost"}, {"repeatodo"}, {"remindodo"}} {
+			numbers = append(numbers, costs.column(keys...)...)
+		}
+	}
+	decimal := opts.decimalFor(numbers)
+
+	if log, ok := sections["log"]; ok {
+		for i, record := range log.Rows {
+			line := log.Lines[i]
+			f := ImportFuel{
+				Row:          line,
+				ID:           log.get(record, "uniqueid"),
+				Vehicle:      iv.Key,
+				PartialFill:  log.has("full") && !parseImportFlag(log.get(record, "full")),
+				MissedFillup: parseImportFlag(log.get(record, "missed")),
+				Location:     log.get(record, "city"),
+				Notes:        log.get(record, "notes"),
+			}
+
+			var volumePrice float64
+			var parseErr error
+			if f.Date, parseErr = parseDate(log.get(record, "data", "date")); parseErr == nil {
+				if f.Odometer, parseErr = parseImportNumber(log.get(record, "odo", "odometer"), decimal); parseErr == nil {
+					if f.Volume, parseErr = parseImportNumber(log.get(record, "fuel"), decimal); parseErr == nil {
+						if f.Cost, parseErr = parseImportNumber(log.get(record, "price"), decimal); parseErr == nil {
+							volumePrice, parseErr = parseImportNumber(log.get(record, "volumeprice"), decimal)
+						}
+					}
+				}
+			}
+			if parseErr == nil && f.Volume <= 0 {
+				parseErr = fmt.Errorf("fuel volume must be positive")
+			}
+			if parseErr == nil && f.Odometer <= 0 {
+				parseErr = fmt.Errorf("needs an odometer reading")
+			}
+			if parseErr != nil {
+				batch.Warnings = append(batch.Warnings, ImportWarning{Row: line, Type: "fuel", Message: parseErr.Error()})
+				continue
+			}
+			if f.Cost == 0 {
+				f.Cost = math.Round(f.Volume*volumePrice*100) / 100
+			}
+			batch.Fuel = append(batch.Fuel, f)
+		}
+	}
+
+	categories := make(map[string]string)
+	if t, ok := sections["costcategories"]; ok {
+		for _, record := range t.Rows {
+			categories[t.get(record, "costtypeid")] = t.get(record, "name")
+		}
+	}
+
+	if costs, ok := sections["costs"]; ok {
+		for i, record := range costs.Rows {
+			line := costs.Lines[i]
+			id := costs.get(record, "uniqueid")
+			title := costs.get(record, "costtitle")
+			categoryName := categories[costs.get(record, "costtypeid")]
+
+			if parseImportFlag(costs.get(record, "isincome")) {
+				batch.Warnings = append(batch.Warnings, ImportWarning{Row: line, Type: "expense", ID: id, Message: "income isn't imported"})
+				continue
+			}
+			if parseImportFlag(costs.get(record, "istemplate")) {
+				batch.Warnings = append(batch.Warnings, ImportWarning{Row: line, Type: "expense", ID: id, Message: "recurring cost templates aren't imported"})
+				continue
+			}
+
+			e := ImportExpense{
+				Row:      line,
+				ID:       id,
+				Vehicle:  iv.Key,
+				Category: expenseCategory(categoryName),
+				Notes:    strings.TrimSpace(title + "\n" + costs.get(record, "notes")),
+			}
+			var parseErr error
+			if e.Date, parseErr = parseDate(costs.get(record, "date", "data")); parseErr == nil {
+				if e.Odometer, parseErr = parseImportNumber(costs.get(record, "odo", "odometer"), decimal); parseErr == nil {
+					e.Amount, parseErr = parseImportNumber(costs.get(record, "cost"), decimal)
+				}
+			}
+			if parseErr != nil {
+				batch.Warnings = append(batch.Warnings, ImportWarning{Row: line, Type: "expense", ID: id, Message: parseErr.Error()})
+				continue
+			}
+			if e.Amount > 0 {
+				batch.Expenses = append(batch.Expenses, e)
+			}
+
+			r := ImportReminder{Row: line, ID: id, Vehicle: iv.Key, Name: title}
+			if r.Name == "" {
+				r.Name = categoryName
+			}
+			repeatDistance, _ := parseImportNumber(costs.get(record, "repeatodo"), decimal)
+			repeatMonths, _ := strconv.Atoi(costs.get(record, "repeatmonths"))
+			remindOdometer, _ := parseImportNumber(costs.get(record, "remindodo"), decimal)
+			var remindDate *time.Time
+			if raw := costs.get(record, "reminddate"); raw != "" {
+				if t, err := parseDate(raw); err == nil {
+					remindDate = &t
+				}
+			}
+
+			switch {
+			case repeatDistance > 0 || repeatMonths > 0:
+				// Repeats from this cost, the last time it was done
+				r.LastDate, r.LastOdometer = e.Date, e.Odometer
+				r.IntervalDistance = repeatDistance
+				if repeatMonths > 0 {
+					r.IntervalDays = intervalDays(e.Date, repeatMonths)
+				}
+			case remindDate != nil || remindOdometer > 0:
+				r.DueDate, r.DueOdometer = remindDate, remindOdometer
+			default:
+				continue
+			}
+			if r.Name == "" {
+				batch.Warnings = append(batch.Warnings, ImportWarning{Row: line, Type: "reminder", ID: id, Message: "reminder has no title"})
+				continue
+			}
+			batch.Reminders = append(batch.Reminders, r)
+		}
+	}
+
+	return batch, nil
+}
+
+// importFuelio imports a Fuelio backup CSV: the vehicle, fill-ups, costs as
+// expenses and cost reminders as maintenance reminders. The vehicle is
+// matched by name or created unless vehicle_map says otherwise.
+func (app *Application) importFuelio(c *gin.Context) {
+	body, _, opts, ok := app.readImportUpload(c)
+	if !ok {
+		return
+	}
+	app.runImport(c, "fuelio", body, opts)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const fuelioExport = `"## Vehicle"
+"Name","Description","DistUnit","FuelUnit","ConsumptionUnit","ImportCSVDateFormat","VIN","Insurance","Plate","Make","Model","Year","TankCount","Tank1Type","Tank2Type","Active","Tank1Capacity","Tank2Capacity","FuelUnitTank2","FuelConsumptionTank2"
+"My Golf","","0","0","0","dd.MM.yyyy","","","","Volkswagen","Golf","2012","1","100","0","1","50","0","0","0"
+"## Log"
+"Data","Odo (km)","Fuel (litres)","Full","Price (optional)","l/100km (optional)","latitude (optional)","longitude (optional)","City (optional)","Notes (optional)","Missed","TankNumber","FuelType","VolumePrice","StationID (optional)","ExcludeDistance","UniqueId","TankCalc","Weather"
+"2023-01-05 10:20","12000","40.5","1","60.00","0","0","0","Berlin","first","0","1","110","1.48","0","0","u1","0",""
+"2023-02-05","12600","20","0","","0","0","0","","","1","1","110","1.5","0","0","u2","0",""
+"05.03.2023","13100","42","1","63","0","0","0","","","0","1","110","1.5","0","0","u3","0",""
+"bad","13100","42","1","63","0","0","0","","","0","1","110","1.5","0","0","u4","0",""
+"## CostCategories"
+"CostTypeID","Name","priority","color"
+"1","Service","0","#000"
+"2","Insurance","0","#000"
+"3","Car wash","0","#000"
+"## Costs"
+"CostTitle","Date","Odo","CostTypeID","Notes","Cost","flag","idR","read","RemindOdo","RemindDate","isTemplate","RepeatOdo","RepeatMonths","isIncome","UniqueId"
+"Oil change","2023-01-10","12100","1","5W30","120","0","0","0","27100","2024-01-10","0","15000","12","0","c1"
+"Policy","2023-01-01","0","2","","500","0","0","0","0","2024-01-01","0","0","0","0","c2"
+"Wash","2023-01-15","12200","3","","10","0","0","0","0","","0","0","0","0","c3"
+"Sold stuff","2023-01-15","12200","3","","10","0","0","0","0","","0","0","0","1","c4"
+`
+
+func TestFuelioParse(t *testing.T) {
+	if format := detectImportFormat([]byte(fuelioExport)); format != "fuelio" {
+		t.Fatalf("detected %q, want fuelio", format)
+	}
+
+	batch, err := parseImport("fuelio", []byte(fuelioExport), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Vehicles) != 1 {
+		t.Fatalf("%d vehicles, want 1", len(batch.Vehicles))
+	}
+	v := batch.Vehicles[0]
+	if v.Key != "My Golf" || v.Make != "Volkswagen" || v.Model != "Golf" || v.Year != 2012 || v.DistanceUnit != "km" || v.VolumeUnit != "l" {
+		t.Errorf("vehicle = %+v", v)
+	}
+
+	if len(batch.Fuel) != 3 {
+		t.Fatalf("%d fill-ups, want 3", len(batch.Fuel))
+	}
+	first, second, third := batch.Fuel[0], batch.Fuel[1], batch.Fuel[2]
+	if first.ID != "u1" || first.Odometer != 12000 || first.Volume != 40.5 || first.Cost != 60 || first.Location != "Berlin" || first.Notes != "first" {
+		t.Errorf("first fill-up = %+v", first)
+	}
+	if !first.Date.Equal(time.Date(2023, 1, 5, 10, 20, 0, 0, time.UTC)) {
+		t.Errorf("date = %v", first.Date)
+	}
+	if second.Cost != 30 || !second.PartialFill || !second.MissedFillup {
+		t.Errorf("second fill-up = %+v, want the cost from the unit price and both flags", second)
+	}
+	if !third.Date.Equal(time.Date(2023, 3, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("date in the file's own format = %v", third.Date)
+	}
+
+	if len(batch.Expenses) != 3 {
+		t.Fatalf("%d expenses, want 3 without the income", len(batch.Expenses))
+	}
+	oil, policy := batch.Expenses[0], batch.Expenses[1]
+	if oil.Category != "Maintenance" || oil.Amount != 120 || oil.Odometer != 12100 || oil.Notes != "Oil change\n5W30" {
+		t.Errorf("service cost = %+v", oil)
+	}
+	if policy.Category != "Insurance" || policy.Amount != 500 {
+		t.Errorf("insurance cost = %+v", policy)
+	}
+
+	if len(batch.Reminders) != 2 {
+		t.Fatalf("%d reminders, want 2", len(batch.Reminders))
+	}
+	repeat, once := batch.Reminders[0], batch.Reminders[1]
+	if repeat.Name != "Oil change" || repeat.IntervalDistance != 15000 || repeat.IntervalDays != 365 || repeat.LastOdometer != 12100 {
+		t.Errorf("repeating reminder = %+v", repeat)
+	}
+	if once.Name != "Policy" || once.DueDate == nil || !once.DueDate.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("one-off reminder = %+v", once)
+	}
+
+	if len(batch.Warnings) != 2 || batch.Warnings[0].Row != 9 || batch.Warnings[1].ID != "c4" {
+		t.Errorf("warnings = %+v, want the bad date and the income", batch.Warnings)
+	}
+}
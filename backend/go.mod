@@ -6,7 +6,14 @@ require (
 	github.com/gin-gonic/gin v1.9.1
 	github.com/gin-contrib/cors v1.5.0
 	gorm.io/driver/sqlite v1.5.4
+	gorm.io/driver/postgres v1.5.2
+	gorm.io/driver/mysql v1.5.2
 	gorm.io/gorm v1.25.5
 	github.com/golang-jwt/jwt/v5 v5.1.0
 	golang.org/x/crypto v0.17.0
+	github.com/jung-kurt/gofpdf v1.16.2
+	github.com/xuri/excelize/v2 v2.9.0
+	github.com/pelletier/go-toml/v2 v2.1.0
+	gopkg.in/yaml.v3 v3.0.1
+	github.com/prometheus/client_golang v1.18.0
 )
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Hammond import. Hammond keeps everything in its SQLite database
+// (hammond.db), which can be uploaded on its own or zipped together with
+// Hammond's assets folder to bring attachments across. JSON using the field
+// names of Hammond's API is accepted too.
+
+// Hammond enums
+const (
+	hammondDistanceKilometers = 0
+	hammondDistanceMiles      = 1
+
+	hammondFuelLitre    = 0
+	hammondFuelGallon   = 1
+	hammondFuelUSGallon = 2
+)
+
+var hammondFuelTypes = map[int]string{
+	0: "Petrol",
+	1: "Diesel",
+	2: "Ethanol",
+	3: "CNG",
+	4: "Electric",
+	5: "LPG",
+}
+
+type HammondVehicle struct {
+	ID                string  `json:"id"`
+	Nickname          string  `json:"nickname"`
+	Registration      string  `json:"registration"`
+	Make              string  `json:"make"`
+	Model             string  `json:"model"`
+	YearOfManufacture int     `json:"yearOfManufacture"`
+	FuelUnit          int     `json:"fuelUnit"`
+	FuelType          int     `json:"fuelType"`
+	DeletedAt         *string `json:"deletedAt"`
+}
+
+type HammondFillup struct {
+	ID              string  `json:"id"`
+	VehicleID       string  `json:"vehicleId"`
+	Date            string  `json:"date"`
+	FuelQuantity    float64 `json:"fuelQuantity"`
+	PerUnitPrice    float64 `json:"perUnitPrice"`
+	TotalAmount     float64 `json:"totalAmount"`
+	OdoReading      float64 `json:"odoReading"`
+	IsTankFull      *bool   `json:"isTankFull"`
+	HasMissedFillup *bool   `json:"hasMissedFillup"`
+	Comments        string  `json:"comments"`
+	FillingStation  string  `json:"fillingStation"`
+	DistanceUnit    int     `json:"distanceUnit"`
+	DeletedAt       *string `json:"deletedAt"`
+}
+
+type HammondExpense struct {
+	ID           string  `json:"id"`
+	VehicleID    string  `json:"vehicleId"`
+	Date         string  `json:"date"`
+	Amount       float64 `json:"amount"`
+	OdoReading   float64 `json:"odoReading"`
+	Comments     string  `json:"comments"`
+	ExpenseType  string  `json:"expenseType"`
+	DistanceUnit int     `json:"distanceUnit"`
+	DeletedAt    *string `json:"deletedAt"`
+}
+
+// HammondAttachment is an attachment linked to a vehicle
+type HammondAttachment struct {
+	ID           string `json:"id"`
+	VehicleID    string `json:"vehicleId"`
+	Path         string `json:"path"`
+	OriginalName string `json:"originalName"`
+	Title        string `json:"title"`
+}
+
+type HammondExport struct {
+	Vehicles    []HammondVehicle    `json:"vehicles"`
+	Fillups     []HammondFillup     `json:"fillups"`
+	Expenses    []HammondExpense    `json:"expenses"`
+	Attachments []HammondAttachment `json:"attachments"`
+}
+
+// hammondTables are Hammond's vehicles and fillups tables with columns that
+// other SQLite databases are unlikely to share
+var hammondTables = []struct {
+	name    string
+	columns []string
+}{
+	{"vehicles", []string{"nickname", "registration", "year_of_manufacture", "fuel_unit", "fuel_type"}},
+	{"fillups", []string{"vehicle_id", "fuel_quantity", "per_unit_price", "odo_reading", "is_tank_full", "has_missed_fillup"}},
+}
+
+// checkHammondSchema tells whether a SQLite database is Hammond's
+func checkHammondSchema(db *gorm.DB) error {
+	for _, table := range hammondTables {
+		if !db.Migrator().HasTable(table.name) {
+			return fmt.Errorf("not a Hammond database (no %s table)", table.name)
+		}
+		for _, column := range table.columns {
+			if !db.Migrator().HasColumn(table.name, column) {
+				return fmt.Errorf("not a Hammond database (no %s.%s column)", table.name, column)
+			}
+		}
+	}
+	return nil
+}
+
+// openHammondDatabase opens a SQLite database upload read-only from a
+// temporary file. closeDB closes it and removes the file.
+func openHammondDatabase(body []byte) (db *gorm.DB, closeDB func(), err error) {
+	tmp, err := os.CreateTemp("", "hammond-*.db")
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = tmp.Write(body)
+	tmp.Close()
+	if err == nil {
+		db, err = gorm.Open(sqlite.Open("file:"+tmp.Name()+"?mode=ro"), &gorm.Config{
+			Logger: logger.Default.LogMode(logger.Silent),
+		})
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+	return db, func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		os.Remove(tmp.Name())
+	}, nil
+}
+
+// readHammondDatabase loads the records from a Hammond SQLite database
+func readHammondDatabase(db *gorm.DB) (HammondExport, error) {
+	var export HammondExport
+	if err := checkHammondSchema(db); err != nil {
+		return export, err
+	}
+
+	if err := db.Raw(`SELECT id, nickname, registration, make, model, year_of_manufacture,
+		fuel_unit, fuel_type, deleted_at FROM vehicles`).Scan(&export.Vehicles).Error; err != nil {
+		return export, fmt.Errorf("reading vehicles: %v", err)
+	}
+	if err := db.Raw(`SELECT id, vehicle_id, date, fuel_quantity, per_unit_price, total_amount,
+		odo_reading, is_tank_full, has_missed_fillup, comments, filling_station, distance_unit,
+		deleted_at FROM fillups`).Scan(&export.Fillups).Error; err != nil {
+		return export, fmt.Errorf("reading fillups: %v", err)
+	}
+	if db.Migrator().HasTable("expenses") {
+		if err := db.Raw(`SELECT id, vehicle_id, date, amount, odo_reading, comments, expense_type,
+			distance_unit, deleted_at FROM expenses`).Scan(&export.Expenses).Error; err != nil {
+			return export, fmt.Errorf("reading expenses: %v", err)
+		}
+	}
+	if db.Migrator().HasTable("vehicle_attachments") && db.Migrator().HasTable("attachments") {
+		if err := db.Raw(`SELECT attachments.id, vehicle_attachments.vehicle_id, attachments.path,
+			attachments.original_name, vehicle_attachments.title
+			FROM vehicle_attachments JOIN attachments ON attachments.id = vehicle_attachments.attachment_id
+			WHERE vehicle_attachments.deleted_at IS NULL AND attachments.deleted_at IS NULL`).
+			Scan(&export.Attachments).Error; err != nil {
+			return export, fmt.Errorf("reading attachments: %v", err)
+		}
+	}
+
+	return export, nil
+}
+
+// hammondVehicleUnit works out whether a vehicle's odometer is in km or
+// miles from its entries, falling back to its fuel unit
+func hammondVehicleUnit(v HammondVehicle, export HammondExport) string {
+	km, miles := 0, 0
+	count := func(vehicleID string, unit int) {
+		if vehicleID != v.ID {
+			return
+		}
+		if unit == hammondDistanceMiles {
+			miles++
+		} else {
+			km++
+		}
+	}
+	for _, f := range export.Fillups {
+		count(f.VehicleID, f.DistanceUnit)
+	}
+	for _, e := range export.Expenses {
+		count(e.VehicleID, e.DistanceUnit)
+	}
+
+	if miles > km {
+		return "mi"
+	}
+	if km > miles {
+		return "km"
+	}
+	if v.FuelUnit == hammondFuelGallon || v.FuelUnit == hammondFuelUSGallon {
+		return "mi"
+	}
+	return "km"
+}
+
+// hammondVolumeUnits maps Hammond's fuel units onto import volume units.
+// Kilograms, kWh and minutes have no equivalent and are left unconverted.
+var hammondVolumeUnits = map[int]string{
+	hammondFuelLitre:    "l",
+	hammondFuelGallon:   "imp_gal",
+	hammondFuelUSGallon: "gal",
+}
+
+func hammondDeleted(deletedAt *string) bool {
+	return deletedAt != nil && *deletedAt != ""
+}
+
+// hammondBatch turns a Hammond export into an import batch. files are the
+// attachment files from the upload by base name. Deleted records, and
+// records whose vehicle isn't imported, are skipped with a warning.
+func hammondBatch(export HammondExport, files map[string]*zip.File) *ImportBatch {
+	batch := &ImportBatch{}
+	skip := func(kind, id, message string) {
+		batch.Warnings = append(batch.Warnings, ImportWarning{Type: kind, ID: id, Message: message})
+	}
+
+	vehicles := make(map[string]bool)
+	for _, hv := range export.Vehicles {
+		if hammondDeleted(hv.DeletedAt) {
+			skip("vehicle", hv.ID, "deleted in Hammond")
+			continue
+		}
+
+		iv := ImportVehicle{
+			Key:          hv.ID,
+			Make:         strings.TrimSpace(hv.Make),
+			Model:        strings.TrimSpace(hv.Model),
+			Year:         hv.YearOfManufacture,
+			FuelType:     hammondFuelTypes[hv.FuelType],
+			DistanceUnit: hammondVehicleUnit(hv, export),
+			VolumeUnit:   hammondVolumeUnits[hv.FuelUnit],
+		}
+		if iv.Make == "" && iv.Model == "" {
+			fallback := vehicleFromModel(hv.Nickname)
+			iv.Make, iv.Model = fallback.Make, fallback.Model
+		}
+		batch.Vehicles = append(batch.Vehicles, iv)
+		vehicles[hv.ID] = true
+	}
+
+	// imported reports whether an entry can be imported, recording why not
+	imported := func(kind, id, vehicleID string, deletedAt *string) bool {
+		if hammondDeleted(deletedAt) {
+			skip(kind, id, "deleted in Hammond")
+			return false
+		}
+		if !vehicles[vehicleID] {
+			skip(kind, id, fmt.Sprintf("vehicle %s was not imported", vehicleID))
+			return false
+		}
+		return true
+	}
+
+	for _, hf := range export.Fillups {
+		if !imported("fillup", hf.ID, hf.VehicleID, hf.DeletedAt) {
+			continue
+		}
+		date, err := parseHammondDate(hf.Date)
+		if err != nil {
+			skip("fillup", hf.ID, err.Error())
+			continue
+		}
+		if hf.FuelQuantity <= 0 {
+			skip("fillup", hf.ID, "no fuel quantity")
+			continue
+		}
+
+		total := hf.TotalAmount
+		if total == 0 {
+			total = hf.FuelQuantity * hf.PerUnitPrice
+		}
+		batch.Fuel = append(batch.Fuel, ImportFuel{
+			ID:           hf.ID,
+			Vehicle:      hf.VehicleID,
+			Date:         date,
+			Odometer:     hf.OdoReading,
+			Volume:       hf.FuelQuantity,
+			Cost:         total,
+			PartialFill:  hf.IsTankFull != nil && !*hf.IsTankFull,
+			MissedFillup: hf.HasMissedFillup != nil && *hf.HasMissedFillup,
+			Location:     hf.FillingStation,
+			Notes:        hf.Comments,
+		})
+	}
+
+	for _, he := range export.Expenses {
+		if !imported("expense", he.ID, he.VehicleID, he.DeletedAt) {
+			continue
+		}
+		date, err := parseHammondDate(he.Date)
+		if err != nil {
+			skip("expense", he.ID, err.Error())
+			continue
+		}
+		batch.Expenses = append(batch.Expenses, ImportExpense{
+			ID:       he.ID,
+			Vehicle:  he.VehicleID,
+			Date:     date,
+			Category: he.ExpenseType,
+			Amount:   he.Amount,
+			Odometer: he.OdoReading,
+			Notes:    he.Comments,
+		})
+	}
+
+	for _, ha := range export.Attachments {
+		if !vehicles[ha.VehicleID] {
+			skip("attachment", ha.ID, fmt.Sprintf("vehicle %s was not imported", ha.VehicleID))
+			continue
+		}
+		zf, ok := files[filepath.Base(ha.Path)]
+		if !ok {
+			skip("attachment", ha.ID, fmt.Sprintf("file %s was not in the upload", filepath.Base(ha.Path)))
+			continue
+		}
+		name := ha.OriginalName
+		if name == "" {
+			name = filepath.Base(ha.Path)
+		}
+		batch.Attachments = append(batch.Attachments, ImportAttachment{ID: ha.ID, Vehicle: ha.VehicleID, Filename: name, file: zf})
+	}
+
+	return batch
+}
+
+var hammondDateFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05-07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+func parseHammondDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range hammondDateFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unreadable date %q", s)
+}
+
+// splitHammondZip returns the .db file in a zip and the zip's other files.
+// Anything other than a zip is returned as it is.
+func splitHammondZip(body []byte) ([]byte, map[string]*zip.File, error) {
+	files := make(map[string]*zip.File)
+	if !bytes.HasPrefix(body, []byte("PK\x03\x04")) {
+		return body, files, nil
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid zip file")
+	}
+	var database *zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if strings.HasSuffix(strings.ToLower(f.Name), ".db") && database == nil {
+			database = f
+			continue
+		}
+		files[filepath.Base(f.Name)] = f
+	}
+	if database == nil {
+		return nil, nil, fmt.Errorf("no .db file in the zip")
+	}
+	body, err = readZipFile(database)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, files, nil
+}
+
+// loadHammondUpload reads hammond.db, a zip of hammond.db and attachment
+// files, or a JSON export
+func loadHammondUpload(body []byte) (HammondExport, map[string]*zip.File, error) {
+	body, files, err := splitHammondZip(body)
+	if err != nil {
+		return HammondExport{}, nil, err
+	}
+
+	if bytes.HasPrefix(body, []byte("SQLite format 3\x00")) {
+		db, closeDB, err := openHammondDatabase(body)
+		if err != nil {
+			return HammondExport{}, nil, err
+		}
+		defer closeDB()
+		export, err := readHammondDatabase(db)
+		return export, files, err
+	}
+
+	var export HammondExport
+	if err := json.Unmarshal(body, &export); err != nil {
+		return export, nil, fmt.Errorf("expected hammond.db, a zip containing it, or JSON")
+	}
+	return export, files, nil
+}
+
+// hammondImporter reads Hammond databases and JSON exports
+type hammondImporter struct{}
+
+func (hammondImporter) Name() string { return "hammond" }
+
+// Detect accepts Hammond's SQLite database, on its own or in a zip, or JSON
+// with Hammond's fillups
+func (hammondImporter) Detect(body []byte) bool {
+	if bytes.HasPrefix(body, []byte("SQLite format 3\x00")) || bytes.HasPrefix(body, []byte("PK\x03\x04")) {
+		database, _, err := splitHammondZip(body)
+		if err != nil || !bytes.HasPrefix(database, []byte("SQLite format 3\x00")) {
+			return false
+		}
+		db, closeDB, err := openHammondDatabase(database)
+		if err != nil {
+			return false
+		}
+		defer closeDB()
+		return checkHammondSchema(db) == nil
+	}
+	var probe struct {
+		Fillups json.RawMessage `json:"fillups"`
+	}
+	trimmed := bytes.TrimSpace(body)
+	return bytes.HasPrefix(trimmed, []byte("{")) && json.Unmarshal(trimmed, &probe) == nil && probe.Fillups != nil
+}
+
+// Parse reads hammond.db, a zip of it and Hammond's assets, or a JSON export
+func (hammondImporter) Parse(body []byte, opts ImportOptions) (*ImportBatch, error) {
+	export, files, err := loadHammondUpload(body)
+	if err != nil {
+		return nil, err
+	}
+	return hammondBatch(export, files), nil
+}
+
+// importHammond imports vehicles, fill-ups, expenses and vehicle attachments
+// from Hammond in one transaction. Vehicles are created unless vehicle_map
+// maps Hammond's vehicle IDs to existing ones; records that can't be
+// imported are listed in warnings with the reason.
+func (app *Application) importHammond(c *gin.Context) {
+	body, _, opts, ok := app.readImportUpload(c)
+	if !ok {
+		return
+	}
+	app.runImport(c, "hammond", body, opts)
+}
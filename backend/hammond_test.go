@@ -0,0 +1,188 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// hammondDatabase writes a small Hammond database and returns its bytes
+func hammondDatabase(t *testing.T) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hammond.db")
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE vehicles (id text, created_at datetime, updated_at datetime, deleted_at datetime, nickname text, registration text, vin text, make text, model text, year_of_manufacture integer, engine_size real, fuel_unit integer, fuel_type integer)`,
+		`CREATE TABLE fillups (id text, created_at datetime, updated_at datetime, deleted_at datetime, vehicle_id text, fuel_unit integer, fuel_quantity real, per_unit_price real, total_amount real, odo_reading integer, is_tank_full numeric, has_missed_fillup numeric, comments text, filling_station text, user_id text, date datetime, currency text, distance_unit integer, source text)`,
+		`CREATE TABLE expenses (id text, created_at datetime, updated_at datetime, deleted_at datetime, vehicle_id text, amount real, odo_reading integer, comments text, expense_type text, user_id text, date datetime, currency text, distance_unit integer, source text)`,
+		`CREATE TABLE attachments (id text, created_at datetime, updated_at datetime, deleted_at datetime, path text, original_name text, size integer, content_type text, title text, user_id text)`,
+		`CREATE TABLE vehicle_attachments (id text, created_at datetime, updated_at datetime, deleted_at datetime, attachment_id text, vehicle_id text, title text)`,
+		`INSERT INTO vehicles VALUES ('v1', '2023-01-01', '2023-01-01', NULL, 'Daily', 'AB12', '', 'Toyota', 'Corolla', 2018, 1.8, 1, 1)`,
+		`INSERT INTO vehicles VALUES ('v2', '2023-01-01', '2023-01-01', '2023-06-01 10:00:00+00:00', 'Old', '', '', 'Ford', 'Ka', 2005, 1.2, 0, 0)`,
+		`INSERT INTO fillups VALUES ('f1', '2023-02-01', '2023-02-01', NULL, 'v1', 1, 10.5, 3.5, 36.75, 12000, 1, 0, 'first', 'Shell', 'u', '2023-02-01 08:30:00+00:00', 'USD', 1, '')`,
+		`INSERT INTO fillups VALUES ('f2', '2023-02-10', '2023-02-10', NULL, 'v1', 1, 5, 3.5, 0, 12300, 0, 1, '', 'BP', 'u', '2023-02-10 08:30:00+00:00', 'USD', 1, '')`,
+		`INSERT INTO fillups VALUES ('f3', '2023-02-10', '2023-02-10', NULL, 'v2', 0, 20, 1.5, 30, 5000, 1, 0, '', '', 'u', '2023-02-10 08:30:00+00:00', 'USD', 0, '')`,
+		`INSERT INTO fillups VALUES ('f4', '2023-02-10', '2023-02-10', '2023-03-01 00:00:00+00:00', 'v1', 1, 20, 1.5, 30, 5000, 1, 0, '', '', 'u', '2023-02-10 08:30:00+00:00', 'USD', 1, '')`,
+		`INSERT INTO expenses VALUES ('e1', '2023-03-01', '2023-03-01', NULL, 'v1', 89.99, 12500, 'oil change', 'Maintenance', 'u', '2023-03-01 00:00:00+00:00', 'USD', 1, '')`,
+		`INSERT INTO attachments VALUES ('a1', '2023-03-01', '2023-03-01', NULL, '/assets/abc.pdf', 'insurance.pdf', 10, 'application/pdf', 'Insurance', 'u')`,
+		`INSERT INTO attachments VALUES ('a2', '2023-03-01', '2023-03-01', NULL, '/assets/missing.pdf', 'gone.pdf', 10, 'application/pdf', 'Gone', 'u')`,
+		`INSERT INTO vehicle_attachments VALUES ('va1', '2023-03-01', '2023-03-01', NULL, 'a1', 'v1', 'Insurance')`,
+		`INSERT INTO vehicle_attachments VALUES ('va2', '2023-03-01', '2023-03-01', NULL, 'a2', 'v1', 'Gone')`,
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestHammondParseDatabase(t *testing.T) {
+	raw := hammondDatabase(t)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("backup/hammond.db")
+	w.Write(raw)
+	w, _ = zw.Create("backup/assets/abc.pdf")
+	w.Write([]byte("%PDF-1.4"))
+	zw.Close()
+
+	for _, body := range [][]byte{raw, buf.Bytes()} {
+		if !(hammondImporter{}).Detect(body) {
+			t.Fatal("Hammond upload not detected")
+		}
+	}
+
+	batch, err := hammondImporter{}.Parse(buf.Bytes(), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Vehicles) != 1 {
+		t.Fatalf("%d vehicles, want the one not deleted", len(batch.Vehicles))
+	}
+	v := batch.Vehicles[0]
+	if v.Key != "v1" || v.Make != "Toyota" || v.Model != "Corolla" || v.Year != 2018 || v.FuelType != "Diesel" {
+		t.Errorf("vehicle = %+v", v)
+	}
+	if v.DistanceUnit != "mi" || v.VolumeUnit != "imp_gal" {
+		t.Errorf("units = %s, %s, want mi, imp_gal", v.DistanceUnit, v.VolumeUnit)
+	}
+
+	if len(batch.Fuel) != 2 {
+		t.Fatalf("%d fill-ups, want 2", len(batch.Fuel))
+	}
+	first, second := batch.Fuel[0], batch.Fuel[1]
+	if first.ID != "f1" || first.Odometer != 12000 || first.Volume != 10.5 || first.Cost != 36.75 || first.PartialFill || first.Location != "Shell" {
+		t.Errorf("first fill-up = %+v", first)
+	}
+	if !first.Date.Equal(time.Date(2023, 2, 1, 8, 30, 0, 0, time.UTC)) {
+		t.Errorf("date = %v", first.Date)
+	}
+	if second.Cost != 17.5 || !second.PartialFill || !second.MissedFillup {
+		t.Errorf("second fill-up = %+v, want the cost from the unit price and both flags", second)
+	}
+
+	if len(batch.Expenses) != 1 || batch.Expenses[0].Category != "Maintenance" || batch.Expenses[0].Amount != 89.99 || batch.Expenses[0].Odometer != 12500 {
+		t.Errorf("expenses = %+v", batch.Expenses)
+	}
+	if len(batch.Attachments) != 1 || batch.Attachments[0].Filename != "insurance.pdf" {
+		t.Errorf("attachments = %+v", batch.Attachments)
+	}
+
+	skipped := make(map[string]bool)
+	for _, w := range batch.Warnings {
+		skipped[w.Type+" "+w.ID] = true
+	}
+	for _, want := range []string{"vehicle v2", "fillup f3", "fillup f4", "attachment a2"} {
+		if !skipped[want] {
+			t.Errorf("%s not skipped, warnings = %+v", want, batch.Warnings)
+		}
+	}
+	if len(batch.Warnings) != 4 {
+		t.Errorf("%d warnings, want 4", len(batch.Warnings))
+	}
+}
+
+func TestHammondParseJSON(t *testing.T) {
+	body := []byte(`{"vehicles":[{"id":"x","make":"VW","model":"Up","fuelType":0}],"fillups":[{"id":"y","vehicleId":"x","date":"2024-01-01T00:00:00Z","fuelQuantity":5,"totalAmount":9,"odoReading":100,"isTankFull":true}]}`)
+	if !(hammondImporter{}).Detect(body) {
+		t.Fatal("Hammond JSON not detected")
+	}
+	batch, err := hammondImporter{}.Parse(body, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Vehicles) != 1 || batch.Vehicles[0].FuelType != "Petrol" || batch.Vehicles[0].DistanceUnit != "km" {
+		t.Errorf("vehicles = %+v", batch.Vehicles)
+	}
+	if len(batch.Fuel) != 1 || batch.Fuel[0].Odometer != 100 || batch.Fuel[0].PartialFill {
+		t.Errorf("fuel = %+v", batch.Fuel)
+	}
+
+	if _, err := (hammondImporter{}).Parse([]byte("not hammond"), ImportOptions{}); err == nil {
+		t.Error("parsed an unrelated file")
+	}
+}
+
+func TestHammondDetectOtherDatabases(t *testing.T) {
+	others := map[string][]string{
+		"no fillups":        {`CREATE TABLE vehicles (id text, nickname text, registration text, year_of_manufacture integer, fuel_unit integer, fuel_type integer)`},
+		"other fillups":     {`CREATE TABLE vehicles (id text, nickname text, registration text, year_of_manufacture integer, fuel_unit integer, fuel_type integer)`, `CREATE TABLE fillups (id text, vehicle_id text, litres real, odometer integer)`},
+		"unrelated":         {`CREATE TABLE notes (id integer, body text)`},
+		"other vehicles db": {`CREATE TABLE vehicles (id integer, make text, model text)`, `CREATE TABLE fillups (id integer, vehicle_id integer, fuel_quantity real, per_unit_price real, odo_reading integer, is_tank_full numeric, has_missed_fillup numeric)`},
+	}
+
+	for name, stmts := range others {
+		path := filepath.Join(t.TempDir(), "other.db")
+		db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stmt := range stmts {
+			if err := db.Exec(stmt).Error; err != nil {
+				t.Fatalf("%s: %v", stmt, err)
+			}
+		}
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, _ := zw.Create("data.db")
+		w.Write(raw)
+		zw.Close()
+
+		if (hammondImporter{}).Detect(raw) {
+			t.Errorf("%s: database detected as Hammond's", name)
+		}
+		if (hammondImporter{}).Detect(buf.Bytes()) {
+			t.Errorf("%s: zip detected as Hammond's", name)
+		}
+		if _, err := (hammondImporter{}).Parse(raw, ImportOptions{}); err == nil {
+			t.Errorf("%s: parsed as Hammond's", name)
+		}
+	}
+}
@@ -2,13 +2,11 @@ package main
 
 import (
 	"fmt"
+	"github.com/gin-gonic/gin"
 	"strconv"
 	"time"
-	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
-
 // Vehicle Handlers
 
 func (app *Application) listVehiclesWithStats(c *gin.Context) {
@@ -26,14 +24,14 @@ func (app *Application) listVehiclesWithStats(c *gin.Context) {
 
 	// Enhance with stats
 	type VehicleWithStats struct {
-		Vehicle        Vehicle   `json:"vehicle"`
-		TotalCost      float64   `json:"total_cost"`
-		TotalMiles     float64   `json:"total_miles"`
-		AverageMPG     float64   `json:"average_mpg"`
-		FuelCount      int64     `json:"fuel_count"`
-		ExpenseCount   int64     `json:"expense_count"`
-		LastFuelDate   *time.Time `json:"last_fuel_date"`
-		DueReminders   int       `json:"due_reminders"`
+		Vehicle      Vehicle    `json:"vehicle"`
+		TotalCost    float64    `json:"total_cost"`
+		TotalMiles   float64    `json:"total_miles"`
+		AverageMPG   float64    `json:"average_mpg"`
+		FuelCount    int64      `json:"fuel_count"`
+		ExpenseCount int64      `json:"expense_count"`
+		LastFuelDate *time.Time `json:"last_fuel_date"`
+		DueReminders int        `json:"due_reminders"`
 	}
 
 	var results []VehicleWithStats
@@ -81,26 +79,8 @@ func (app *Application) listVehiclesWithStats(c *gin.Context) {
 		app.db.Where("vehicle_id = ?", v.ID).Find(&reminders)
 
 		for _, r := range reminders {
-			status := "upcoming"
-			if r.IntervalMiles > 0 {
-				nextServiceMiles := r.LastServiceMiles + r.IntervalMiles
-				if v.Odometer >= nextServiceMiles {
-					status = "overdue"
-				} else if v.Odometer >= nextServiceMiles-500 {
-					status = "soon"
-				}
-			}
-
-			if r.IntervalDays > 0 {
-				nextServiceDate := r.LastServiceDate.AddDate(0, 0, r.IntervalDays)
-				if time.Now().After(nextServiceDate) {
-					status = "overdue"
-				} else if time.Until(nextServiceDate).Hours()/24 < 7 {
-					status = "soon"
-				}
-			}
-
-			if status != "upcoming" {
+			state := evaluateReminder(r, v.RemindersPaused, v.Odometer, time.Now())
+			if state.Status == "overdue" || state.Status == "soon" {
 				stats.DueReminders++
 			}
 		}
@@ -121,12 +101,12 @@ func (app *Application) getFuelStats(c *gin.Context) {
 	}
 
 	type FuelStats struct {
-		TotalCost     float64       `json:"total_cost"`
-		AverageMPG    float64       `json:"average_mpg"`
-		TotalGallons  float64       `json:"total_gallons"`
-		TotalDistance float64       `json:"total_distance"`
-		LastFillup    *FuelEntry    `json:"last_fillup"`
-		MonthlyTrend  []gin.H       `json:"monthly_trend"`
+		TotalCost     float64    `json:"total_cost"`
+		AverageMPG    float64    `json:"average_mpg"`
+		TotalGallons  float64    `json:"total_gallons"`
+		TotalDistance float64    `json:"total_distance"`
+		LastFillup    *FuelEntry `json:"last_fillup"`
+		MonthlyTrend  []gin.H    `json:"monthly_trend"`
 	}
 
 	stats := FuelStats{}
@@ -230,12 +210,12 @@ func (app *Application) createFuelEntryEnhanced(c *gin.Context) {
 	}
 
 	var req struct {
-		Date      time.Time `json:"date" binding:"required"`
-		Gallons   float64   `json:"gallons" binding:"required,gt=0"`
-		Price     float64   `json:"price" binding:"required,gt=0"`
-		Odometer  float64   `json:"odometer" binding:"required,gt=0"`
-		Location  string    `json:"location"`
-		Notes     string    `json:"notes"`
+		Date     time.Time `json:"date" binding:"required"`
+		Gallons  float64   `json:"gallons" binding:"required,gt=0"`
+		Price    float64   `json:"price" binding:"required,gt=0"`
+		Odometer float64   `json:"odometer" binding:"required,gt=0"`
+		Location string    `json:"location"`
+		Notes    string    `json:"notes"`
 	}
 
 	if err := c.BindJSON(&req); err != nil {
@@ -272,13 +252,21 @@ func (app *Application) createFuelEntryEnhanced(c *gin.Context) {
 		return
 	}
 
+	app.publishVehicleEvent(entry.VehicleID, "entry.created", gin.H{"kind": "fuel", "entry": entry})
+
 	// Check and trigger reminders
 	alerts := app.checkVehicleReminders(uint(vehicleID), req.Odometer)
 
-	c.JSON(201, gin.H{
+	response := gin.H{
 		"entry":  entry,
 		"alerts": alerts,
-	})
+	}
+	if duplicate, found := findFuelDuplicate(app.db, entry); found {
+		response["warning"] = fmt.Sprintf("This looks like a duplicate of the fill-up on %s (entry %d)", duplicate.Date.Format("2006-01-02"), duplicate.ID)
+		response["duplicate_of"] = duplicate
+	}
+
+	c.JSON(201, response)
 }
 
 // Expense Handlers
@@ -315,7 +303,20 @@ func (app *Application) createExpenseEnhanced(c *gin.Context) {
 		return
 	}
 
-	c.JSON(201, expense)
+	app.publishVehicleEvent(expense.VehicleID, "entry.created", gin.H{"kind": "expense", "entry": expense})
+
+	// The expense's own fields stay at the top level of the response
+	response := struct {
+		Expense
+		Warning     string   `json:"warning,omitempty"`
+		DuplicateOf *Expense `json:"duplicate_of,omitempty"`
+	}{Expense: expense}
+	if duplicate, found := findExpenseDuplicate(app.db, expense); found {
+		response.Warning = fmt.Sprintf("This looks like a duplicate of the %s expense on %s (expense %d)", duplicate.Category, duplicate.Date.Format("2006-01-02"), duplicate.ID)
+		response.DuplicateOf = &duplicate
+	}
+
+	c.JSON(201, response)
 }
 
 // Reminder Handlers with Advanced Logic
@@ -341,11 +342,13 @@ func (app *Application) checkRemindersDue(c *gin.Context) {
 }
 
 func (app *Application) completeReminder(c *gin.Context) {
+	userID := c.GetUint("userID")
 	reminderID := c.Param("id")
 
+	// service_miles may be left out of reminders that don't track distance
 	var req struct {
 		ServiceDate  time.Time `json:"service_date" binding:"required"`
-		ServiceMiles float64   `json:"service_miles" binding:"required"`
+		ServiceMiles *float64  `json:"service_miles" binding:"omitempty,gte=0"`
 	}
 
 	if err := c.BindJSON(&req); err != nil {
@@ -353,17 +356,130 @@ func (app *Application) completeReminder(c *gin.Context) {
 		return
 	}
 
-	if err := app.db.Model(&MaintenanceReminder{}).Where("id = ?", reminderID).Updates(map[string]interface{}{
-		"last_service_date":  req.ServiceDate,
-		"last_service_miles": req.ServiceMiles,
-	}).Error; err != nil {
+	reminder, err := app.accessibleReminder(userID, reminderID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Reminder not found"})
+		return
+	}
+	if req.ServiceMiles == nil && reminder.IntervalMiles > 0 {
+		c.JSON(400, gin.H{"error": "service_miles is required for reminders with a distance interval"})
+		return
+	}
+
+	updates := map[string]interface{}{
+		"last_service_date":   req.ServiceDate,
+		"snoozed_until":       nil,
+		"snoozed_until_miles": 0,
+	}
+	if req.ServiceMiles != nil {
+		updates["last_service_miles"] = *req.ServiceMiles
+	}
+
+	// One-off reminders are done for good once completed
+	if reminder.IsOneOff() {
+		updates["completed_at"] = req.ServiceDate
+	}
+
+	if err := app.db.Model(&MaintenanceReminder{}).Where("id = ?", reminder.ID).Updates(updates).Error; err != nil {
 		c.JSON(500, gin.H{"error": "Update failed"})
 		return
 	}
 
+	app.resolveReminderNotifications(reminder.ID)
+
 	c.JSON(200, gin.H{"message": "Reminder completed"})
 }
 
+func (app *Application) snoozeReminder(c *gin.Context) {
+	userID := c.GetUint("userID")
+	reminderID := c.Param("id")
+
+	var req struct {
+		Days  int     `json:"days" binding:"gte=0"`
+		Miles float64 `json:"miles" binding:"gte=0"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if req.Days == 0 && req.Miles == 0 {
+		c.JSON(400, gin.H{"error": "Snooze requires days or miles"})
+		return
+	}
+
+	reminder, err := app.accessibleReminder(userID, reminderID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Reminder not found"})
+		return
+	}
+
+	updates := map[string]interface{}{
+		"snoozed_until":       nil,
+		"snoozed_until_miles": 0,
+	}
+	if req.Days > 0 {
+		updates["snoozed_until"] = time.Now().AddDate(0, 0, req.Days)
+	}
+	if req.Miles > 0 {
+		updates["snoozed_until_miles"] = reminder.Vehicle.Odometer + req.Miles
+	}
+
+	if err := app.db.Model(&MaintenanceReminder{}).Where("id = ?", reminder.ID).Updates(updates).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Update failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Reminder snoozed"})
+}
+
+func (app *Application) unsnoozeReminder(c *gin.Context) {
+	userID := c.GetUint("userID")
+	reminderID := c.Param("id")
+
+	reminder, err := app.accessibleReminder(userID, reminderID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Reminder not found"})
+		return
+	}
+
+	if err := app.db.Model(&MaintenanceReminder{}).Where("id = ?", reminder.ID).Updates(map[string]interface{}{
+		"snoozed_until":       nil,
+		"snoozed_until_miles": 0,
+	}).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Update failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Snooze cleared"})
+}
+
+func (app *Application) pauseVehicleReminders(c *gin.Context) {
+	app.setVehicleRemindersPaused(c, true)
+}
+
+func (app *Application) resumeVehicleReminders(c *gin.Context) {
+	app.setVehicleRemindersPaused(c, false)
+}
+
+func (app *Application) setVehicleRemindersPaused(c *gin.Context, paused bool) {
+	userID := c.GetUint("userID")
+
+	vehicle, err := app.accessibleVehicle(userID, c.Param("id"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Vehicle not found"})
+		return
+	}
+
+	if err := app.db.Model(&Vehicle{}).Where("id = ?", vehicle.ID).Update("reminders_paused", paused).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Update failed"})
+		return
+	}
+
+	c.JSON(200, gin.H{"reminders_paused": paused})
+}
+
 func (app *Application) getRemindersOverdue(c *gin.Context) {
 	userID := c.GetUint("userID")
 
@@ -375,7 +491,7 @@ func (app *Application) getRemindersOverdue(c *gin.Context) {
 		VehicleName  string  `json:"vehicle_name"`
 		ReminderID   uint    `json:"reminder_id"`
 		ReminderName string  `json:"reminder_name"`
-		Status       string  `json:"status"` // overdue, soon, upcoming
+		Status       string  `json:"status"` // overdue, soon
 		MilesToGo    float64 `json:"miles_to_go"`
 		DaysUntil    int     `json:"days_until"`
 	}
@@ -392,34 +508,14 @@ func (app *Application) getRemindersOverdue(c *gin.Context) {
 				VehicleName:  fmt.Sprintf("%d %s %s", v.Year, v.Make, v.Model),
 				ReminderID:   r.ID,
 				ReminderName: r.Name,
-				Status:       "upcoming",
-			}
-
-			// Check mileage
-			if r.IntervalMiles > 0 {
-				nextServiceMiles := r.LastServiceMiles + r.IntervalMiles
-				alert.MilesToGo = nextServiceMiles - v.Odometer
-
-				if v.Odometer >= nextServiceMiles {
-					alert.Status = "overdue"
-				} else if alert.MilesToGo < 500 {
-					alert.Status = "soon"
-				}
 			}
 
-			// Check days
-			if r.IntervalDays > 0 {
-				nextServiceDate := r.LastServiceDate.AddDate(0, 0, r.IntervalDays)
-				alert.DaysUntil = int(time.Until(nextServiceDate).Hours() / 24)
+			state := evaluateReminder(r, v.RemindersPaused, v.Odometer, time.Now())
+			alert.Status = state.Status
+			alert.MilesToGo = state.MilesToGo
+			alert.DaysUntil = state.DaysUntil
 
-				if alert.DaysUntil <= 0 {
-					alert.Status = "overdue"
-				} else if alert.DaysUntil < 7 {
-					alert.Status = "soon"
-				}
-			}
-
-			if alert.Status != "upcoming" {
+			if alert.Status == "overdue" || alert.Status == "soon" {
 				allAlerts = append(allAlerts, alert)
 			}
 		}
@@ -445,13 +541,13 @@ func (app *Application) attachFileToEntry(c *gin.Context) {
 		return
 	}
 
-	// Validate file size (max 5MB)
-	if file.Size > 5*1024*1024 {
-		c.JSON(400, gin.H{"error": "File too large (max 5MB)"})
+	// Validate file size
+	if file.Size > int64(app.config.MaxAttachmentMB)<<20 {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("File too large (max %dMB)", app.config.MaxAttachmentMB)})
 		return
 	}
 
-	assetsPath := "/assets"
+	assetsPath := app.config.AssetsPath
 	filename := fmt.Sprintf("%d-%s", time.Now().Unix(), file.Filename)
 	filepath := assetsPath + "/" + filename
 
@@ -459,6 +555,7 @@ func (app *Application) attachFileToEntry(c *gin.Context) {
 		c.JSON(500, gin.H{"error": "Upload failed"})
 		return
 	}
+	app.metrics.uploaded("attachment", file.Size)
 
 	// Create attachment record
 	attachment := Attachment{
@@ -509,6 +606,42 @@ func (app *Application) removeVehicleUser(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "User removed from vehicle"})
 }
 
+// Access checks
+
+// accessibleVehicles returns vehicles the user owns or has been shared
+func (app *Application) accessibleVehicles(userID uint) ([]Vehicle, error) {
+	var vehicles []Vehicle
+	err := app.db.
+		Joins("LEFT JOIN vehicle_users ON vehicle_users.vehicle_id = vehicles.id").
+		Where("vehicles.user_id = ? OR vehicle_users.user_id = ?", userID, userID).
+		Distinct("vehicles.*").
+		Find(&vehicles).Error
+	return vehicles, err
+}
+
+// accessibleVehicle returns the vehicle if the user owns it or it has been
+// shared with them
+func (app *Application) accessibleVehicle(userID uint, vehicleID interface{}) (Vehicle, error) {
+	var vehicle Vehicle
+	err := app.db.
+		Joins("LEFT JOIN vehicle_users ON vehicle_users.vehicle_id = vehicles.id").
+		Where("vehicles.id = ? AND (vehicles.user_id = ? OR vehicle_users.user_id = ?)", vehicleID, userID, userID).
+		First(&vehicle).Error
+	return vehicle, err
+}
+
+// accessibleReminder returns the reminder, with its vehicle, if the user can
+// access the vehicle
+func (app *Application) accessibleReminder(userID uint, reminderID string) (MaintenanceReminder, error) {
+	var reminder MaintenanceReminder
+	if err := app.db.First(&reminder, parseUint(reminderID)).Error; err != nil {
+		return reminder, err
+	}
+	vehicle, err := app.accessibleVehicle(userID, reminder.VehicleID)
+	reminder.Vehicle = vehicle
+	return reminder, err
+}
+
 func parseUint(s string) uint {
 	i, _ := strconv.ParseUint(s, 10, 32)
 	return uint(i)
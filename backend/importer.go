@@ -0,0 +1,779 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Imports from other trackers are parsed into an ImportBatch before anything
+// is written, so an upload can be previewed and adjusted (see
+// importsession.go) and then written in one transaction.
+
+// ImportVehicle is a vehicle as the import file describes it
+type ImportVehicle struct {
+	Key          string   `json:"key"` // How the file refers to the vehicle
+	Make         string   `json:"make"`
+	Model        string   `json:"model"`
+	Year         int      `json:"year"`
+	FuelType     string   `json:"fuel_type"`
+	DistanceUnit string   `json:"distance_unit"` // mi or km
+	VolumeUnit   string   `json:"volume_unit"`   // l, gal or imp_gal; empty when fuel isn't measured by volume
+	Match        []string `json:"-"`             // Names to look for among the user's vehicles
+}
+
+type ImportFuel struct {
+	Row          int       `json:"row,omitempty"` // Line in a CSV file
+	ID           string    `json:"id,omitempty"`  // Record ID in other formats
+	Vehicle      string    `json:"vehicle"`       // ImportVehicle key
+	Date         time.Time `json:"date"`
+	Odometer     float64   `json:"odometer"`
+	Distance     float64   `json:"distance,omitempty"` // Trip distance, used when there's no odometer reading
+	Volume       float64   `json:"volume"`
+	Cost         float64   `json:"cost"`
+	PartialFill  bool      `json:"partial_fill"`
+	MissedFillup bool      `json:"missed_fillup"`
+	Location     string    `json:"location"`
+	Notes        string    `json:"notes"`
+}
+
+type ImportExpense struct {
+	Row      int       `json:"row,omitempty"`
+	ID       string    `json:"id,omitempty"`
+	Vehicle  string    `json:"vehicle"`
+	Date     time.Time `json:"date"`
+	Category string    `json:"category"`
+	Amount   float64   `json:"amount"`
+	Odometer float64   `json:"odometer,omitempty"` // Kept in the notes, expenses have no odometer
+	Notes    string    `json:"notes"`
+}
+
+// ImportReminder is a maintenance reminder. It repeats every interval from
+// the last service, or is due once at a date or odometer reading.
+type ImportReminder struct {
+	Row              int        `json:"row,omitempty"`
+	ID               string     `json:"id,omitempty"`
+	Vehicle          string     `json:"vehicle"`
+	Name             string     `json:"name"`
+	IntervalDistance float64    `json:"interval_distance,omitempty"`
+	IntervalDays     int        `json:"interval_days,omitempty"`
+	LastDate         time.Time  `json:"last_date"`
+	LastOdometer     float64    `json:"last_odometer,omitempty"`
+	DueDate          *time.Time `json:"due_date,omitempty"`
+	DueOdometer      float64    `json:"due_odometer,omitempty"`
+}
+
+// ImportAttachment is a file from the upload to attach to a vehicle
+type ImportAttachment struct {
+	ID       string `json:"id,omitempty"`
+	Vehicle  string `json:"vehicle"`
+	Filename string `json:"filename"`
+	file     *zip.File
+}
+
+// ImportWarning is a record that was skipped. CSV and interchange files give
+// the line number (a CSV header is row 1), others the record's type and ID.
+type ImportWarning struct {
+	Row     int    `json:"row,omitempty"`
+	Type    string `json:"type,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Field   string `json:"field,omitempty"` // Interchange files: the field that's wrong
+	Message string `json:"message"`
+}
+
+// ImportBatch is an import file parsed into Clarkson's records
+type ImportBatch struct {
+	Format      string
+	Header      []string          // CSV formats: the header row
+	Columns     map[string]string // CSV formats: field to the column it's read from
+	Vehicles    []ImportVehicle
+	Fuel        []ImportFuel
+	Expenses    []ImportExpense
+	Reminders   []ImportReminder
+	Attachments []ImportAttachment
+	Warnings    []ImportWarning
+}
+
+// ImportOptions are the user's adjustments to how an upload is read
+type ImportOptions struct {
+	VehicleMap       map[string]uint   `json:"vehicle_map,omitempty"`       // Vehicle key to an existing vehicle ID; 0 creates the vehicle
+	Columns          map[string]string `json:"columns,omitempty"`           // CSV formats: field to column name
+	DateFormat       string            `json:"date_format,omitempty"`       // CSV formats: e.g. DD/MM/YYYY, detected when empty
+	DecimalSeparator string            `json:"decimal_separator,omitempty"` // CSV formats: "." or ",", detected from the file's numbers when empty
+	DistanceUnit     string            `json:"distance_unit,omitempty"`     // mi or km, overrides the file's
+	VolumeUnit       string            `json:"volume_unit,omitempty"`       // l, gal or imp_gal, overrides the file's
+	Duplicates       string            `json:"duplicates,omitempty"`        // skip (default), merge or keep entries matching existing ones
+	Strict           bool              `json:"strict,omitempty"`            // Clarkson backups: roll back if any record fails; interchange files: reject if any record is invalid
+}
+
+// ImportDuplicate is an imported fuel entry or expense that matched one
+// already recorded (see duplicates.go)
+type ImportDuplicate struct {
+	Row        int    `json:"row,omitempty"`
+	ID         string `json:"id,omitempty"`
+	Type       string `json:"type"` // fuel, expense or reminder
+	ExistingID uint   `json:"existing_id"`
+	Action     string `json:"action"` // skipped, merged or imported
+}
+
+// ImportResult is what an import wrote
+type ImportResult struct {
+	Format     string            `json:"format"`
+	Imported   map[string]int    `json:"imported"` // vehicles (created), matched_vehicles, fuel, expenses, reminders, attachments, duplicates
+	Warnings   []ImportWarning   `json:"warnings"`
+	Duplicates []ImportDuplicate `json:"duplicates"`
+}
+
+const kmPerMile = 1.609344
+
+var litresPerUnit = map[string]float64{
+	"l":       1,
+	"gal":     3.785411784,
+	"imp_gal": 4.54609,
+}
+
+func (o ImportOptions) validate() error {
+	if o.DistanceUnit != "" && o.DistanceUnit != "mi" && o.DistanceUnit != "km" {
+		return fmt.Errorf("distance_unit must be mi or km")
+	}
+	if _, ok := litresPerUnit[o.VolumeUnit]; o.VolumeUnit != "" && !ok {
+		return fmt.Errorf("volume_unit must be l, gal or imp_gal")
+	}
+	if o.DecimalSeparator != "" && o.DecimalSeparator != "." && o.DecimalSeparator != "," {
+		return fmt.Errorf(`decimal_separator must be "." or ","`)
+	}
+	switch o.Duplicates {
+	case "", "skip", "merge", "keep":
+	default:
+		return fmt.Errorf("duplicates must be skip, merge or keep")
+	}
+	return nil
+}
+
+// decimalFor is the decimal_separator option, or else the separator a
+// file's numbers are written with
+func (o ImportOptions) decimalFor(numbers []string) string {
+	if o.DecimalSeparator != "" {
+		return o.DecimalSeparator
+	}
+	return detectDecimalSeparator(numbers)
+}
+
+// Importer reads another tracker's export into a batch
+type Importer interface {
+	Name() string            // The format, as used in routes and the preview's format field
+	Detect(body []byte) bool // Whether an upload looks like this format
+	Parse(body []byte, opts ImportOptions) (*ImportBatch, error)
+}
+
+// importers in the order uploads are checked against them. Fuelly is last as
+// any CSV file with a date column could be one.
+var importers = []Importer{
+	interchangeImporter{},
+	hammondImporter{},
+	fuelioImporter{},
+	drivvoImporter{},
+	lubeLoggerImporter{},
+	fuellyImporter{},
+}
+
+func findImporter(format string) (Importer, bool) {
+	for _, importer := range importers {
+		if importer.Name() == format {
+			return importer, true
+		}
+	}
+	return nil, false
+}
+
+// parseImport reads an upload into a batch. A CSV file whose columns can't
+// be worked out returns the batch, with its header, along with the error so
+// the user can map the columns.
+func parseImport(format string, body []byte, opts ImportOptions) (*ImportBatch, error) {
+	importer, ok := findImporter(format)
+	if !ok {
+		return nil, fmt.Errorf("unknown import format: %s", format)
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	batch, err := importer.Parse(body, opts)
+	if batch == nil {
+		return nil, err
+	}
+	if len(opts.Columns) > 0 && batch.Header == nil {
+		return nil, fmt.Errorf("columns can't be mapped for %s exports", format)
+	}
+	batch.Format = format
+	for i := range batch.Vehicles {
+		if opts.DistanceUnit != "" {
+			batch.Vehicles[i].DistanceUnit = opts.DistanceUnit
+		}
+		if opts.VolumeUnit != "" {
+			batch.Vehicles[i].VolumeUnit = opts.VolumeUnit
+		}
+	}
+	return batch, err
+}
+
+// detectImportFormat guesses what kind of file was uploaded. Other JSON is
+// taken for a Clarkson backup, anything else for a Fuelly CSV, whose columns
+// can be mapped.
+func detectImportFormat(body []byte) string {
+	if bytes.HasPrefix(body, []byte("PK\x03\x04")) {
+		if zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body))); err == nil {
+			for _, f := range zr.File {
+				if f.Name == "backup.json" {
+					return "clarkson"
+				}
+			}
+		}
+	}
+
+	for _, importer := range importers {
+		if importer.Detect(body) {
+			return importer.Name()
+		}
+	}
+	if trimmed := bytes.TrimSpace(body); bytes.HasPrefix(trimmed, []byte("{")) {
+		return "clarkson"
+	}
+	return "fuelly"
+}
+
+// expenseCategories maps words in other trackers' expense and service types
+// to Clarkson's categories
+var expenseCategories = []struct {
+	category string
+	words    []string
+}{
+	{"Maintenance", []string{"service", "maintenance", "repair", "upgrade", "oil", "tire", "tyre", "brake", "inspection", "wash", "manutenção", "manutencao", "revisão", "revisao"}},
+	{"Insurance", []string{"insurance", "seguro"}},
+	{"Registration", []string{"registration", "tax", "licen", "ipva", "licenciamento"}},
+	{"Parking", []string{"parking", "estacionamento"}},
+	{"Tolls", []string{"toll", "pedágio", "pedagio"}},
+}
+
+// expenseCategory picks the category for another tracker's expense type,
+// keeping the type itself when nothing matches
+func expenseCategory(name string) string {
+	lower := strings.ToLower(name)
+	for _, c := range expenseCategories {
+		for _, word := range c.words {
+			if strings.Contains(lower, word) {
+				return c.category
+			}
+		}
+	}
+	if strings.TrimSpace(name) == "" {
+		return "Other"
+	}
+	return strings.TrimSpace(name)
+}
+
+// intervalDays is the number of days in a repeat interval of months
+// starting at from
+func intervalDays(from time.Time, months int) int {
+	return int(math.Round(from.AddDate(0, months, 0).Sub(from).Hours() / 24))
+}
+
+// dueReminder is a reminder next due at a date or odometer reading. If it
+// repeats, the last service is worked back from when it's due.
+func dueReminder(r ImportReminder, due *time.Time, dueOdometer, distance float64, months int) ImportReminder {
+	if distance <= 0 && months <= 0 {
+		r.DueDate, r.DueOdometer = due, dueOdometer
+		return r
+	}
+	if distance > 0 && dueOdometer > 0 {
+		r.IntervalDistance = distance
+		r.LastOdometer = math.Max(dueOdometer-distance, 0)
+	}
+	if months > 0 && due != nil {
+		r.LastDate = due.AddDate(0, -months, 0)
+		r.IntervalDays = intervalDays(r.LastDate, months)
+	}
+	if r.IntervalDistance == 0 && r.IntervalDays == 0 {
+		r.DueDate, r.DueOdometer = due, dueOdometer
+	}
+	return r
+}
+
+// readImportUpload reads the uploaded file and the optional options form
+// field, a JSON ImportOptions. vehicle_map may also be sent on its own.
+func (app *Application) readImportUpload(c *gin.Context) (body []byte, filename string, opts ImportOptions, ok bool) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(400, gin.H{"error": "No file uploaded"})
+		return nil, "", opts, false
+	}
+	if !app.importSizeOK(c, file.Size) {
+		return nil, "", opts, false
+	}
+
+	if raw := c.PostForm("options"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &opts); err != nil {
+			c.JSON(400, gin.H{"error": "options must be a JSON object"})
+			return nil, "", opts, false
+		}
+	}
+	if raw := c.PostForm("vehicle_map"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &opts.VehicleMap); err != nil {
+			c.JSON(400, gin.H{"error": "vehicle_map must be a JSON object of vehicle name to vehicle ID"})
+			return nil, "", opts, false
+		}
+	}
+	if err := opts.validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return nil, "", opts, false
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to open file"})
+		return nil, "", opts, false
+	}
+	defer src.Close()
+
+	body, err = io.ReadAll(src)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read file"})
+		return nil, "", opts, false
+	}
+	return body, file.Filename, opts, true
+}
+
+// importSizeOK responds 413 if an import or backup upload is over the
+// configured limit, and counts it in the metrics otherwise
+func (app *Application) importSizeOK(c *gin.Context, size int64) bool {
+	if size > int64(app.config.MaxImportMB)<<20 {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("File too large (max %dMB)", app.config.MaxImportMB)})
+		return false
+	}
+	app.metrics.uploaded("import", size)
+	return true
+}
+
+// proposeVehicleMap decides which of the user's vehicles each vehicle in the
+// file goes to: the user's choice, else a match by name, else 0 to create it
+func proposeVehicleMap(vehicles []Vehicle, batch *ImportBatch, choices map[string]uint) (map[string]uint, error) {
+	byID := make(map[uint]bool)
+	for _, v := range vehicles {
+		byID[v.ID] = true
+	}
+	keys := make(map[string]bool)
+	for _, iv := range batch.Vehicles {
+		keys[iv.Key] = true
+	}
+	for key, id := range choices {
+		if !keys[key] {
+			return nil, fmt.Errorf("no vehicle %q in the file", key)
+		}
+		if id != 0 && !byID[id] {
+			return nil, fmt.Errorf("vehicle %d not found", id)
+		}
+	}
+
+	proposed := make(map[string]uint)
+	for _, iv := range batch.Vehicles {
+		if id, ok := choices[iv.Key]; ok {
+			proposed[iv.Key] = id
+		} else if v, ok := matchVehicle(vehicles, iv.Match...); ok {
+			proposed[iv.Key] = v.ID
+		} else {
+			proposed[iv.Key] = 0
+		}
+	}
+	return proposed, nil
+}
+
+// vehicleDistanceUnit is the unit records are written in for a vehicle. A
+// vehicle without a unit takes the file's.
+func vehicleDistanceUnit(v Vehicle, fileUnit string) string {
+	if v.MileageUnit == "" {
+		return fileUnit
+	}
+	return v.MileageUnit
+}
+
+func convertDistance(d float64, from, to string) float64 {
+	switch {
+	case from == "mi" && to == "km":
+		return math.Round(d*kmPerMile*10) / 10
+	case from == "km" && to == "mi":
+		return math.Round(d/kmPerMile*10) / 10
+	}
+	return d
+}
+
+// storedVolumeUnit is the unit fuel is kept in for a vehicle: litres with
+// kilometres, gallons with miles. Imperial gallons stay as they are.
+func storedVolumeUnit(distanceUnit, from string) string {
+	switch {
+	case from == "":
+		return ""
+	case distanceUnit == "km":
+		return "l"
+	case from == "imp_gal":
+		return from
+	}
+	return "gal"
+}
+
+func convertVolume(v float64, from, to string) float64 {
+	if from == to || litresPerUnit[from] == 0 || litresPerUnit[to] == 0 {
+		return v
+	}
+	return math.Round(v*litresPerUnit[from]/litresPerUnit[to]*1000) / 1000
+}
+
+// errDryRun rolls back a dry run's transaction
+var errDryRun = fmt.Errorf("dry run")
+
+// importWriter writes a batch inside a transaction
+type importWriter struct {
+	tx         *gorm.DB
+	userID     uint
+	assetsPath string
+	limits     *extractLimits
+	duplicates string // skip, merge or keep
+	dryRun     bool   // Attachment files aren't written
+
+	vehicles map[string]Vehicle // By ImportVehicle key
+	result   ImportResult
+	written  []string // Attachment files to remove if the import is rolled back
+}
+
+func (w *importWriter) write(batch *ImportBatch, existing []Vehicle, vehicleMap map[string]uint) error {
+	byID := make(map[uint]Vehicle)
+	for _, v := range existing {
+		byID[v.ID] = v
+	}
+
+	units := make(map[string]ImportVehicle)
+	for _, iv := range batch.Vehicles {
+		units[iv.Key] = iv
+		if id := vehicleMap[iv.Key]; id != 0 {
+			w.vehicles[iv.Key] = byID[id]
+			w.result.Imported["matched_vehicles"]++
+			continue
+		}
+
+		v := Vehicle{
+			UserID:      w.userID,
+			Make:        iv.Make,
+			Model:       iv.Model,
+			Year:        iv.Year,
+			MileageUnit: iv.DistanceUnit,
+			FuelType:    iv.FuelType,
+		}
+		if v.MileageUnit == "" {
+			v.MileageUnit = "mi"
+		}
+		if v.FuelType == "" {
+			v.FuelType = "Petrol"
+		}
+		if err := w.tx.Create(&v).Error; err != nil {
+			return err
+		}
+		w.vehicles[iv.Key] = v
+		w.result.Imported["vehicles"]++
+	}
+
+	odometers := make(map[string]float64)
+	track := func(key string, odometer float64) {
+		if odometer > odometers[key] {
+			odometers[key] = odometer
+		}
+	}
+
+	// Oldest first, so trip distances can fill in missing odometer readings
+	fuel := append([]ImportFuel(nil), batch.Fuel...)
+	sort.SliceStable(fuel, func(i, j int) bool { return fuel[i].Date.Before(fuel[j].Date) })
+
+	// Files with trip distances only count on from the vehicle's current
+	// odometer, in the file's unit; new vehicles start at 0
+	running := make(map[string]float64)
+	hasReadings := make(map[string]bool)
+	for _, f := range fuel {
+		if f.Odometer > 0 {
+			hasReadings[f.Vehicle] = true
+		}
+	}
+	for key, v := range w.vehicles {
+		if !hasReadings[key] && v.Odometer > 0 {
+			fileUnit := units[key].DistanceUnit
+			running[key] = convertDistance(v.Odometer, vehicleDistanceUnit(v, fileUnit), fileUnit)
+		}
+	}
+
+	for _, f := range fuel {
+		v := w.vehicles[f.Vehicle]
+		iv := units[f.Vehicle]
+		unit := vehicleDistanceUnit(v, iv.DistanceUnit)
+
+		odometer := f.Odometer
+		if odometer <= 0 {
+			odometer = running[f.Vehicle] + f.Distance
+		}
+		running[f.Vehicle] = odometer
+
+		entry := FuelEntry{
+			VehicleID:    v.ID,
+			Date:         f.Date,
+			Gallons:      convertVolume(f.Volume, iv.VolumeUnit, storedVolumeUnit(unit, iv.VolumeUnit)),
+			Price:        f.Cost,
+			Odometer:     convertDistance(odometer, iv.DistanceUnit, unit),
+			Location:     f.Location,
+			Notes:        f.Notes,
+			PartialFill:  f.PartialFill,
+			MissedFillup: f.MissedFillup,
+		}
+		track(f.Vehicle, entry.Odometer)
+
+		if existing, found := findFuelDuplicate(w.tx, entry); found {
+			action, err := w.duplicate(func() error {
+				mergeFuelEntries(&existing, entry)
+				return w.tx.Save(&existing).Error
+			})
+			if err != nil {
+				return err
+			}
+			w.result.Duplicates = append(w.result.Duplicates, ImportDuplicate{
+				Row: f.Row, ID: f.ID, Type: "fuel", ExistingID: existing.ID, Action: action,
+			})
+			if action != "imported" {
+				continue
+			}
+		}
+
+		if err := w.tx.Create(&entry).Error; err != nil {
+			return err
+		}
+		w.result.Imported["fuel"]++
+	}
+
+	for _, e := range batch.Expenses {
+		v := w.vehicles[e.Vehicle]
+		unit := vehicleDistanceUnit(v, units[e.Vehicle].DistanceUnit)
+
+		notes := e.Notes
+		if e.Odometer > 0 {
+			odometer := convertDistance(e.Odometer, units[e.Vehicle].DistanceUnit, unit)
+			notes = strings.TrimSpace(fmt.Sprintf("%s\nOdometer: %.0f %s", notes, odometer, unit))
+			track(e.Vehicle, odometer)
+		}
+		category := strings.TrimSpace(e.Category)
+		if category == "" {
+			category = "Other"
+		}
+
+		expense := Expense{
+			VehicleID: v.ID,
+			Category:  category,
+			Amount:    e.Amount,
+			Date:      e.Date,
+			Notes:     notes,
+		}
+		if existing, found := findExpenseDuplicate(w.tx, expense); found {
+			action, err := w.duplicate(func() error {
+				mergeExpenses(&existing, expense)
+				return w.tx.Save(&existing).Error
+			})
+			if err != nil {
+				return err
+			}
+			w.result.Duplicates = append(w.result.Duplicates, ImportDuplicate{
+				Row: e.Row, ID: e.ID, Type: "expense", ExistingID: existing.ID, Action: action,
+			})
+			if action != "imported" {
+				continue
+			}
+		}
+
+		if err := w.tx.Create(&expense).Error; err != nil {
+			return err
+		}
+		w.result.Imported["expenses"]++
+	}
+
+	for _, r := range batch.Reminders {
+		v := w.vehicles[r.Vehicle]
+		from := units[r.Vehicle].DistanceUnit
+		unit := vehicleDistanceUnit(v, from)
+
+		reminder := MaintenanceReminder{
+			VehicleID:        v.ID,
+			Name:             strings.TrimSpace(r.Name),
+			IntervalMiles:    convertDistance(r.IntervalDistance, from, unit),
+			IntervalDays:     r.IntervalDays,
+			LastServiceDate:  r.LastDate,
+			LastServiceMiles: convertDistance(r.LastOdometer, from, unit),
+			DueDate:          r.DueDate,
+			DueMiles:         convertDistance(r.DueOdometer, from, unit),
+		}
+		if existing, found := findReminderDuplicate(w.tx, reminder); found {
+			action, err := w.duplicate(func() error {
+				mergeReminders(&existing, reminder)
+				return w.tx.Save(&existing).Error
+			})
+			if err != nil {
+				return err
+			}
+			w.result.Duplicates = append(w.result.Duplicates, ImportDuplicate{
+				Row: r.Row, ID: r.ID, Type: "reminder", ExistingID: existing.ID, Action: action,
+			})
+			if action != "imported" {
+				continue
+			}
+		}
+
+		if err := w.tx.Create(&reminder).Error; err != nil {
+			return err
+		}
+		w.result.Imported["reminders"]++
+	}
+
+	for key, odometer := range odometers {
+		v := w.vehicles[key]
+		if odometer > v.Odometer {
+			if err := w.tx.Model(&v).Update("odometer", odometer).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, a := range batch.Attachments {
+		if err := w.attachment(a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// duplicate handles a record matching an existing one, returning what was
+// done with it
+func (w *importWriter) duplicate(merge func() error) (string, error) {
+	w.result.Imported["duplicates"]++
+	switch w.duplicates {
+	case "keep":
+		return "imported", nil
+	case "merge":
+		return "merged", merge()
+	}
+	return "skipped", nil
+}
+
+func (w *importWriter) attachment(a ImportAttachment) error {
+	if w.dryRun {
+		w.result.Imported["attachments"]++
+		return nil
+	}
+
+	path := filepath.Join(w.assetsPath, fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(a.Filename)))
+	if err := extractZipFile(a.file, path, w.limits); err != nil {
+		w.result.Warnings = append(w.result.Warnings, ImportWarning{Type: "attachment", ID: a.ID, Message: err.Error()})
+		return nil
+	}
+	w.written = append(w.written, path)
+
+	attachment := Attachment{EntryID: w.vehicles[a.Vehicle].ID, EntryType: "vehicle", Filename: a.Filename, Path: path}
+	if err := w.tx.Create(&attachment).Error; err != nil {
+		return err
+	}
+	w.result.Imported["attachments"]++
+	return nil
+}
+
+// writeImport writes a batch for the user in one transaction. vehicleMap
+// comes from proposeVehicleMap. A dry run rolls the transaction back and
+// returns what would have been written.
+func (app *Application) writeImport(userID uint, batch *ImportBatch, vehicles []Vehicle, vehicleMap map[string]uint, opts ImportOptions, dryRun bool) (ImportResult, error) {
+	assetsPath := app.config.AssetsPath
+	os.MkdirAll(assetsPath, 0755)
+
+	w := &importWriter{
+		userID:     userID,
+		assetsPath: assetsPath,
+		limits:     app.newExtractLimits(),
+		duplicates: opts.Duplicates,
+		dryRun:     dryRun,
+		vehicles:   make(map[string]Vehicle),
+		result: ImportResult{
+			Format:     batch.Format,
+			Imported:   map[string]int{"vehicles": 0, "matched_vehicles": 0, "fuel": 0, "expenses": 0, "reminders": 0, "attachments": 0, "duplicates": 0},
+			Warnings:   append([]ImportWarning{}, batch.Warnings...),
+			Duplicates: []ImportDuplicate{},
+		},
+	}
+
+	err := app.db.Transaction(func(tx *gorm.DB) error {
+		w.tx = tx
+		if err := w.write(batch, vehicles, vehicleMap); err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		return w.result, nil
+	}
+	if err != nil {
+		for _, path := range w.written {
+			os.Remove(path)
+		}
+		return w.result, err
+	}
+	return w.result, nil
+}
+
+// runImport parses an upload and writes it, responding with the result
+func (app *Application) runImport(c *gin.Context, format string, body []byte, opts ImportOptions) bool {
+	userID := c.GetUint("userID")
+
+	batch, err := parseImport(format, body, opts)
+	if err != nil {
+		response := gin.H{"error": fmt.Sprintf("Invalid %s import: %v", format, err)}
+		if batch != nil && len(batch.Warnings) > 0 {
+			response["warnings"] = batch.Warnings
+		}
+		c.JSON(400, response)
+		return false
+	}
+
+	vehicles, err := app.accessibleVehicles(userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load vehicles"})
+		return false
+	}
+	vehicleMap, err := proposeVehicleMap(vehicles, batch, opts.VehicleMap)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return false
+	}
+
+	result, err := app.writeImport(userID, batch, vehicles, vehicleMap, opts, false)
+	if err != nil {
+		requestLogger(c).Error("import failed", "format", format, "error", err)
+		c.JSON(500, gin.H{"error": "Import failed: " + err.Error()})
+		return false
+	}
+
+	requestLogger(c).Info("import finished", "format", format, countsAttr("imported", result.Imported), "warnings", len(result.Warnings))
+	c.JSON(200, result)
+	return true
+}
@@ -1,195 +1,552 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"encoding/csv"
 	"fmt"
 	"io"
-	"os"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 )
 
+// fuellyColumns maps each field to the header names Fuelly uses for it in
+// imperial and metric exports
+var fuellyColumns = map[string][]string{
+	"car":      {"car_name", "car", "vehicle"},
+	"model":    {"model"},
+	"odometer": {"odometer"},
+	"distance": {"miles", "km", "kilometers", "kilometres", "distance"},
+	"volume":   {"gallons", "litres", "liters", "volume"},
+	"price":    {"price", "price_per_unit"},
+	"date":     {"fuelup_date", "date"},
+	"notes":    {"notes"},
+	"tags":     {"tags"},
+	"brand":    {"brand"},
+	"missed":   {"missed_fuelup", "missed"},
+	"partial":  {"partial_fuelup", "partial"},
+}
 
-// Hammond export format
-type HammondVehicle struct {
-	Name       string `json:"name"`
-	Make       string `json:"make"`
-	Model      string `json:"model"`
-	Year       int    `json:"year"`
-	Odometer   float64 `json:"odometer"`
+var importDateFormats = []string{
+	"2006-01-02",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05Z07:00",
+	"01/02/2006",
+	"1/2/2006",
+	"01/02/2006 15:04",
+	"02.01.2006",
 }
 
-type HammondFuelEntry struct {
-	Date      string  `json:"date"`
-	Odometer  float64 `json:"odometer"`
-	Gallons   float64 `json:"gallons"`
-	Price     float64 `json:"cost_per_unit"`
-	TotalCost float64 `json:"total_cost"`
+// dateFormatLayout turns a date format such as DD/MM/YYYY or
+// YYYY-MM-DD HH:mm into a Go time layout
+var dateFormatLayout = strings.NewReplacer(
+	"YYYY", "2006", "YY", "06",
+	"MM", "01", "M", "1",
+	"DD", "02", "D", "2",
+	"HH", "15", "mm", "04", "ss", "05",
+)
+
+// parseImportDate reads a date in the given format, or in any of
+// importDateFormats when format is empty
+func parseImportDate(s, format string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if format != "" {
+		t, err := time.Parse(dateFormatLayout.Replace(format), s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("date %q doesn't match %s", s, format)
+		}
+		return t, nil
+	}
+	for _, layout := range importDateFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised date: %q", s)
 }
 
-type HammondExport struct {
-	Vehicles []HammondVehicle `json:"vehicles"`
-	Fuel     []HammondFuelEntry `json:"fuel_entries"`
+// parseImportNumber reads a number whose decimal separator is decimal, "."
+// or ",". The other separator may group thousands in threes: "1,234.5" or
+// "1.234,5". Currency symbols and spaces are ignored and empty values are 0.
+func parseImportNumber(s, decimal string) (float64, error) {
+	s = strings.TrimSpace(strings.Trim(strings.TrimSpace(s), "$€£"))
+	s = strings.NewReplacer(" ", "", "\u00a0", "", "\u202f", "").Replace(s)
+	if s == "" {
+		return 0, nil
+	}
+	original := s
+
+	group := ","
+	if decimal == "," {
+		group = "."
+	}
+	whole, fraction, hasFraction := strings.Cut(s, decimal)
+	if strings.Contains(whole, group) {
+		groups := strings.Split(whole, group)
+		for i, g := range groups {
+			// The leading group has one to three digits and isn't 0, so
+			// "0,500" is never five hundred
+			if digits := strings.TrimLeft(g, "+-"); i == 0 && (digits == "" || digits == "0" || len(digits) > 3) || i > 0 && len(g) != 3 {
+				return 0, fmt.Errorf("invalid number: %q", original)
+			}
+		}
+		whole = strings.Join(groups, "")
+	}
+	s = whole
+	if hasFraction {
+		s += "." + fraction
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || strings.TrimLeft(whole, "+-") == "" {
+		return 0, fmt.Errorf("invalid number: %q", original)
+	}
+	return f, nil
 }
 
-func (app *Application) importHammondDatabase(c *gin.Context) {
-	userID := c.GetUint("userID")
+// detectDecimalSeparator works out whether a file's numbers are written with
+// a decimal point or a decimal comma. Only numbers that read one way and not
+// the other count: "1.5" and "1,234.5" for a point, "0,500" and "1.234,5" for
+// a comma. "1,234" reads either way. Without any, a point is assumed.
+func detectDecimalSeparator(numbers []string) string {
+	points, commas := 0, 0
+	for _, s := range numbers {
+		_, pointErr := parseImportNumber(s, ".")
+		_, commaErr := parseImportNumber(s, ",")
+		switch {
+		case pointErr == nil && commaErr != nil:
+			points++
+		case commaErr == nil && pointErr != nil:
+			commas++
+		}
+	}
+	if commas > points {
+		return ","
+	}
+	return "."
+}
 
-	file, err := c.FormFile("file")
-	if err != nil {
-		c.JSON(400, gin.H{"error": "No file uploaded"})
-		return
+func parseImportFlag(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes", "y", "sim":
+		return true
 	}
+	return false
+}
+
+// fuellyImporter reads Fuelly CSV exports
+type fuellyImporter struct{}
+
+func (fuellyImporter) Name() string { return "fuelly" }
 
-	src, err := file.Open()
+// Detect looks for Fuelly's date and volume columns in the header
+func (fuellyImporter) Detect(body []byte) bool {
+	header, err := csv.NewReader(bytes.NewReader(body)).Read()
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to open file"})
-		return
+		return false
+	}
+	found := make(map[string]bool)
+	for _, name := range header {
+		lower := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		for _, field := range []string{"date", "volume"} {
+			for _, alias := range fuellyColumns[field] {
+				if lower == alias {
+					found[field] = true
+				}
+			}
+		}
 	}
-	defer src.Close()
+	return found["date"] && found["volume"]
+}
 
-	body, err := io.ReadAll(src)
+// Parse reads a Fuelly CSV export. Each car becomes a vehicle; gallons and
+// miles or litres and kilometres are detected from the header. Rows that
+// can't be read are skipped with a warning.
+func (fuellyImporter) Parse(body []byte, opts ImportOptions) (*ImportBatch, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to read file"})
-		return
+		return nil, fmt.Errorf("failed to read header: %v", err)
 	}
 
-	var export HammondExport
-	if err := json.Unmarshal(body, &export); err != nil {
-		c.JSON(400, gin.H{"error": "Invalid Hammond export format"})
-		return
+	batch := &ImportBatch{Columns: make(map[string]string)}
+	metric := false
+	for _, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		batch.Header = append(batch.Header, name)
+
+		lower := strings.ToLower(name)
+		for field, aliases := range fuellyColumns {
+			for _, alias := range aliases {
+				if _, taken := batch.Columns[field]; lower == alias && !taken {
+					batch.Columns[field] = name
+				}
+			}
+		}
+		switch lower {
+		case "litres", "liters", "km", "kilometers", "kilometres", "l/100km", "km/l":
+			metric = true
+		}
+	}
+	if err := mapImportColumns(batch, fuellyColumns, opts.Columns); err != nil {
+		return nil, err
 	}
 
-	imported := gin.H{
-		"vehicles": 0,
-		"fuel":     0,
-		"errors":   []string{},
+	index := make(map[string]int)
+	for field, column := range batch.Columns {
+		for i, name := range batch.Header {
+			if name == column {
+				index[field] = i
+			}
+		}
 	}
 
-	// Import vehicles
-	for _, v := range export.Vehicles {
-		vehicle := Vehicle{
-			UserID:      userID,
-			Make:        v.Make,
-			Model:       v.Model,
-			Year:        v.Year,
-			Odometer:    v.Odometer,
-			MileageUnit: "mi", // Hammond default
-			FuelType:    "Petrol",
+	for _, required := range []string{"date", "volume"} {
+		if _, ok := index[required]; !ok {
+			return batch, fmt.Errorf("missing %s column (expected one of %s)", required, strings.Join(fuellyColumns[required], ", "))
 		}
-		if err := app.db.Create(&vehicle).Error; err != nil {
-			imported["errors"] = append(imported["errors"].([]string), fmt.Sprintf("Failed to import vehicle %s: %v", v.Name, err))
+	}
+	if _, ok := index["odometer"]; !ok {
+		if _, ok := index["distance"]; !ok {
+			return batch, fmt.Errorf("missing odometer or distance column")
+		}
+	}
+
+	distanceUnit, volumeUnit := "mi", "gal"
+	if metric {
+		distanceUnit, volumeUnit = "km", "l"
+	}
+
+	// Read every row first so the decimal separator is decided from all of
+	// the file's numbers
+	var records [][]string
+	var rows []int
+	var numbers []string
+	row := 1
+	for {
+		record, err := reader.Read()
+		row++
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			batch.Warnings = append(batch.Warnings, ImportWarning{Row: row, Message: err.Error()})
 			continue
 		}
+		records, rows = append(records, record), append(rows, row)
+		for _, field := range []string{"odometer", "distance", "volume", "price"} {
+			if i, ok := index[field]; ok && i < len(record) {
+				numbers = append(numbers, record[i])
+			}
+		}
+	}
+	decimal := opts.decimalFor(numbers)
 
-		// Import fuel entries
-		for _, fuel := range export.Fuel {
-			date, _ := time.Parse("2006-01-02", fuel.Date)
-			entry := FuelEntry{
-				VehicleID: vehicle.ID,
-				Date:      date,
-				Odometer:  fuel.Odometer,
-				Gallons:   fuel.Gallons,
-				Price:     fuel.TotalCost,
+	cars := make(map[string]bool)
+	for n, record := range records {
+		row := rows[n]
+		get := func(field string) string {
+			i, ok := index[field]
+			if !ok || i >= len(record) {
+				return ""
 			}
-			if err := app.db.Create(&entry).Error; err != nil {
-				imported["errors"] = append(imported["errors"].([]string), fmt.Sprintf("Failed to import fuel entry: %v", err))
-				continue
+			return strings.TrimSpace(record[i])
+		}
+
+		car, model := get("car"), get("model")
+		if car == "" {
+			car = model
+		}
+		if car == "" {
+			car = "Fuelly"
+		}
+
+		f := ImportFuel{
+			Row:          row,
+			Vehicle:      car,
+			PartialFill:  parseImportFlag(get("partial")),
+			MissedFillup: parseImportFlag(get("missed")),
+			Location:     get("brand"),
+			Notes:        get("notes"),
+		}
+		if tags := get("tags"); tags != "" {
+			f.Notes = strings.TrimSpace(f.Notes + "\nTags: " + tags)
+		}
+
+		var pricePerUnit float64
+		var parseErr error
+		if f.Date, parseErr = parseImportDate(get("date"), opts.DateFormat); parseErr == nil {
+			if f.Odometer, parseErr = parseImportNumber(get("odometer"), decimal); parseErr == nil {
+				if f.Distance, parseErr = parseImportNumber(get("distance"), decimal); parseErr == nil {
+					if f.Volume, parseErr = parseImportNumber(get("volume"), decimal); parseErr == nil {
+						pricePerUnit, parseErr = parseImportNumber(get("price"), decimal)
+					}
+				}
 			}
-			imported["fuel"] = imported["fuel"].(int) + 1
 		}
-		imported["vehicles"] = imported["vehicles"].(int) + 1
+		if parseErr == nil && f.Volume <= 0 {
+			parseErr = fmt.Errorf("fuel volume must be positive")
+		}
+		if parseErr == nil && f.Odometer <= 0 && f.Distance <= 0 {
+			parseErr = fmt.Errorf("needs an odometer reading or trip distance")
+		}
+		if parseErr != nil {
+			batch.Warnings = append(batch.Warnings, ImportWarning{Row: row, Message: parseErr.Error()})
+			continue
+		}
+		f.Cost = math.Round(f.Volume*pricePerUnit*100) / 100
+
+		if !cars[car] {
+			cars[car] = true
+			name := model
+			if name == "" {
+				name = car
+			}
+			v := vehicleFromModel(name)
+			batch.Vehicles = append(batch.Vehicles, ImportVehicle{
+				Key:          car,
+				Make:         v.Make,
+				Model:        v.Model,
+				Year:         v.Year,
+				FuelType:     "Petrol",
+				DistanceUnit: distanceUnit,
+				VolumeUnit:   volumeUnit,
+				Match:        []string{car, model},
+			})
+		}
+		batch.Fuel = append(batch.Fuel, f)
 	}
 
-	c.JSON(200, imported)
+	return batch, nil
 }
 
-func (app *Application) importFuellyCSV(c *gin.Context) {
-	userID := c.GetUint("userID")
+// mapImportColumns applies the user's column choices over the detected ones.
+// An empty column name stops a field being read.
+func mapImportColumns(batch *ImportBatch, fields map[string][]string, choices map[string]string) error {
+	for field, column := range choices {
+		if _, ok := fields[field]; !ok {
+			names := make([]string, 0, len(fields))
+			for name := range fields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown field %q (use %s)", field, strings.Join(names, ", "))
+		}
+		if column == "" {
+			delete(batch.Columns, field)
+			continue
+		}
 
-	file, err := c.FormFile("file")
-	if err != nil {
-		c.JSON(400, gin.H{"error": "No file uploaded"})
-		return
+		found := false
+		for _, name := range batch.Header {
+			if strings.EqualFold(name, strings.TrimSpace(column)) {
+				batch.Columns[field] = name
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("no column %q in the file", column)
+		}
 	}
+	return nil
+}
 
-	src, err := file.Open()
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to open file"})
-		return
-	}
-	defer src.Close()
+// csvTable is a header and the rows under it. Fuelio and Drivvo exports
+// hold several, each after a line naming it.
+type csvTable struct {
+	Name   string
+	Header []string
+	Rows   [][]string
+	Lines  []int // Line in the file of each row
 
-	// TODO: Implement CSV parsing for Fuelly format
-	// Fuelly CSV format: Date, Odometer, Fuel Type, Gallons, Price, Cost, Car, Notes
+	index map[string]int // Column by csvColumnKey
+}
 
-	imported := gin.H{
-		"vehicles": 0,
-		"fuel":     0,
-		"errors":   []string{},
+// csvColumnKey normalises a column name for matching: lower case, letters
+// and digits only, without a bracketed unit or "(optional)"
+func csvColumnKey(name string) string {
+	name = strings.ToLower(strings.TrimPrefix(name, "\ufeff"))
+	if i := strings.Index(name, "("); i > 0 {
+		name = name[:i]
 	}
-
-	c.JSON(200, imported)
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
 }
 
-func (app *Application) importClarksonBackup(c *gin.Context) {
-	userID := c.GetUint("userID")
+// has reports whether the table has any of the columns
+func (t *csvTable) has(keys ...string) bool {
+	for _, key := range keys {
+		if _, ok := t.index[key]; ok {
+			return true
+		}
+	}
+	return false
+}
 
-	file, err := c.FormFile("file")
-	if err != nil {
-		c.JSON(400, gin.H{"error": "No file uploaded"})
-		return
+// get returns the first of the columns the table has from a row
+func (t *csvTable) get(record []string, keys ...string) string {
+	for _, key := range keys {
+		if i, ok := t.index[key]; ok {
+			if i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
 	}
+	return ""
+}
 
-	src, err := file.Open()
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to open file"})
-		return
+// column returns the first of the columns the table has from every row
+func (t *csvTable) column(keys ...string) []string {
+	values := make([]string, 0, len(t.Rows))
+	for _, record := range t.Rows {
+		values = append(values, t.get(record, keys...))
 	}
-	defer src.Close()
+	return values
+}
 
-	body, err := io.ReadAll(src)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to read file"})
-		return
+// readCSVTables splits a CSV file into tables. section names a line that
+// starts a table, the line after it being the header; with no section
+// function the file is one table.
+func readCSVTables(body []byte, section func(record []string) (string, bool)) ([]*csvTable, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(body, []byte("\ufeff"))))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var tables []*csvTable
+	var current *csvTable
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return tables, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		blank := true
+		for _, field := range record {
+			if strings.TrimSpace(field) != "" {
+				blank = false
+			}
+		}
+		if blank {
+			continue
+		}
+		if section != nil {
+			if name, ok := section(record); ok {
+				current = &csvTable{Name: name}
+				tables = append(tables, current)
+				continue
+			}
+		}
+
+		switch {
+		case current == nil && section != nil:
+			return nil, fmt.Errorf("line %d is outside a section", line)
+		case current == nil:
+			current = &csvTable{}
+			tables = append(tables, current)
+			fallthrough
+		case current.Header == nil:
+			current.Header = record
+			current.index = make(map[string]int)
+			for i, name := range record {
+				if key := csvColumnKey(name); key != "" {
+					if _, taken := current.index[key]; !taken {
+						current.index[key] = i
+					}
+				}
+			}
+		default:
+			current.Rows = append(current.Rows, record)
+			current.Lines = append(current.Lines, line)
+		}
 	}
+	return tables, nil
+}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal(body, &data); err != nil {
-		c.JSON(400, gin.H{"error": "Invalid Clarkson backup format"})
-		return
+// firstCSVLine is the first non-blank line of a file, without quotes
+func firstCSVLine(body []byte) string {
+	body = bytes.TrimPrefix(body, []byte("\ufeff"))
+	for len(body) > 0 {
+		line := body
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line, body = body[:i], body[i+1:]
+		} else {
+			body = nil
+		}
+		if trimmed := strings.Trim(strings.TrimSpace(string(line)), `",;`); trimmed != "" {
+			return trimmed
+		}
 	}
+	return ""
+}
 
-	imported := gin.H{
-		"vehicles":   0,
-		"fuel":       0,
-		"expenses":   0,
-		"reminders":  0,
-		"errors":     []string{},
+// vehicleFromModel builds a vehicle from a free-text name such as
+// "2015 Honda Civic"
+func vehicleFromModel(name string) Vehicle {
+	fields := strings.Fields(name)
+	var v Vehicle
+	if len(fields) > 0 {
+		if year, err := strconv.Atoi(fields[0]); err == nil && year > 1885 && year < 2200 {
+			v.Year = year
+			fields = fields[1:]
+		}
+	}
+	if len(fields) > 0 {
+		v.Make = fields[0]
+		v.Model = strings.Join(fields[1:], " ")
+	}
+	if v.Make == "" {
+		v.Make = "Imported"
+	}
+	if v.Model == "" {
+		v.Model = "Vehicle"
 	}
+	return v
+}
 
-	// Parse and import vehicles
-	if vehicles, ok := data["vehicles"].([]interface{}); ok {
+// matchVehicle finds one of the user's vehicles by a name from an import
+// file, comparing against "year make model" and "make model"
+func matchVehicle(vehicles []Vehicle, names ...string) (Vehicle, bool) {
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
 		for _, v := range vehicles {
-			if vmap, ok := v.(map[string]interface{}); ok {
-				vehicle := Vehicle{
-					UserID:      userID,
-					Make:        vmap["make"].(string),
-					Model:       vmap["model"].(string),
-					Year:        int(vmap["year"].(float64)),
-					Odometer:    vmap["odometer"].(float64),
-					MileageUnit: vmap["mileage_unit"].(string),
-					FuelType:    vmap["fuel_type"].(string),
-				}
-				if err := app.db.Create(&vehicle).Error; err != nil {
-					imported["errors"] = append(imported["errors"].([]string), fmt.Sprintf("Failed to import vehicle: %v", err))
-					continue
-				}
-				imported["vehicles"] = imported["vehicles"].(int) + 1
+			if name == strings.ToLower(vehicleName(v)) || name == strings.ToLower(v.Make+" "+v.Model) {
+				return v, true
 			}
 		}
 	}
+	return Vehicle{}, false
+}
 
-	c.JSON(200, imported)
+// importFuelly imports a Fuelly CSV export. Cars are matched to the user's
+// vehicles by name or created; the optional vehicle_map form field, a JSON
+// object of car name to vehicle ID (0 to create), overrides matching.
+func (app *Application) importFuelly(c *gin.Context) {
+	body, _, opts, ok := app.readImportUpload(c)
+	if !ok {
+		return
+	}
+	app.runImport(c, "fuelly", body, opts)
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseImportNumber(t *testing.T) {
+	tests := []struct {
+		in      string
+		decimal string
+		want    float64
+	}{
+		{"", ".", 0},
+		{"42", ".", 42},
+		{"-3.5", ".", -3.5},
+		{"1234.5", ".", 1234.5},
+		{"1234,5", ",", 1234.5},
+		{"0,75", ",", 0.75},
+		{"0,500", ",", 0.5},
+		{"12,345", ".", 12345},
+		{"1,234", ".", 1234},
+		{"1,234", ",", 1.234},
+		{"1,234,567", ".", 1234567},
+		{"1,234.56", ".", 1234.56},
+		{"1,234,567.89", ".", 1234567.89},
+		{"1.234,56", ",", 1234.56},
+		{"1.234.567,89", ",", 1234567.89},
+		{"1.234.567", ",", 1234567},
+		{"1.234", ".", 1.234},
+		{"1.234", ",", 1234},
+		{"$1,234.50", ".", 1234.5},
+		{"45,90 €", ",", 45.9},
+		{"£ 12.30", ".", 12.3},
+		{"1 234,5", ",", 1234.5},
+		{"1\u00a0234,5", ",", 1234.5},
+	}
+
+	for _, tt := range tests {
+		got, err := parseImportNumber(tt.in, tt.decimal)
+		if err != nil {
+			t.Errorf("parseImportNumber(%q, %q): %v", tt.in, tt.decimal, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseImportNumber(%q, %q) = %v, want %v", tt.in, tt.decimal, got, tt.want)
+		}
+	}
+}
+
+func TestParseImportNumberErrors(t *testing.T) {
+	tests := []struct {
+		in      string
+		decimal string
+	}{
+		{"abc", "."},
+		{"1,2x", ","},
+		{"12..5", "."},
+		{"--1", "."},
+		{",123", "."},
+		{",123", ","},
+		{"1,234,56", "."},
+		{"0,500", "."},
+		{"1234,567", "."},
+		{"1,234.5", ","},
+		{"1.5", ","},
+		{"1,5", "."},
+	}
+	for _, tt := range tests {
+		if got, err := parseImportNumber(tt.in, tt.decimal); err == nil {
+			t.Errorf("parseImportNumber(%q, %q) = %v, want an error", tt.in, tt.decimal, got)
+		}
+	}
+}
+
+func TestDetectDecimalSeparator(t *testing.T) {
+	tests := []struct {
+		numbers []string
+		want    string
+	}{
+		{nil, "."},
+		{[]string{"1,234", "12,345", ""}, "."},
+		{[]string{"1,234", "35.5", "10500"}, "."},
+		{[]string{"1,659", "35,5", "10500"}, ","},
+		{[]string{"0,500"}, ","},
+		{[]string{"1.234,5", "1,5", "2.5"}, ","},
+	}
+	for _, tt := range tests {
+		if got := detectDecimalSeparator(tt.numbers); got != tt.want {
+			t.Errorf("detectDecimalSeparator(%q) = %q, want %q", tt.numbers, got, tt.want)
+		}
+	}
+}
+
+const fuellyMetric = "\ufeffcar_name,model,l/100km,odometer,km,litres,price,city_percentage,fuelup_date,date_added,tags,notes,missed_fuelup,partial_fuelup,latitude,longitude,brand\n" +
+	"My Civic,2015 Honda Civic,7.1,10500,500,35.5,1.45,50,2024-02-01,2024-02-01,,\"note, with comma\",0,1,,,Shell\n" +
+	"My Civic,2015 Honda Civic,7.1,10000,0,30,1.40,50,2024-01-01,2024-01-01,work,,0,0,,,BP\n" +
+	"Van,Ford Transit,9,,400,40,1.5,0,2024-01-05,,,,0,0,,,\n" +
+	"Van,Ford Transit,9,,450,41,1.5,0,2024-01-20,,,,1,0,,,\n" +
+	"Van,Ford Transit,9,,450,x,1.5,0,2024-01-25,,,,1,0,,,\n" +
+	"Van,Ford Transit,9,,450,41,1.5,0,notadate,,,,1,0,,,\n"
+
+func TestFuellyParse(t *testing.T) {
+	if !(fuellyImporter{}).Detect([]byte(fuellyMetric)) {
+		t.Fatal("Fuelly export not detected")
+	}
+
+	batch, err := fuellyImporter{}.Parse([]byte(fuellyMetric), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Vehicles) != 2 {
+		t.Fatalf("%d vehicles, want 2", len(batch.Vehicles))
+	}
+	civic := batch.Vehicles[0]
+	if civic.Key != "My Civic" || civic.Year != 2015 || civic.Make != "Honda" || civic.Model != "Civic" {
+		t.Errorf("vehicle = %+v", civic)
+	}
+	if civic.DistanceUnit != "km" || civic.VolumeUnit != "l" {
+		t.Errorf("units = %s, %s, want km, l", civic.DistanceUnit, civic.VolumeUnit)
+	}
+
+	if len(batch.Fuel) != 4 {
+		t.Fatalf("%d fill-ups, want 4", len(batch.Fuel))
+	}
+	first := batch.Fuel[0]
+	if first.Odometer != 10500 || first.Volume != 35.5 || first.Cost != 51.48 {
+		t.Errorf("fill-up = %+v, want 10500 km, 35.5 l costing 51.48", first)
+	}
+	if !first.PartialFill || first.MissedFillup || first.Location != "Shell" || first.Notes != "note, with comma" {
+		t.Errorf("fill-up flags and text = %+v", first)
+	}
+	if !first.Date.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("date = %v", first.Date)
+	}
+	if notes := batch.Fuel[1].Notes; notes != "Tags: work" {
+		t.Errorf("notes = %q, want the tags", notes)
+	}
+	van := batch.Fuel[3]
+	if van.Vehicle != "Van" || van.Odometer != 0 || van.Distance != 450 || !van.MissedFillup {
+		t.Errorf("trip fill-up = %+v", van)
+	}
+
+	if len(batch.Warnings) != 2 || batch.Warnings[0].Row != 6 || batch.Warnings[1].Row != 7 {
+		t.Errorf("warnings = %+v, want rows 6 and 7", batch.Warnings)
+	}
+}
+
+// fuellyDecimalComma is a metric Fuelly export written with decimal commas,
+// where "1,659" is a price per litre rather than 1659
+const fuellyDecimalComma = "car_name,model,l/100km,odometer,km,litres,price,fuelup_date\n" +
+	"Golf,2019 VW Golf,\"6,2\",\"12.500\",600,\"35,5\",\"1,659\",2024-03-01\n" +
+	"Golf,2019 VW Golf,\"6,4\",\"13.100\",600,\"0,500\",\"1,7\",2024-03-20\n"
+
+func TestFuellyParseDecimalComma(t *testing.T) {
+	batch, err := fuellyImporter{}.Parse([]byte(fuellyDecimalComma), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Fuel) != 2 || len(batch.Warnings) != 0 {
+		t.Fatalf("fill-ups = %+v, warnings = %+v", batch.Fuel, batch.Warnings)
+	}
+	if f := batch.Fuel[0]; f.Odometer != 12500 || f.Volume != 35.5 || f.Cost != 58.89 {
+		t.Errorf("fill-up = %+v, want 12500 km, 35.5 l costing 58.89", f)
+	}
+	if f := batch.Fuel[1]; f.Odometer != 13100 || f.Volume != 0.5 || f.Cost != 0.85 {
+		t.Errorf("fill-up = %+v, want 13100 km, 0.5 l costing 0.85", f)
+	}
+
+	// The option overrides what the file looks like
+	batch, err = fuellyImporter{}.Parse([]byte(fuellyDecimalComma), ImportOptions{DecimalSeparator: "."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Fuel) != 0 || len(batch.Warnings) != 2 {
+		t.Errorf("with a decimal point: fill-ups = %+v, warnings = %+v", batch.Fuel, batch.Warnings)
+	}
+}
+
+func TestFuellyParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no volume", "car_name,odometer,fuelup_date\nGolf,100,2024-01-01\n"},
+		{"no distance", "car_name,gallons,fuelup_date\nGolf,10,2024-01-01\n"},
+	}
+
+	for _, tt := range tests {
+		if _, err := (fuellyImporter{}).Parse([]byte(tt.body), ImportOptions{}); err == nil {
+			t.Errorf("%s: parsed without an error", tt.name)
+		}
+	}
+}
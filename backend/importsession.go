@@ -0,0 +1,572 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Two-phase imports. Uploading to /import/preview parses the file without
+// writing anything and keeps it in an import session. The user adjusts the
+// options (vehicle mapping, CSV columns, date format, units), getting a new
+// preview each time, then commits the session in one transaction. Sessions
+// are kept in memory and expire after a period without use.
+
+// ImportSession is an upload waiting to be committed
+type ImportSession struct {
+	ID         string
+	UserID     uint
+	Format     string
+	Filename   string
+	Body       []byte
+	Options    ImportOptions
+	ExpiresAt  time.Time
+	committing bool
+
+	// The last dry run and the options and vehicle mapping it was run with
+	dryRunKey    string
+	dryRun       ImportResult
+	dryRunFailed string
+}
+
+// ImportSessions holds the open sessions. Each user keeps at most
+// maxPerUser; starting another drops their oldest.
+type ImportSessions struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxPerUser int
+	sessions   map[string]*ImportSession
+}
+
+func NewImportSessions(ttl time.Duration, maxPerUser int) *ImportSessions {
+	return &ImportSessions{
+		ttl:        ttl,
+		maxPerUser: maxPerUser,
+		sessions:   make(map[string]*ImportSession),
+	}
+}
+
+// purge drops expired sessions. The caller holds the lock.
+func (s *ImportSessions) purge(now time.Time) {
+	for id, session := range s.sessions {
+		if now.After(session.ExpiresAt) && !session.committing {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Purge drops expired sessions and returns how many there were
+func (s *ImportSessions) Purge() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := len(s.sessions)
+	s.purge(time.Now())
+	return before - len(s.sessions)
+}
+
+func (s *ImportSessions) Create(userID uint, format, filename string, body []byte, opts ImportOptions) ImportSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.purge(now)
+
+	var own []*ImportSession
+	for _, session := range s.sessions {
+		if session.UserID == userID && !session.committing {
+			own = append(own, session)
+		}
+	}
+	sort.Slice(own, func(i, j int) bool { return own[i].ExpiresAt.Before(own[j].ExpiresAt) })
+	for len(own) >= s.maxPerUser {
+		delete(s.sessions, own[0].ID)
+		own = own[1:]
+	}
+
+	session := &ImportSession{
+		ID:        randomToken(16),
+		UserID:    userID,
+		Format:    format,
+		Filename:  filename,
+		Body:      body,
+		Options:   opts,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	s.sessions[session.ID] = session
+	return *session
+}
+
+// Get returns one of the user's sessions, extending its expiry
+func (s *ImportSessions) Get(userID uint, id string) (ImportSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.purge(now)
+
+	session, ok := s.sessions[id]
+	if !ok || session.UserID != userID {
+		return ImportSession{}, false
+	}
+	session.ExpiresAt = now.Add(s.ttl)
+	return *session, true
+}
+
+func (s *ImportSessions) SetOptions(userID uint, id string, opts ImportOptions) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.UserID != userID {
+		return false
+	}
+	session.Options = opts
+	return true
+}
+
+// SetDryRun keeps a dry run's outcome, so previews with the same options,
+// vehicle mapping and existing data don't run it again
+func (s *ImportSessions) SetDryRun(userID uint, id, key string, result ImportResult, failed string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.UserID != userID {
+		return
+	}
+	session.dryRunKey = key
+	session.dryRun = result
+	session.dryRunFailed = failed
+}
+
+// Begin marks a session as being committed so it can't be committed twice.
+// busy is true when a commit is already running.
+func (s *ImportSessions) Begin(userID uint, id string) (session ImportSession, found, busy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(time.Now())
+
+	current, ok := s.sessions[id]
+	if !ok || current.UserID != userID {
+		return ImportSession{}, false, false
+	}
+	if current.committing {
+		return ImportSession{}, true, true
+	}
+	current.committing = true
+	return *current, true, false
+}
+
+// Finish ends a commit. A committed session is removed; after a failure it
+// stays open so the user can adjust it and try again.
+func (s *ImportSessions) Finish(id string, committed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return
+	}
+	if committed {
+		delete(s.sessions, id)
+		return
+	}
+	session.committing = false
+	session.ExpiresAt = time.Now().Add(s.ttl)
+}
+
+func (s *ImportSessions) Delete(userID uint, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.UserID != userID || session.committing {
+		return false
+	}
+	delete(s.sessions, id)
+	return true
+}
+
+type importPreviewVehicle struct {
+	ImportVehicle
+	VehicleID uint `json:"vehicle_id"` // Existing vehicle the records go to, 0 creates the vehicle
+	Fuel      int  `json:"fuel"`
+	Expenses  int  `json:"expenses"`
+	Reminders int  `json:"reminders"`
+}
+
+// ImportPreview shows what committing a session would write
+type ImportPreview struct {
+	ID        string                 `json:"id"`
+	Format    string                 `json:"format"`
+	Filename  string                 `json:"filename"`
+	ExpiresAt time.Time              `json:"expires_at"`
+	Options   ImportOptions          `json:"options"`
+	Error     string                 `json:"error,omitempty"`   // Why the file can't be imported with these options
+	Header    []string               `json:"header,omitempty"`  // CSV formats: the file's columns
+	Columns   map[string]string      `json:"columns,omitempty"` // CSV formats: field to the column it's read from
+	Vehicles  []importPreviewVehicle `json:"vehicles"`
+	Counts    map[string]int         `json:"counts"`
+	Fuel      []ImportFuel           `json:"fuel"`      // The first rows
+	Expenses  []ImportExpense        `json:"expenses"`  // The first rows
+	Reminders []ImportReminder       `json:"reminders"` // The first rows
+	Warnings  []ImportWarning        `json:"warnings"`
+	Result    *ImportResult          `json:"result,omitempty"` // What commit would write, from a dry run
+}
+
+// previewImport parses a session's upload with its options and, if it can
+// be imported, does a dry run of the import
+func (app *Application) previewImport(session ImportSession, vehicles []Vehicle, rows int) (ImportPreview, error) {
+	preview := ImportPreview{
+		ID:        session.ID,
+		Format:    session.Format,
+		Filename:  session.Filename,
+		ExpiresAt: session.ExpiresAt,
+		Options:   session.Options,
+		Vehicles:  []importPreviewVehicle{},
+		Fuel:      []ImportFuel{},
+		Expenses:  []ImportExpense{},
+		Reminders: []ImportReminder{},
+		Warnings:  []ImportWarning{},
+	}
+
+	if session.Format == "clarkson" {
+		backup, _, err := loadClarksonUpload(session.Body)
+		if err != nil {
+			return preview, err
+		}
+		previewBackup(&preview, backup, rows)
+		return preview, nil
+	}
+
+	batch, err := parseImport(session.Format, session.Body, session.Options)
+	if batch == nil {
+		return preview, err
+	}
+	if err != nil {
+		preview.Error = err.Error()
+	}
+	preview.Header = batch.Header
+	preview.Columns = batch.Columns
+
+	vehicleMap, err := proposeVehicleMap(vehicles, batch, session.Options.VehicleMap)
+	if err != nil {
+		return preview, err
+	}
+
+	fuel := make(map[string]int)
+	for _, f := range batch.Fuel {
+		fuel[f.Vehicle]++
+	}
+	expenses := make(map[string]int)
+	for _, e := range batch.Expenses {
+		expenses[e.Vehicle]++
+	}
+	reminders := make(map[string]int)
+	for _, r := range batch.Reminders {
+		reminders[r.Vehicle]++
+	}
+	for _, iv := range batch.Vehicles {
+		preview.Vehicles = append(preview.Vehicles, importPreviewVehicle{
+			ImportVehicle: iv,
+			VehicleID:     vehicleMap[iv.Key],
+			Fuel:          fuel[iv.Key],
+			Expenses:      expenses[iv.Key],
+			Reminders:     reminders[iv.Key],
+		})
+	}
+
+	preview.Counts = map[string]int{
+		"vehicles":    len(batch.Vehicles),
+		"fuel":        len(batch.Fuel),
+		"expenses":    len(batch.Expenses),
+		"reminders":   len(batch.Reminders),
+		"attachments": len(batch.Attachments),
+	}
+	preview.Fuel = append(preview.Fuel, batch.Fuel[:min(rows, len(batch.Fuel))]...)
+	preview.Expenses = append(preview.Expenses, batch.Expenses[:min(rows, len(batch.Expenses))]...)
+	preview.Reminders = append(preview.Reminders, batch.Reminders[:min(rows, len(batch.Reminders))]...)
+	preview.Warnings = append(preview.Warnings, batch.Warnings...)
+
+	if preview.Error == "" {
+		result, failed := app.sessionDryRun(session, batch, vehicles, vehicleMap)
+		if failed != "" {
+			preview.Error = failed
+		} else {
+			preview.Result = &result
+		}
+	}
+	return preview, nil
+}
+
+// sessionDryRun returns what committing the session would write. The dry
+// run is a rolled-back write of the whole file, so its outcome is kept on
+// the session and only run again when the options or vehicle mapping
+// change, or the vehicles mapped to change along with their records.
+func (app *Application) sessionDryRun(session ImportSession, batch *ImportBatch, vehicles []Vehicle, vehicleMap map[string]uint) (ImportResult, string) {
+	version, err := app.mappedDataVersion(vehicleMap)
+	var key []byte
+	if err == nil {
+		key, err = json.Marshal(struct {
+			Options    ImportOptions
+			VehicleMap map[string]uint
+			Data       string
+		}{session.Options, vehicleMap, version})
+	}
+	if err == nil && session.dryRunKey != "" && session.dryRunKey == string(key) {
+		return session.dryRun, session.dryRunFailed
+	}
+
+	var failed string
+	result, err := app.writeImport(session.UserID, batch, vehicles, vehicleMap, session.Options, true)
+	if err != nil {
+		failed = err.Error()
+	}
+	if app.imports != nil {
+		app.imports.SetDryRun(session.UserID, session.ID, string(key), result, failed)
+	}
+	return result, failed
+}
+
+// mappedDataVersion describes the vehicles an import is mapped to and their
+// fuel entries, expenses and reminders by count and last update, so it
+// changes whenever any of them are added, edited or deleted
+func (app *Application) mappedDataVersion(vehicleMap map[string]uint) (string, error) {
+	var ids []uint
+	for _, id := range vehicleMap {
+		if id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+
+	var version []string
+	for _, model := range []interface{}{&Vehicle{}, &FuelEntry{}, &Expense{}, &MaintenanceReminder{}} {
+		column := "vehicle_id"
+		if _, ok := model.(*Vehicle); ok {
+			column = "id"
+		}
+		var row struct {
+			Count  int64
+			Latest sql.NullString
+		}
+		if err := app.db.Model(model).
+			Select("COUNT(*) AS count, MAX(updated_at) AS latest").
+			Where(column+" IN ?", ids).
+			Scan(&row).Error; err != nil {
+			return "", err
+		}
+		version = append(version, fmt.Sprintf("%d@%s", row.Count, row.Latest.String))
+	}
+	return strings.Join(version, ","), nil
+}
+
+// previewBackup describes a Clarkson backup. Backups are always restored as
+// new vehicles, so there's nothing to map.
+func previewBackup(preview *ImportPreview, backup Backup, rows int) {
+	key := func(id uint) string {
+		return strconv.FormatUint(uint64(id), 10)
+	}
+
+	fuel := make(map[uint]int)
+	for _, f := range backup.FuelEntries {
+		fuel[f.VehicleID]++
+	}
+	expenses := make(map[uint]int)
+	for _, e := range backup.Expenses {
+		expenses[e.VehicleID]++
+	}
+	for _, bv := range backup.Vehicles {
+		preview.Vehicles = append(preview.Vehicles, importPreviewVehicle{
+			ImportVehicle: ImportVehicle{
+				Key:          key(bv.ID),
+				Make:         bv.Make,
+				Model:        bv.Model,
+				Year:         bv.Year,
+				FuelType:     bv.FuelType,
+				DistanceUnit: bv.MileageUnit,
+			},
+			Fuel:     fuel[bv.ID],
+			Expenses: expenses[bv.ID],
+		})
+	}
+
+	preview.Counts = map[string]int{
+		"vehicles":      len(backup.Vehicles),
+		"fuel":          len(backup.FuelEntries),
+		"expenses":      len(backup.Expenses),
+		"reminders":     len(backup.Reminders),
+		"notifications": len(backup.Notifications),
+		"shares":        len(backup.Shares),
+		"attachments":   len(backup.Attachments),
+	}
+
+	for _, f := range backup.FuelEntries[:min(rows, len(backup.FuelEntries))] {
+		preview.Fuel = append(preview.Fuel, ImportFuel{
+			ID:           key(f.ID),
+			Vehicle:      key(f.VehicleID),
+			Date:         f.Date,
+			Odometer:     f.Odometer,
+			Volume:       f.Gallons,
+			Cost:         f.Price,
+			PartialFill:  f.PartialFill,
+			MissedFillup: f.MissedFillup,
+			Location:     f.Location,
+			Notes:        f.Notes,
+		})
+	}
+	for _, e := range backup.Expenses[:min(rows, len(backup.Expenses))] {
+		preview.Expenses = append(preview.Expenses, ImportExpense{
+			ID:       key(e.ID),
+			Vehicle:  key(e.VehicleID),
+			Date:     e.Date,
+			Category: e.Category,
+			Amount:   e.Amount,
+			Notes:    e.Notes,
+		})
+	}
+}
+
+// respondPreview responds with the preview of a session. ?rows= sets how
+// many fuel and expense rows are included (default 20).
+func (app *Application) respondPreview(c *gin.Context, session ImportSession) bool {
+	vehicles, err := app.accessibleVehicles(session.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load vehicles"})
+		return false
+	}
+
+	rows := 20
+	if n, err := strconv.Atoi(c.Query("rows")); err == nil && n >= 0 {
+		rows = min(n, 500)
+	}
+
+	preview, err := app.previewImport(session, vehicles, rows)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return false
+	}
+	c.JSON(200, preview)
+	return true
+}
+
+// previewUpload starts an import session. Form fields: file, format
+// (fuelly, hammond, lubelogger, fuelio, drivvo or clarkson; detected when
+// empty) and options, a JSON
+// ImportOptions.
+func (app *Application) previewUpload(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	body, filename, opts, ok := app.readImportUpload(c)
+	if !ok {
+		return
+	}
+
+	format := c.PostForm("format")
+	if format == "" {
+		format = detectImportFormat(body)
+	}
+	if _, ok := findImporter(format); !ok && format != "clarkson" {
+		c.JSON(400, gin.H{"error": "Unknown import format: " + format})
+		return
+	}
+	if format == "clarkson" && len(opts.VehicleMap) > 0 {
+		c.JSON(400, gin.H{"error": "Backups are always restored as new vehicles"})
+		return
+	}
+
+	session := app.imports.Create(userID, format, filename, body, opts)
+	if !app.respondPreview(c, session) {
+		app.imports.Delete(userID, session.ID)
+	}
+}
+
+func (app *Application) getImportSession(c *gin.Context) {
+	session, ok := app.imports.Get(c.GetUint("userID"), c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "Import session not found or expired"})
+		return
+	}
+	app.respondPreview(c, session)
+}
+
+// updateImportSession replaces the session's options and responds with the
+// new preview. Options the file can't be read with are rejected and the
+// previous ones kept.
+func (app *Application) updateImportSession(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var opts ImportOptions
+	if err := c.ShouldBindJSON(&opts); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := opts.validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, ok := app.imports.Get(userID, c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "Import session not found or expired"})
+		return
+	}
+	if session.Format == "clarkson" && len(opts.VehicleMap) > 0 {
+		c.JSON(400, gin.H{"error": "Backups are always restored as new vehicles"})
+		return
+	}
+
+	session.Options = opts
+	if app.respondPreview(c, session) {
+		app.imports.SetOptions(userID, session.ID, opts)
+	}
+}
+
+// commitImportSession writes the session's upload in one transaction and
+// closes the session. A failed commit leaves the session open.
+func (app *Application) commitImportSession(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	session, found, busy := app.imports.Begin(userID, c.Param("id"))
+	if !found {
+		c.JSON(404, gin.H{"error": "Import session not found or expired"})
+		return
+	}
+	if busy {
+		c.JSON(409, gin.H{"error": "Import is already being committed"})
+		return
+	}
+
+	committed := false
+	defer func() { app.imports.Finish(session.ID, committed) }()
+
+	if session.Format == "clarkson" {
+		backup, files, err := loadClarksonUpload(session.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		committed = app.restoreBackup(c, userID, backup, files, session.Options.Strict)
+		return
+	}
+
+	committed = app.runImport(c, session.Format, session.Body, session.Options)
+}
+
+func (app *Application) deleteImportSession(c *gin.Context) {
+	if !app.imports.Delete(c.GetUint("userID"), c.Param("id")) {
+		c.JSON(404, gin.H{"error": "Import session not found or expired"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Import cancelled"})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const tripOnlyFuelly = `car_name,model,fuelup_date,miles,gallons,price
+Golf,VW Golf,2025-01-05,300,10,3.50
+Golf,VW Golf,2025-01-20,250,9,3.60
+`
+
+func TestPreviewCachesDryRun(t *testing.T) {
+	app := newTestApp(t)
+	app.imports = NewImportSessions(time.Minute, 3)
+	user := User{Email: "driver@example.com"}
+	app.db.Create(&user)
+
+	// Dry runs create rows before rolling back; count them
+	creates := 0
+	app.db.Callback().Create().Before("gorm:create").Register("test:count_creates", func(*gorm.DB) { creates++ })
+
+	session := app.imports.Create(user.ID, "fuelly", "fuelly.csv", []byte(tripOnlyFuelly), ImportOptions{})
+	preview := func() ImportPreview {
+		t.Helper()
+		current, ok := app.imports.Get(user.ID, session.ID)
+		if !ok {
+			t.Fatal("session gone")
+		}
+		vehicles, _ := app.accessibleVehicles(user.ID)
+		p, err := app.previewImport(current, vehicles, 20)
+		if err != nil || p.Error != "" || p.Result == nil {
+			t.Fatalf("preview: %v %q", err, p.Error)
+		}
+		return p
+	}
+
+	first := preview()
+	if creates == 0 {
+		t.Fatal("the first preview didn't dry run")
+	}
+	if first.Result.Imported["fuel"] != 2 {
+		t.Errorf("dry run imported %d fill-ups, want 2", first.Result.Imported["fuel"])
+	}
+
+	before := creates
+	second := preview()
+	if creates != before {
+		t.Errorf("the same options ran the dry run again (%d creates)", creates-before)
+	}
+	if second.Result.Imported["fuel"] != 2 {
+		t.Errorf("cached dry run imported %d fill-ups, want 2", second.Result.Imported["fuel"])
+	}
+
+	app.imports.SetOptions(user.ID, session.ID, ImportOptions{DistanceUnit: "km"})
+	preview()
+	if creates == before {
+		t.Error("new options didn't run the dry run again")
+	}
+
+	vehicle := Vehicle{UserID: user.ID, Make: "VW", Model: "Golf"}
+	app.db.Create(&vehicle)
+	before = creates
+	p := preview()
+	if creates == before {
+		t.Error("a new vehicle mapping didn't run the dry run again")
+	}
+	if p.Result.Imported["matched_vehicles"] != 1 {
+		t.Errorf("matched %d vehicles, want 1", p.Result.Imported["matched_vehicles"])
+	}
+
+	// Changes to the matched vehicle's records can change what the import
+	// would skip or merge
+	before = creates
+	preview()
+	if creates != before {
+		t.Error("the same mapping and data ran the dry run again")
+	}
+	entry := FuelEntry{VehicleID: vehicle.ID, Date: time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC), Gallons: 10, Price: 35}
+	changes := []struct {
+		name   string
+		change func()
+	}{
+		{"a new fill-up", func() { app.db.Create(&entry) }},
+		{"an edited fill-up", func() { app.db.Model(&entry).Update("price", 36) }},
+		{"a deleted fill-up", func() { app.db.Delete(&entry) }},
+		{"an edited vehicle", func() { app.db.Model(&vehicle).Update("odometer", 500) }},
+	}
+	for _, c := range changes {
+		c.change()
+		before = creates
+		preview()
+		if creates == before {
+			t.Errorf("%s didn't run the dry run again", c.name)
+		}
+	}
+}
+
+func TestTripDistancesStartFromVehicleOdometer(t *testing.T) {
+	tests := []struct {
+		name      string
+		unit      string
+		odometer  float64
+		fileUnit  string
+		want      []float64
+		wantFinal float64
+	}{
+		{"same unit", "mi", 12000, "", []float64{12300, 12550}, 12550},
+		{"vehicle in km", "km", 20000, "mi", []float64{20482.8, 20885.1}, 20885.1},
+		{"new odometer", "mi", 0, "", []float64{300, 550}, 550},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			user := User{Email: "driver@example.com"}
+			app.db.Create(&user)
+			vehicle := Vehicle{UserID: user.ID, Make: "VW", Model: "Golf", MileageUnit: tt.unit, Odometer: tt.odometer}
+			app.db.Create(&vehicle)
+
+			opts := ImportOptions{VehicleMap: map[string]uint{"Golf": vehicle.ID}, DistanceUnit: tt.fileUnit}
+			batch, err := parseImport("fuelly", []byte(tripOnlyFuelly), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vehicles, _ := app.accessibleVehicles(user.ID)
+			if _, err := app.writeImport(user.ID, batch, vehicles, opts.VehicleMap, opts, false); err != nil {
+				t.Fatal(err)
+			}
+
+			var entries []FuelEntry
+			app.db.Where("vehicle_id = ?", vehicle.ID).Order("date").Find(&entries)
+			if len(entries) != len(tt.want) {
+				t.Fatalf("%d entries, want %d", len(entries), len(tt.want))
+			}
+			for i, e := range entries {
+				if e.Odometer != tt.want[i] {
+					t.Errorf("entry %d odometer = %v, want %v", i, e.Odometer, tt.want[i])
+				}
+			}
+			app.db.First(&vehicle, vehicle.ID)
+			if vehicle.Odometer != tt.wantFinal {
+				t.Errorf("vehicle odometer = %v, want %v", vehicle.Odometer, tt.wantFinal)
+			}
+		})
+	}
+}
@@ -0,0 +1,990 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The interchange format is a documented, stable layout for moving fuel
+// entries, expenses, services and reminders in and out of Clarkson from
+// scripts and spreadsheets. It comes as a JSON file, described by the JSON
+// Schema at /api/interchange/schema, or as a flat CSV file with a type
+// column and one column per field. Both are read and written from the
+// record definitions below, so the schema, validation and export always
+// agree.
+
+const interchangeFormat = "clarkson-interchange"
+const interchangeVersion = 1
+
+// interchangeField is one field of a record
+type interchangeField struct {
+	name        string
+	kind        string // string, number, integer, boolean or date
+	required    bool
+	positive    bool     // Numbers must be more than 0; other numbers can't be negative
+	enum        []string // Allowed values of a string
+	description string
+}
+
+// interchangeRecord is a kind of record: the CSV type column, and the array
+// it's listed in in a JSON file
+type interchangeRecord struct {
+	name        string
+	list        string
+	description string
+	fields      []interchangeField
+}
+
+var interchangeRecords = []interchangeRecord{
+	{
+		name:        "vehicle",
+		list:        "vehicles",
+		description: "A vehicle. Records for a vehicle that isn't listed go to one of your vehicles with that name, or a new one.",
+		fields: []interchangeField{
+			{name: "vehicle", kind: "string", required: true, description: "Name the other records use for the vehicle"},
+			{name: "make", kind: "string", required: true},
+			{name: "model", kind: "string", required: true},
+			{name: "year", kind: "integer"},
+			{name: "fuel_type", kind: "string", description: "Petrol, Diesel, Electric, Hybrid, ..."},
+			{name: "distance_unit", kind: "string", enum: []string{"mi", "km"}, description: "Unit of odometer readings and distances; the vehicle's own when empty"},
+			{name: "volume_unit", kind: "string", enum: []string{"l", "gal", "imp_gal"}, description: "Unit of fuel volumes; the vehicle's own when empty"},
+		},
+	},
+	{
+		name:        "fuel",
+		list:        "fuel",
+		description: "A fill-up",
+		fields: []interchangeField{
+			{name: "id", kind: "string", description: "Your reference, repeated in warnings"},
+			{name: "vehicle", kind: "string", required: true},
+			{name: "date", kind: "date", required: true},
+			{name: "odometer", kind: "number", description: "Odometer reading; either this or distance is needed"},
+			{name: "distance", kind: "number", description: "Distance since the last fill-up, used when there's no odometer reading"},
+			{name: "volume", kind: "number", required: true, positive: true},
+			{name: "cost", kind: "number", description: "Total cost"},
+			{name: "partial_fill", kind: "boolean", description: "The tank wasn't filled"},
+			{name: "missed_fillup", kind: "boolean", description: "A fill-up before this one wasn't recorded"},
+			{name: "location", kind: "string"},
+			{name: "notes", kind: "string"},
+		},
+	},
+	{
+		name:        "expense",
+		list:        "expenses",
+		description: "An expense other than fuel",
+		fields: []interchangeField{
+			{name: "id", kind: "string", description: "Your reference, repeated in warnings"},
+			{name: "vehicle", kind: "string", required: true},
+			{name: "date", kind: "date", required: true},
+			{name: "category", kind: "string", required: true, description: "Maintenance, Insurance, Registration, Parking, Tolls, Other or your own"},
+			{name: "amount", kind: "number", required: true},
+			{name: "odometer", kind: "number", description: "Kept in the notes"},
+			{name: "notes", kind: "string"},
+		},
+	},
+	{
+		name:        "service",
+		list:        "services",
+		description: "Work done on the vehicle, recorded as a Maintenance expense",
+		fields: []interchangeField{
+			{name: "id", kind: "string", description: "Your reference, repeated in warnings"},
+			{name: "vehicle", kind: "string", required: true},
+			{name: "date", kind: "date", required: true},
+			{name: "description", kind: "string", required: true, description: "What was done"},
+			{name: "cost", kind: "number", required: true},
+			{name: "odometer", kind: "number", description: "Kept in the notes"},
+			{name: "notes", kind: "string"},
+		},
+	},
+	{
+		name:        "reminder",
+		list:        "reminders",
+		description: "A maintenance reminder, repeating every interval from the last service or due once. Needs an interval, a due date or a due odometer reading.",
+		fields: []interchangeField{
+			{name: "id", kind: "string", description: "Your reference, repeated in warnings"},
+			{name: "vehicle", kind: "string", required: true},
+			{name: "name", kind: "string", required: true},
+			{name: "interval_distance", kind: "number"},
+			{name: "interval_days", kind: "integer"},
+			{name: "last_date", kind: "date", description: "Last service, where intervals are counted from"},
+			{name: "last_odometer", kind: "number"},
+			{name: "due_date", kind: "date", description: "One-off reminder by date"},
+			{name: "due_odometer", kind: "number", description: "One-off reminder by odometer reading"},
+		},
+	},
+}
+
+func findInterchangeRecord(match func(r interchangeRecord) bool) (interchangeRecord, bool) {
+	for _, r := range interchangeRecords {
+		if match(r) {
+			return r, true
+		}
+	}
+	return interchangeRecord{}, false
+}
+
+func (r interchangeRecord) field(name string) (interchangeField, bool) {
+	for _, f := range r.fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return interchangeField{}, false
+}
+
+// interchangeColumns are the CSV columns: type, then every field once
+func interchangeColumns() []string {
+	columns := []string{"type"}
+	seen := map[string]bool{"type": true}
+	for _, r := range interchangeRecords {
+		for _, f := range r.fields {
+			if !seen[f.name] {
+				seen[f.name] = true
+				columns = append(columns, f.name)
+			}
+		}
+	}
+	return columns
+}
+
+// schema describes the field in JSON Schema
+func (f interchangeField) schema() gin.H {
+	s := gin.H{}
+	switch f.kind {
+	case "date":
+		s["type"] = "string"
+		s["pattern"] = `^\d{4}-\d{2}-\d{2}`
+		s["description"] = "YYYY-MM-DD date or RFC 3339 date-time"
+	case "number", "integer":
+		s["type"] = f.kind
+		if f.positive {
+			s["exclusiveMinimum"] = 0
+		} else {
+			s["minimum"] = 0
+		}
+	default:
+		s["type"] = f.kind
+	}
+	if f.kind == "string" && f.required {
+		s["minLength"] = 1
+	}
+	if len(f.enum) > 0 {
+		s["enum"] = f.enum
+	}
+	if f.description != "" {
+		if s["description"] != nil {
+			s["description"] = f.description + " (" + s["description"].(string) + ")"
+		} else {
+			s["description"] = f.description
+		}
+	}
+	return s
+}
+
+// interchangeSchemaDocument is the JSON Schema of an interchange JSON file
+func interchangeSchemaDocument() gin.H {
+	defs := gin.H{}
+	properties := gin.H{
+		"format":  gin.H{"const": interchangeFormat},
+		"version": gin.H{"type": "integer", "minimum": 1, "maximum": interchangeVersion},
+	}
+	for _, r := range interchangeRecords {
+		fields := gin.H{}
+		required := []string{}
+		for _, f := range r.fields {
+			fields[f.name] = f.schema()
+			if f.required {
+				required = append(required, f.name)
+			}
+		}
+		defs[r.name] = gin.H{
+			"type":                 "object",
+			"description":          r.description,
+			"properties":           fields,
+			"required":             required,
+			"additionalProperties": false,
+		}
+		properties[r.list] = gin.H{"type": "array", "items": gin.H{"$ref": "#/$defs/" + r.name}}
+	}
+
+	return gin.H{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "Clarkson interchange file",
+		"description": fmt.Sprintf("Version %d. The CSV variant has a type column (vehicle, fuel, expense, service or reminder) "+
+			"and a column for each field, named as here: %s. Cells for fields a type doesn't have are left empty.",
+			interchangeVersion, strings.Join(interchangeColumns()[1:], ", ")),
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+		"$defs":                defs,
+	}
+}
+
+// interchangeSchema publishes the JSON Schema (no auth)
+func (app *Application) interchangeSchema(c *gin.Context) {
+	c.Header("Content-Type", "application/schema+json")
+	c.JSON(200, interchangeSchemaDocument())
+}
+
+func parseInterchangeDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("must be a YYYY-MM-DD date or an RFC 3339 date-time")
+}
+
+// fromJSON reads the field from a decoded JSON value
+func (f interchangeField) fromJSON(raw interface{}) (interface{}, error) {
+	switch f.kind {
+	case "number", "integer":
+		n, ok := raw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("must be a number")
+		}
+		if f.kind == "integer" {
+			if n != math.Trunc(n) {
+				return nil, fmt.Errorf("must be a whole number")
+			}
+			return f.check(int(n))
+		}
+		return f.check(n)
+	case "boolean":
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		return b, nil
+	}
+
+	s, ok := raw.(string)
+	if !ok {
+		return nil, fmt.Errorf("must be a string")
+	}
+	if f.kind == "date" {
+		return parseInterchangeDate(s)
+	}
+	return f.check(s)
+}
+
+// fromCSV reads the field from a CSV cell
+func (f interchangeField) fromCSV(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	switch f.kind {
+	case "number":
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return f.check(n)
+	case "integer":
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("must be a whole number")
+		}
+		return f.check(n)
+	case "boolean":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		return b, nil
+	case "date":
+		return parseInterchangeDate(s)
+	}
+	return f.check(s)
+}
+
+// check applies the field's limits to a value
+func (f interchangeField) check(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case float64:
+		if f.positive && v <= 0 {
+			return nil, fmt.Errorf("must be more than 0")
+		}
+		if v < 0 {
+			return nil, fmt.Errorf("can't be negative")
+		}
+	case int:
+		if v < 0 {
+			return nil, fmt.Errorf("can't be negative")
+		}
+	case string:
+		if len(f.enum) > 0 {
+			for _, allowed := range f.enum {
+				if v == allowed {
+					return v, nil
+				}
+			}
+			return nil, fmt.Errorf("must be one of %s", strings.Join(f.enum, ", "))
+		}
+	}
+	return value, nil
+}
+
+// interchangeValues are a record's fields, read into strings, float64s,
+// ints, bools and time.Times
+type interchangeValues map[string]interface{}
+
+func (v interchangeValues) str(name string) string {
+	s, _ := v[name].(string)
+	return strings.TrimSpace(s)
+}
+
+func (v interchangeValues) num(name string) float64 {
+	switch n := v[name].(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	}
+	return 0
+}
+
+func (v interchangeValues) flag(name string) bool {
+	b, _ := v[name].(bool)
+	return b
+}
+
+func (v interchangeValues) date(name string) *time.Time {
+	t, ok := v[name].(time.Time)
+	if !ok {
+		return nil
+	}
+	return &t
+}
+
+// interchangeReader validates records and adds them to a batch
+type interchangeReader struct {
+	batch    *ImportBatch
+	declared map[string]bool
+	used     []string // Vehicles records refer to, in order
+}
+
+func (r *interchangeReader) warn(line int, kind, id, field, message string) {
+	r.batch.Warnings = append(r.batch.Warnings, ImportWarning{Row: line, Type: kind, ID: id, Field: field, Message: message})
+}
+
+// add checks a record's fields, given as JSON values or CSV cells, and adds
+// it to the batch. Every problem with the record is a warning and the
+// record is skipped.
+func (r *interchangeReader) add(line int, record interchangeRecord, raw map[string]interface{}, read func(f interchangeField, raw interface{}) (interface{}, error)) {
+	id, _ := raw["id"].(string)
+	values := interchangeValues{}
+	valid := true
+
+	var unknown []string
+	for name := range raw {
+		if _, ok := record.field(name); !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		r.warn(line, record.name, id, name, fmt.Sprintf("%s records have no %s field", record.name, name))
+		valid = false
+	}
+
+	for _, f := range record.fields {
+		value, present := raw[f.name]
+		if present {
+			v, err := read(f, value)
+			if err != nil {
+				r.warn(line, record.name, id, f.name, err.Error())
+				valid = false
+				continue
+			}
+			values[f.name] = v
+		}
+		if f.required && (!present || f.kind == "string" && values.str(f.name) == "") {
+			r.warn(line, record.name, id, f.name, "is required")
+			valid = false
+		}
+	}
+	if !valid {
+		return
+	}
+
+	key := values.str("vehicle")
+	switch record.name {
+	case "vehicle":
+		if r.declared[key] {
+			r.warn(line, record.name, id, "vehicle", fmt.Sprintf("vehicle %q is listed twice", key))
+			return
+		}
+		r.declared[key] = true
+		iv := ImportVehicle{
+			Key:          key,
+			Make:         values.str("make"),
+			Model:        values.str("model"),
+			Year:         int(values.num("year")),
+			FuelType:     values.str("fuel_type"),
+			DistanceUnit: values.str("distance_unit"),
+			VolumeUnit:   values.str("volume_unit"),
+		}
+		iv.Match = []string{key, iv.Make + " " + iv.Model}
+		if iv.Year > 0 {
+			iv.Match = append(iv.Match, fmt.Sprintf("%d %s %s", iv.Year, iv.Make, iv.Model))
+		}
+		r.batch.Vehicles = append(r.batch.Vehicles, iv)
+		return
+
+	case "fuel":
+		if values.num("odometer") <= 0 && values.num("distance") <= 0 {
+			r.warn(line, record.name, id, "odometer", "needs an odometer reading or distance")
+			return
+		}
+		r.batch.Fuel = append(r.batch.Fuel, ImportFuel{
+			Row:          line,
+			ID:           id,
+			Vehicle:      key,
+			Date:         *values.date("date"),
+			Odometer:     values.num("odometer"),
+			Distance:     values.num("distance"),
+			Volume:       values.num("volume"),
+			Cost:         values.num("cost"),
+			PartialFill:  values.flag("partial_fill"),
+			MissedFillup: values.flag("missed_fillup"),
+			Location:     values.str("location"),
+			Notes:        values.str("notes"),
+		})
+
+	case "expense", "service":
+		e := ImportExpense{
+			Row:      line,
+			ID:       id,
+			Vehicle:  key,
+			Date:     *values.date("date"),
+			Category: values.str("category"),
+			Amount:   values.num("amount"),
+			Odometer: values.num("odometer"),
+			Notes:    values.str("notes"),
+		}
+		if record.name == "service" {
+			e.Category = "Maintenance"
+			e.Amount = values.num("cost")
+			e.Notes = strings.TrimSpace(values.str("description") + "\n" + e.Notes)
+		}
+		r.batch.Expenses = append(r.batch.Expenses, e)
+
+	case "reminder":
+		reminder := ImportReminder{
+			Row:              line,
+			ID:               id,
+			Vehicle:          key,
+			Name:             values.str("name"),
+			IntervalDistance: values.num("interval_distance"),
+			IntervalDays:     int(values.num("interval_days")),
+			LastOdometer:     values.num("last_odometer"),
+			DueDate:          values.date("due_date"),
+			DueOdometer:      values.num("due_odometer"),
+		}
+		if last := values.date("last_date"); last != nil {
+			reminder.LastDate = *last
+		}
+		if reminder.IntervalDistance == 0 && reminder.IntervalDays == 0 && reminder.DueDate == nil && reminder.DueOdometer == 0 {
+			r.warn(line, record.name, id, "", "needs an interval, a due date or a due odometer reading")
+			return
+		}
+		r.batch.Reminders = append(r.batch.Reminders, reminder)
+	}
+
+	for _, used := range r.used {
+		if used == key {
+			return
+		}
+	}
+	r.used = append(r.used, key)
+}
+
+// finish adds the vehicles records refer to without listing them
+func (r *interchangeReader) finish() {
+	for _, key := range r.used {
+		if r.declared[key] {
+			continue
+		}
+		v := vehicleFromModel(key)
+		r.batch.Vehicles = append(r.batch.Vehicles, ImportVehicle{
+			Key:   key,
+			Make:  v.Make,
+			Model: v.Model,
+			Year:  v.Year,
+			Match: []string{key},
+		})
+	}
+}
+
+// lineAt is the line a JSON value starting after offset is on
+func lineAt(body []byte, offset int64) int {
+	for offset < int64(len(body)) && strings.IndexByte(" \t\r\n,", body[offset]) >= 0 {
+		offset++
+	}
+	return bytes.Count(body[:offset], []byte("\n")) + 1
+}
+
+// readJSON reads a JSON file value by value so each record's line is known
+func (r *interchangeReader) readJSON(body []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	expect := func(want json.Delim) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineAt(body, dec.InputOffset()), err)
+		}
+		if tok != want {
+			return fmt.Errorf("line %d: expected %s", lineAt(body, dec.InputOffset()), want)
+		}
+		return nil
+	}
+
+	if err := expect('{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineAt(body, dec.InputOffset()), err)
+		}
+		key, _ := tok.(string)
+		line := lineAt(body, dec.InputOffset())
+
+		switch key {
+		case "format":
+			var format string
+			if err := dec.Decode(&format); err != nil || format != interchangeFormat {
+				return fmt.Errorf("line %d: format must be %q", line, interchangeFormat)
+			}
+			continue
+		case "version":
+			var version int
+			if err := dec.Decode(&version); err != nil {
+				return fmt.Errorf("line %d: version must be a whole number", line)
+			}
+			if version < 1 || version > interchangeVersion {
+				return fmt.Errorf("line %d: version %d isn't supported (this server reads up to %d)", line, version, interchangeVersion)
+			}
+			continue
+		}
+
+		record, ok := findInterchangeRecord(func(rec interchangeRecord) bool { return rec.list == key })
+		if !ok {
+			return fmt.Errorf("line %d: unknown key %q", line, key)
+		}
+		if err := expect('['); err != nil {
+			return err
+		}
+		for dec.More() {
+			line := lineAt(body, dec.InputOffset())
+			var raw map[string]interface{}
+			if err := dec.Decode(&raw); err != nil {
+				if _, ok := err.(*json.UnmarshalTypeError); ok {
+					r.warn(line, record.name, "", "", "must be an object")
+					continue
+				}
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			for name, value := range raw {
+				if value == nil {
+					delete(raw, name)
+				}
+			}
+			r.add(line, record, raw, interchangeField.fromJSON)
+		}
+		if err := expect(']'); err != nil {
+			return err
+		}
+	}
+	return expect('}')
+}
+
+// readCSV reads the flat CSV variant. Column names are matched loosely
+// ("Partial Fill" for partial_fill); empty cells are missing values.
+func (r *interchangeReader) readCSV(body []byte) error {
+	tables, err := readCSVTables(body, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read CSV: %v", err)
+	}
+	if len(tables) == 0 {
+		return fmt.Errorf("the file is empty")
+	}
+	t := tables[0]
+
+	fields := make(map[string]string)
+	for _, name := range interchangeColumns() {
+		fields[csvColumnKey(name)] = name
+	}
+	columns := make([]string, len(t.Header))
+	for i, name := range t.Header {
+		field, ok := fields[csvColumnKey(name)]
+		if !ok {
+			return fmt.Errorf("line 1: unknown column %q", name)
+		}
+		columns[i] = field
+	}
+	if !t.has("type") {
+		return fmt.Errorf("line 1: missing type column")
+	}
+
+	for i, row := range t.Rows {
+		line := t.Lines[i]
+		kind := strings.ToLower(t.get(row, "type"))
+		record, ok := findInterchangeRecord(func(rec interchangeRecord) bool { return rec.name == kind })
+		if !ok {
+			r.warn(line, "", "", "type", fmt.Sprintf("unknown type %q (use vehicle, fuel, expense, service or reminder)", kind))
+			continue
+		}
+
+		raw := make(map[string]interface{})
+		for j, cell := range row {
+			if j < len(columns) && columns[j] != "type" && strings.TrimSpace(cell) != "" {
+				raw[columns[j]] = cell
+			}
+		}
+		r.add(line, record, raw, func(f interchangeField, value interface{}) (interface{}, error) {
+			return f.fromCSV(value.(string))
+		})
+	}
+	return nil
+}
+
+// interchangeImporter reads interchange JSON and CSV files
+type interchangeImporter struct{}
+
+func (interchangeImporter) Name() string { return "interchange" }
+
+// Detect accepts JSON naming the format, or CSV with only interchange
+// columns, including type and vehicle
+func (interchangeImporter) Detect(body []byte) bool {
+	if trimmed := bytes.TrimSpace(body); bytes.HasPrefix(trimmed, []byte("{")) {
+		var probe struct {
+			Format string `json:"format"`
+		}
+		return json.Unmarshal(trimmed, &probe) == nil && probe.Format == interchangeFormat
+	}
+
+	header, err := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(body, []byte("\ufeff")))).Read()
+	if err != nil {
+		return false
+	}
+	known := make(map[string]bool)
+	for _, name := range interchangeColumns() {
+		known[csvColumnKey(name)] = true
+	}
+	found := make(map[string]bool)
+	for _, name := range header {
+		key := csvColumnKey(name)
+		if !known[key] {
+			return false
+		}
+		found[key] = true
+	}
+	return found["type"] && found["vehicle"]
+}
+
+// Parse validates every record, skipping invalid ones with a warning for
+// each problem (line, field and message). With the strict option any
+// invalid record fails the import.
+func (interchangeImporter) Parse(body []byte, opts ImportOptions) (*ImportBatch, error) {
+	r := &interchangeReader{batch: &ImportBatch{}, declared: make(map[string]bool)}
+
+	var err error
+	if trimmed := bytes.TrimSpace(body); bytes.HasPrefix(trimmed, []byte("{")) {
+		err = r.readJSON(body)
+	} else {
+		err = r.readCSV(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.finish()
+
+	if opts.Strict && len(r.batch.Warnings) > 0 {
+		return r.batch, fmt.Errorf("%d problems found, nothing was imported", len(r.batch.Warnings))
+	}
+	return r.batch, nil
+}
+
+// importInterchange imports an interchange JSON or CSV file
+func (app *Application) importInterchange(c *gin.Context) {
+	body, _, opts, ok := app.readImportUpload(c)
+	if !ok {
+		return
+	}
+	app.runImport(c, "interchange", body, opts)
+}
+
+// formatInterchangeDate writes dates without a time of day as YYYY-MM-DD
+func formatInterchangeDate(t time.Time) string {
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339)
+}
+
+// buildInterchange collects the user's records, by record list. Optional
+// fields are left out when empty.
+func (app *Application) buildInterchange(vehicles []Vehicle, filter reportFilter) (map[string][]interchangeValues, error) {
+	export := make(map[string][]interchangeValues)
+	add := func(list string, values interchangeValues) {
+		record, _ := findInterchangeRecord(func(r interchangeRecord) bool { return r.list == list })
+		for _, f := range record.fields {
+			switch v := values[f.name].(type) {
+			case string:
+				if v == "" && !f.required {
+					delete(values, f.name)
+				}
+			case float64:
+				if v == 0 && !f.required {
+					delete(values, f.name)
+				}
+			case int:
+				if v == 0 && !f.required {
+					delete(values, f.name)
+				}
+			case bool:
+				if !v {
+					delete(values, f.name)
+				}
+			case *time.Time:
+				if v == nil {
+					delete(values, f.name)
+				} else {
+					values[f.name] = *v
+				}
+			}
+		}
+		export[list] = append(export[list], values)
+	}
+
+	keys := make(map[uint]string)
+	taken := make(map[string]bool)
+	var ids []uint
+	for _, v := range vehicles {
+		key := strings.TrimSpace(v.Make + " " + v.Model)
+		if v.Year > 0 {
+			key = vehicleName(v)
+		}
+		if taken[key] {
+			key = fmt.Sprintf("%s #%d", key, v.ID)
+		}
+		taken[key] = true
+		keys[v.ID] = key
+		ids = append(ids, v.ID)
+
+		unit := v.MileageUnit
+		if unit == "" {
+			unit = "mi"
+		}
+		add("vehicles", interchangeValues{
+			"vehicle":       key,
+			"make":          v.Make,
+			"model":         v.Model,
+			"year":          v.Year,
+			"fuel_type":     v.FuelType,
+			"distance_unit": unit,
+		})
+	}
+
+	var fuel []FuelEntry
+	if err := filter.dateRange(app.db.Where("vehicle_id IN ?", ids)).Order("vehicle_id, date").Find(&fuel).Error; err != nil {
+		return nil, err
+	}
+	for _, f := range fuel {
+		add("fuel", interchangeValues{
+			"id":            strconv.FormatUint(uint64(f.ID), 10),
+			"vehicle":       keys[f.VehicleID],
+			"date":          f.Date,
+			"odometer":      f.Odometer,
+			"volume":        f.Gallons,
+			"cost":          f.Price,
+			"partial_fill":  f.PartialFill,
+			"missed_fillup": f.MissedFillup,
+			"location":      f.Location,
+			"notes":         f.Notes,
+		})
+	}
+
+	var expenses []Expense
+	if err := filter.dateRange(app.db.Where("vehicle_id IN ?", ids)).Order("vehicle_id, date").Find(&expenses).Error; err != nil {
+		return nil, err
+	}
+	for _, e := range expenses {
+		id := strconv.FormatUint(uint64(e.ID), 10)
+		if e.Category != "Maintenance" {
+			add("expenses", interchangeValues{
+				"id": id, "vehicle": keys[e.VehicleID], "date": e.Date,
+				"category": e.Category, "amount": e.Amount, "notes": e.Notes,
+			})
+			continue
+		}
+		// A service's description is the first line of its notes
+		description, notes, _ := strings.Cut(strings.TrimSpace(e.Notes), "\n")
+		if description == "" {
+			description = "Service"
+		}
+		add("services", interchangeValues{
+			"id": id, "vehicle": keys[e.VehicleID], "date": e.Date,
+			"description": description, "cost": e.Amount, "notes": strings.TrimSpace(notes),
+		})
+	}
+
+	// Reminders describe what's due next, so the date range doesn't apply
+	var reminders []MaintenanceReminder
+	if err := app.db.Where("vehicle_id IN ? AND completed_at IS NULL", ids).Order("vehicle_id, name").Find(&reminders).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range reminders {
+		var last *time.Time
+		if !r.LastServiceDate.IsZero() {
+			last = &r.LastServiceDate
+		}
+		add("reminders", interchangeValues{
+			"id":                strconv.FormatUint(uint64(r.ID), 10),
+			"vehicle":           keys[r.VehicleID],
+			"name":              r.Name,
+			"interval_distance": r.IntervalMiles,
+			"interval_days":     r.IntervalDays,
+			"last_date":         last,
+			"last_odometer":     r.LastServiceMiles,
+			"due_date":          r.DueDate,
+			"due_odometer":      r.DueMiles,
+		})
+	}
+
+	return export, nil
+}
+
+// writeInterchangeJSON writes records with their fields in schema order
+func writeInterchangeJSON(w io.Writer, export map[string][]interchangeValues) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "{\n  \"format\": %q,\n  \"version\": %d", interchangeFormat, interchangeVersion)
+	for _, record := range interchangeRecords {
+		fmt.Fprintf(&buf, ",\n  %q: [", record.list)
+		for i, values := range export[record.list] {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n    {")
+			first := true
+			for _, f := range record.fields {
+				value, ok := values[f.name]
+				if !ok {
+					continue
+				}
+				if t, ok := value.(time.Time); ok {
+					value = formatInterchangeDate(t)
+				}
+				encoded, err := json.Marshal(value)
+				if err != nil {
+					return err
+				}
+				if !first {
+					buf.WriteString(", ")
+				}
+				first = false
+				fmt.Fprintf(&buf, "%q: %s", f.name, encoded)
+			}
+			buf.WriteString("}")
+		}
+		if len(export[record.list]) > 0 {
+			buf.WriteString("\n  ")
+		}
+		buf.WriteString("]")
+	}
+	buf.WriteString("\n}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeInterchangeCSV writes the flat CSV variant
+func writeInterchangeCSV(w io.Writer, export map[string][]interchangeValues) error {
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+	columns := interchangeColumns()
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, record := range interchangeRecords {
+		for _, values := range export[record.list] {
+			row := make([]string, len(columns))
+			row[0] = record.name
+			for i, name := range columns[1:] {
+				switch v := values[name].(type) {
+				case string:
+					row[i+1] = v
+				case float64:
+					row[i+1] = formatCSVFloat(v)
+				case int:
+					row[i+1] = strconv.Itoa(v)
+				case bool:
+					row[i+1] = strconv.FormatBool(v)
+				case time.Time:
+					row[i+1] = formatInterchangeDate(v)
+				}
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportInterchange downloads the user's vehicles and records as an
+// interchange file. Query: format (json, the default, or csv), vehicle_id,
+// from and to.
+func (app *Application) exportInterchange(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(400, gin.H{"error": "format must be json or csv"})
+		return
+	}
+	filter, err := parseReportFilter(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	vehicles, err := app.filteredVehicles(userID, filter)
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	export, err := app.buildInterchange(vehicles, filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Export failed: " + err.Error()})
+		return
+	}
+
+	filename := fmt.Sprintf("clarkson-interchange-%s.%s", time.Now().Format("2006-01-02"), format)
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/json")
+	}
+	c.Status(200)
+
+	write := writeInterchangeJSON
+	if format == "csv" {
+		write = writeInterchangeCSV
+	}
+	if err := write(c.Writer, export); err != nil {
+		requestLogger(c).Error("interchange export failed", "error", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const interchangeJSON = `{
+  "format": "clarkson-interchange",
+  "version": 1,
+  "vehicles": [
+    {"vehicle": "civic", "make": "Honda", "model": "Civic", "year": 2015, "distance_unit": "mi"},
+    {"vehicle": "civic", "make": "Honda", "model": "Civic"}
+  ],
+  "fuel": [
+    {"id": "f1", "vehicle": "civic", "date": "2024-01-02", "odometer": 1000, "volume": 10, "cost": 35.5},
+    {"id": "f2", "vehicle": "civic", "date": "2024-01-20T10:00:00Z", "odometer": 1300, "volume": 9.5, "cost": 33, "colour": "red"},
+    {"id": "f3", "vehicle": "civic", "date": "tomorrow", "volume": -1},
+    42,
+    {"id": "f4", "vehicle": "2020 Ford Transit", "date": "2024-02-01", "distance": 300, "volume": 40, "cost": 70}
+  ],
+  "expenses": [
+    {"vehicle": "civic", "date": "2024-01-05", "category": "Insurance", "amount": 400}
+  ],
+  "services": [
+    {"vehicle": "civic", "date": "2024-01-06", "description": "Oil change", "cost": 80, "notes": "synthetic", "odometer": 1100}
+  ],
+  "reminders": [
+    {"vehicle": "civic", "name": "Oil", "interval_distance": 5000, "interval_days": 180, "last_date": "2024-01-06", "last_odometer": 1100},
+    {"vehicle": "civic", "name": ""}
+  ]
+}`
+
+const interchangeCSV = "type,vehicle,make,model,year,date,odometer,volume,Cost,Partial Fill,category,amount,name,due_date\n" +
+	"vehicle,Van,Ford,Transit,2020,,,,,,,,,\n" +
+	"fuel,Van,,,,2024-03-01,5000,40,60,true,,,,\n" +
+	"fuel,Van,,,,2024-03-09,5400,x,60,maybe,,,,\n" +
+	"expense,Van,,,,2024-03-02,,,,,Tolls,3.5,,\n" +
+	"reminder,Van,,,,,,,,,,,MOT,2025-03-01\n" +
+	"boat,Van,,,,,,,,,,,,\n"
+
+// warningAt reports whether the batch has a warning for the line and field
+func warningAt(batch *ImportBatch, row int, field string) bool {
+	for _, w := range batch.Warnings {
+		if w.Row == row && w.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInterchangeParseJSON(t *testing.T) {
+	if format := detectImportFormat([]byte(interchangeJSON)); format != "interchange" {
+		t.Fatalf("detected %q, want interchange", format)
+	}
+
+	batch, err := parseImport("interchange", []byte(interchangeJSON), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Vehicles) != 2 {
+		t.Fatalf("%d vehicles, want the listed one and one named by a record", len(batch.Vehicles))
+	}
+	if v := batch.Vehicles[0]; v.Key != "civic" || v.Year != 2015 || v.DistanceUnit != "mi" {
+		t.Errorf("vehicle = %+v", v)
+	}
+	if v := batch.Vehicles[1]; v.Key != "2020 Ford Transit" || v.Make != "Ford" || v.Model != "Transit" || v.Year != 2020 {
+		t.Errorf("vehicle from a name = %+v", v)
+	}
+
+	if len(batch.Fuel) != 2 || batch.Fuel[0].ID != "f1" || batch.Fuel[1].ID != "f4" {
+		t.Fatalf("fuel = %+v, want f1 and f4", batch.Fuel)
+	}
+	if f := batch.Fuel[0]; f.Row != 9 || f.Odometer != 1000 || f.Volume != 10 || f.Cost != 35.5 || !f.Date.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("fill-up = %+v", f)
+	}
+	if f := batch.Fuel[1]; f.Odometer != 0 || f.Distance != 300 {
+		t.Errorf("trip fill-up = %+v", f)
+	}
+
+	if len(batch.Expenses) != 2 {
+		t.Fatalf("%d expenses, want the expense and the service", len(batch.Expenses))
+	}
+	if s := batch.Expenses[1]; s.Category != "Maintenance" || s.Amount != 80 || s.Odometer != 1100 || s.Notes != "Oil change\nsynthetic" {
+		t.Errorf("service = %+v", s)
+	}
+	if len(batch.Reminders) != 1 || batch.Reminders[0].IntervalDistance != 5000 || batch.Reminders[0].IntervalDays != 180 {
+		t.Errorf("reminders = %+v", batch.Reminders)
+	}
+
+	for _, want := range []struct {
+		row   int
+		field string
+	}{{6, "vehicle"}, {10, "colour"}, {11, "date"}, {11, "volume"}, {12, ""}, {23, "name"}} {
+		if !warningAt(batch, want.row, want.field) {
+			t.Errorf("no warning for line %d %s, warnings = %+v", want.row, want.field, batch.Warnings)
+		}
+	}
+
+	if _, err := parseImport("interchange", []byte(interchangeJSON), ImportOptions{Strict: true}); err == nil || !strings.Contains(err.Error(), "6 problems") {
+		t.Errorf("strict err = %v, want the 6 problems reported", err)
+	}
+}
+
+func TestInterchangeParseCSV(t *testing.T) {
+	if format := detectImportFormat([]byte(interchangeCSV)); format != "interchange" {
+		t.Fatalf("detected %q, want interchange", format)
+	}
+
+	batch, err := parseImport("interchange", []byte(interchangeCSV), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Vehicles) != 1 || batch.Vehicles[0].Make != "Ford" || batch.Vehicles[0].Year != 2020 {
+		t.Errorf("vehicles = %+v", batch.Vehicles)
+	}
+	if len(batch.Fuel) != 1 || !batch.Fuel[0].PartialFill || batch.Fuel[0].Cost != 60 {
+		t.Errorf("fuel = %+v, want the partial fill-up read from loosely named columns", batch.Fuel)
+	}
+	if len(batch.Expenses) != 1 || batch.Expenses[0].Category != "Tolls" || batch.Expenses[0].Amount != 3.5 {
+		t.Errorf("expenses = %+v", batch.Expenses)
+	}
+	if len(batch.Reminders) != 1 || batch.Reminders[0].DueDate == nil {
+		t.Errorf("reminders = %+v", batch.Reminders)
+	}
+	for _, want := range []struct {
+		row   int
+		field string
+	}{{4, "volume"}, {4, "partial_fill"}, {7, "type"}} {
+		if !warningAt(batch, want.row, want.field) {
+			t.Errorf("no warning for line %d %s, warnings = %+v", want.row, want.field, batch.Warnings)
+		}
+	}
+
+	if _, err := parseImport("interchange", []byte(`{"format":"x"}`), ImportOptions{}); err == nil {
+		t.Error("parsed JSON that isn't an interchange file")
+	}
+}
+
+func TestInterchangeExportRoundTrip(t *testing.T) {
+	app := newTestApp(t)
+	user := User{Email: "driver@example.com"}
+	app.db.Create(&user)
+
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	golf := Vehicle{UserID: user.ID, Year: 2019, Make: "VW", Model: "Golf", MileageUnit: "km", Odometer: 12000}
+	app.db.Create(&golf)
+	app.db.Create(&FuelEntry{VehicleID: golf.ID, Date: date, Gallons: 40, Price: 70.5, Odometer: 11900, Location: "Shell", Notes: "said \"hi\", ok\nline2", PartialFill: true})
+	app.db.Create(&Expense{VehicleID: golf.ID, Date: date, Category: "Insurance", Amount: 400})
+	app.db.Create(&MaintenanceReminder{VehicleID: golf.ID, Name: "Oil", IntervalMiles: 5000, LastServiceDate: date, LastServiceMiles: 10000})
+
+	for _, format := range []string{"json", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/api/export/interchange?format="+format, nil)
+			c.Set("userID", user.ID)
+			app.exportInterchange(c)
+			if w.Code != 200 {
+				t.Fatalf("export: %d %s", w.Code, w.Body.String())
+			}
+
+			batch, err := parseImport("interchange", w.Body.Bytes(), ImportOptions{Strict: true})
+			if err != nil {
+				t.Fatalf("re-import: %v %+v", err, batch)
+			}
+			if len(batch.Vehicles) != 1 || batch.Vehicles[0].Make != "VW" || batch.Vehicles[0].DistanceUnit != "km" {
+				t.Errorf("vehicles = %+v", batch.Vehicles)
+			}
+			if len(batch.Fuel) != 1 {
+				t.Fatalf("%d fill-ups, want 1", len(batch.Fuel))
+			}
+			f := batch.Fuel[0]
+			if f.Odometer != 11900 || f.Volume != 40 || f.Cost != 70.5 || !f.PartialFill || f.Location != "Shell" || f.Notes != "said \"hi\", ok\nline2" || !f.Date.Equal(date) {
+				t.Errorf("fill-up = %+v", f)
+			}
+			if len(batch.Expenses) != 1 || batch.Expenses[0].Amount != 400 {
+				t.Errorf("expenses = %+v", batch.Expenses)
+			}
+			if len(batch.Reminders) != 1 || batch.Reminders[0].IntervalDistance != 5000 || batch.Reminders[0].LastOdometer != 10000 {
+				t.Errorf("reminders = %+v", batch.Reminders)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Server lifecycle. The HTTP server and the background workers run until
+// SIGINT or SIGTERM; then live event streams are closed, in-flight requests
+// get up to shutdown_timeout to finish, workers are stopped between jobs and
+// the database is closed. A second signal exits at once.
+
+// cleanupInterval is how often expired import sessions and old
+// notifications are cleared out
+const cleanupInterval = time.Hour
+
+// readHeaderTimeout bounds how long a client may take to send its headers
+const readHeaderTimeout = 10 * time.Second
+
+// Workers runs background jobs for the life of the server and waits for
+// them on shutdown
+type Workers struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	running  map[string]int
+	stopping bool
+}
+
+func NewWorkers() *Workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Workers{ctx: ctx, cancel: cancel, running: make(map[string]int)}
+}
+
+// Start runs a long-lived worker. fn returns once ctx is done, after
+// finishing the job in hand.
+func (w *Workers) Start(name string, fn func(ctx context.Context)) {
+	w.run(name, func() {
+		slog.Debug("worker started", "worker", name)
+		fn(w.ctx)
+		slog.Debug("worker stopped", "worker", name)
+	})
+}
+
+// Go runs a one-off task, like delivering fresh notifications, that
+// shutdown waits for. Once stopping, new tasks are dropped: what they
+// would have done is left pending for the scheduler after a restart.
+// Without Workers, as in the CLI commands, the task just runs.
+func (w *Workers) Go(name string, fn func()) {
+	if w == nil {
+		go fn()
+		return
+	}
+	w.run(name, fn)
+}
+
+func (w *Workers) run(name string, fn func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopping {
+		return
+	}
+	w.running[name]++
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			w.mu.Lock()
+			if w.running[name]--; w.running[name] == 0 {
+				delete(w.running, name)
+			}
+			w.mu.Unlock()
+			w.wg.Done()
+		}()
+		fn()
+	}()
+}
+
+// Stop tells the workers to stop and waits for them until ctx is done. It
+// returns the workers still running then.
+func (w *Workers) Stop(ctx context.Context) []string {
+	w.mu.Lock()
+	w.stopping = true
+	w.mu.Unlock()
+	w.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var names []string
+	for name := range w.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sleepContext waits for d, or returns false as soon as ctx is done
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// runCleanup regularly drops expired import sessions and purges old
+// closed notifications
+func (app *Application) runCleanup(ctx context.Context) {
+	for {
+		app.metrics.runJob("cleanup", func() error {
+			if n := app.imports.Purge(); n > 0 {
+				slog.Info("dropped expired import sessions", "count", n)
+			}
+			return app.purgeOldNotifications()
+		})
+		if !sleepContext(ctx, cleanupInterval) {
+			return
+		}
+	}
+}
+
+// newHTTPServer wraps the router in a server with the configured timeouts
+func (app *Application) newHTTPServer() *http.Server {
+	return &http.Server{
+		Addr:              ":" + app.config.Port,
+		Handler:           app.router,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       app.config.ReadTimeout,
+		WriteTimeout:      app.config.WriteTimeout,
+		IdleTimeout:       app.config.IdleTimeout,
+	}
+}
+
+// serve runs the server until it fails or a shutdown signal arrives, then
+// shuts everything down within the configured timeout
+func (app *Application) serve(srv *http.Server) error {
+	failed := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			failed <- err
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	var serveErr error
+	select {
+	case serveErr = <-failed:
+	case sig := <-signals:
+		slog.Info("shutting down", "signal", sig.String())
+	}
+	// A second signal kills the process the usual way
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.ShutdownTimeout)
+	defer cancel()
+
+	// Event streams never finish on their own; clients reconnect and replay
+	app.events.Close()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("requests still running at the shutdown timeout were cut off", "timeout", app.config.ShutdownTimeout)
+		srv.Close()
+	}
+	if running := app.workers.Stop(ctx); len(running) > 0 {
+		slog.Warn("background jobs still running at exit", "workers", running)
+	}
+
+	if sqlDB, err := app.db.DB(); err == nil {
+		sqlDB.Close()
+	}
+	if serveErr == nil {
+		slog.Info("shutdown complete")
+	}
+	return serveErr
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Logging goes through log/slog, as text or JSON lines on stderr at the
+// configured level. Every request gets an ID, taken from a valid incoming
+// X-Request-ID or generated, which is sent back in the X-Request-ID header
+// and as request_id in JSON error bodies, and is on every log line written
+// for the request together with the user ID once authenticated.
+
+// logLevels are the accepted log levels
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogging makes the configured logger the default
+func setupLogging(cfg Config) {
+	opts := &slog.HandlerOptions{Level: logLevels[cfg.LogLevel]}
+	var handler slog.Handler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// validRequestID accepts incoming request IDs that are safe to log and echo
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// requestID gives each request an ID and adds it to JSON error responses
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = randomToken(8)
+		}
+		c.Set("requestID", id)
+		c.Header("X-Request-ID", id)
+
+		w := &errorBodyWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		w.finish(id)
+	}
+}
+
+// errorBodyWriter holds back JSON error bodies so the request ID can be
+// added to them. Everything else is written straight through.
+type errorBodyWriter struct {
+	gin.ResponseWriter
+	held *bytes.Buffer
+}
+
+func (w *errorBodyWriter) hold() bool {
+	if w.held != nil {
+		return true
+	}
+	if w.Status() >= 400 && !w.ResponseWriter.Written() &&
+		strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		w.held = new(bytes.Buffer)
+		return true
+	}
+	return false
+}
+
+func (w *errorBodyWriter) Write(b []byte) (int, error) {
+	if w.hold() {
+		return w.held.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorBodyWriter) WriteString(s string) (int, error) {
+	if w.hold() {
+		return w.held.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *errorBodyWriter) Written() bool {
+	return w.held != nil || w.ResponseWriter.Written()
+}
+
+func (w *errorBodyWriter) Size() int {
+	if w.held != nil {
+		return w.held.Len()
+	}
+	return w.ResponseWriter.Size()
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *errorBodyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes a held error body with request_id added
+func (w *errorBodyWriter) finish(id string) {
+	if w.held == nil {
+		return
+	}
+	body := w.held.Bytes()
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err == nil {
+		fields["request_id"] = id
+		if withID, err := json.Marshal(fields); err == nil {
+			body = withID
+		}
+	}
+	w.ResponseWriter.Write(body)
+}
+
+// requestLog logs each request once it's done. The query string is left
+// out as it can carry tokens.
+func requestLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case c.Request.URL.Path == "/health" || c.Request.URL.Path == "/metrics":
+			level = slog.LevelDebug
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int("bytes", c.Writer.Size()),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+		requestLogger(c).LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// requestLogger returns a logger carrying the request ID and, once
+// authenticated, the user ID
+func requestLogger(c *gin.Context) *slog.Logger {
+	logger := slog.Default()
+	if id := c.GetString("requestID"); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	if userID := c.GetUint("userID"); userID != 0 {
+		logger = logger.With("user_id", userID)
+	}
+	return logger
+}
+
+// recoverWithLog replaces gin.Recovery so panics are logged with the
+// request ID
+func recoverWithLog() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(nil, func(c *gin.Context, err interface{}) {
+		requestLogger(c).Error("panic", "error", fmt.Sprint(err), "path", c.Request.URL.Path)
+		c.AbortWithStatusJSON(500, gin.H{"error": "Internal server error"})
+	})
+}
+
+// countsAttr groups per-kind counts, like an import's, in a stable order
+func countsAttr(key string, counts map[string]int) slog.Attr {
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	attrs := make([]interface{}, 0, len(kinds))
+	for _, kind := range kinds {
+		attrs = append(attrs, slog.Int(kind, counts[kind]))
+	}
+	return slog.Group(key, attrs...)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LubeLogger exports each kind of record as its own CSV file for one
+// vehicle: gas records, service, repair and upgrade records, taxes and
+// reminders. One file or a zip of several can be imported; the kind is
+// worked out from each file's header. The files don't say which units are
+// used, so miles and US gallons are assumed unless distance_unit and
+// volume_unit are set.
+
+// lubeLoggerVehicle is the key of the one vehicle in a LubeLogger import
+const lubeLoggerVehicle = "LubeLogger"
+
+// lubeLoggerImporter reads LubeLogger CSV exports
+type lubeLoggerImporter struct{}
+
+func (lubeLoggerImporter) Name() string { return "lubelogger" }
+
+// Detect accepts a CSV file, or a zip with at least one, that LubeLogger
+// could have exported
+func (lubeLoggerImporter) Detect(body []byte) bool {
+	files, err := lubeLoggerFiles(body)
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		if tables, err := readCSVTables(f.body, nil); err == nil && len(tables) > 0 && lubeLoggerKind(tables[0]) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+type lubeLoggerFile struct {
+	name string
+	body []byte
+}
+
+// lubeLoggerFiles returns the CSV files in a zip, or the upload itself
+func lubeLoggerFiles(body []byte) ([]lubeLoggerFile, error) {
+	if !bytes.HasPrefix(body, []byte("PK\x03\x04")) {
+		return []lubeLoggerFile{{body: body}}, nil
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	var files []lubeLoggerFile
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !strings.EqualFold(path.Ext(f.Name), ".csv") {
+			continue
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, lubeLoggerFile{name: path.Base(f.Name), body: data})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// lubeLoggerKind tells the kind of records in a file from its header: gas,
+// reminder, tax or service (also used for repairs and upgrades)
+func lubeLoggerKind(t *csvTable) string {
+	switch {
+	case t.has("fuelconsumed"):
+		return "gas"
+	case t.has("urgency", "duedate", "dueodometer"):
+		return "reminder"
+	case t.has("date") && t.has("description") && t.has("cost") && !t.has("odometer"):
+		return "tax"
+	case t.has("date") && t.has("description") && t.has("cost"):
+		return "service"
+	}
+	return ""
+}
+
+// Parse reads gas records as fill-ups, service, repair, upgrade and tax
+// records as expenses, and reminders
+func (lubeLoggerImporter) Parse(body []byte, opts ImportOptions) (*ImportBatch, error) {
+	files, err := lubeLoggerFiles(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zip: %v", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no CSV files in the zip")
+	}
+
+	batch := &ImportBatch{
+		Vehicles: []ImportVehicle{{
+			Key:          lubeLoggerVehicle,
+			Make:         "Imported",
+			Model:        "Vehicle",
+			DistanceUnit: "mi",
+			VolumeUnit:   "gal",
+		}},
+	}
+
+	// Read every file before any record so the decimal separator is decided
+	// from the numbers in all of them
+	type lubeLoggerTable struct {
+		*csvTable
+		file, kind string
+	}
+	var tables []lubeLoggerTable
+	var numbers []string
+	warn := func(file string, row int, kind, message string) {
+		if file != "" {
+			message = file + ": " + message
+		}
+		batch.Warnings = append(batch.Warnings, ImportWarning{Row: row, Type: kind, Message: message})
+	}
+	for _, f := range files {
+		read, err := readCSVTables(f.body, nil)
+		if err == nil && len(read) == 0 {
+			err = fmt.Errorf("the file is empty")
+		}
+		if err != nil {
+			if len(files) == 1 {
+				return nil, fmt.Errorf("failed to read CSV: %v", err)
+			}
+			warn(f.name, 0, "", fmt.Sprintf("can't be read: %v", err))
+			continue
+		}
+		t := read[0]
+		kind := lubeLoggerKind(t)
+		if kind == "" {
+			if len(files) == 1 {
+				return nil, fmt.Errorf("not a LubeLogger gas, service, repair, upgrade, tax or reminder export")
+			}
+			warn(f.name, 0, "", "not a LubeLogger gas, service, repair, upgrade, tax or reminder export")
+			continue
+		}
+		tables = append(tables, lubeLoggerTable{csvTable: t, file: f.name, kind: kind})
+		for _, keys := range [][]string{{"odometer"}, {"fuelconsumed"}, {"cost"}, {"dueodometer"}, {"remindermileageinterval", "custommileageinterval", "mileageinterval"}} {
+			numbers = append(numbers, t.column(keys...)...)
+		}
+	}
+	decimal := opts.decimalFor(numbers)
+
+	for _, lt := range tables {
+		t, kind := lt.csvTable, lt.kind
+		for i, record := range t.Rows {
+			line := t.Lines[i]
+			notes := t.get(record, "notes")
+			if tags := t.get(record, "tags"); tags != "" {
+				notes = strings.TrimSpace(notes + "\nTags: " + tags)
+			}
+
+			switch kind {
+			case "gas":
+				fuel := ImportFuel{
+					Row:          line,
+					Vehicle:      lubeLoggerVehicle,
+					PartialFill:  t.has("isfilltofull") && !parseImportFlag(t.get(record, "isfilltofull")),
+					MissedFillup: parseImportFlag(t.get(record, "missedfuelup")),
+					Notes:        notes,
+				}
+				var parseErr error
+				if fuel.Date, parseErr = parseImportDate(t.get(record, "date"), opts.DateFormat); parseErr == nil {
+					if fuel.Odometer, parseErr = parseImportNumber(t.get(record, "odometer"), decimal); parseErr == nil {
+						if fuel.Volume, parseErr = parseImportNumber(t.get(record, "fuelconsumed"), decimal); parseErr == nil {
+							fuel.Cost, parseErr = parseImportNumber(t.get(record, "cost"), decimal)
+						}
+					}
+				}
+				if parseErr == nil && fuel.Volume <= 0 {
+					parseErr = fmt.Errorf("fuel volume must be positive")
+				}
+				if parseErr == nil && fuel.Odometer <= 0 {
+					parseErr = fmt.Errorf("needs an odometer reading")
+				}
+				if parseErr != nil {
+					warn(lt.file, line, "fuel", parseErr.Error())
+					continue
+				}
+				batch.Fuel = append(batch.Fuel, fuel)
+
+			case "service", "tax":
+				e := ImportExpense{
+					Row:      line,
+					Vehicle:  lubeLoggerVehicle,
+					Category: "Maintenance",
+					Notes:    strings.TrimSpace(t.get(record, "description") + "\n" + notes),
+				}
+				if kind == "tax" {
+					e.Category = "Registration"
+				}
+				var parseErr error
+				if e.Date, parseErr = parseImportDate(t.get(record, "date"), opts.DateFormat); parseErr == nil {
+					if e.Odometer, parseErr = parseImportNumber(t.get(record, "odometer"), decimal); parseErr == nil {
+						e.Amount, parseErr = parseImportNumber(t.get(record, "cost"), decimal)
+					}
+				}
+				if parseErr != nil {
+					warn(lt.file, line, "expense", parseErr.Error())
+					continue
+				}
+				batch.Expenses = append(batch.Expenses, e)
+
+			case "reminder":
+				r, err := lubeLoggerReminder(t, record, line, opts.DateFormat, decimal)
+				if err != nil {
+					warn(lt.file, line, "reminder", err.Error())
+					continue
+				}
+				batch.Reminders = append(batch.Reminders, r)
+			}
+		}
+	}
+
+	return batch, nil
+}
+
+// lubeLoggerReminder reads a reminder. Metric says whether it's due by
+// date, odometer or both; recurring reminders are worked back to their last
+// service.
+func lubeLoggerReminder(t *csvTable, record []string, line int, dateFormat, decimal string) (ImportReminder, error) {
+	r := ImportReminder{Row: line, Vehicle: lubeLoggerVehicle, Name: t.get(record, "description")}
+	if r.Name == "" {
+		return r, fmt.Errorf("reminder has no description")
+	}
+
+	metric := strings.ToLower(t.get(record, "metric"))
+	var due *time.Time
+	if raw := t.get(record, "duedate"); raw != "" && metric != "odometer" {
+		d, err := parseImportDate(raw, dateFormat)
+		if err != nil {
+			return r, err
+		}
+		due = &d
+	}
+	var dueOdometer float64
+	if metric != "date" {
+		var err error
+		if dueOdometer, err = parseImportNumber(t.get(record, "dueodometer"), decimal); err != nil {
+			return r, err
+		}
+	}
+	if due == nil && dueOdometer <= 0 {
+		return r, fmt.Errorf("reminder has no due date or odometer")
+	}
+
+	var distance float64
+	var months int
+	if parseImportFlag(t.get(record, "isrecurring")) {
+		distance, _ = parseImportNumber(t.get(record, "remindermileageinterval", "custommileageinterval", "mileageinterval"), decimal)
+		months, _ = strconv.Atoi(t.get(record, "remindermonthinterval", "custommonthinterval", "monthinterval"))
+	}
+	return dueReminder(r, due, dueOdometer, distance, months), nil
+}
+
+// importLubeLogger imports LubeLogger CSV exports, one file or a zip of
+// them, into one vehicle. The vehicle is created unless vehicle_map maps
+// "LubeLogger" to an existing one.
+func (app *Application) importLubeLogger(c *gin.Context) {
+	body, _, opts, ok := app.readImportUpload(c)
+	if !ok {
+		return
+	}
+	app.runImport(c, "lubelogger", body, opts)
+}
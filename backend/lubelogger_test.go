@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+	"time"
+)
+
+const lubeLoggerGas = "Date,Odometer,FuelConsumed,Cost,FuelEconomy,IsFillToFull,MissedFuelUp,Notes,Tags,ExtraFields\n" +
+	"1/15/2024,30500,10.5,\"$35.20\",25,True,False,,costco,\n" +
+	"2/1/2024,30800,8,28,0,False,False,top up,,\n"
+
+// lubeLoggerExport zips the CSV files of a LubeLogger vehicle export
+func lubeLoggerExport(t *testing.T) []byte {
+	t.Helper()
+	files := map[string]string{
+		"gasrecords.csv":     lubeLoggerGas,
+		"servicerecords.csv": "Date,Odometer,Description,Notes,Cost,Tags,ExtraFields\n1/20/2024,30600,Oil change,synthetic,80,,\n",
+		"taxrecords.csv":     "Date,Description,Cost,Notes,IsRecurring,Tags\n3/1/2024,Registration renewal,150,,True,\n",
+		"reminders.csv": "Description,Urgency,Metric,Notes,DueDate,DueOdometer,Tags,IsRecurring,ReminderMileageInterval,ReminderMonthInterval\n" +
+			"Tire rotation,NotUrgent,Both,,6/1/2024,35000,,True,5000,6\n" +
+			"Inspection,NotUrgent,Date,,9/1/2024,0,,False,,\n" +
+			"Nothing,NotUrgent,Odometer,,,0,,False,,\n",
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, _ := zw.Create("export/" + name)
+		w.Write([]byte(data))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestLubeLoggerParse(t *testing.T) {
+	body := lubeLoggerExport(t)
+	if format := detectImportFormat(body); format != "lubelogger" {
+		t.Fatalf("detected %q, want lubelogger", format)
+	}
+
+	batch, err := parseImport("lubelogger", body, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Vehicles) != 1 || batch.Vehicles[0].DistanceUnit != "mi" || batch.Vehicles[0].VolumeUnit != "gal" {
+		t.Fatalf("vehicles = %+v", batch.Vehicles)
+	}
+
+	if len(batch.Fuel) != 2 {
+		t.Fatalf("%d fill-ups, want 2", len(batch.Fuel))
+	}
+	first, second := batch.Fuel[0], batch.Fuel[1]
+	if first.Odometer != 30500 || first.Volume != 10.5 || first.Cost != 35.2 || first.PartialFill || first.Notes != "Tags: costco" {
+		t.Errorf("first fill-up = %+v", first)
+	}
+	if !first.Date.Equal(time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("date = %v", first.Date)
+	}
+	if !second.PartialFill || second.Notes != "top up" {
+		t.Errorf("second fill-up = %+v", second)
+	}
+
+	if len(batch.Expenses) != 2 {
+		t.Fatalf("%d expenses, want 2", len(batch.Expenses))
+	}
+	service, tax := batch.Expenses[0], batch.Expenses[1]
+	if service.Category != "Maintenance" || service.Amount != 80 || service.Odometer != 30600 || service.Notes != "Oil change\nsynthetic" {
+		t.Errorf("service = %+v", service)
+	}
+	if tax.Category != "Registration" || tax.Amount != 150 {
+		t.Errorf("tax = %+v", tax)
+	}
+
+	if len(batch.Reminders) != 2 {
+		t.Fatalf("%d reminders, want 2", len(batch.Reminders))
+	}
+	repeat, once := batch.Reminders[0], batch.Reminders[1]
+	// The last service is worked back from the next due date and odometer
+	if repeat.IntervalDistance != 5000 || repeat.IntervalDays != 183 || repeat.LastOdometer != 30000 || !repeat.LastDate.Equal(time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("repeating reminder = %+v", repeat)
+	}
+	if once.Name != "Inspection" || once.DueDate == nil || !once.DueDate.Equal(time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("one-off reminder = %+v", once)
+	}
+	if len(batch.Warnings) != 1 || batch.Warnings[0].Row != 4 {
+		t.Errorf("warnings = %+v, want the reminder with nothing due", batch.Warnings)
+	}
+}
+
+func TestLubeLoggerParseSingleCSV(t *testing.T) {
+	batch, err := parseImport("lubelogger", []byte(lubeLoggerGas), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Fuel) != 2 || len(batch.Expenses) != 0 {
+		t.Errorf("%d fill-ups and %d expenses, want 2 and 0", len(batch.Fuel), len(batch.Expenses))
+	}
+
+	if _, err := parseImport("lubelogger", []byte("a,b\n1,2\n"), ImportOptions{}); err == nil {
+		t.Error("parsed a CSV file that isn't LubeLogger's")
+	}
+}
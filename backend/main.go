@@ -1,172 +1,158 @@
 package main
 
 import (
-	"os"
+	"context"
 	"fmt"
-	"time"
 	"github.com/gin-gonic/gin"
-	"github.com/gin-contrib/cors"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 type Application struct {
-	db *gorm.DB
-	router *gin.Engine
-	jwtSecret string
+	db                        *gorm.DB
+	router                    *gin.Engine
+	config                    Config
+	jwtSecret                 string
+	mailer                    *Mailer
+	events                    *EventHub
+	streamTickets             *StreamTickets
+	imports                   *ImportSessions
+	workers                   *Workers
+	metrics                   *Metrics
+	notificationRetentionDays int
+	deliveryMu                sync.Mutex
+	backups                   ServerBackupConfig
+	backupMu                  sync.Mutex // Serialises server backups and restores
 }
 
 func main() {
+	// clarkson-server migrate [status|up|copy <sqlite file>]
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrateCommand(os.Args[2:]))
+	}
+
+	// Load and check the configuration file and environment
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		os.Exit(1)
+	}
+	setupLogging(config)
+	if err := config.resolveJWTSecret(); err != nil {
+		slog.Error("configuration error", "error", err)
+		os.Exit(1)
+	}
+	if config.File != "" {
+		slog.Info("loaded configuration", "file", config.File)
+	}
+
 	// Initialize database
-	db, err := initDB()
+	db, err := initDB(config.Database)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Database initialization failed: %v\n", err)
+		slog.Error("database initialization failed", "driver", config.Database.Driver, "error", err)
 		os.Exit(1)
 	}
 
-	// Get JWT secret from env or generate
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "your-default-secret-change-in-production"
+	// Prometheus metrics, including database query timings (metrics.go)
+	var metrics *Metrics
+	if config.MetricsEnabled {
+		if metrics, err = NewMetrics(db); err != nil {
+			slog.Error("setting up metrics failed", "error", err)
+			os.Exit(1)
+		}
 	}
 
-	// Setup Gin router
+	// Setup Gin router; every request gets an ID and is logged (logging.go)
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
-	router.Use(gin.Logger())
-	router.Use(gin.Recovery())
-
-	// CORS middleware
-	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+	router.Use(requestID())
+	router.Use(requestLog())
+	router.Use(recoverWithLog())
+	if metrics != nil {
+		router.Use(metrics.middleware())
+	}
+
+	// Only the configured reverse proxies may set the client IP and scheme
+	if err := router.SetTrustedProxies(config.TrustedProxies); err != nil {
+		slog.Error("configuration error", "error", err)
+		os.Exit(1)
+	}
+	trusted, _ := parseTrustedProxies(config.TrustedProxies) // Checked by loadConfig
+
+	// Security headers, and CORS when other origins are allowed
+	router.Use(securityHeaders(config.ContentSecurityPolicy, trusted))
+	if cors := corsMiddleware(config.CORSOrigins); cors != nil {
+		router.Use(cors)
+	}
+
+	// Push channels stay off private addresses unless allowed (channels.go)
+	channelHTTPClient = newChannelHTTPClient(config.AllowPrivateChannels)
 
 	// Create app instance
 	app := &Application{
-		db:        db,
-		router:    router,
-		jwtSecret: jwtSecret,
+		db:                        db,
+		router:                    router,
+		config:                    config,
+		jwtSecret:                 config.JWTSecret,
+		mailer:                    NewMailer(config.SMTP),
+		events:                    NewEventHub(1000, 64),
+		streamTickets:             NewStreamTickets(streamTicketTTL, streamTicketReconnect),
+		imports:                   NewImportSessions(config.ImportSessionTTL, 3),
+		workers:                   NewWorkers(),
+		metrics:                   metrics,
+		notificationRetentionDays: config.NotificationRetentionDays,
+		backups:                   config.Backups,
+	}
+
+	// Bring the schema up to date, backing the database up first
+	if err := app.migrate(); err != nil {
+		slog.Error("database migration failed", "error", err)
+		os.Exit(1)
+	}
+
+	// Notifications a previous run stopped in the middle of sending go out again
+	if err := app.requeueInterruptedDeliveries(); err != nil {
+		slog.Error("requeueing notification deliveries failed", "error", err)
 	}
 
 	// Setup routes
 	setupRoutes(app)
 
-	// Health check endpoint
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "healthy"})
+	// Start background workers; they are stopped on shutdown (lifecycle.go)
+	app.workers.Start("reminder scheduler", func(ctx context.Context) {
+		app.runReminderScheduler(ctx, config.ReminderInterval)
 	})
+	app.workers.Start("cleanup", app.runCleanup)
 
-	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
+	// Start scheduled database backups unless BACKUP_INTERVAL is 0. They
+	// need SQLite; other databases are backed up with their own tools.
+	if app.backups.Interval > 0 && isSQLite(app.db) {
+		app.workers.Start("backup scheduler", func(ctx context.Context) {
+			app.runBackupScheduler(ctx, app.backups.Interval)
+		})
 	}
 
-	fmt.Printf("Clarkson starting on port %s\n", port)
-	if err := router.Run(":" + port); err != nil {
-		fmt.Fprintf(os.Stderr, "Server failed: %v\n", err)
+	// Start server, until SIGINT or SIGTERM
+	slog.Info("clarkson starting", "port", config.Port, "database", config.Database.Driver)
+	if err := app.serve(app.newHTTPServer()); err != nil {
+		slog.Error("server failed", "error", err)
 		os.Exit(1)
 	}
 }
 
-func initDB() (*gorm.DB, error) {
-	configPath := os.Getenv("CONFIG_PATH")
-	if configPath == "" {
-		configPath = "/config"
+func initDB(cfg DatabaseConfig) (*gorm.DB, error) {
+	// Ensure the SQLite file's directory exists
+	if cfg.Driver == "sqlite" {
+		os.MkdirAll(filepath.Dir(cfg.DSN), 0755)
 	}
 
-	// Ensure config directory exists
-	os.MkdirAll(configPath, 0755)
-
-	dbPath := configPath + "/clarkson.db"
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
-	if err != nil {
-		return nil, err
-	}
-
-	// AutoMigrate models
-	return db, db.AutoMigrate(
-		&User{},
-		&Vehicle{},
-		&VehicleUser{},
-		&FuelEntry{},
-		&Expense{},
-		&MaintenanceReminder{},
-		&Attachment{},
-		&Notification{},
-	)
-}
-
-func setupRoutes(app *Application) {
-	// Auth routes
-	auth := app.router.Group("/api/auth")
-	{
-		auth.POST("/register", app.handleRegister)
-		auth.POST("/login", app.handleLogin)
-	}
-
-	// Protected routes
-	protected := app.router.Group("/api")
-	protected.Use(authMiddleware(app.jwtSecret))
-	{
-		// User routes
-		protected.GET("/users/:id", app.getUser)
-		protected.PUT("/users/:id", app.updateUser)
-
-		// Vehicle routes
-		protected.GET("/vehicles", app.listVehicles)
-		protected.POST("/vehicles", app.createVehicle)
-		protected.GET("/vehicles/:id", app.getVehicle)
-		protected.PUT("/vehicles/:id", app.updateVehicle)
-		protected.DELETE("/vehicles/:id", app.deleteVehicle)
-		protected.POST("/vehicles/:id/share", app.shareVehicle)
-
-		// Fuel entry routes
-		protected.GET("/vehicles/:id/fuel", app.listFuelEntries)
-		protected.POST("/vehicles/:id/fuel", app.createFuelEntry)
-		protected.PUT("/fuel/:id", app.updateFuelEntry)
-		protected.DELETE("/fuel/:id", app.deleteFuelEntry)
-
-		// Expense routes
-		protected.GET("/vehicles/:id/expenses", app.listExpenses)
-		protected.POST("/vehicles/:id/expenses", app.createExpense)
-		protected.PUT("/expenses/:id", app.updateExpense)
-		protected.DELETE("/expenses/:id", app.deleteExpense)
-
-		// Reminder routes
-		protected.GET("/vehicles/:id/reminders", app.listReminders)
-		protected.POST("/vehicles/:id/reminders", app.createReminder)
-		protected.PUT("/reminders/:id", app.updateReminder)
-		protected.DELETE("/reminders/:id", app.deleteReminder)
-		protected.GET("/reminders/check", app.checkReminders)
-
-		// Reports
-		protected.GET("/vehicles/:id/report", app.generateReport)
-		protected.GET("/report/overall", app.generateOverallReport)
-		protected.GET("/export/csv", app.exportCSV)
-		protected.GET("/export/pdf", app.exportPDF)
-
-		// Import/Migration
-		protected.POST("/import/hammond", app.importHammond)
-		protected.POST("/import/fuelly", app.importFuelly)
-		protected.POST("/import/clarkson", app.importClarkson)
-
-		// Notification routes
-		protected.GET("/notifications", app.listNotifications)
-		protected.POST("/notifications", app.createNotification)
-		protected.PUT("/notifications/:id", app.updateNotification)
-		protected.DELETE("/notifications/:id", app.deleteNotification)
-	}
-
-	// File upload/download (protected)
-	protected.POST("/upload", app.uploadFile)
-	protected.GET("/download/:id", app.downloadFile)
+	// The schema is brought up to date by app.migrate (migrations.go)
+	return openDatabase(cfg)
 }
 
 // JWT Claims
@@ -189,9 +175,9 @@ func (app *Application) handleRegister(c *gin.Context) {
 	}
 
 	user := &User{
-		Email:    req.Email,
-		Name:     req.Name,
-		Role:     "admin",
+		Email: req.Email,
+		Name:  req.Name,
+		Role:  "admin",
 	}
 
 	if err := user.SetPassword(req.Password); err != nil {
@@ -263,9 +249,11 @@ func (app *Application) getUser(c *gin.Context) {
 func (app *Application) updateUser(c *gin.Context) {
 	userID := c.GetUint("userID")
 	var req struct {
-		Name     string `json:"name"`
-		Currency string `json:"currency"`
-		Units    string `json:"units"`
+		Name               string `json:"name"`
+		Currency           string `json:"currency"`
+		Units              string `json:"units"`
+		EmailNotifications *bool  `json:"email_notifications"`
+		EmailDigest        *bool  `json:"email_digest"`
 	}
 	if err := c.BindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": "Invalid request"})
@@ -295,12 +283,12 @@ func (app *Application) listVehicles(c *gin.Context) {
 func (app *Application) createVehicle(c *gin.Context) {
 	userID := c.GetUint("userID")
 	var req struct {
-		Make         string  `json:"make" binding:"required"`
-		Model        string  `json:"model" binding:"required"`
-		Year         int     `json:"year" binding:"required"`
-		Odometer     float64 `json:"odometer"`
-		MileageUnit  string  `json:"mileage_unit"` // km or mi
-		FuelType     string  `json:"fuel_type"`
+		Make        string  `json:"make" binding:"required"`
+		Model       string  `json:"model" binding:"required"`
+		Year        int     `json:"year" binding:"required"`
+		Odometer    float64 `json:"odometer"`
+		MileageUnit string  `json:"mileage_unit"` // km or mi
+		FuelType    string  `json:"fuel_type"`
 	}
 
 	if err := c.BindJSON(&req); err != nil {
@@ -412,11 +400,11 @@ func (app *Application) listFuelEntries(c *gin.Context) {
 func (app *Application) createFuelEntry(c *gin.Context) {
 	vehicleID := c.Param("id")
 	var req struct {
-		Date      time.Time `json:"date" binding:"required"`
-		Gallons   float64   `json:"gallons" binding:"required"`
-		Price     float64   `json:"price" binding:"required"`
-		Odometer  float64   `json:"odometer" binding:"required"`
-		Location  string    `json:"location"`
+		Date     time.Time `json:"date" binding:"required"`
+		Gallons  float64   `json:"gallons" binding:"required"`
+		Price    float64   `json:"price" binding:"required"`
+		Odometer float64   `json:"odometer" binding:"required"`
+		Location string    `json:"location"`
 	}
 
 	if err := c.BindJSON(&req); err != nil {
@@ -447,11 +435,11 @@ func (app *Application) createFuelEntry(c *gin.Context) {
 func (app *Application) updateFuelEntry(c *gin.Context) {
 	fuelID := c.Param("id")
 	var req struct {
-		Date      time.Time `json:"date"`
-		Gallons   float64   `json:"gallons"`
-		Price     float64   `json:"price"`
-		Odometer  float64   `json:"odometer"`
-		Location  string    `json:"location"`
+		Date     time.Time `json:"date"`
+		Gallons  float64   `json:"gallons"`
+		Price    float64   `json:"price"`
+		Odometer float64   `json:"odometer"`
+		Location string    `json:"location"`
 	}
 
 	if err := c.BindJSON(&req); err != nil {
@@ -470,15 +458,28 @@ func (app *Application) updateFuelEntry(c *gin.Context) {
 		return
 	}
 
+	app.db.First(&entry, fuelID)
+	app.publishVehicleEvent(entry.VehicleID, "entry.updated", gin.H{"kind": "fuel", "entry": entry})
+
 	c.JSON(200, gin.H{"message": "Updated"})
 }
 
 func (app *Application) deleteFuelEntry(c *gin.Context) {
 	fuelID := c.Param("id")
-	if err := app.db.Delete(&FuelEntry{}, fuelID).Error; err != nil {
+
+	var entry FuelEntry
+	if err := app.db.First(&entry, fuelID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Entry not found"})
+		return
+	}
+
+	if err := app.db.Delete(&entry).Error; err != nil {
 		c.JSON(500, gin.H{"error": "Delete failed"})
 		return
 	}
+
+	app.publishVehicleEvent(entry.VehicleID, "entry.deleted", gin.H{"kind": "fuel", "id": entry.ID})
+
 	c.JSON(200, gin.H{"message": "Deleted"})
 }
 
@@ -541,15 +542,30 @@ func (app *Application) updateExpense(c *gin.Context) {
 		return
 	}
 
+	var expense Expense
+	if err := app.db.First(&expense, expenseID).Error; err == nil {
+		app.publishVehicleEvent(expense.VehicleID, "entry.updated", gin.H{"kind": "expense", "entry": expense})
+	}
+
 	c.JSON(200, gin.H{"message": "Updated"})
 }
 
 func (app *Application) deleteExpense(c *gin.Context) {
 	expenseID := c.Param("id")
-	if err := app.db.Delete(&Expense{}, expenseID).Error; err != nil {
+
+	var expense Expense
+	if err := app.db.First(&expense, expenseID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Expense not found"})
+		return
+	}
+
+	if err := app.db.Delete(&expense).Error; err != nil {
 		c.JSON(500, gin.H{"error": "Delete failed"})
 		return
 	}
+
+	app.publishVehicleEvent(expense.VehicleID, "entry.deleted", gin.H{"kind": "expense", "id": expense.ID})
+
 	c.JSON(200, gin.H{"message": "Deleted"})
 }
 
@@ -563,28 +579,55 @@ func (app *Application) listReminders(c *gin.Context) {
 	c.JSON(200, reminders)
 }
 
-func (app *Application) createReminder(c *gin.Context) {
-	vehicleID := c.Param("id")
-	var req struct {
-		Name             string    `json:"name" binding:"required"`
-		IntervalMiles    float64   `json:"interval_miles"`
-		IntervalDays     int       `json:"interval_days"`
-		LastServiceDate  time.Time `json:"last_service_date"`
-		LastServiceMiles float64   `json:"last_service_miles"`
-	}
+// reminderRequest is the body of creating or updating a reminder
+type reminderRequest struct {
+	Name             string     `json:"name" binding:"required"`
+	IntervalMiles    float64    `json:"interval_miles"`
+	IntervalDays     int        `json:"interval_days"`
+	LastServiceDate  time.Time  `json:"last_service_date"`
+	LastServiceMiles float64    `json:"last_service_miles"`
+	DueDate          *time.Time `json:"due_date"`
+	DueMiles         float64    `json:"due_miles"`
+}
 
+// bindReminder reads a reminder request, responding with an error if it
+// is invalid
+func bindReminder(c *gin.Context) (reminderRequest, bool) {
+	var req reminderRequest
 	if err := c.BindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": "Invalid request"})
+		return req, false
+	}
+
+	if req.IntervalMiles == 0 && req.IntervalDays == 0 && req.DueDate == nil && req.DueMiles == 0 {
+		c.JSON(400, gin.H{"error": "Reminder needs an interval or a due date/mileage"})
+		return req, false
+	}
+	return req, true
+}
+
+func (app *Application) createReminder(c *gin.Context) {
+	userID := c.GetUint("userID")
+	vehicle, err := app.accessibleVehicle(userID, c.Param("id"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Vehicle not found"})
+		return
+	}
+
+	req, ok := bindReminder(c)
+	if !ok {
 		return
 	}
 
 	reminder := MaintenanceReminder{
-		VehicleID:        parseUint(vehicleID),
+		VehicleID:        vehicle.ID,
 		Name:             req.Name,
 		IntervalMiles:    req.IntervalMiles,
 		IntervalDays:     req.IntervalDays,
 		LastServiceDate:  req.LastServiceDate,
 		LastServiceMiles: req.LastServiceMiles,
+		DueDate:          req.DueDate,
+		DueMiles:         req.DueMiles,
 	}
 
 	if err := app.db.Create(&reminder).Error; err != nil {
@@ -595,35 +638,58 @@ func (app *Application) createReminder(c *gin.Context) {
 	c.JSON(201, reminder)
 }
 
+// updateReminder replaces a reminder's name and schedule. Fields left out
+// are cleared, so a one-off reminder can be turned into a recurring one.
 func (app *Application) updateReminder(c *gin.Context) {
-	reminderID := c.Param("id")
-	var req struct {
-		Name             string    `json:"name"`
-		IntervalMiles    float64   `json:"interval_miles"`
-		IntervalDays     int       `json:"interval_days"`
-		LastServiceDate  time.Time `json:"last_service_date"`
-		LastServiceMiles float64   `json:"last_service_miles"`
+	userID := c.GetUint("userID")
+	reminder, err := app.accessibleReminder(userID, c.Param("id"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Reminder not found"})
+		return
 	}
 
-	if err := c.BindJSON(&req); err != nil {
-		c.JSON(400, gin.H{"error": "Invalid request"})
+	req, ok := bindReminder(c)
+	if !ok {
 		return
 	}
 
-	if err := app.db.Model(&MaintenanceReminder{}).Where("id = ?", reminderID).Updates(req).Error; err != nil {
+	// A column map, as Updates skips zero values in a struct
+	updates := map[string]interface{}{
+		"name":               req.Name,
+		"interval_miles":     req.IntervalMiles,
+		"interval_days":      req.IntervalDays,
+		"last_service_date":  req.LastServiceDate,
+		"last_service_miles": req.LastServiceMiles,
+		"due_date":           req.DueDate,
+		"due_miles":          req.DueMiles,
+	}
+	if req.DueDate == nil && req.DueMiles == 0 {
+		// Recurring reminders are never done for good
+		updates["completed_at"] = nil
+	}
+
+	if err := app.db.Model(&MaintenanceReminder{}).Where("id = ?", reminder.ID).Updates(updates).Error; err != nil {
 		c.JSON(500, gin.H{"error": "Update failed"})
 		return
 	}
+	app.resolveReminderNotifications(reminder.ID)
 
 	c.JSON(200, gin.H{"message": "Updated"})
 }
 
 func (app *Application) deleteReminder(c *gin.Context) {
-	reminderID := c.Param("id")
-	if err := app.db.Delete(&MaintenanceReminder{}, reminderID).Error; err != nil {
+	userID := c.GetUint("userID")
+	reminder, err := app.accessibleReminder(userID, c.Param("id"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Reminder not found"})
+		return
+	}
+
+	if err := app.db.Delete(&MaintenanceReminder{}, reminder.ID).Error; err != nil {
 		c.JSON(500, gin.H{"error": "Delete failed"})
 		return
 	}
+	app.resolveReminderNotifications(reminder.ID)
 	c.JSON(200, gin.H{"message": "Deleted"})
 }
 
@@ -642,53 +708,30 @@ func (app *Application) checkReminders(c *gin.Context) {
 }
 
 func (app *Application) checkVehicleReminders(vehicleID uint, currentOdometer float64) []gin.H {
+	var vehicle Vehicle
+	if err := app.db.First(&vehicle, vehicleID).Error; err != nil {
+		return nil
+	}
+
 	var reminders []MaintenanceReminder
 	app.db.Where("vehicle_id = ?", vehicleID).Find(&reminders)
 
 	var alerts []gin.H
+	now := time.Now()
 
 	for _, r := range reminders {
-		var isOverdue bool
-		var daysUntilDue int
-		var milesToGo float64
-
-		// Check mileage-based reminder
-		if r.IntervalMiles > 0 {
-			nextServiceMiles := r.LastServiceMiles + r.IntervalMiles
-			if currentOdometer >= nextServiceMiles {
-				isOverdue = true
-				milesToGo = nextServiceMiles - currentOdometer
-			} else {
-				milesToGo = nextServiceMiles - currentOdometer
-			}
-		}
-
-		// Check days-based reminder
-		if r.IntervalDays > 0 {
-			nextServiceDate := r.LastServiceDate.AddDate(0, 0, r.IntervalDays)
-			daysUntilDue = int(time.Until(nextServiceDate).Hours() / 24)
-			if daysUntilDue <= 0 {
-				isOverdue = true
-			}
-		}
-
-		status := "upcoming"
-		if isOverdue {
-			status = "overdue"
-		} else if daysUntilDue < 7 || milesToGo < 500 {
-			status = "soon"
-		}
+		state := evaluateReminder(r, vehicle.RemindersPaused, currentOdometer, now)
 
 		alert := gin.H{
 			"vehicleID":    vehicleID,
 			"reminderID":   r.ID,
 			"name":         r.Name,
-			"status":       status,
-			"daysUntilDue": daysUntilDue,
-			"milesToGo":    milesToGo,
+			"status":       state.Status,
+			"daysUntilDue": state.DaysUntil,
+			"milesToGo":    state.MilesToGo,
 		}
 
-		if status != "upcoming" {
+		if state.Status == "overdue" || state.Status == "soon" {
 			alerts = append(alerts, alert)
 		}
 	}
@@ -789,51 +832,6 @@ func (app *Application) generateOverallReport(c *gin.Context) {
 	})
 }
 
-func (app *Application) exportCSV(c *gin.Context) {
-	userID := c.GetUint("userID")
-	c.Header("Content-Disposition", "attachment; filename=clarkson-export.csv")
-	c.Header("Content-Type", "text/csv")
-
-	csv := "Vehicle,Date,Type,Amount,Odometer,Notes\n"
-
-	var vehicles []Vehicle
-	app.db.Where("user_id = ?", userID).Find(&vehicles)
-
-	for _, v := range vehicles {
-		var fuelEntries []FuelEntry
-		app.db.Where("vehicle_id = ?", v.ID).Find(&fuelEntries)
-
-		for _, f := range fuelEntries {
-			csv += fmt.Sprintf("%s %s,%s,Fuel,%.2f,%.1f,\n", v.Year, v.Make, f.Date.Format("2006-01-02"), f.Price, f.Odometer)
-		}
-
-		var expenses []Expense
-		app.db.Where("vehicle_id = ?", v.ID).Find(&expenses)
-
-		for _, e := range expenses {
-			csv += fmt.Sprintf("%s %s,%s,%s,%.2f,,\"%s\"\n", v.Year, v.Make, e.Date.Format("2006-01-02"), e.Category, e.Amount, e.Notes)
-		}
-	}
-
-	c.Data(200, "text/csv", []byte(csv))
-}
-
-func (app *Application) exportPDF(c *gin.Context) {
-	c.JSON(200, gin.H{"message": "PDF export not yet implemented"})
-}
-
-func (app *Application) importHammond(c *gin.Context) {
-	c.JSON(200, gin.H{"message": "Hammond import not yet implemented"})
-}
-
-func (app *Application) importFuelly(c *gin.Context) {
-	c.JSON(200, gin.H{"message": "Fuelly import not yet implemented"})
-}
-
-func (app *Application) importClarkson(c *gin.Context) {
-	c.JSON(200, gin.H{"message": "Clarkson import not yet implemented"})
-}
-
 func (app *Application) uploadFile(c *gin.Context) {
 	file, err := c.FormFile("file")
 	if err != nil {
@@ -841,11 +839,13 @@ func (app *Application) uploadFile(c *gin.Context) {
 		return
 	}
 
-	assetsPath := os.Getenv("ASSETS_PATH")
-	if assetsPath == "" {
-		assetsPath = "/assets"
+	if file.Size > int64(app.config.MaxAttachmentMB)<<20 {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("File too large (max %dMB)", app.config.MaxAttachmentMB)})
+		return
 	}
 
+	assetsPath := app.config.AssetsPath
+
 	os.MkdirAll(assetsPath, 0755)
 
 	filename := fmt.Sprintf("%d-%s", time.Now().Unix(), file.Filename)
@@ -855,16 +855,14 @@ func (app *Application) uploadFile(c *gin.Context) {
 		c.JSON(500, gin.H{"error": "Upload failed"})
 		return
 	}
+	app.metrics.uploaded("attachment", file.Size)
 
 	c.JSON(201, gin.H{"filename": filename})
 }
 
 func (app *Application) downloadFile(c *gin.Context) {
 	filename := c.Param("id")
-	assetsPath := os.Getenv("ASSETS_PATH")
-	if assetsPath == "" {
-		assetsPath = "/assets"
-	}
+	assetsPath := app.config.AssetsPath
 
 	filepath := assetsPath + "/" + filename
 	if _, err := os.Stat(filepath); err != nil {
@@ -968,73 +966,16 @@ func authMiddleware(jwtSecret string) gin.HandlerFunc {
 	}
 }
 
-func parseUint(s string) uint {
-	var u uint
-	fmt.Sscanf(s, "%d", &u)
-	return u
-}
-
-type User struct {
-	ID       uint
-	Email    string
-	Name     string
-	Password string
-	Role     string
-}
-
-type Vehicle struct {
-	ID          uint
-	UserID      uint
-	Make        string
-	Model       string
-	Year        int
-	Odometer    float64
-	MileageUnit string
-	FuelType    string
-}
-
-type VehicleUser struct {
-	VehicleID uint
-	UserID    uint
-}
-
-type FuelEntry struct {
-	ID        uint
-	VehicleID uint
-	Date      time.Time
-	Gallons   float64
-	Price     float64
-	Odometer  float64
-	Location  string
-}
-
-type Expense struct {
-	ID        uint
-	VehicleID uint
-	Category  string
-	Amount    float64
-	Date      time.Time
-	Notes     string
-}
-
-type MaintenanceReminder struct {
-	ID               uint
-	VehicleID        uint
-	Name             string
-	IntervalMiles    float64
-	IntervalDays     int
-	LastServiceDate  time.Time
-	LastServiceMiles float64
-}
-
-type Attachment struct {
-	ID       uint
-	VehicleID uint
-	Filename string
-}
-
-type Notification struct {
-	ID       uint
-	UserID   uint
-	Message  string
+// adminMiddleware only lets users with the admin role through. It runs
+// after authMiddleware.
+func (app *Application) adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user User
+		if err := app.db.First(&user, c.GetUint("userID")).Error; err != nil || user.Role != "admin" {
+			c.JSON(403, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/logger"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// newTestApp returns an application on a fresh, fully migrated SQLite
+// database in a temporary directory, without a mailer, event hub or workers
+func newTestApp(t *testing.T) *Application {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.ConfigPath = dir
+	cfg.AssetsPath = filepath.Join(dir, "assets")
+	cfg.Database = DatabaseConfig{Driver: "sqlite", DSN: filepath.Join(dir, "clarkson.db")}
+
+	db, err := openDatabase(cfg.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Default.LogMode(logger.Silent)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	app := &Application{db: db, config: cfg, backups: cfg.Backups}
+	if err := app.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// callHandler runs a handler as the user with the route's :id set to id and
+// body, if any, as JSON
+func callHandler(handler gin.HandlerFunc, userID uint, id string, body interface{}) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	var payload io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		payload = strings.NewReader(string(data))
+	}
+	c.Request = httptest.NewRequest("POST", "/", payload)
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Params = gin.Params{{Key: "id", Value: id}}
+	c.Set("userID", userID)
+	handler(c)
+	return w
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// Prometheus metrics, served at /metrics unless metrics.enabled is false and
+// only with `Authorization: Bearer <metrics.token>` when a token is set.
+// Besides the Go runtime and process metrics there are HTTP requests per
+// route, database query timings, background job runs, notification
+// deliveries, upload sizes, and counts of users, vehicles, entries and
+// reminders by status read from the database on each scrape. Without
+// Metrics, as in the CLI commands, nothing is recorded.
+
+// Metrics holds the server's metrics
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests   *prometheus.CounterVec
+	httpDuration   *prometheus.HistogramVec
+	dbDuration     *prometheus.HistogramVec
+	dbErrors       *prometheus.CounterVec
+	jobRuns        *prometheus.CounterVec
+	jobDuration    *prometheus.HistogramVec
+	jobLastSuccess *prometheus.GaugeVec
+	deliveries     *prometheus.CounterVec
+	uploads        *prometheus.CounterVec
+	uploadBytes    *prometheus.CounterVec
+}
+
+// jobBuckets suit background jobs, which take from milliseconds to minutes
+var jobBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}
+
+// dbBuckets suit single queries
+var dbBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// NewMetrics creates the metrics and times every query made through db
+func NewMetrics(db *gorm.DB) (*Metrics, error) {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "clarkson_http_requests_total",
+			Help: "HTTP requests by route, method and status code.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "clarkson_http_request_duration_seconds",
+			Help:    "HTTP request latency by route, except live event streams.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "clarkson_db_query_duration_seconds",
+			Help:    "Database query time by operation and table.",
+			Buckets: dbBuckets,
+		}, []string{"operation", "table"}),
+		dbErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "clarkson_db_query_errors_total",
+			Help: "Failed database queries by operation, not counting record not found.",
+		}, []string{"operation"}),
+		jobRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "clarkson_job_runs_total",
+			Help: "Background job runs by job and result (success or failure).",
+		}, []string{"job", "result"}),
+		jobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "clarkson_job_duration_seconds",
+			Help:    "Background job run time.",
+			Buckets: jobBuckets,
+		}, []string{"job"}),
+		jobLastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "clarkson_job_last_success_timestamp_seconds",
+			Help: "When each background job last finished without errors.",
+		}, []string{"job"}),
+		deliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "clarkson_notification_deliveries_total",
+			Help: "Notification deliveries by channel, kind (reminder or digest) and status (sent or failed).",
+		}, []string{"channel", "kind", "status"}),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "clarkson_uploads_total",
+			Help: "Accepted uploads by kind (attachment or import).",
+		}, []string{"kind"}),
+		uploadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "clarkson_upload_bytes_total",
+			Help: "Bytes of accepted uploads by kind (attachment or import).",
+		}, []string{"kind"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpDuration,
+		m.dbDuration, m.dbErrors,
+		m.jobRuns, m.jobDuration, m.jobLastSuccess,
+		m.deliveries, m.uploads, m.uploadBytes,
+		&domainCollector{db: db},
+	)
+	if err := m.timeQueries(db); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// timeQueries hooks into gorm's callbacks to time every query
+func (m *Metrics) timeQueries(db *gorm.DB) error {
+	before := func(tx *gorm.DB) {
+		tx.InstanceSet("metrics:start", time.Now())
+	}
+	after := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			start, ok := tx.InstanceGet("metrics:start")
+			if !ok {
+				return
+			}
+			table := tx.Statement.Table
+			if table == "" {
+				table = "none"
+			}
+			m.dbDuration.WithLabelValues(operation, table).Observe(time.Since(start.(time.Time)).Seconds())
+			if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+				m.dbErrors.WithLabelValues(operation).Inc()
+			}
+		}
+	}
+
+	cb := db.Callback()
+	type register func(name string, fn func(*gorm.DB)) error
+	hooks := []struct {
+		operation     string
+		before, after register
+	}{
+		{"create", cb.Create().Before("gorm:create").Register, cb.Create().After("gorm:create").Register},
+		{"query", cb.Query().Before("gorm:query").Register, cb.Query().After("gorm:query").Register},
+		{"update", cb.Update().Before("gorm:update").Register, cb.Update().After("gorm:update").Register},
+		{"delete", cb.Delete().Before("gorm:delete").Register, cb.Delete().After("gorm:delete").Register},
+		{"row", cb.Row().Before("gorm:row").Register, cb.Row().After("gorm:row").Register},
+		{"raw", cb.Raw().Before("gorm:raw").Register, cb.Raw().After("gorm:raw").Register},
+	}
+	for _, h := range hooks {
+		if err := h.before("metrics:before_"+h.operation, before); err != nil {
+			return err
+		}
+		if err := h.after("metrics:after_"+h.operation, after(h.operation)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// middleware counts and times requests by route template, so IDs in paths
+// don't make new series. Unrouted requests share the route "unmatched".
+func (m *Metrics) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		m.httpRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		// Event streams stay open for hours and would swamp the latencies
+		if c.Writer.Header().Get("Content-Type") != "text/event-stream" {
+			m.httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// handler serves the metrics, checking the bearer token when one is set
+func (m *Metrics) handler(token string) gin.HandlerFunc {
+	serve := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return func(c *gin.Context) {
+		if token != "" {
+			given := c.GetHeader("Authorization")
+			if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) != 1 {
+				c.Header("WWW-Authenticate", `Bearer realm="metrics"`)
+				c.JSON(401, gin.H{"error": "Invalid metrics token"})
+				return
+			}
+		}
+		serve.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// runJob runs a background job, recording how long it took and whether it
+// failed. The job logs its own errors.
+func (m *Metrics) runJob(job string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	if m == nil {
+		return err
+	}
+
+	m.jobDuration.WithLabelValues(job).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.jobRuns.WithLabelValues(job, "failure").Inc()
+		return err
+	}
+	m.jobRuns.WithLabelValues(job, "success").Inc()
+	m.jobLastSuccess.WithLabelValues(job).SetToCurrentTime()
+	return nil
+}
+
+// delivered counts a notification delivery
+func (m *Metrics) delivered(channel, kind, status string) {
+	if m == nil {
+		return
+	}
+	m.deliveries.WithLabelValues(channel, kind, status).Inc()
+}
+
+// uploaded counts an accepted upload
+func (m *Metrics) uploaded(kind string, size int64) {
+	if m == nil {
+		return
+	}
+	m.uploads.WithLabelValues(kind).Inc()
+	m.uploadBytes.WithLabelValues(kind).Add(float64(size))
+}
+
+// domainCollector reads the domain gauges from the database on each scrape
+type domainCollector struct {
+	db *gorm.DB
+}
+
+var (
+	usersDesc     = prometheus.NewDesc("clarkson_users", "Registered users.", nil, nil)
+	vehiclesDesc  = prometheus.NewDesc("clarkson_vehicles", "Vehicles.", nil, nil)
+	entriesDesc   = prometheus.NewDesc("clarkson_entries", "Fuel and expense entries by type.", []string{"type"}, nil)
+	remindersDesc = prometheus.NewDesc("clarkson_reminders", "Maintenance reminders by status (overdue, soon, upcoming, snoozed, paused, completed).", []string{"status"}, nil)
+)
+
+// reminderStatuses are reported even when no reminder has them
+var reminderStatuses = []string{"overdue", "soon", "upcoming", "snoozed", "paused", "completed"}
+
+func (d *domainCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- usersDesc
+	ch <- vehiclesDesc
+	ch <- entriesDesc
+	ch <- remindersDesc
+}
+
+func (d *domainCollector) Collect(ch chan<- prometheus.Metric) {
+	count := func(model interface{}) (float64, bool) {
+		var n int64
+		if err := d.db.Model(model).Count(&n).Error; err != nil {
+			slog.Error("collecting metrics failed", "error", err)
+			return 0, false
+		}
+		return float64(n), true
+	}
+	if n, ok := count(&User{}); ok {
+		ch <- prometheus.MustNewConstMetric(usersDesc, prometheus.GaugeValue, n)
+	}
+	if n, ok := count(&Vehicle{}); ok {
+		ch <- prometheus.MustNewConstMetric(vehiclesDesc, prometheus.GaugeValue, n)
+	}
+	if n, ok := count(&FuelEntry{}); ok {
+		ch <- prometheus.MustNewConstMetric(entriesDesc, prometheus.GaugeValue, n, "fuel")
+	}
+	if n, ok := count(&Expense{}); ok {
+		ch <- prometheus.MustNewConstMetric(entriesDesc, prometheus.GaugeValue, n, "expense")
+	}
+
+	// Reminder status depends on the vehicle's odometer and today's date,
+	// so it is worked out as in the reminder check
+	var vehicles []Vehicle
+	var reminders []MaintenanceReminder
+	if err := d.db.Find(&vehicles).Error; err != nil {
+		slog.Error("collecting metrics failed", "error", err)
+		return
+	}
+	if err := d.db.Find(&reminders).Error; err != nil {
+		slog.Error("collecting metrics failed", "error", err)
+		return
+	}
+	byID := make(map[uint]Vehicle)
+	for _, v := range vehicles {
+		byID[v.ID] = v
+	}
+	statuses := make(map[string]int)
+	now := time.Now()
+	for _, r := range reminders {
+		v := byID[r.VehicleID]
+		statuses[evaluateReminder(r, v.RemindersPaused, v.Odometer, now).Status]++
+	}
+	for _, status := range reminderStatuses {
+		ch <- prometheus.MustNewConstMetric(remindersDesc, prometheus.GaugeValue, float64(statuses[status]), status)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Schema migrations. Each step runs once, in version order, in its own
+// transaction together with the schema_migrations row recording it. Steps
+// are never edited once released: a change to the models, a renamed column
+// or a data fix gets a new step at the end. Before pending steps run on an
+// existing database a server backup is taken (see serverbackup.go).
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+var migrations = []migration{
+	{
+		// The tables as AutoMigrate left them before versioned migrations,
+		// frozen in baselineschema.go. Databases from older releases only
+		// gain missing columns.
+		Version: 1,
+		Name:    "baseline schema",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(
+				&baselineUser{},
+				&baselineVehicle{},
+				&baselineVehicleUser{},
+				&baselineFuelEntry{},
+				&baselineExpense{},
+				&baselineMaintenanceReminder{},
+				&baselineAttachment{},
+				&baselineNotification{},
+				&baselineNotificationDelivery{},
+				&baselineUserChannel{},
+				&baselineNotificationPreference{},
+			)
+		},
+	},
+	{
+		// Early clients and imports stored units as "Miles", "KM" and the
+		// like, which the reports and importers don't recognise. Empty units
+		// are left alone: the importers give those vehicles the file's unit.
+		Version: 2,
+		Name:    "normalize distance units and currencies",
+		Up: func(tx *gorm.DB) error {
+			units := map[string][]string{
+				"mi": {"mi", "mi.", "mile", "miles"},
+				"km": {"km", "km.", "kms", "kilometer", "kilometers", "kilometre", "kilometres"},
+			}
+			for unit, spellings := range units {
+				if err := tx.Model(&Vehicle{}).
+					Where("LOWER(TRIM(mileage_unit)) IN ? AND mileage_unit <> ?", spellings, unit).
+					UpdateColumn("mileage_unit", unit).Error; err != nil {
+					return err
+				}
+				if err := tx.Model(&User{}).
+					Where("LOWER(TRIM(units)) IN ? AND units <> ?", spellings, unit).
+					UpdateColumn("units", unit).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Model(&User{}).
+				Where("currency <> UPPER(TRIM(currency))").
+				UpdateColumn("currency", gorm.Expr("UPPER(TRIM(currency))")).Error
+		},
+	},
+	{
+		// Deliveries record the notifications they carried. Databases
+		// created while the baseline step still used the live models
+		// already have the column.
+		Version: 3,
+		Name:    "link deliveries to notifications",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&NotificationDelivery{}, "NotificationIDs") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&NotificationDelivery{}, "NotificationIDs")
+		},
+	},
+}
+
+// appliedMigrations returns the applied migrations by version
+func appliedMigrations(db *gorm.DB) (map[int]SchemaMigration, error) {
+	applied := make(map[int]SchemaMigration)
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return applied, nil
+	}
+	var rows []SchemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, m := range rows {
+		applied[m.Version] = m
+	}
+	return applied, nil
+}
+
+// migrate applies pending migrations. It refuses to run against a database
+// migrated by a newer release.
+func (app *Application) migrate() error {
+	if err := app.db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(app.db)
+	if err != nil {
+		return err
+	}
+
+	latest := migrations[len(migrations)-1].Version
+	for version := range applied {
+		if version > latest {
+			return fmt.Errorf("the database is at schema version %d, newer than this release supports (%d)", version, latest)
+		}
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// A new database has nothing worth backing up. Server backups need
+	// SQLite; Postgres and MySQL are left to pg_dump and mysqldump.
+	if app.db.Migrator().HasTable(&User{}) {
+		if isSQLite(app.db) {
+			backup, err := app.takeServerBackup()
+			if err != nil {
+				return fmt.Errorf("backup before migrating failed: %v", err)
+			}
+			slog.Info("backed up the database before migrating", "backup", backup.Name)
+		} else {
+			slog.Warn("migrating without a backup; back the database up first if you haven't", "driver", app.db.Dialector.Name())
+		}
+	}
+
+	for _, m := range pending {
+		err := app.db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+		slog.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	return nil
+}
+
+// runMigrateCommand handles `clarkson-server migrate [status|up|copy]`:
+// status lists applied and pending migrations, up applies the pending ones
+// without starting the server and copy is runCopyCommand
+func runMigrateCommand(args []string) int {
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	if command == "copy" {
+		return runCopyCommand(args[1:])
+	}
+	if command != "status" && command != "up" {
+		fmt.Fprintln(os.Stderr, "usage: clarkson-server migrate [status|up|copy <sqlite file>]")
+		return 2
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		return 1
+	}
+	setupLogging(config)
+	db, err := initDB(config.Database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Database initialization failed: %v\n", err)
+		return 1
+	}
+	app := &Application{db: db, config: config, backups: config.Backups}
+
+	if command == "up" {
+		if err := app.migrate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+			return 1
+		}
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reading migrations failed: %v\n", err)
+		return 1
+	}
+	known := make(map[int]bool)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	pending := 0
+	for _, m := range migrations {
+		known[m.Version] = true
+		status := "pending"
+		if a, ok := applied[m.Version]; ok {
+			status = a.AppliedAt.Local().Format("2006-01-02 15:04:05")
+		} else {
+			pending++
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, status)
+	}
+	var unknown []int
+	for version := range applied {
+		if !known[version] {
+			unknown = append(unknown, version)
+		}
+	}
+	sort.Ints(unknown)
+	for _, version := range unknown {
+		a := applied[version]
+		fmt.Fprintf(w, "%d\t%s\t%s (unknown to this release)\n", version, a.Name, a.AppliedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	w.Flush()
+	fmt.Printf("%d pending\n", pending)
+	return 0
+}
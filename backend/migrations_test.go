@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// legacyDelivery is notification_deliveries before it gained notification_ids
+type legacyDelivery struct {
+	ID      uint `gorm:"primaryKey"`
+	UserID  uint
+	Channel string
+	Status  string
+}
+
+func (legacyDelivery) TableName() string { return "notification_deliveries" }
+
+// emptyTestApp returns an application on an empty, unmigrated database, with
+// backups going to a temporary directory
+func emptyTestApp(t *testing.T) *Application {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.Database = DatabaseConfig{Driver: "sqlite", DSN: filepath.Join(dir, "clarkson.db")}
+	cfg.Backups.Dir = filepath.Join(dir, "backups")
+
+	db, err := openDatabase(cfg.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Default.LogMode(logger.Silent)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return &Application{db: db, config: cfg, backups: cfg.Backups}
+}
+
+// legacyTestApp returns an application on a database as AutoMigrate left it
+// before versioned migrations
+func legacyTestApp(t *testing.T) *Application {
+	t.Helper()
+	app := emptyTestApp(t)
+	if err := app.db.AutoMigrate(&User{}, &Vehicle{}, &legacyDelivery{}); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	app := legacyTestApp(t)
+	app.db.Create(&User{Email: "driver@example.com", Units: "Miles", Currency: " eur"})
+	app.db.Create(&Vehicle{Make: "VW", MileageUnit: "KM"})
+	app.db.Create(&Vehicle{Make: "Ford", MileageUnit: ""})
+	app.db.Create(&legacyDelivery{UserID: 1, Channel: "email", Status: "sent"})
+
+	if err := app.migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := appliedMigrations(app.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("%d migrations applied, want %d", len(applied), len(migrations))
+	}
+
+	var user User
+	app.db.First(&user)
+	if user.Units != "mi" || user.Currency != "EUR" {
+		t.Errorf("user units and currency = %q, %q, want mi, EUR", user.Units, user.Currency)
+	}
+	var vehicles []Vehicle
+	app.db.Order("id").Find(&vehicles)
+	if vehicles[0].MileageUnit != "km" || vehicles[1].MileageUnit != "" {
+		t.Errorf("vehicle units = %q, %q, want km and the empty one left alone", vehicles[0].MileageUnit, vehicles[1].MileageUnit)
+	}
+
+	if !app.db.Migrator().HasColumn(&NotificationDelivery{}, "NotificationIDs") {
+		t.Fatal("notification_ids wasn't added")
+	}
+	var delivery NotificationDelivery
+	if err := app.db.First(&delivery).Error; err != nil || delivery.Channel != "email" {
+		t.Errorf("existing delivery = %+v, %v", delivery, err)
+	}
+
+	backups, _ := os.ReadDir(app.backups.Dir)
+	if len(backups) != 1 || !strings.HasSuffix(backups[0].Name(), ".zip") {
+		t.Errorf("backups = %v, want one taken before migrating", backups)
+	}
+
+	// Nothing is pending, so a second run neither migrates nor backs up
+	if err := app.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadDir(app.backups.Dir); len(again) != 1 {
+		t.Errorf("%d backups after a second run, want 1", len(again))
+	}
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	app := emptyTestApp(t)
+	if err := app.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := appliedMigrations(app.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			t.Errorf("migration %d not applied", m.Version)
+		}
+	}
+	if _, err := os.Stat(app.backups.Dir); !os.IsNotExist(err) {
+		t.Error("an empty database was backed up")
+	}
+
+	// The steps together give every model all of its columns
+	models := []interface{}{
+		&User{}, &Vehicle{}, &VehicleUser{}, &FuelEntry{}, &Expense{}, &MaintenanceReminder{},
+		&Attachment{}, &Notification{}, &NotificationDelivery{}, &UserChannel{}, &NotificationPreference{},
+	}
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: app.db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !app.db.Migrator().HasColumn(model, field.DBName) {
+				t.Errorf("%s.%s wasn't created", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+}
+
+func TestBaselineMigrationIsFrozen(t *testing.T) {
+	app := emptyTestApp(t)
+	if err := migrations[0].Up(app.db); err != nil {
+		t.Fatal(err)
+	}
+	// Columns added to the models since belong to later steps
+	if app.db.Migrator().HasColumn(&NotificationDelivery{}, "NotificationIDs") {
+		t.Error("the baseline step created notification_ids")
+	}
+	for _, m := range migrations[1:] {
+		if err := m.Up(app.db); err != nil {
+			t.Fatalf("migration %d: %v", m.Version, err)
+		}
+	}
+	if !app.db.Migrator().HasColumn(&NotificationDelivery{}, "NotificationIDs") {
+		t.Error("migration 3 didn't add notification_ids")
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	app := newTestApp(t)
+	latest := migrations[len(migrations)-1].Version
+	app.db.Create(&SchemaMigration{Version: latest + 1, Name: "from the future"})
+
+	err := app.migrate()
+	if err == nil || !strings.Contains(err.Error(), "newer than this release") {
+		t.Errorf("err = %v, want the newer schema refused", err)
+	}
+}
@@ -3,20 +3,22 @@ package main
 import (
 	"golang.org/x/crypto/bcrypt"
 	"time"
-	"gorm.io/gorm"
 )
 
-
 type User struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Email     string    `gorm:"uniqueIndex" json:"email"`
-	Name      string    json:"name"`
-	Password  string    json:"-"`
-	Role      string    json:"role"` // admin, user
-	Currency  string    `json:"currency"` // USD, EUR, etc
-	Units     string    `json:"units"` // mi, km
-	CreatedAt time.Time json:"created_at"`
-	UpdatedAt time.Time json:"updated_at"`
+	ID                 uint       `gorm:"primaryKey" json:"id"`
+	Email              string     `gorm:"uniqueIndex;size:255" json:"email"`
+	Name               string     `json:"name"`
+	Password           string     `json:"-"`
+	Role               string     `json:"role"`                // admin, user
+	Currency           string     `json:"currency"`            // USD, EUR, etc
+	Units              string     `json:"units"`               // mi, km
+	EmailNotifications bool       `json:"email_notifications"` // Opt-in to due/overdue emails
+	EmailDigest        bool       `json:"email_digest"`        // Opt-in to the weekly digest
+	LastDigestAt       *time.Time `json:"last_digest_at"`
+	CalendarToken      string     `gorm:"index" json:"-"` // Secret for the iCalendar feed URLs
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
 
 	Vehicles []Vehicle `gorm:"foreignKey:UserID" json:"vehicles,omitempty"`
 }
@@ -35,16 +37,17 @@ func (u *User) CheckPassword(password string) bool {
 }
 
 type Vehicle struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	UserID      uint      `json:"user_id"` // Owner
-	Make        string    `json:"make"`
-	Model       string    `json:"model"`
-	Year        int       `json:"year"`
-	Odometer    float64   `json:"odometer"` // Current odometer reading
-	MileageUnit string    `json:"mileage_unit"` // mi or km
-	FuelType    string    `json:"fuel_type"` // Petrol, Diesel, Electric, Hybrid, etc
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	UserID          uint      `json:"user_id"` // Owner
+	Make            string    `json:"make"`
+	Model           string    `json:"model"`
+	Year            int       `json:"year"`
+	Odometer        float64   `json:"odometer"`         // Current odometer reading
+	MileageUnit     string    `json:"mileage_unit"`     // mi or km
+	FuelType        string    `json:"fuel_type"`        // Petrol, Diesel, Electric, Hybrid, etc
+	RemindersPaused bool      `json:"reminders_paused"` // In storage, no reminders fire
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
 
 	FuelEntries []FuelEntry           `gorm:"foreignKey:VehicleID" json:"fuel_entries,omitempty"`
 	Expenses    []Expense             `gorm:"foreignKey:VehicleID" json:"expenses,omitempty"`
@@ -60,16 +63,18 @@ type VehicleUser struct {
 }
 
 type FuelEntry struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	VehicleID uint      `json:"vehicle_id"`
-	Date      time.Time `json:"date"`
-	Gallons   float64   `json:"gallons"` // Or liters
-	Price     float64   `json:"price"`
-	Odometer  float64   `json:"odometer"`
-	Location  string    `json:"location"`
-	Notes     string    `json:"notes"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	VehicleID    uint      `json:"vehicle_id"`
+	Date         time.Time `json:"date"`
+	Gallons      float64   `json:"gallons"` // Or liters
+	Price        float64   `json:"price"`
+	Odometer     float64   `json:"odometer"`
+	Location     string    `json:"location"`
+	Notes        string    `json:"notes"`
+	PartialFill  bool      `json:"partial_fill"`  // Tank not filled to the top
+	MissedFillup bool      `json:"missed_fillup"` // A previous fill-up wasn't recorded
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 
 	Vehicle     Vehicle      `gorm:"foreignKey:VehicleID" json:"vehicle,omitempty"`
 	Attachments []Attachment `gorm:"foreignKey:EntryID;foreignKeyValue:fuelentry" json:"attachments,omitempty"`
@@ -90,15 +95,20 @@ type Expense struct {
 }
 
 type MaintenanceReminder struct {
-	ID               uint      `gorm:"primaryKey" json:"id"`
-	VehicleID        uint      `json:"vehicle_id"`
-	Name             string    `json:"name"` // Oil Change, Tire Rotation, etc
-	IntervalMiles    float64   `json:"interval_miles"` // 0 = disabled
-	IntervalDays     int       `json:"interval_days"` // 0 = disabled
-	LastServiceDate  time.Time `json:"last_service_date"`
-	LastServiceMiles float64   `json:"last_service_miles"`
-	CreatedAt        time.Time `json:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at"`
+	ID                uint       `gorm:"primaryKey" json:"id"`
+	VehicleID         uint       `json:"vehicle_id"`
+	Name              string     `json:"name"`           // Oil Change, Tire Rotation, etc
+	IntervalMiles     float64    `json:"interval_miles"` // 0 = disabled
+	IntervalDays      int        `json:"interval_days"`  // 0 = disabled
+	LastServiceDate   time.Time  `json:"last_service_date"`
+	LastServiceMiles  float64    `json:"last_service_miles"`
+	DueDate           *time.Time `json:"due_date"`  // One-off reminder by date
+	DueMiles          float64    `json:"due_miles"` // One-off reminder by odometer, 0 = disabled
+	SnoozedUntil      *time.Time `json:"snoozed_until"`
+	SnoozedUntilMiles float64    `json:"snoozed_until_miles"` // 0 = not snoozed by distance
+	CompletedAt       *time.Time `json:"completed_at"`        // Set when a one-off reminder is done
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
 
 	Vehicle Vehicle `gorm:"foreignKey:VehicleID" json:"vehicle,omitempty"`
 }
@@ -113,14 +123,30 @@ type Attachment struct {
 }
 
 type Notification struct {
-	ID            uint       `gorm:"primaryKey" json:"id"`
-	UserID        uint       `json:"user_id"`
-	VehicleID     uint       `json:"vehicle_id"`
-	ReminderID    uint       `json:"reminder_id"`
-	Type          string     `json:"type"` // reminder_due, reminder_overdue
-	Title         string     `json:"title"`
-	Message       string     `json:"message"`
-	Status        string     `json:"status"` // unread, read, dismissed
-	CreatedAt     time.Time  `json:"created_at"`
-	DismissedAt   *time.Time `json:"dismissed_at"`
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `json:"user_id"`
+	VehicleID   uint       `json:"vehicle_id"`
+	ReminderID  uint       `json:"reminder_id"`
+	Type        string     `json:"type"` // reminder_due, reminder_overdue
+	Title       string     `json:"title"`
+	Message     string     `json:"message"`
+	Status      string     `json:"status"` // unread, read, dismissed, resolved
+	CreatedAt   time.Time  `json:"created_at"`
+	DismissedAt *time.Time `json:"dismissed_at"` // When dismissed or resolved
+	Delivery    string     `json:"delivery"`     // pending, sending, sent, partial, failed, skipped, suppressed
+}
+
+// NotificationDelivery records each attempt to send notifications outside the app
+type NotificationDelivery struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	UserID          uint      `gorm:"index" json:"user_id"`
+	Channel         string    `json:"channel"` // email, ntfy, gotify, webhook
+	Kind            string    `json:"kind"`    // reminder, digest, test
+	Recipient       string    `json:"recipient"`
+	Subject         string    `json:"subject"`
+	NotificationIDs []uint    `gorm:"serializer:json" json:"notification_ids"` // The notifications carried, if any
+	Status          string    `json:"status"`                                  // sent, failed
+	Attempts        int       `json:"attempts"`
+	Error           string    `json:"error"`
+	CreatedAt       time.Time `json:"created_at"`
 }
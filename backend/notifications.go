@@ -2,69 +2,156 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
+	"strconv"
 	"time"
-	"gorm.io/gorm"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Thresholds for flagging a reminder as due soon
+const (
+	reminderSoonMiles = 500
+	reminderSoonDays  = 7
 )
 
+// ReminderState is the evaluated due state of a reminder at an odometer reading.
+type ReminderState struct {
+	Status    string // overdue, soon, upcoming, snoozed, paused, completed
+	ByMiles   bool
+	ByDays    bool
+	DueMiles  float64
+	DueDate   time.Time
+	MilesToGo float64
+	DaysUntil int
+}
+
+// IsOneOff reports whether the reminder fires once at a fixed date or odometer
+// reading instead of recurring on an interval.
+func (r *MaintenanceReminder) IsOneOff() bool {
+	return r.DueDate != nil || r.DueMiles > 0
+}
 
-type Notification struct {
-	ID            uint      `gorm:"primaryKey" json:"id"`
-	UserID        uint      `json:"user_id"`
-	VehicleID     uint      `json:"vehicle_id"`
-	ReminderID    uint      `json:"reminder_id"`
-	Type          string    `json:"type"` // reminder_due, reminder_overdue
-	Title         string    `json:"title"`
-	Message       string    `json:"message"`
-	Status        string    `json:"status"` // unread, read, dismissed
-	CreatedAt     time.Time `json:"created_at"`
-	DismissedAt   *time.Time `json:"dismissed_at"`
+// IsSnoozed reports whether a snooze set on the reminder is still in effect.
+// A snooze by both days and distance ends at whichever limit is reached first.
+func (r *MaintenanceReminder) IsSnoozed(odometer float64, now time.Time) bool {
+	if r.SnoozedUntil == nil && r.SnoozedUntilMiles == 0 {
+		return false
+	}
+	if r.SnoozedUntil != nil && !now.Before(*r.SnoozedUntil) {
+		return false
+	}
+	if r.SnoozedUntilMiles > 0 && odometer >= r.SnoozedUntilMiles {
+		return false
+	}
+	return true
+}
+
+// evaluateReminder works out whether a reminder is due at the given odometer
+// reading. Paused, snoozed and completed reminders never report overdue or soon.
+func evaluateReminder(r MaintenanceReminder, paused bool, odometer float64, now time.Time) ReminderState {
+	var state ReminderState
+
+	if r.IsOneOff() {
+		if r.DueMiles > 0 {
+			state.ByMiles = true
+			state.DueMiles = r.DueMiles
+		}
+		if r.DueDate != nil {
+			state.ByDays = true
+			state.DueDate = *r.DueDate
+		}
+	} else {
+		if r.IntervalMiles > 0 {
+			state.ByMiles = true
+			state.DueMiles = r.LastServiceMiles + r.IntervalMiles
+		}
+		if r.IntervalDays > 0 {
+			state.ByDays = true
+			state.DueDate = r.LastServiceDate.AddDate(0, 0, r.IntervalDays)
+		}
+	}
+
+	state.Status = "upcoming"
+	if state.ByMiles {
+		state.MilesToGo = state.DueMiles - odometer
+		if state.MilesToGo <= 0 {
+			state.Status = "overdue"
+		} else if state.MilesToGo < reminderSoonMiles {
+			state.Status = "soon"
+		}
+	}
+	if state.ByDays {
+		state.DaysUntil = int(state.DueDate.Sub(now).Hours() / 24)
+		if state.DaysUntil <= 0 {
+			state.Status = "overdue"
+		} else if state.DaysUntil < reminderSoonDays && state.Status != "overdue" {
+			state.Status = "soon"
+		}
+	}
+
+	switch {
+	case r.IsOneOff() && r.CompletedAt != nil:
+		state.Status = "completed"
+	case paused:
+		state.Status = "paused"
+	case state.Status != "upcoming" && r.IsSnoozed(odometer, now):
+		state.Status = "snoozed"
+	}
+
+	return state
 }
 
 func (app *Application) checkVehicleRemindersAdvanced(vehicleID uint, currentOdometer float64) []Notification {
+	var vehicle Vehicle
+	if err := app.db.First(&vehicle, vehicleID).Error; err != nil {
+		return nil
+	}
+
 	var reminders []MaintenanceReminder
 	app.db.Where("vehicle_id = ?", vehicleID).Find(&reminders)
 
 	var notifications []Notification
+	now := time.Now()
 
 	for _, r := range reminders {
+		state := evaluateReminder(r, vehicle.RemindersPaused, currentOdometer, now)
+		if state.Status != "overdue" && state.Status != "soon" {
+			continue
+		}
+
 		var notif Notification
 		notif.VehicleID = vehicleID
 		notif.ReminderID = r.ID
 		notif.Status = "unread"
-		notif.CreatedAt = time.Now()
+		notif.CreatedAt = now
 
 		// Check mileage-based reminder
-		if r.IntervalMiles > 0 {
-			nextServiceMiles := r.LastServiceMiles + r.IntervalMiles
-			milesSinceService := nextServiceMiles - currentOdometer
-
-			if currentOdometer >= nextServiceMiles {
+		if state.ByMiles {
+			if state.MilesToGo <= 0 {
 				notif.Type = "reminder_overdue"
 				notif.Title = fmt.Sprintf("%s - OVERDUE", r.Name)
-				notif.Message = fmt.Sprintf("This service was due %.0f miles ago at %.0f miles", -milesSinceService, nextServiceMiles)
+				notif.Message = fmt.Sprintf("This service was due %.0f miles ago at %.0f miles", -state.MilesToGo, state.DueMiles)
 				notifications = append(notifications, notif)
-			} else if milesSinceService < 500 {
+			} else if state.MilesToGo < reminderSoonMiles {
 				notif.Type = "reminder_due"
 				notif.Title = fmt.Sprintf("%s - DUE SOON", r.Name)
-				notif.Message = fmt.Sprintf("Service due in %.0f miles (at %.0f miles)", milesSinceService, nextServiceMiles)
+				notif.Message = fmt.Sprintf("Service due in %.0f miles (at %.0f miles)", state.MilesToGo, state.DueMiles)
 				notifications = append(notifications, notif)
 			}
 		}
 
-		// Check days-based reminder
-		if r.IntervalDays > 0 {
-			nextServiceDate := r.LastServiceDate.AddDate(0, 0, r.IntervalDays)
-			daysUntilDue := int(time.Until(nextServiceDate).Hours() / 24)
-
-			if daysUntilDue <= 0 {
+		// Check date-based reminder
+		if state.ByDays {
+			if state.DaysUntil <= 0 {
 				notif.Type = "reminder_overdue"
 				notif.Title = fmt.Sprintf("%s - OVERDUE", r.Name)
-				notif.Message = fmt.Sprintf("This service was due %d days ago", -daysUntilDue)
+				notif.Message = fmt.Sprintf("This service was due %d days ago", -state.DaysUntil)
 				notifications = append(notifications, notif)
-			} else if daysUntilDue < 7 {
+			} else if state.DaysUntil < reminderSoonDays {
 				notif.Type = "reminder_due"
 				notif.Title = fmt.Sprintf("%s - DUE SOON", r.Name)
-				notif.Message = fmt.Sprintf("Service due in %d days", daysUntilDue)
+				notif.Message = fmt.Sprintf("Service due in %d days", state.DaysUntil)
 				notifications = append(notifications, notif)
 			}
 		}
@@ -74,51 +161,332 @@ func (app *Application) checkVehicleRemindersAdvanced(vehicleID uint, currentOdo
 }
 
 func (app *Application) storeNotifications(userID uint, notifications []Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
 	for i := range notifications {
 		notifications[i].UserID = userID
+		notifications[i].Delivery = "pending"
+	}
+	if err := app.db.Create(&notifications).Error; err != nil {
+		return err
+	}
+
+	for _, n := range notifications {
+		app.events.Publish(userID, "notification.created", n)
+	}
+
+	// External delivery waits on the user's quiet hours and batching preferences
+	app.workers.Go("notification delivery", func() { app.flushUserNotifications(userID, time.Now()) })
+	return nil
+}
+
+// emailNotifications sends notifications to a user who has opted in to email
+// delivery, adding the result to outcomes
+func (app *Application) emailNotifications(userID uint, notifications []Notification, outcomes deliveryOutcomes) {
+	if app.mailer == nil {
+		return
+	}
+
+	var user User
+	if err := app.db.First(&user, userID).Error; err != nil || !user.EmailNotifications {
+		return
+	}
+
+	msg, err := renderReminderEmail(user, notifications)
+	if err != nil {
+		slog.Error("rendering reminder email failed", "user_id", userID, "error", err)
+		outcomes.add(notifications, err)
+		return
 	}
-	return app.db.Create(&notifications).Error
+
+	outcomes.add(notifications, app.sendLoggedEmail(userID, "reminder", msg, notificationIDs(notifications)))
 }
 
-func (app *Application) getUnreadNotifications(c *gin.Context) {
+// sendLoggedEmail sends a message and records the outcome in the delivery
+// log against the notifications it carried
+func (app *Application) sendLoggedEmail(userID uint, kind string, msg EmailMessage, ids []uint) error {
+	attempts, err := app.mailer.Send(msg)
+
+	delivery := NotificationDelivery{
+		UserID:          userID,
+		Channel:         "email",
+		Kind:            kind,
+		Recipient:       msg.To,
+		Subject:         msg.Subject,
+		NotificationIDs: ids,
+		Status:          "sent",
+		Attempts:        attempts,
+	}
+	if err != nil {
+		delivery.Status = "failed"
+		delivery.Error = err.Error()
+		slog.Warn("notification delivery failed", "channel", "email", "kind", kind, "user_id", userID, "attempts", attempts, "error", err)
+	}
+	app.metrics.delivered("email", kind, delivery.Status)
+
+	if dbErr := app.db.Create(&delivery).Error; dbErr != nil {
+		slog.Error("recording delivery failed", "channel", "email", "error", dbErr)
+	}
+
+	return err
+}
+
+func (app *Application) listNotificationDeliveries(c *gin.Context) {
 	userID := c.GetUint("userID")
-	var notifications []Notification
+	var deliveries []NotificationDelivery
 
 	if err := app.db.
-		Where("user_id = ? AND status = ?", userID, "unread").
+		Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Limit(100).
+		Find(&deliveries).Error; err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, deliveries)
+}
+
+// openNotificationStatuses are the statuses still shown to the user
+var openNotificationStatuses = []string{"unread", "read"}
+
+// listUserNotifications lists the user's notifications, newest first.
+// Filters: status (unread, read, dismissed, resolved, open or all; default
+// unread), type and vehicle_id. Paginated with page and per_page; the total
+// is returned in X-Total-Count.
+func (app *Application) listUserNotifications(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	query := app.db.Model(&Notification{}).Where("user_id = ?", userID)
+
+	switch status := c.DefaultQuery("status", "unread"); status {
+	case "all":
+	case "open":
+		query = query.Where("status IN ?", openNotificationStatuses)
+	case "unread", "read", "dismissed", "resolved":
+		query = query.Where("status = ?", status)
+	default:
+		c.JSON(400, gin.H{"error": "Invalid status filter"})
+		return
+	}
+	if notifType := c.Query("type"); notifType != "" {
+		query = query.Where("type = ?", notifType)
+	}
+	if vehicleID := c.Query("vehicle_id"); vehicleID != "" {
+		query = query.Where("vehicle_id = ?", vehicleID)
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "50"))
+	if perPage < 1 || perPage > 200 {
+		perPage = 50
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	var notifications []Notification
+	if err := query.
 		Order("created_at DESC").
+		Offset((page - 1) * perPage).
+		Limit(perPage).
 		Find(&notifications).Error; err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	c.Header("X-Page", strconv.Itoa(page))
+	c.Header("X-Per-Page", strconv.Itoa(perPage))
 	c.JSON(200, notifications)
 }
 
 func (app *Application) markNotificationRead(c *gin.Context) {
-	notifID := c.Param("id")
+	userID := c.GetUint("userID")
+	notifID := parseUint(c.Param("id"))
 
-	if err := app.db.Model(&Notification{}).Where("id = ?", notifID).Update("status", "read").Error; err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	result := app.db.Model(&Notification{}).
+		Where("id = ? AND user_id = ?", notifID, userID).
+		Update("status", "read")
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Notification not found"})
 		return
 	}
 
+	app.events.Publish(userID, "notification.updated", gin.H{
+		"ids":    []uint{notifID},
+		"status": "read",
+	})
+
 	c.JSON(200, gin.H{"message": "Marked as read"})
 }
 
 func (app *Application) dismissNotification(c *gin.Context) {
-	notifID := c.Param("id")
+	userID := c.GetUint("userID")
+	notifID := parseUint(c.Param("id"))
 	now := time.Now()
 
-	if err := app.db.Model(&Notification{}).Where("id = ?", notifID).Updates(map[string]interface{}{
+	result := app.db.Model(&Notification{}).
+		Where("id = ? AND user_id = ?", notifID, userID).
+		Updates(map[string]interface{}{
+			"status":       "dismissed",
+			"dismissed_at": now,
+		})
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Notification not found"})
+		return
+	}
+
+	app.events.Publish(userID, "notification.updated", gin.H{
+		"ids":          []uint{notifID},
 		"status":       "dismissed",
 		"dismissed_at": now,
-	}).Error; err != nil {
+	})
+
+	c.JSON(200, gin.H{"message": "Dismissed"})
+}
+
+func (app *Application) markAllNotificationsRead(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	query := app.db.Model(&Notification{}).Where("user_id = ? AND status = ?", userID, "unread")
+	if vehicleID := c.Query("vehicle_id"); vehicleID != "" {
+		query = query.Where("vehicle_id = ?", vehicleID)
+	}
+
+	var ids []uint
+	if err := query.Pluck("id", &ids).Error; err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(200, gin.H{"message": "Dismissed"})
+	if len(ids) > 0 {
+		if err := app.db.Model(&Notification{}).Where("id IN ?", ids).Update("status", "read").Error; err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		app.events.Publish(userID, "notification.updated", gin.H{
+			"ids":    ids,
+			"status": "read",
+		})
+	}
+
+	c.JSON(200, gin.H{"updated": len(ids)})
+}
+
+func (app *Application) bulkUpdateNotifications(c *gin.Context) {
+	userID := c.GetUint("userID")
+	var req struct {
+		IDs    []uint `json:"ids" binding:"required,min=1,max=500"`
+		Action string `json:"action" binding:"required,oneof=read dismiss"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	// Only touch the caller's own notifications
+	var ids []uint
+	if err := app.db.Model(&Notification{}).
+		Where("id IN ? AND user_id = ?", req.IDs, userID).
+		Pluck("id", &ids).Error; err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(ids) == 0 {
+		c.JSON(200, gin.H{"updated": 0})
+		return
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"status": "read"}
+	event := gin.H{"ids": ids, "status": "read"}
+	if req.Action == "dismiss" {
+		updates = map[string]interface{}{"status": "dismissed", "dismissed_at": now}
+		event = gin.H{"ids": ids, "status": "dismissed", "dismissed_at": now}
+	}
+
+	if err := app.db.Model(&Notification{}).Where("id IN ?", ids).Updates(updates).Error; err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	app.events.Publish(userID, "notification.updated", event)
+
+	c.JSON(200, gin.H{"updated": len(ids)})
+}
+
+// resolveReminderNotifications closes the open notifications of a reminder
+// once it has been serviced or removed
+func (app *Application) resolveReminderNotifications(reminderID uint) {
+	var notifications []Notification
+	if err := app.db.
+		Where("reminder_id = ? AND status IN ?", reminderID, openNotificationStatuses).
+		Find(&notifications).Error; err != nil || len(notifications) == 0 {
+		return
+	}
+
+	now := time.Now()
+	byUser := make(map[uint][]uint)
+	var ids []uint
+	for _, n := range notifications {
+		ids = append(ids, n.ID)
+		byUser[n.UserID] = append(byUser[n.UserID], n.ID)
+	}
+
+	if err := app.db.Model(&Notification{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+		"status":       "resolved",
+		"dismissed_at": now,
+	}).Error; err != nil {
+		slog.Error("resolving notifications failed", "reminder_id", reminderID, "error", err)
+		return
+	}
+
+	for userID, userIDs := range byUser {
+		app.events.Publish(userID, "notification.updated", gin.H{
+			"ids":          userIDs,
+			"status":       "resolved",
+			"dismissed_at": now,
+		})
+	}
+}
+
+// purgeOldNotifications deletes dismissed and resolved notifications closed
+// more than the retention period ago
+func (app *Application) purgeOldNotifications() error {
+	if app.notificationRetentionDays <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -app.notificationRetentionDays)
+	result := app.db.
+		Where("status IN ? AND dismissed_at < ?", []string{"dismissed", "resolved"}, cutoff).
+		Delete(&Notification{})
+	if result.Error != nil {
+		slog.Error("purging old notifications failed", "error", result.Error)
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		slog.Info("purged old notifications", "count", result.RowsAffected, "retention_days", app.notificationRetentionDays)
+	}
+	return nil
 }
 
 func (app *Application) getNotificationSummary(c *gin.Context) {
@@ -128,10 +496,10 @@ func (app *Application) getNotificationSummary(c *gin.Context) {
 	app.db.Model(&Notification{}).Where("user_id = ? AND status = ?", userID, "unread").Count(&unreadCount)
 
 	var overdueCount int64
-	app.db.Model(&Notification{}).Where("user_id = ? AND status != ? AND type = ?", userID, "dismissed", "reminder_overdue").Count(&overdueCount)
+	app.db.Model(&Notification{}).Where("user_id = ? AND status IN ? AND type = ?", userID, openNotificationStatuses, "reminder_overdue").Count(&overdueCount)
 
 	var upcomingCount int64
-	app.db.Model(&Notification{}).Where("user_id = ? AND status != ? AND type = ?", userID, "dismissed", "reminder_due").Count(&upcomingCount)
+	app.db.Model(&Notification{}).Where("user_id = ? AND status IN ? AND type = ?", userID, openNotificationStatuses, "reminder_due").Count(&upcomingCount)
 
 	c.JSON(200, gin.H{
 		"unread_count":   unreadCount,
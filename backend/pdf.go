@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// PDF reports are drawn with gofpdf's built-in fonts and shapes, so no font
+// files or headless browser are needed at runtime.
+
+const (
+	pdfChartHeight = 55.0
+	pdfThumbSize   = 40.0
+	pdfThumbPixels = 400
+	pdfMaxReceipts = 24
+	pdfRowHeight   = 6.0
+)
+
+type chartPoint struct {
+	Label string
+	Value float64
+}
+
+// pdfReport wraps a document with the user's currency and helpers for the
+// building blocks every report uses
+type pdfReport struct {
+	pdf      *gofpdf.Fpdf
+	tr       func(string) string // UTF-8 to the core fonts' code page
+	currency string
+}
+
+func newPDFReport(title, currency string) *pdfReport {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(15, 15, 15)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.SetTitle(title, true)
+	pdf.SetCreator("Clarkson", true)
+	pdf.AliasNbPages("")
+
+	r := &pdfReport{
+		pdf:      pdf,
+		tr:       pdf.UnicodeTranslatorFromDescriptor(""),
+		currency: currency,
+	}
+	if r.currency == "" {
+		r.currency = "USD"
+	}
+
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.SetTextColor(128, 128, 128)
+		pdf.CellFormat(0, 6, r.tr(fmt.Sprintf("%s - page %d of {nb}", title, pdf.PageNo())), "", 0, "C", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+	})
+
+	return r
+}
+
+func (r *pdfReport) money(amount float64) string {
+	return fmt.Sprintf("%s %.2f", r.currency, amount)
+}
+
+func (r *pdfReport) contentWidth() float64 {
+	pageW, _ := r.pdf.GetPageSize()
+	left, _, right, _ := r.pdf.GetMargins()
+	return pageW - left - right
+}
+
+// ensureSpace starts a new page unless h millimetres are left on this one
+func (r *pdfReport) ensureSpace(h float64) {
+	_, pageH := r.pdf.GetPageSize()
+	_, _, _, bottom := r.pdf.GetMargins()
+	if r.pdf.GetY()+h > pageH-bottom {
+		r.pdf.AddPage()
+	}
+}
+
+func (r *pdfReport) title(text, subtitle string) {
+	r.pdf.SetFont("Helvetica", "B", 18)
+	r.pdf.CellFormat(0, 10, r.tr(text), "", 1, "L", false, 0, "")
+	r.pdf.SetFont("Helvetica", "", 10)
+	r.pdf.SetTextColor(96, 96, 96)
+	r.pdf.CellFormat(0, 6, r.tr(subtitle), "", 1, "L", false, 0, "")
+	r.pdf.SetTextColor(0, 0, 0)
+	r.pdf.Ln(4)
+}
+
+func (r *pdfReport) heading(text string) {
+	r.ensureSpace(20)
+	r.pdf.Ln(3)
+	r.pdf.SetFont("Helvetica", "B", 12)
+	r.pdf.CellFormat(0, 8, r.tr(text), "B", 1, "L", false, 0, "")
+	r.pdf.Ln(2)
+}
+
+func (r *pdfReport) note(text string) {
+	r.pdf.SetFont("Helvetica", "I", 9)
+	r.pdf.SetTextColor(96, 96, 96)
+	r.pdf.MultiCell(0, 5, r.tr(text), "", "L", false)
+	r.pdf.SetTextColor(0, 0, 0)
+}
+
+// fit truncates text so it fits in a cell of width w
+func (r *pdfReport) fit(text string, w float64) string {
+	text = r.tr(strings.ReplaceAll(text, "\n", " "))
+	if r.pdf.GetStringWidth(text) <= w-2 {
+		return text
+	}
+	for len(text) > 0 && r.pdf.GetStringWidth(text+"...") > w-2 {
+		text = text[:len(text)-1]
+	}
+	return text + "..."
+}
+
+// table draws rows under a header that is repeated on each new page. aligns
+// holds one CellFormat alignment per column.
+func (r *pdfReport) table(headers []string, widths []float64, aligns []string, rows [][]string) {
+	drawHeader := func() {
+		r.pdf.SetFont("Helvetica", "B", 9)
+		r.pdf.SetFillColor(230, 230, 230)
+		for i, h := range headers {
+			r.pdf.CellFormat(widths[i], pdfRowHeight+1, r.tr(h), "B", 0, aligns[i], true, 0, "")
+		}
+		r.pdf.Ln(-1)
+		r.pdf.SetFont("Helvetica", "", 9)
+	}
+
+	r.ensureSpace(3 * pdfRowHeight)
+	drawHeader()
+
+	_, pageH := r.pdf.GetPageSize()
+	_, _, _, bottom := r.pdf.GetMargins()
+	for n, row := range rows {
+		if r.pdf.GetY()+pdfRowHeight > pageH-bottom {
+			r.pdf.AddPage()
+			drawHeader()
+		}
+		fill := n%2 == 1
+		r.pdf.SetFillColor(246, 246, 246)
+		for i, cell := range row {
+			r.pdf.CellFormat(widths[i], pdfRowHeight, r.fit(cell, widths[i]), "", 0, aligns[i], fill, 0, "")
+		}
+		r.pdf.Ln(-1)
+	}
+	r.pdf.Ln(2)
+}
+
+// keyValues draws label/value pairs in two columns
+func (r *pdfReport) keyValues(pairs [][2]string) {
+	colW := r.contentWidth() / 2
+	left, _, _, _ := r.pdf.GetMargins()
+
+	for i := 0; i < len(pairs); i += 2 {
+		r.ensureSpace(pdfRowHeight)
+		for j := i; j < i+2 && j < len(pairs); j++ {
+			r.pdf.SetX(left + colW*float64(j-i))
+			r.pdf.SetFont("Helvetica", "", 9)
+			r.pdf.SetTextColor(96, 96, 96)
+			r.pdf.CellFormat(colW*0.45, pdfRowHeight, r.tr(pairs[j][0]), "", 0, "L", false, 0, "")
+			r.pdf.SetFont("Helvetica", "B", 9)
+			r.pdf.SetTextColor(0, 0, 0)
+			r.pdf.CellFormat(colW*0.55, pdfRowHeight, r.tr(pairs[j][1]), "", 0, "L", false, 0, "")
+		}
+		r.pdf.Ln(-1)
+	}
+	r.pdf.Ln(2)
+}
+
+// costBreakdown lists each category with its share of the total as a bar
+func (r *pdfReport) costBreakdown(categories map[string]float64) {
+	type category struct {
+		name   string
+		amount float64
+	}
+
+	var sorted []category
+	total := 0.0
+	for name, amount := range categories {
+		sorted = append(sorted, category{name, amount})
+		total += amount
+	}
+	if total <= 0 {
+		r.note("No costs in this period.")
+		return
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].amount > sorted[j].amount })
+
+	barW := r.contentWidth() - 110
+	r.pdf.SetFont("Helvetica", "", 9)
+	for _, cat := range sorted {
+		r.ensureSpace(pdfRowHeight)
+		share := cat.amount / total
+		r.pdf.CellFormat(50, pdfRowHeight, r.fit(cat.name, 50), "", 0, "L", false, 0, "")
+		r.pdf.CellFormat(40, pdfRowHeight, r.money(cat.amount), "", 0, "R", false, 0, "")
+		r.pdf.CellFormat(20, pdfRowHeight, fmt.Sprintf("%.1f%%", share*100), "", 0, "R", false, 0, "")
+
+		x, y := r.pdf.GetXY()
+		r.pdf.SetFillColor(52, 101, 164)
+		if w := barW * share; w > 0 {
+			r.pdf.Rect(x+3, y+1.5, w, pdfRowHeight-3, "F")
+		}
+		r.pdf.Ln(-1)
+	}
+	r.pdf.SetFont("Helvetica", "B", 9)
+	r.pdf.CellFormat(50, pdfRowHeight, "Total", "T", 0, "L", false, 0, "")
+	r.pdf.CellFormat(40, pdfRowHeight, r.money(total), "T", 1, "R", false, 0, "")
+	r.pdf.Ln(2)
+}
+
+// chartFrame draws the title, gridlines and value axis shared by both chart
+// types and returns the plot area
+func (r *pdfReport) chartFrame(title string, lo, hi float64, format string) (x0, y0, w, h float64) {
+	r.ensureSpace(pdfChartHeight + 10)
+	r.pdf.SetFont("Helvetica", "B", 10)
+	r.pdf.CellFormat(0, 7, r.tr(title), "", 1, "L", false, 0, "")
+
+	left, _, _, _ := r.pdf.GetMargins()
+	x0 = left + 18
+	y0 = r.pdf.GetY() + 2
+	w = r.contentWidth() - 18
+	h = pdfChartHeight - 12
+
+	r.pdf.SetFont("Helvetica", "", 7)
+	r.pdf.SetDrawColor(220, 220, 220)
+	r.pdf.SetLineWidth(0.2)
+	for i := 0; i <= 4; i++ {
+		y := y0 + h - h*float64(i)/4
+		r.pdf.Line(x0, y, x0+w, y)
+		r.pdf.SetXY(left, y-2)
+		r.pdf.CellFormat(16, 4, fmt.Sprintf(format, lo+(hi-lo)*float64(i)/4), "", 0, "R", false, 0, "")
+	}
+	r.pdf.SetDrawColor(0, 0, 0)
+
+	return x0, y0, w, h
+}
+
+// chartLabels writes category labels under the plot, thinned out so they
+// don't overlap
+func (r *pdfReport) chartLabels(points []chartPoint, x0, y, slot float64) {
+	step := (len(points) + 11) / 12
+	r.pdf.SetFont("Helvetica", "", 7)
+	for i, p := range points {
+		if i%step != 0 {
+			continue
+		}
+		r.pdf.SetXY(x0+slot*float64(i)+slot/2-10, y+1)
+		r.pdf.CellFormat(20, 4, r.tr(p.Label), "", 0, "C", false, 0, "")
+	}
+}
+
+func (r *pdfReport) barChart(title string, points []chartPoint) {
+	if len(points) == 0 {
+		return
+	}
+
+	max := 0.0
+	for _, p := range points {
+		if p.Value > max {
+			max = p.Value
+		}
+	}
+	if max <= 0 {
+		max = 1
+	}
+
+	x0, y0, w, h := r.chartFrame(title, 0, max, "%.0f")
+	slot := w / float64(len(points))
+
+	r.pdf.SetFillColor(52, 101, 164)
+	for i, p := range points {
+		barH := h * p.Value / max
+		if barH > 0 {
+			r.pdf.Rect(x0+slot*float64(i)+slot*0.15, y0+h-barH, slot*0.7, barH, "F")
+		}
+	}
+
+	r.chartLabels(points, x0, y0+h, slot)
+	r.pdf.SetY(y0 + pdfChartHeight - 8)
+}
+
+func (r *pdfReport) lineChart(title string, points []chartPoint) {
+	if len(points) < 2 {
+		return
+	}
+
+	lo, hi := points[0].Value, points[0].Value
+	for _, p := range points {
+		if p.Value < lo {
+			lo = p.Value
+		}
+		if p.Value > hi {
+			hi = p.Value
+		}
+	}
+	pad := (hi - lo) * 0.1
+	if pad == 0 {
+		pad = 1
+	}
+	lo, hi = lo-pad, hi+pad
+	if lo < 0 {
+		lo = 0
+	}
+
+	x0, y0, w, h := r.chartFrame(title, lo, hi, "%.1f")
+	slot := w / float64(len(points))
+	pointXY := func(i int) (float64, float64) {
+		return x0 + slot*float64(i) + slot/2, y0 + h - h*(points[i].Value-lo)/(hi-lo)
+	}
+
+	r.pdf.SetDrawColor(52, 101, 164)
+	r.pdf.SetFillColor(52, 101, 164)
+	r.pdf.SetLineWidth(0.6)
+	for i := range points {
+		x, y := pointXY(i)
+		if i > 0 {
+			px, py := pointXY(i - 1)
+			r.pdf.Line(px, py, x, y)
+		}
+		r.pdf.Circle(x, y, 0.8, "F")
+	}
+	r.pdf.SetLineWidth(0.2)
+	r.pdf.SetDrawColor(0, 0, 0)
+
+	r.chartLabels(points, x0, y0+h, slot)
+	r.pdf.SetY(y0 + pdfChartHeight - 8)
+}
+
+// receipts embeds thumbnails of image attachments in a grid. Files that are
+// missing or aren't JPEG/PNG images are skipped.
+func (r *pdfReport) receipts(attachments []Attachment) {
+	perRow := int(r.contentWidth() / (pdfThumbSize + 5))
+	left, _, _, _ := r.pdf.GetMargins()
+
+	col := 0
+	for _, a := range attachments {
+		name := fmt.Sprintf("attachment-%d", a.ID)
+		width, height, err := r.registerThumbnail(name, a.Path)
+		if err != nil {
+			continue
+		}
+
+		if col == 0 {
+			r.ensureSpace(pdfThumbSize + 8)
+		}
+		x := left + float64(col)*(pdfThumbSize+5)
+		y := r.pdf.GetY()
+
+		// Scale into the square cell, keeping the aspect ratio
+		w, h := pdfThumbSize, pdfThumbSize*height/width
+		if height > width {
+			w, h = pdfThumbSize*width/height, pdfThumbSize
+		}
+		r.pdf.ImageOptions(name, x+(pdfThumbSize-w)/2, y+(pdfThumbSize-h)/2, w, h, false, gofpdf.ImageOptions{ImageType: "JPG"}, 0, "")
+
+		r.pdf.SetFont("Helvetica", "", 7)
+		r.pdf.SetXY(x, y+pdfThumbSize+0.5)
+		r.pdf.CellFormat(pdfThumbSize, 4, r.fit(a.Filename, pdfThumbSize), "", 0, "C", false, 0, "")
+		r.pdf.SetXY(left, y)
+
+		col++
+		if col == perRow {
+			col = 0
+			r.pdf.SetY(y + pdfThumbSize + 6)
+		}
+	}
+	if col > 0 {
+		r.pdf.SetY(r.pdf.GetY() + pdfThumbSize + 6)
+	}
+}
+
+// registerThumbnail downscales an image file and adds it to the document as
+// a JPEG, returning its pixel size
+func (r *pdfReport) registerThumbnail(name, path string) (float64, float64, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+		return 0, 0, fmt.Errorf("unsupported image format: %s", ext)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	thumb := thumbnail(img, pdfThumbPixels)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 75}); err != nil {
+		return 0, 0, err
+	}
+
+	r.pdf.RegisterImageOptionsReader(name, gofpdf.ImageOptions{ImageType: "JPG"}, &buf)
+	if err := r.pdf.Error(); err != nil {
+		r.pdf.ClearError()
+		return 0, 0, err
+	}
+
+	bounds := thumb.Bounds()
+	return float64(bounds.Dx()), float64(bounds.Dy()), nil
+}
+
+// thumbnail scales an image down so neither side exceeds max pixels
+func thumbnail(img image.Image, max int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= max && h <= max {
+		return img
+	}
+
+	scale := float64(max) / float64(w)
+	if h > w {
+		scale = float64(max) / float64(h)
+	}
+	tw, th := int(float64(w)*scale), int(float64(h)*scale)
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			thumb.Set(x, y, img.At(bounds.Min.X+int(float64(x)/scale), bounds.Min.Y+int(float64(y)/scale)))
+		}
+	}
+	return thumb
+}
+
+// Report content
+
+func vehicleName(v Vehicle) string {
+	return fmt.Sprintf("%d %s %s", v.Year, v.Make, v.Model)
+}
+
+func economyUnit(v Vehicle) string {
+	if v.MileageUnit == "km" {
+		return "km/L"
+	}
+	return "mpg"
+}
+
+// costCategories totals fuel and each expense category
+func costCategories(report VehicleReportData) map[string]float64 {
+	categories := make(map[string]float64)
+	if report.FuelCosts > 0 {
+		categories["Fuel"] = report.FuelCosts
+	}
+	for _, e := range report.Expenses {
+		category := e.Category
+		if category == "" {
+			category = "Other"
+		}
+		categories[category] += e.Amount
+	}
+	return categories
+}
+
+// monthlyCosts adds fuel and expenses into per-month totals, oldest first
+func monthlyCosts(fuelEntries []FuelEntry, expenses []Expense) []chartPoint {
+	totals := make(map[string]float64)
+	for _, f := range fuelEntries {
+		totals[f.Date.Format("2006-01")] += f.Price
+	}
+	for _, e := range expenses {
+		totals[e.Date.Format("2006-01")] += e.Amount
+	}
+
+	var points []chartPoint
+	for month, total := range totals {
+		points = append(points, chartPoint{Label: month, Value: total})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Label < points[j].Label })
+	return points
+}
+
+func economyPoints(report VehicleReportData) []chartPoint {
+	var points []chartPoint
+	for _, t := range report.FuelTrend {
+		if t.MPG > 0 {
+			points = append(points, chartPoint{Label: t.Month, Value: t.MPG})
+		}
+	}
+	return points
+}
+
+// vehicleSection writes one vehicle's part of a report
+func (r *pdfReport) vehicleSection(report VehicleReportData, reminders []MaintenanceReminder, attachments []Attachment) {
+	v := report.Vehicle
+	unit := v.MileageUnit
+	if unit == "" {
+		unit = "mi"
+	}
+
+	r.heading(vehicleName(v))
+	r.keyValues([][2]string{
+		{"Odometer", fmt.Sprintf("%.0f %s", v.Odometer, unit)},
+		{"Fuel type", v.FuelType},
+		{"Distance tracked", fmt.Sprintf("%.0f %s", report.TotalDistance, unit)},
+		{"Average economy", fmt.Sprintf("%.1f %s", report.AverageMPG, economyUnit(v))},
+		{"Fuel", r.money(report.FuelCosts)},
+		{"Maintenance", r.money(report.MaintenanceCost)},
+		{"Other expenses", r.money(report.OtherCosts)},
+		{"Total cost", r.money(report.TotalCost)},
+	})
+
+	r.pdf.SetFont("Helvetica", "B", 10)
+	r.pdf.CellFormat(0, 7, "Cost by category", "", 1, "L", false, 0, "")
+	r.costBreakdown(costCategories(report))
+
+	r.lineChart(fmt.Sprintf("Fuel economy (%s)", economyUnit(v)), economyPoints(report))
+	r.barChart(fmt.Sprintf("Monthly cost (%s)", r.currency), monthlyCosts(report.FuelEntries, report.Expenses))
+
+	var services [][]string
+	for _, e := range report.Expenses {
+		if e.Category == "Maintenance" {
+			services = append(services, []string{e.Date.Format("2006-01-02"), r.money(e.Amount), e.Notes})
+		}
+	}
+	r.heading("Service history - " + vehicleName(v))
+	if len(services) == 0 {
+		r.note("No maintenance recorded in this period.")
+	} else {
+		r.table([]string{"Date", "Cost", "Notes"}, []float64{25, 30, r.contentWidth() - 55}, []string{"L", "R", "L"}, services)
+	}
+
+	if len(reminders) > 0 {
+		now := time.Now()
+		var rows [][]string
+		for _, rem := range reminders {
+			state := evaluateReminder(rem, v.RemindersPaused, v.Odometer, now)
+			var due []string
+			if state.ByDays {
+				due = append(due, state.DueDate.Format("2006-01-02"))
+			}
+			if state.ByMiles {
+				due = append(due, fmt.Sprintf("%.0f %s", state.DueMiles, unit))
+			}
+			rows = append(rows, []string{rem.Name, state.Status, strings.Join(due, " or ")})
+		}
+		r.pdf.SetFont("Helvetica", "B", 10)
+		r.pdf.CellFormat(0, 7, "Reminders", "", 1, "L", false, 0, "")
+		r.table([]string{"Reminder", "Status", "Due"}, []float64{80, 30, r.contentWidth() - 110}, []string{"L", "L", "L"}, rows)
+	}
+
+	if len(attachments) > 0 {
+		r.heading("Receipts - " + vehicleName(v))
+		if len(attachments) > pdfMaxReceipts {
+			r.note(fmt.Sprintf("Showing the first %d of %d attachments.", pdfMaxReceipts, len(attachments)))
+			attachments = attachments[:pdfMaxReceipts]
+		}
+		r.receipts(attachments)
+	}
+}
+
+// reportAttachments returns the attachments on a report's entries
+func (app *Application) reportAttachments(report VehicleReportData) []Attachment {
+	var fuelIDs, expenseIDs []uint
+	for _, f := range report.FuelEntries {
+		fuelIDs = append(fuelIDs, f.ID)
+	}
+	for _, e := range report.Expenses {
+		expenseIDs = append(expenseIDs, e.ID)
+	}
+	if len(fuelIDs) == 0 && len(expenseIDs) == 0 {
+		return nil
+	}
+
+	var attachments []Attachment
+	app.db.
+		Where("(entry_type IN ? AND entry_id IN ?) OR (entry_type = ? AND entry_id IN ?)",
+			[]string{"fuel", "fuelentry"}, append(fuelIDs, 0), "expense", append(expenseIDs, 0)).
+		Order("id").
+		Find(&attachments)
+	return attachments
+}
+
+// renderVehiclesPDF writes a report covering the given vehicles. With more
+// than one vehicle it opens with a fleet summary.
+func (app *Application) renderVehiclesPDF(c *gin.Context, user User, vehicles []Vehicle, filter reportFilter, withReceipts bool) {
+	title := "Clarkson Report"
+	if len(vehicles) == 1 {
+		title = "Clarkson Report: " + vehicleName(vehicles[0])
+	}
+
+	r := newPDFReport(title, user.Currency)
+	r.pdf.AddPage()
+	r.title(title, fmt.Sprintf("%s - generated %s for %s", filter.describe(), time.Now().Format("Jan 2, 2006"), user.Name))
+
+	var reports []VehicleReportData
+	for _, v := range vehicles {
+		reports = append(reports, app.loadVehicleReport(v, filter))
+	}
+
+	if len(reports) > 1 {
+		r.heading("Summary")
+		allCategories := make(map[string]float64)
+		var allFuel []FuelEntry
+		var allExpenses []Expense
+		var rows [][]string
+		grandTotal := 0.0
+		for _, report := range reports {
+			rows = append(rows, []string{
+				vehicleName(report.Vehicle),
+				fmt.Sprintf("%.0f", report.TotalDistance),
+				r.money(report.FuelCosts),
+				r.money(report.MaintenanceCost + report.OtherCosts),
+				r.money(report.TotalCost),
+				fmt.Sprintf("%.1f %s", report.AverageMPG, economyUnit(report.Vehicle)),
+			})
+			for name, amount := range costCategories(report) {
+				allCategories[name] += amount
+			}
+			allFuel = append(allFuel, report.FuelEntries...)
+			allExpenses = append(allExpenses, report.Expenses...)
+			grandTotal += report.TotalCost
+		}
+		rows = append(rows, []string{"All vehicles", "", "", "", r.money(grandTotal), ""})
+		r.table(
+			[]string{"Vehicle", "Distance", "Fuel", "Expenses", "Total", "Economy"},
+			[]float64{55, 20, 27, 27, 27, r.contentWidth() - 156},
+			[]string{"L", "R", "R", "R", "R", "R"},
+			rows,
+		)
+
+		r.pdf.SetFont("Helvetica", "B", 10)
+		r.pdf.CellFormat(0, 7, "Cost by category", "", 1, "L", false, 0, "")
+		r.costBreakdown(allCategories)
+		r.barChart(fmt.Sprintf("Monthly cost, all vehicles (%s)", r.currency), monthlyCosts(allFuel, allExpenses))
+	}
+
+	for i, report := range reports {
+		if i > 0 || len(reports) > 1 {
+			r.pdf.AddPage()
+		}
+
+		var reminders []MaintenanceReminder
+		app.db.Where("vehicle_id = ? AND completed_at IS NULL", report.Vehicle.ID).Order("name").Find(&reminders)
+
+		var attachments []Attachment
+		if withReceipts {
+			attachments = app.reportAttachments(report)
+		}
+
+		r.vehicleSection(report, reminders, attachments)
+	}
+
+	if len(reports) == 0 {
+		r.note("No vehicles to report on.")
+	}
+
+	var buf bytes.Buffer
+	if err := r.pdf.Output(&buf); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate PDF"})
+		return
+	}
+
+	filename := fmt.Sprintf("clarkson-report-%s.pdf", time.Now().Format("2006-01-02"))
+	if len(vehicles) == 1 {
+		filename = fmt.Sprintf("clarkson-vehicle-%d-%s.pdf", vehicles[0].ID, time.Now().Format("2006-01-02"))
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(200, "application/pdf", buf.Bytes())
+}
+
+// exportPDF renders the overall report for the selected vehicles (all by
+// default). Query: from, to, vehicle_id, receipts=true.
+func (app *Application) exportPDF(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := app.db.First(&user, userID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+
+	filter, err := parseReportFilter(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	vehicles, err := app.filteredVehicles(userID, filter)
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	app.renderVehiclesPDF(c, user, vehicles, filter, c.Query("receipts") == "true")
+}
+
+// exportVehiclePDF renders the detailed report for one vehicle
+func (app *Application) exportVehiclePDF(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := app.db.First(&user, userID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+
+	filter, err := parseReportFilter(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	filter.VehicleIDs = []uint{parseUint(c.Param("id"))}
+
+	vehicles, err := app.filteredVehicles(userID, filter)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Vehicle not found"})
+		return
+	}
+
+	app.renderVehiclesPDF(c, user, vehicles, filter, c.Query("receipts") == "true")
+}
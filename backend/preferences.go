@@ -0,0 +1,410 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	_ "time/tzdata" // The runtime image has no zoneinfo
+
+	"github.com/gin-gonic/gin"
+)
+
+// NotificationPreference controls when and where a user's notifications are
+// delivered outside the app. In-app notifications are always stored.
+type NotificationPreference struct {
+	ID              uint                `gorm:"primaryKey" json:"id"`
+	UserID          uint                `gorm:"uniqueIndex" json:"user_id"`
+	TimeZone        string              `json:"time_zone"`                            // IANA name, e.g. Europe/London
+	QuietHoursStart string              `json:"quiet_hours_start"`                    // HH:MM local, empty = no quiet hours
+	QuietHoursEnd   string              `json:"quiet_hours_end"`                      // HH:MM local
+	Delivery        string              `json:"delivery"`                             // immediate, daily, weekly
+	DigestHour      int                 `json:"digest_hour"`                          // Local hour daily/weekly batches go out
+	DigestWeekday   int                 `json:"digest_weekday"`                       // 0 = Sunday, for weekly batches
+	MinSeverity     string              `json:"min_severity"`                         // info, warning, critical
+	TypeChannels    map[string][]string `gorm:"serializer:json" json:"type_channels"` // Notification type -> channel types; missing = all
+	LastBatchAt     *time.Time          `json:"last_batch_at"`
+	CreatedAt       time.Time           `json:"created_at"`
+	UpdatedAt       time.Time           `json:"updated_at"`
+}
+
+var notificationTypes = map[string]bool{
+	"reminder_due":     true,
+	"reminder_overdue": true,
+}
+
+var notificationChannelTypes = map[string]bool{
+	"email":   true,
+	"ntfy":    true,
+	"gotify":  true,
+	"webhook": true,
+}
+
+func defaultNotificationPreference(userID uint) NotificationPreference {
+	return NotificationPreference{
+		UserID:        userID,
+		TimeZone:      "UTC",
+		Delivery:      "immediate",
+		DigestHour:    8,
+		DigestWeekday: 1,
+		MinSeverity:   "info",
+	}
+}
+
+func (app *Application) loadNotificationPreference(userID uint) NotificationPreference {
+	var prefs NotificationPreference
+	if err := app.db.Where("user_id = ?", userID).First(&prefs).Error; err != nil {
+		return defaultNotificationPreference(userID)
+	}
+	return prefs
+}
+
+func (p *NotificationPreference) location() *time.Location {
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// parseClock parses "HH:MM" into minutes after midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("time must be HH:MM")
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// InQuietHours reports whether now falls in the user's quiet hours. The
+// window may wrap past midnight, e.g. 22:00 to 07:00.
+func (p *NotificationPreference) InQuietHours(now time.Time) bool {
+	if p.QuietHoursStart == "" || p.QuietHoursEnd == "" {
+		return false
+	}
+	start, err := parseClock(p.QuietHoursStart)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(p.QuietHoursEnd)
+	if err != nil {
+		return false
+	}
+
+	local := now.In(p.location())
+	minute := local.Hour()*60 + local.Minute()
+
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// batchSlot returns the most recent scheduled batch time at or before now
+func (p *NotificationPreference) batchSlot(now time.Time) time.Time {
+	local := now.In(p.location())
+	slot := time.Date(local.Year(), local.Month(), local.Day(), p.DigestHour, 0, 0, 0, local.Location())
+	if slot.After(local) {
+		slot = slot.AddDate(0, 0, -1)
+	}
+	if p.Delivery == "weekly" {
+		back := (int(slot.Weekday()) - p.DigestWeekday + 7) % 7
+		slot = slot.AddDate(0, 0, -back)
+	}
+	return slot
+}
+
+// ReadyToDeliver reports whether pending notifications may be sent now
+func (p *NotificationPreference) ReadyToDeliver(now time.Time) bool {
+	if p.InQuietHours(now) {
+		return false
+	}
+	if p.Delivery == "daily" || p.Delivery == "weekly" {
+		return p.LastBatchAt == nil || p.LastBatchAt.Before(p.batchSlot(now))
+	}
+	return true
+}
+
+// AllowsChannel reports whether a notification type may go to a channel type
+func (p *NotificationPreference) AllowsChannel(notifType, channelType string) bool {
+	channels, ok := p.TypeChannels[notifType]
+	if !ok {
+		return true
+	}
+	for _, ch := range channels {
+		if ch == channelType {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *NotificationPreference) Validate() error {
+	if _, err := time.LoadLocation(p.TimeZone); err != nil {
+		return fmt.Errorf("unknown time zone: %s", p.TimeZone)
+	}
+	if (p.QuietHoursStart == "") != (p.QuietHoursEnd == "") {
+		return fmt.Errorf("quiet hours need both a start and an end")
+	}
+	if p.QuietHoursStart != "" {
+		if _, err := parseClock(p.QuietHoursStart); err != nil {
+			return fmt.Errorf("quiet_hours_start: %v", err)
+		}
+		if _, err := parseClock(p.QuietHoursEnd); err != nil {
+			return fmt.Errorf("quiet_hours_end: %v", err)
+		}
+	}
+	switch p.Delivery {
+	case "immediate", "daily", "weekly":
+	default:
+		return fmt.Errorf("delivery must be immediate, daily or weekly")
+	}
+	if p.DigestHour < 0 || p.DigestHour > 23 {
+		return fmt.Errorf("digest_hour must be between 0 and 23")
+	}
+	if p.DigestWeekday < 0 || p.DigestWeekday > 6 {
+		return fmt.Errorf("digest_weekday must be between 0 (Sunday) and 6")
+	}
+	if _, ok := severityLevels[p.MinSeverity]; !ok {
+		return fmt.Errorf("min_severity must be info, warning or critical")
+	}
+	for notifType, channels := range p.TypeChannels {
+		if !notificationTypes[notifType] {
+			return fmt.Errorf("unknown notification type: %s", notifType)
+		}
+		for _, ch := range channels {
+			if !notificationChannelTypes[ch] {
+				return fmt.Errorf("unknown channel type: %s", ch)
+			}
+		}
+	}
+	return nil
+}
+
+// flushUserNotifications delivers the user's pending notifications if their
+// preferences allow it right now. Notifications below the user's minimum
+// severity, or closed before they could be sent, are suppressed. Only
+// claiming the notifications holds the delivery lock; the sends don't, so a
+// slow channel doesn't hold up other users.
+func (app *Application) flushUserNotifications(userID uint, now time.Time) {
+	prefs := app.loadNotificationPreference(userID)
+	if !prefs.ReadyToDeliver(now) {
+		return
+	}
+
+	batched := prefs.Delivery != "immediate"
+	deliver := app.claimPendingNotifications(userID, prefs, now)
+	if len(deliver) == 0 {
+		return
+	}
+
+	outcomes := make(deliveryOutcomes)
+	var email []Notification
+	for _, n := range deliver {
+		if prefs.AllowsChannel(n.Type, "email") {
+			email = append(email, n)
+		}
+	}
+	if len(email) > 0 {
+		app.emailNotifications(userID, email, outcomes)
+	}
+	app.pushNotifications(userID, deliver, prefs, batched, outcomes)
+
+	app.recordDeliveryOutcomes(deliver, outcomes)
+}
+
+// claimPendingNotifications marks the user's pending notifications that are
+// due to go out as sending, and the ones that shouldn't go out as
+// suppressed, and returns those to send
+func (app *Application) claimPendingNotifications(userID uint, prefs NotificationPreference, now time.Time) []Notification {
+	app.deliveryMu.Lock()
+	defer app.deliveryMu.Unlock()
+
+	// Batches hold everything raised before the scheduled slot; later
+	// notifications wait for the next one
+	batched := prefs.Delivery != "immediate"
+	query := app.db.Where("user_id = ? AND delivery = ?", userID, "pending")
+	if batched {
+		query = query.Where("created_at <= ?", prefs.batchSlot(now))
+	}
+
+	var pending []Notification
+	if err := query.Order("created_at").Find(&pending).Error; err != nil {
+		slog.Error("loading pending notifications failed", "user_id", userID, "error", err)
+		return nil
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var deliver []Notification
+	var sendingIDs, suppressedIDs []uint
+	for _, n := range pending {
+		open := n.Status == "unread" || n.Status == "read"
+		if open && severityLevels[notificationSeverity(n)] >= severityLevels[prefs.MinSeverity] {
+			deliver = append(deliver, n)
+			sendingIDs = append(sendingIDs, n.ID)
+		} else {
+			suppressedIDs = append(suppressedIDs, n.ID)
+		}
+	}
+
+	if len(suppressedIDs) > 0 {
+		if err := app.db.Model(&Notification{}).Where("id IN ?", suppressedIDs).Update("delivery", "suppressed").Error; err != nil {
+			slog.Error("suppressing notifications failed", "user_id", userID, "error", err)
+		}
+	}
+	if len(sendingIDs) > 0 {
+		if err := app.db.Model(&Notification{}).Where("id IN ?", sendingIDs).Update("delivery", "sending").Error; err != nil {
+			slog.Error("claiming notifications failed", "user_id", userID, "error", err)
+			return nil
+		}
+	}
+
+	if batched && prefs.ID != 0 {
+		app.db.Model(&prefs).Update("last_batch_at", now)
+	}
+	return deliver
+}
+
+// deliveryOutcomes collects, per notification ID, whether each channel it
+// went out on succeeded
+type deliveryOutcomes map[uint][]bool
+
+// add records one channel's result for the notifications it carried
+func (o deliveryOutcomes) add(notifications []Notification, err error) {
+	for _, n := range notifications {
+		o[n.ID] = append(o[n.ID], err == nil)
+	}
+}
+
+// status sums up a notification's channels: sent when every one succeeded,
+// failed when every one failed, partial in between, and skipped when no
+// channel took it
+func (o deliveryOutcomes) status(id uint) string {
+	results := o[id]
+	if len(results) == 0 {
+		return "skipped"
+	}
+	succeeded := 0
+	for _, ok := range results {
+		if ok {
+			succeeded++
+		}
+	}
+	switch succeeded {
+	case len(results):
+		return "sent"
+	case 0:
+		return "failed"
+	default:
+		return "partial"
+	}
+}
+
+// recordDeliveryOutcomes moves claimed notifications from sending to the
+// outcome of their channels
+func (app *Application) recordDeliveryOutcomes(notifications []Notification, outcomes deliveryOutcomes) {
+	byStatus := make(map[string][]uint)
+	for _, n := range notifications {
+		status := outcomes.status(n.ID)
+		byStatus[status] = append(byStatus[status], n.ID)
+	}
+	for status, ids := range byStatus {
+		if err := app.db.Model(&Notification{}).Where("id IN ?", ids).Update("delivery", status).Error; err != nil {
+			slog.Error("recording notification delivery failed", "status", status, "error", err)
+		}
+	}
+}
+
+// requeueInterruptedDeliveries puts notifications left sending by a server
+// that stopped mid-delivery back in the queue
+func (app *Application) requeueInterruptedDeliveries() error {
+	result := app.db.Model(&Notification{}).Where("delivery = ?", "sending").Update("delivery", "pending")
+	if result.RowsAffected > 0 {
+		slog.Info("requeued interrupted notification deliveries", "count", result.RowsAffected)
+	}
+	return result.Error
+}
+
+// flushPendingNotifications runs delivery for every user with pending notifications
+func (app *Application) flushPendingNotifications() error {
+	var userIDs []uint
+	if err := app.db.Model(&Notification{}).
+		Where("delivery = ?", "pending").
+		Distinct("user_id").
+		Pluck("user_id", &userIDs).Error; err != nil {
+		slog.Error("loading pending notifications failed", "error", err)
+		return err
+	}
+
+	now := time.Now()
+	for _, userID := range userIDs {
+		app.flushUserNotifications(userID, now)
+	}
+	return nil
+}
+
+// Preference Handlers
+
+func (app *Application) getNotificationPreferences(c *gin.Context) {
+	userID := c.GetUint("userID")
+	c.JSON(200, app.loadNotificationPreference(userID))
+}
+
+func (app *Application) updateNotificationPreferences(c *gin.Context) {
+	userID := c.GetUint("userID")
+	var req struct {
+		TimeZone        *string             `json:"time_zone"`
+		QuietHoursStart *string             `json:"quiet_hours_start"`
+		QuietHoursEnd   *string             `json:"quiet_hours_end"`
+		Delivery        *string             `json:"delivery"`
+		DigestHour      *int                `json:"digest_hour"`
+		DigestWeekday   *int                `json:"digest_weekday"`
+		MinSeverity     *string             `json:"min_severity"`
+		TypeChannels    map[string][]string `json:"type_channels"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	prefs := app.loadNotificationPreference(userID)
+	if req.TimeZone != nil {
+		prefs.TimeZone = *req.TimeZone
+	}
+	if req.QuietHoursStart != nil {
+		prefs.QuietHoursStart = strings.TrimSpace(*req.QuietHoursStart)
+	}
+	if req.QuietHoursEnd != nil {
+		prefs.QuietHoursEnd = strings.TrimSpace(*req.QuietHoursEnd)
+	}
+	if req.Delivery != nil {
+		prefs.Delivery = *req.Delivery
+	}
+	if req.DigestHour != nil {
+		prefs.DigestHour = *req.DigestHour
+	}
+	if req.DigestWeekday != nil {
+		prefs.DigestWeekday = *req.DigestWeekday
+	}
+	if req.MinSeverity != nil {
+		prefs.MinSeverity = *req.MinSeverity
+	}
+	if req.TypeChannels != nil {
+		prefs.TypeChannels = req.TypeChannels
+	}
+
+	if err := prefs.Validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := app.db.Save(&prefs).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Update failed"})
+		return
+	}
+
+	c.JSON(200, prefs)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveryOutcomesStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []bool
+		want    string
+	}{
+		{"no channel", nil, "skipped"},
+		{"all sent", []bool{true, true}, "sent"},
+		{"all failed", []bool{false, false}, "failed"},
+		{"mixed", []bool{true, false}, "partial"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outcomes := deliveryOutcomes{1: tt.results}
+			if got := outcomes.status(1); got != tt.want {
+				t.Errorf("status = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlushUserNotificationsRecordsOutcome(t *testing.T) {
+	tests := []struct {
+		name         string
+		optedIn      bool
+		failFirst    int
+		status       string
+		wantDelivery string
+		wantLog      string
+	}{
+		{"sent", true, 0, "unread", "sent", "sent"},
+		{"failed", true, 10, "unread", "failed", "failed"},
+		{"no channel", false, 0, "unread", "skipped", ""},
+		{"dismissed first", true, 0, "dismissed", "suppressed", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			stub, pool := newSMTPStub(t, false, tt.failFirst)
+			app.mailer = testMailer(stub, pool, "none")
+
+			user := User{Email: "driver@example.com", Name: "Sam", EmailNotifications: tt.optedIn}
+			app.db.Create(&user)
+			n := Notification{UserID: user.ID, Type: "reminder_due", Title: "Oil - DUE SOON", Status: tt.status, Delivery: "pending"}
+			app.db.Create(&n)
+
+			app.flushUserNotifications(user.ID, time.Now())
+
+			app.db.First(&n, n.ID)
+			if n.Delivery != tt.wantDelivery {
+				t.Errorf("delivery = %q, want %q", n.Delivery, tt.wantDelivery)
+			}
+
+			var deliveries []NotificationDelivery
+			app.db.Find(&deliveries)
+			if tt.wantLog == "" {
+				if len(deliveries) != 0 {
+					t.Errorf("logged %d deliveries, want none", len(deliveries))
+				}
+				return
+			}
+			if len(deliveries) != 1 {
+				t.Fatalf("logged %d deliveries, want 1", len(deliveries))
+			}
+			d := deliveries[0]
+			if d.Status != tt.wantLog || d.Channel != "email" {
+				t.Errorf("logged %s delivery %q, want email %q", d.Channel, d.Status, tt.wantLog)
+			}
+			if len(d.NotificationIDs) != 1 || d.NotificationIDs[0] != n.ID {
+				t.Errorf("notification_ids = %v, want [%d]", d.NotificationIDs, n.ID)
+			}
+		})
+	}
+}
+
+func TestFlushUserNotificationsSendsWithoutDeliveryLock(t *testing.T) {
+	app := newTestApp(t)
+	stub, pool := newSMTPStub(t, false, 0)
+	app.mailer = testMailer(stub, pool, "none")
+
+	locked := make(chan bool, 1)
+	stub.onData = func() {
+		free := app.deliveryMu.TryLock()
+		if free {
+			app.deliveryMu.Unlock()
+		}
+		locked <- !free
+	}
+
+	user := User{Email: "driver@example.com", EmailNotifications: true}
+	app.db.Create(&user)
+	app.db.Create(&Notification{UserID: user.ID, Type: "reminder_due", Status: "unread", Delivery: "pending"})
+
+	app.flushUserNotifications(user.ID, time.Now())
+	if <-locked {
+		t.Error("the delivery lock was held while sending")
+	}
+}
+
+func TestRequeueInterruptedDeliveries(t *testing.T) {
+	app := newTestApp(t)
+	sending := Notification{UserID: 1, Type: "reminder_due", Status: "unread", Delivery: "sending"}
+	sent := Notification{UserID: 1, Type: "reminder_due", Status: "unread", Delivery: "sent"}
+	app.db.Create(&sending)
+	app.db.Create(&sent)
+
+	if err := app.requeueInterruptedDeliveries(); err != nil {
+		t.Fatal(err)
+	}
+	app.db.First(&sending, sending.ID)
+	app.db.First(&sent, sent.ID)
+	if sending.Delivery != "pending" || sent.Delivery != "sent" {
+		t.Errorf("deliveries = %q, %q, want pending, sent", sending.Delivery, sent.Delivery)
+	}
+}
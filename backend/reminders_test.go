@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReminderHandlersCheckAccess(t *testing.T) {
+	app := newTestApp(t)
+	owner := User{Email: "owner@example.com"}
+	friend := User{Email: "friend@example.com"}
+	stranger := User{Email: "stranger@example.com"}
+	app.db.Create(&owner)
+	app.db.Create(&friend)
+	app.db.Create(&stranger)
+	vehicle := Vehicle{UserID: owner.ID, Make: "VW", Model: "Golf", Odometer: 1000}
+	app.db.Create(&vehicle)
+	app.db.Create(&VehicleUser{VehicleID: vehicle.ID, UserID: friend.ID})
+	reminder := MaintenanceReminder{VehicleID: vehicle.ID, Name: "Oil", IntervalDays: 365, LastServiceDate: time.Now()}
+	app.db.Create(&reminder)
+
+	reminderID := strconv.Itoa(int(reminder.ID))
+	vehicleID := strconv.Itoa(int(vehicle.ID))
+	update := gin.H{"name": "Oil", "interval_days": 180}
+	calls := []struct {
+		name    string
+		handler gin.HandlerFunc
+		id      string
+		body    interface{}
+		ok      int
+	}{
+		{"create", app.createReminder, vehicleID, update, 201},
+		{"update", app.updateReminder, reminderID, update, 200},
+		{"snooze", app.snoozeReminder, reminderID, gin.H{"days": 7}, 200},
+		{"unsnooze", app.unsnoozeReminder, reminderID, nil, 200},
+		{"complete", app.completeReminder, reminderID, gin.H{"service_date": time.Now()}, 200},
+		{"pause", app.pauseVehicleReminders, vehicleID, nil, 200},
+		{"resume", app.resumeVehicleReminders, vehicleID, nil, 200},
+	}
+	users := []struct {
+		name    string
+		userID  uint
+		allowed bool
+	}{
+		{"stranger", stranger.ID, false},
+		{"owner", owner.ID, true},
+		{"shared with", friend.ID, true},
+	}
+
+	for _, u := range users {
+		for _, call := range calls {
+			t.Run(u.name+" "+call.name, func(t *testing.T) {
+				want := 404
+				if u.allowed {
+					want = call.ok
+				}
+				w := callHandler(call.handler, u.userID, call.id, call.body)
+				if w.Code != want {
+					t.Errorf("status = %d, want %d: %s", w.Code, want, w.Body.String())
+				}
+			})
+		}
+	}
+
+	var created int64
+	app.db.Model(&MaintenanceReminder{}).Where("vehicle_id = ?", vehicle.ID).Count(&created)
+	if created != 3 {
+		t.Errorf("%d reminders, want the original and 2 created", created)
+	}
+	if w := callHandler(app.deleteReminder, stranger.ID, reminderID, nil); w.Code != 404 {
+		t.Errorf("stranger delete: status = %d, want 404", w.Code)
+	}
+	if w := callHandler(app.deleteReminder, friend.ID, reminderID, nil); w.Code != 200 {
+		t.Errorf("shared delete: status = %d, want 200", w.Code)
+	}
+
+	app.db.First(&vehicle, vehicle.ID)
+	if vehicle.RemindersPaused {
+		t.Error("reminders left paused")
+	}
+}
+
+func TestUpdateReminderReplacesSchedule(t *testing.T) {
+	app := newTestApp(t)
+	user := User{Email: "owner@example.com"}
+	app.db.Create(&user)
+	vehicle := Vehicle{UserID: user.ID, Make: "VW", Model: "Golf"}
+	app.db.Create(&vehicle)
+	due := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	reminder := MaintenanceReminder{VehicleID: vehicle.ID, Name: "MOT", DueDate: &due, DueMiles: 20000, CompletedAt: &due}
+	app.db.Create(&reminder)
+	id := strconv.Itoa(int(reminder.ID))
+
+	if w := callHandler(app.updateReminder, user.ID, id, gin.H{"name": "MOT"}); w.Code != 400 {
+		t.Errorf("update without a schedule: status = %d, want 400", w.Code)
+	}
+
+	// The one-off reminder becomes a yearly one
+	w := callHandler(app.updateReminder, user.ID, id, gin.H{"name": "MOT", "interval_days": 365, "last_service_date": due})
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	var updated MaintenanceReminder
+	app.db.First(&updated, reminder.ID)
+	if updated.DueDate != nil || updated.DueMiles != 0 || updated.CompletedAt != nil || updated.IntervalDays != 365 {
+		t.Errorf("reminder = %+v, want a yearly reminder with no due date or mileage", updated)
+	}
+}
+
+func TestCompleteReminderServiceMiles(t *testing.T) {
+	due := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		reminder  MaintenanceReminder
+		body      gin.H
+		want      int
+		wantMiles float64
+	}{
+		{"date-only one-off without miles", MaintenanceReminder{Name: "MOT", DueDate: &due}, gin.H{"service_date": due}, 200, 0},
+		{"date-only one-off at 0 miles", MaintenanceReminder{Name: "MOT", DueDate: &due}, gin.H{"service_date": due, "service_miles": 0}, 200, 0},
+		{"yearly without miles", MaintenanceReminder{Name: "Service", IntervalDays: 365}, gin.H{"service_date": due}, 200, 0},
+		{"distance interval without miles", MaintenanceReminder{Name: "Oil", IntervalMiles: 5000}, gin.H{"service_date": due}, 400, 0},
+		{"distance interval with miles", MaintenanceReminder{Name: "Oil", IntervalMiles: 5000}, gin.H{"service_date": due, "service_miles": 15000}, 200, 15000},
+		{"negative miles", MaintenanceReminder{Name: "Oil", IntervalMiles: 5000}, gin.H{"service_date": due, "service_miles": -1}, 400, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			user := User{Email: "driver@example.com"}
+			app.db.Create(&user)
+			vehicle := Vehicle{UserID: user.ID, Make: "VW", Model: "Golf"}
+			app.db.Create(&vehicle)
+			reminder := tt.reminder
+			reminder.VehicleID = vehicle.ID
+			app.db.Create(&reminder)
+
+			w := callHandler(app.completeReminder, user.ID, strconv.Itoa(int(reminder.ID)), tt.body)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if w.Code != 200 {
+				return
+			}
+			app.db.First(&reminder, reminder.ID)
+			if reminder.LastServiceMiles != tt.wantMiles || !reminder.LastServiceDate.Equal(due) {
+				t.Errorf("last service = %v at %v, want %v at %v", reminder.LastServiceDate, reminder.LastServiceMiles, due, tt.wantMiles)
+			}
+			if reminder.IsOneOff() && reminder.CompletedAt == nil {
+				t.Error("one-off reminder not marked completed")
+			}
+		})
+	}
+}
@@ -2,38 +2,140 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
-
 type FuelTrendPoint struct {
-	Month     string  `json:"month"`
-	Cost      float64 `json:"cost"`
-	Gallons   float64 `json:"gallons"`
-	Distance  float64 `json:"distance"`
-	MPG       float64 `json:"mpg"`
+	Month    string  `json:"month"`
+	Cost     float64 `json:"cost"`
+	Gallons  float64 `json:"gallons"`
+	Distance float64 `json:"distance"`
+	MPG      float64 `json:"mpg"`
 }
 
 type ExpenseTrendPoint struct {
-	Month     string             `json:"month"`
-	Total     float64            `json:"total"`
+	Month      string             `json:"month"`
+	Total      float64            `json:"total"`
 	Categories map[string]float64 `json:"categories"`
 }
 
 type VehicleReportData struct {
-	Vehicle         Vehicle                   `json:"vehicle"`
-	FuelEntries     []FuelEntry               `json:"fuel_entries"`
-	Expenses        []Expense                 `json:"expenses"`
-	FuelTrend       []FuelTrendPoint          `json:"fuel_trend"`
-	ExpenseTrend    []ExpenseTrendPoint       `json:"expense_trend"`
-	TotalCost       float64                   `json:"total_cost"`
-	TotalDistance   float64                   `json:"total_distance"`
-	AverageMPG      float64                   `json:"average_mpg"`
-	FuelCosts       float64                   `json:"fuel_costs"`
-	MaintenanceCost float64                   `json:"maintenance_cost"`
-	OtherCosts      float64                   `json:"other_costs"`
+	Vehicle         Vehicle             `json:"vehicle"`
+	FuelEntries     []FuelEntry         `json:"fuel_entries"`
+	Expenses        []Expense           `json:"expenses"`
+	FuelTrend       []FuelTrendPoint    `json:"fuel_trend"`
+	ExpenseTrend    []ExpenseTrendPoint `json:"expense_trend"`
+	TotalCost       float64             `json:"total_cost"`
+	TotalDistance   float64             `json:"total_distance"`
+	AverageMPG      float64             `json:"average_mpg"`
+	FuelCosts       float64             `json:"fuel_costs"`
+	MaintenanceCost float64             `json:"maintenance_cost"`
+	OtherCosts      float64             `json:"other_costs"`
+}
+
+// reportFilter narrows reports and exports to a date range and a set of vehicles
+type reportFilter struct {
+	From       *time.Time
+	To         *time.Time // Inclusive
+	VehicleIDs []uint     // Empty = every vehicle the user can access
+}
+
+// parseReportFilter reads ?from=YYYY-MM-DD&to=YYYY-MM-DD&vehicle_id=1,2
+// (vehicle_id may also be repeated)
+func parseReportFilter(c *gin.Context) (reportFilter, error) {
+	var filter reportFilter
+
+	for _, param := range []string{"from", "to"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be a YYYY-MM-DD date", param)
+		}
+		if param == "from" {
+			filter.From = &date
+		} else {
+			filter.To = &date
+		}
+	}
+	if filter.From != nil && filter.To != nil && filter.To.Before(*filter.From) {
+		return filter, fmt.Errorf("to must not be before from")
+	}
+
+	for _, value := range c.QueryArray("vehicle_id") {
+		for _, id := range strings.Split(value, ",") {
+			id = strings.TrimSpace(id)
+			if id == "" {
+				continue
+			}
+			vehicleID, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid vehicle_id: %s", id)
+			}
+			filter.VehicleIDs = append(filter.VehicleIDs, uint(vehicleID))
+		}
+	}
+
+	return filter, nil
+}
+
+// dateRange restricts a query on a table with a date column to the range
+func (f reportFilter) dateRange(query *gorm.DB) *gorm.DB {
+	if f.From != nil {
+		query = query.Where("date >= ?", *f.From)
+	}
+	if f.To != nil {
+		query = query.Where("date < ?", f.To.AddDate(0, 0, 1))
+	}
+	return query
+}
+
+// filteredVehicles returns the selected vehicles the user can access. Selecting a
+// vehicle the user can't see is an error rather than silently skipped.
+func (app *Application) filteredVehicles(userID uint, filter reportFilter) ([]Vehicle, error) {
+	vehicles, err := app.accessibleVehicles(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(filter.VehicleIDs) == 0 {
+		return vehicles, nil
+	}
+
+	byID := make(map[uint]Vehicle)
+	for _, v := range vehicles {
+		byID[v.ID] = v
+	}
+
+	var selected []Vehicle
+	for _, id := range filter.VehicleIDs {
+		v, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("vehicle %d not found", id)
+		}
+		selected = append(selected, v)
+	}
+	return selected, nil
+}
+
+// describe summarises the date range for report headings
+func (f reportFilter) describe() string {
+	switch {
+	case f.From != nil && f.To != nil:
+		return f.From.Format("Jan 2, 2006") + " to " + f.To.Format("Jan 2, 2006")
+	case f.From != nil:
+		return "Since " + f.From.Format("Jan 2, 2006")
+	case f.To != nil:
+		return "Up to " + f.To.Format("Jan 2, 2006")
+	}
+	return "All time"
 }
 
 func (app *Application) generateDetailedReport(c *gin.Context) {
@@ -45,16 +147,32 @@ func (app *Application) generateDetailedReport(c *gin.Context) {
 		return
 	}
 
+	filter, err := parseReportFilter(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, app.loadVehicleReport(vehicle, filter))
+}
+
+// loadVehicleReport loads a vehicle's entries within the filter's date range
+// and builds its report
+func (app *Application) loadVehicleReport(vehicle Vehicle, filter reportFilter) VehicleReportData {
 	var fuelEntries []FuelEntry
-	app.db.Where("vehicle_id = ?", vehicleID).Order("date ASC").Find(&fuelEntries)
+	filter.dateRange(app.db.Where("vehicle_id = ?", vehicle.ID)).Order("date ASC").Find(&fuelEntries)
 
 	var expenses []Expense
-	app.db.Where("vehicle_id = ?", vehicleID).Order("date ASC").Find(&expenses)
+	filter.dateRange(app.db.Where("vehicle_id = ?", vehicle.ID)).Order("date ASC").Find(&expenses)
+
+	return buildVehicleReport(vehicle, fuelEntries, expenses)
+}
 
+func buildVehicleReport(vehicle Vehicle, fuelEntries []FuelEntry, expenses []Expense) VehicleReportData {
 	report := VehicleReportData{
-		Vehicle:      vehicle,
-		FuelEntries:  fuelEntries,
-		Expenses:     expenses,
+		Vehicle:     vehicle,
+		FuelEntries: fuelEntries,
+		Expenses:    expenses,
 	}
 
 	// Calculate fuel statistics
@@ -150,102 +268,16 @@ func (app *Application) generateDetailedReport(c *gin.Context) {
 		report.ExpenseTrend = append(report.ExpenseTrend, data)
 	}
 
-	report.TotalCost += report.FuelCosts
-
-	c.JSON(200, report)
-}
-
-func (app *Application) exportDetailedCSV(c *gin.Context) {
-	userID := c.GetUint("userID")
-	c.Header("Content-Disposition", "attachment; filename=clarkson-detailed-export.csv")
-	c.Header("Content-Type", "text/csv; charset=utf-8")
-
-	csv := "CLARKSON DETAILED EXPORT\n"
-	csv += fmt.Sprintf("Generated: %s\n\n", time.Now().Format("2006-01-02 15:04:05"))
-
-	var vehicles []Vehicle
-	app.db.Where("user_id = ?", userID).Find(&vehicles)
-
-	totalAllCosts := 0.0
-
-	for _, v := range vehicles {
-		csv += fmt.Sprintf("\nVEHICLE: %d %s %s\n", v.Year, v.Make, v.Model)
-		csv += fmt.Sprintf("Current Odometer: %.1f %s\n", v.Odometer, v.MileageUnit)
-		csv += "\n--- FUEL ENTRIES ---\n"
-		csv += "Date,Odometer,Gallons,Price,Location\n"
-
-		var fuelEntries []FuelEntry
-		app.db.Where("vehicle_id = ?", v.ID).Order("date ASC").Find(&fuelEntries)
-
-		totalFuelCost := 0.0
-		for _, f := range fuelEntries {
-			csv += fmt.Sprintf("%s,%.1f,%.2f,%.2f,%s\n",
-				f.Date.Format("2006-01-02"), f.Odometer, f.Gallons, f.Price, f.Location)
-			totalFuelCost += f.Price
-		}
-
-		csv += "\n--- EXPENSES ---\n"
-		csv += "Date,Category,Amount,Notes\n"
-
-		var expenses []Expense
-		app.db.Where("vehicle_id = ?", v.ID).Order("date ASC").Find(&expenses)
-
-		totalExpenseCost := 0.0
-		for _, e := range expenses {
-			csv += fmt.Sprintf("%s,%s,%.2f,\"%s\"\n",
-				e.Date.Format("2006-01-02"), e.Category, e.Amount, e.Notes)
-			totalExpenseCost += e.Amount
-		}
-
-		totalAllCosts += totalFuelCost + totalExpenseCost
-
-		csv += fmt.Sprintf("\nVehicle Total: $%.2f\n", totalFuelCost+totalExpenseCost)
-	}
-
-	csv += fmt.Sprintf("\n\nGRAND TOTAL: $%.2f\n", totalAllCosts)
-
-	c.Data(200, "text/csv; charset=utf-8", []byte(csv))
-}
-
-func (app *Application) exportJSON(c *gin.Context) {
-	userID := c.GetUint("userID")
-	c.Header("Content-Disposition", "attachment; filename=clarkson-backup.json")
-	c.Header("Content-Type", "application/json")
-
-	var vehicles []Vehicle
-	app.db.Where("user_id = ?", userID).Find(&vehicles)
-
-	export := gin.H{
-		"version":   "1.0",
-		"exported":  time.Now().Format(time.RFC3339),
-		"vehicles":  []gin.H{},
-	}
-
-	vehicleList := []gin.H{}
-
-	for _, v := range vehicles {
-		var fuelEntries []FuelEntry
-		app.db.Where("vehicle_id = ?", v.ID).Find(&fuelEntries)
-
-		var expenses []Expense
-		app.db.Where("vehicle_id = ?", v.ID).Find(&expenses)
-
-		var reminders []MaintenanceReminder
-		app.db.Where("vehicle_id = ?", v.ID).Find(&reminders)
-
-		vehicleData := gin.H{
-			"vehicle":    v,
-			"fuel":       fuelEntries,
-			"expenses":   expenses,
-			"reminders":  reminders,
-		}
-
-		vehicleList = append(vehicleList, vehicleData)
-	}
+	sort.Slice(report.FuelTrend, func(i, j int) bool {
+		return report.FuelTrend[i].Month < report.FuelTrend[j].Month
+	})
+	sort.Slice(report.ExpenseTrend, func(i, j int) bool {
+		return report.ExpenseTrend[i].Month < report.ExpenseTrend[j].Month
+	})
 
-	export["vehicles"] = vehicleList
+	report.TotalCost += report.FuelCosts
 
-	c.JSON(200, export)
+	return report
 }
 
 func (app *Application) generateComparisonReport(c *gin.Context) {
@@ -255,13 +287,13 @@ func (app *Application) generateComparisonReport(c *gin.Context) {
 	app.db.Where("user_id = ?", userID).Find(&vehicles)
 
 	type VehicleComparison struct {
-		Vehicle       Vehicle `json:"vehicle"`
-		TotalCost     float64 `json:"total_cost"`
-		TotalMiles    float64 `json:"total_miles"`
-		AverageMPG    float64 `json:"average_mpg"`
-		CostPerMile   float64 `json:"cost_per_mile"`
-		FuelCount     int     `json:"fuel_count"`
-		ExpenseCount  int     `json:"expense_count"`
+		Vehicle      Vehicle `json:"vehicle"`
+		TotalCost    float64 `json:"total_cost"`
+		TotalMiles   float64 `json:"total_miles"`
+		AverageMPG   float64 `json:"average_mpg"`
+		CostPerMile  float64 `json:"cost_per_mile"`
+		FuelCount    int     `json:"fuel_count"`
+		ExpenseCount int     `json:"expense_count"`
 	}
 
 	comparisons := []VehicleComparison{}
@@ -321,16 +353,19 @@ func (app *Application) generateSearchResults(c *gin.Context) {
 		return
 	}
 
+	// LIKE is case-sensitive in Postgres, so both sides are lowercased
+	pattern := likePattern(query)
+
 	var fuelEntries []FuelEntry
 	app.db.
 		Joins("JOIN vehicles ON vehicles.id = fuel_entries.vehicle_id").
-		Where("vehicles.user_id = ? AND (fuel_entries.location LIKE ? OR fuel_entries.notes LIKE ?)", userID, "%"+query+"%", "%"+query+"%").
+		Where("vehicles.user_id = ? AND (LOWER(fuel_entries.location) LIKE ? ESCAPE '!' OR LOWER(fuel_entries.notes) LIKE ? ESCAPE '!')", userID, pattern, pattern).
 		Find(&fuelEntries)
 
 	var expenses []Expense
 	app.db.
 		Joins("JOIN vehicles ON vehicles.id = expenses.vehicle_id").
-		Where("vehicles.user_id = ? AND (expenses.category LIKE ? OR expenses.notes LIKE ?)", userID, "%"+query+"%", "%"+query+"%").
+		Where("vehicles.user_id = ? AND (LOWER(expenses.category) LIKE ? ESCAPE '!' OR LOWER(expenses.notes) LIKE ? ESCAPE '!')", userID, pattern, pattern).
 		Find(&expenses)
 
 	results := gin.H{
@@ -4,7 +4,6 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-
 func setupRoutes(app *Application) {
 	// Auth routes (no auth required)
 	auth := app.router.Group("/api/auth")
@@ -45,32 +44,73 @@ func setupRoutes(app *Application) {
 		protected.PUT("/expenses/:id", app.updateExpense)
 		protected.DELETE("/expenses/:id", app.deleteExpense)
 
+		// Suspected duplicate fuel entries and expenses
+		protected.GET("/duplicates", app.listDuplicates)
+		protected.POST("/duplicates/merge", app.mergeDuplicates)
+
 		// Reminder routes - enhanced
 		protected.GET("/vehicles/:id/reminders", app.listReminders)
 		protected.POST("/vehicles/:id/reminders", app.createReminder)
 		protected.PUT("/reminders/:id", app.updateReminder)
 		protected.DELETE("/reminders/:id", app.deleteReminder)
 		protected.POST("/reminders/:id/complete", app.completeReminder)
+		protected.POST("/reminders/:id/snooze", app.snoozeReminder)
+		protected.DELETE("/reminders/:id/snooze", app.unsnoozeReminder)
 		protected.GET("/reminders/check", app.checkReminders)
 		protected.GET("/reminders/overdue", app.getRemindersOverdue)
 		protected.GET("/vehicles/:id/reminders/due", app.checkRemindersDue)
+		protected.POST("/vehicles/:id/reminders/pause", app.pauseVehicleReminders)
+		protected.POST("/vehicles/:id/reminders/resume", app.resumeVehicleReminders)
+
+		// Ticket for opening the live event stream
+		protected.POST("/events/ticket", app.issueStreamTicket)
 
 		// Notification routes
-		protected.GET("/notifications", app.getUnreadNotifications)
+		protected.GET("/notifications", app.listUserNotifications)
 		protected.GET("/notifications/summary", app.getNotificationSummary)
+		protected.GET("/notifications/deliveries", app.listNotificationDeliveries)
+		protected.GET("/notifications/preferences", app.getNotificationPreferences)
+		protected.PUT("/notifications/preferences", app.updateNotificationPreferences)
+		protected.POST("/notifications/read-all", app.markAllNotificationsRead)
+		protected.POST("/notifications/bulk", app.bulkUpdateNotifications)
 		protected.POST("/notifications/:id/read", app.markNotificationRead)
 		protected.POST("/notifications/:id/dismiss", app.dismissNotification)
 
+		// Push notification channels
+		protected.GET("/channels", app.listChannels)
+		protected.POST("/channels", app.createChannel)
+		protected.PUT("/channels/:id", app.updateChannel)
+		protected.DELETE("/channels/:id", app.deleteChannel)
+		protected.POST("/channels/:id/test", app.testChannel)
+
+		// Calendar feed URLs
+		protected.GET("/calendar", app.getCalendarFeeds)
+		protected.POST("/calendar/rotate", app.rotateCalendarToken)
+
 		// Reports
 		protected.GET("/vehicles/:id/report", app.generateReport)
+		protected.GET("/vehicles/:id/report/pdf", app.exportVehiclePDF)
 		protected.GET("/report/overall", app.generateOverallReport)
 		protected.GET("/export/csv", app.exportCSV)
 		protected.GET("/export/pdf", app.exportPDF)
+		protected.GET("/export/xlsx", app.exportXLSX)
+		protected.GET("/export/json", app.exportJSON)
+		protected.GET("/export/backup", app.exportBackup)
+		protected.GET("/export/interchange", app.exportInterchange)
 
 		// Import/Migration
 		protected.POST("/import/hammond", app.importHammond)
 		protected.POST("/import/fuelly", app.importFuelly)
+		protected.POST("/import/lubelogger", app.importLubeLogger)
+		protected.POST("/import/fuelio", app.importFuelio)
+		protected.POST("/import/drivvo", app.importDrivvo)
+		protected.POST("/import/interchange", app.importInterchange)
 		protected.POST("/import/clarkson", app.importClarkson)
+		protected.POST("/import/preview", app.previewUpload)
+		protected.GET("/import/sessions/:id", app.getImportSession)
+		protected.PUT("/import/sessions/:id", app.updateImportSession)
+		protected.POST("/import/sessions/:id/commit", app.commitImportSession)
+		protected.DELETE("/import/sessions/:id", app.deleteImportSession)
 
 		// File upload/download
 		protected.POST("/upload", app.uploadFile)
@@ -78,6 +118,34 @@ func setupRoutes(app *Application) {
 		protected.POST("/attach", app.attachFileToEntry)
 	}
 
+	// Admin routes (require the admin role)
+	admin := protected.Group("/admin")
+	admin.Use(app.adminMiddleware())
+	{
+		// Server backups of the whole database
+		admin.GET("/backups", app.listServerBackups)
+		admin.POST("/backups", app.createServerBackup)
+		admin.GET("/backups/:name", app.downloadServerBackup)
+		admin.POST("/backups/:name/restore", app.restoreServerBackup)
+		admin.DELETE("/backups/:name", app.deleteServerBackup)
+	}
+
+	// Live event stream. EventSource can't send headers, so it is opened
+	// with a ticket from /api/events/ticket (events.go)
+	app.router.GET("/api/events", app.streamAuth(), app.streamEvents)
+
+	// iCalendar feeds, authenticated by the secret token in the URL
+	app.router.GET("/calendar/:token/clarkson.ics", app.userCalendarFeed)
+	app.router.GET("/calendar/:token/vehicles/:file", app.vehicleCalendarFeed)
+
+	// JSON Schema of the interchange format (no auth)
+	app.router.GET("/api/interchange/schema", app.interchangeSchema)
+
+	// Prometheus scrape endpoint, behind metrics.token when set
+	if app.metrics != nil {
+		app.router.GET("/metrics", app.metrics.handler(app.config.MetricsToken))
+	}
+
 	// Health check (no auth)
 	app.router.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "healthy"})
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestSetupRoutes builds the router the way main does. gin panics when a
+// route is registered twice, which would otherwise only show at startup.
+func TestSetupRoutes(t *testing.T) {
+	app := newTestApp(t)
+	app.router = gin.New()
+	metrics, err := NewMetrics(app.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.metrics = metrics
+
+	setupRoutes(app)
+
+	for _, path := range []string{"/health", "/metrics"} {
+		w := httptest.NewRecorder()
+		app.router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 {
+			t.Errorf("GET %s = %d, want 200", path, w.Code)
+		}
+	}
+}
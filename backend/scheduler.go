@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// runReminderScheduler periodically checks every vehicle's reminders, stores
+// new notifications for the owner and anyone the vehicle is shared with,
+// delivers notifications held back by quiet hours or batching and sends
+// weekly digests, until ctx is done.
+func (app *Application) runReminderScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		app.metrics.runJob("reminder_check", app.checkAllReminders)
+		app.metrics.runJob("notification_flush", app.flushPendingNotifications)
+		app.metrics.runJob("weekly_digest", app.sendWeeklyDigests)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAllReminders stores new reminder notifications for every vehicle and
+// logs how the run went
+func (app *Application) checkAllReminders() error {
+	start := time.Now()
+	var vehicles []Vehicle
+	if err := app.db.Find(&vehicles).Error; err != nil {
+		slog.Error("reminder check failed", "error", err)
+		return err
+	}
+
+	stored, failed := 0, 0
+	for _, v := range vehicles {
+		notifications := app.checkVehicleRemindersAdvanced(v.ID, v.Odometer)
+		if len(notifications) == 0 {
+			continue
+		}
+
+		for _, userID := range app.vehicleUserIDs(v) {
+			fresh := app.filterNewNotifications(userID, notifications)
+			if err := app.storeNotifications(userID, fresh); err != nil {
+				slog.Error("storing notifications failed", "user_id", userID, "error", err)
+				failed++
+				continue
+			}
+			stored += len(fresh)
+		}
+	}
+	slog.Info("reminder check finished", "vehicles", len(vehicles), "notifications", stored, "failed", failed, "duration", time.Since(start))
+	if failed > 0 {
+		return fmt.Errorf("storing notifications failed for %d users", failed)
+	}
+	return nil
+}
+
+// vehicleUserIDs returns the owner and every user the vehicle is shared with
+func (app *Application) vehicleUserIDs(v Vehicle) []uint {
+	userIDs := []uint{v.UserID}
+
+	var shared []VehicleUser
+	app.db.Where("vehicle_id = ?", v.ID).Find(&shared)
+	for _, vu := range shared {
+		if vu.UserID != v.UserID {
+			userIDs = append(userIDs, vu.UserID)
+		}
+	}
+
+	return userIDs
+}
+
+// filterNewNotifications drops notifications the user already received for
+// the reminder's current service cycle. Completing, snoozing or editing a
+// reminder bumps its UpdatedAt and so starts a new cycle.
+func (app *Application) filterNewNotifications(userID uint, notifications []Notification) []Notification {
+	var fresh []Notification
+
+	for _, n := range notifications {
+		var reminder MaintenanceReminder
+		if err := app.db.First(&reminder, n.ReminderID).Error; err != nil {
+			continue
+		}
+
+		var count int64
+		app.db.Model(&Notification{}).
+			Where("user_id = ? AND reminder_id = ? AND type = ? AND created_at >= ?", userID, n.ReminderID, n.Type, reminder.UpdatedAt).
+			Count(&count)
+		if count == 0 {
+			fresh = append(fresh, n)
+		}
+	}
+
+	return fresh
+}
+
+// sendWeeklyDigests emails each opted-in user a summary of their open
+// notifications, at most once a week
+func (app *Application) sendWeeklyDigests() error {
+	if app.mailer == nil {
+		return nil
+	}
+
+	var users []User
+	if err := app.db.Where("email_digest = ?", true).Find(&users).Error; err != nil {
+		slog.Error("loading digest users failed", "error", err)
+		return err
+	}
+
+	now := time.Now()
+	sent, failed := 0, 0
+	for _, u := range users {
+		if u.LastDigestAt != nil && now.Sub(*u.LastDigestAt) < 7*24*time.Hour {
+			continue
+		}
+		prefs := app.loadNotificationPreference(u.ID)
+		if prefs.InQuietHours(now) {
+			continue
+		}
+
+		var notifications []Notification
+		app.db.
+			Where("user_id = ? AND status IN ?", u.ID, openNotificationStatuses).
+			Order("vehicle_id, created_at").
+			Find(&notifications)
+
+		vehicles := app.groupNotificationsByVehicle(notifications)
+
+		msg, err := renderDigestEmail(u, vehicles)
+		if err != nil {
+			slog.Error("rendering digest failed", "user_id", u.ID, "error", err)
+			failed++
+			continue
+		}
+
+		if err := app.sendLoggedEmail(u.ID, "digest", msg, nil); err != nil {
+			failed++
+			continue
+		}
+		app.db.Model(&User{}).Where("id = ?", u.ID).Update("last_digest_at", now)
+		sent++
+	}
+	if sent > 0 {
+		slog.Info("sent weekly digests", "count", sent)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d digests failed", failed)
+	}
+	return nil
+}
+
+func (app *Application) groupNotificationsByVehicle(notifications []Notification) []digestVehicle {
+	var vehicles []digestVehicle
+	index := make(map[uint]int)
+
+	for _, n := range notifications {
+		i, exists := index[n.VehicleID]
+		if !exists {
+			var v Vehicle
+			app.db.First(&v, n.VehicleID)
+			vehicles = append(vehicles, digestVehicle{
+				Name: fmt.Sprintf("%d %s %s", v.Year, v.Make, v.Model),
+			})
+			i = len(vehicles) - 1
+			index[n.VehicleID] = i
+		}
+		vehicles[i].Alerts = append(vehicles[i].Alerts, n)
+	}
+
+	return vehicles
+}
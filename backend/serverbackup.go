@@ -0,0 +1,535 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server backups are snapshots of the whole database, taken by an admin or on
+// a schedule, unlike the per-user backups in backup.go. Each is a zip holding
+// clarkson.db, written with VACUUM INTO so the snapshot is consistent while
+// the server keeps running, and optionally the assets directory under
+// assets/. They are only available with SQLite (see database.go). Old backups are rotated: the newest backup of each of the last few
+// days, weeks and months is kept, as is everything from the last day.
+
+// ServerBackupConfig holds the backup schedule and retention settings
+type ServerBackupConfig struct {
+	Dir           string
+	Interval      time.Duration // 0 disables scheduled backups
+	KeepDaily     int
+	KeepWeekly    int
+	KeepMonthly   int
+	IncludeAssets bool
+	AssetsPath    string
+}
+
+// ServerBackup is a backup file in the backup directory
+type ServerBackup struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Assets    bool      `json:"assets"` // Includes the assets directory
+}
+
+// serverBackupName matches backup file names; the time they were taken is
+// in UTC
+var serverBackupName = regexp.MustCompile(`^clarkson-(\d{8}-\d{6})\.zip$`)
+
+const serverBackupTimeFormat = "20060102-150405"
+
+// serverBackups returns the backups in the backup directory, newest
+// first
+func (app *Application) serverBackups() ([]ServerBackup, error) {
+	entries, err := os.ReadDir(app.backups.Dir)
+	if os.IsNotExist(err) {
+		return []ServerBackup{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []ServerBackup{}
+	for _, entry := range entries {
+		match := serverBackupName.FindStringSubmatch(entry.Name())
+		if match == nil || !entry.Type().IsRegular() {
+			continue
+		}
+		createdAt, err := time.Parse(serverBackupTimeFormat, match[1])
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backup := ServerBackup{Name: entry.Name(), Size: info.Size(), CreatedAt: createdAt}
+		if zr, err := zip.OpenReader(filepath.Join(app.backups.Dir, entry.Name())); err == nil {
+			for _, f := range zr.File {
+				if strings.HasPrefix(f.Name, "assets/") {
+					backup.Assets = true
+					break
+				}
+			}
+			zr.Close()
+		}
+		backups = append(backups, backup)
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// takeServerBackup takes a backup now and rotates old ones
+func (app *Application) takeServerBackup() (ServerBackup, error) {
+	app.backupMu.Lock()
+	defer app.backupMu.Unlock()
+	return app.writeServerBackup()
+}
+
+// writeServerBackup snapshots the database, and the assets if configured,
+// into a new zip. The caller holds backupMu.
+func (app *Application) writeServerBackup() (ServerBackup, error) {
+	cfg := app.backups
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return ServerBackup{}, err
+	}
+
+	now := time.Now().UTC()
+	backup := ServerBackup{
+		Name:      "clarkson-" + now.Format(serverBackupTimeFormat) + ".zip",
+		CreatedAt: now.Truncate(time.Second),
+	}
+	target := filepath.Join(cfg.Dir, backup.Name)
+	if _, err := os.Stat(target); err == nil {
+		return ServerBackup{}, fmt.Errorf("backup %s already exists", backup.Name)
+	}
+
+	snapshot := filepath.Join(cfg.Dir, ".snapshot-"+now.Format(serverBackupTimeFormat)+".db")
+	os.Remove(snapshot)
+	defer os.Remove(snapshot)
+	if err := app.db.Exec("VACUUM INTO ?", snapshot).Error; err != nil {
+		return ServerBackup{}, fmt.Errorf("database snapshot failed: %v", err)
+	}
+
+	// Written under a temporary name so a half-written zip is never listed
+	tmp := target + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return ServerBackup{}, err
+	}
+	zw := zip.NewWriter(f)
+	err = copyFileToZip(zw, "clarkson.db", snapshot)
+	if err == nil && cfg.IncludeAssets {
+		backup.Assets = true
+		err = filepath.WalkDir(cfg.AssetsPath, func(p string, d fs.DirEntry, err error) error {
+			if os.IsNotExist(err) && p == cfg.AssetsPath {
+				return filepath.SkipDir
+			}
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(cfg.AssetsPath, p)
+			if err != nil {
+				return err
+			}
+			return copyFileToZip(zw, "assets/"+filepath.ToSlash(rel), p)
+		})
+	}
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return ServerBackup{}, err
+	}
+
+	if info, err := os.Stat(target); err == nil {
+		backup.Size = info.Size()
+	}
+	slog.Info("server backup written", "name", backup.Name, "size", backup.Size, "assets", backup.Assets, "duration", time.Since(now))
+	if err := app.pruneServerBackups(); err != nil {
+		slog.Error("rotating server backups failed", "error", err)
+	}
+	return backup, nil
+}
+
+// keptServerBackups picks the backups the retention settings keep: the
+// newest one, any taken in the last 24 hours, and the newest of each of the
+// last KeepDaily days, KeepWeekly ISO weeks and KeepMonthly months that have
+// a backup. Backups are newest first.
+func keptServerBackups(backups []ServerBackup, cfg ServerBackupConfig, now time.Time) map[string]bool {
+	keep := make(map[string]bool)
+	for i, b := range backups {
+		if i == 0 || now.Sub(b.CreatedAt) < 24*time.Hour {
+			keep[b.Name] = true
+		}
+	}
+
+	rules := []struct {
+		count  int
+		period func(t time.Time) string
+	}{
+		{cfg.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{cfg.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{cfg.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, rule := range rules {
+		seen := make(map[string]bool)
+		for _, b := range backups {
+			if len(seen) >= rule.count {
+				break
+			}
+			if period := rule.period(b.CreatedAt); !seen[period] {
+				seen[period] = true
+				keep[b.Name] = true
+			}
+		}
+	}
+	return keep
+}
+
+// pruneServerBackups deletes backups no retention rule keeps
+func (app *Application) pruneServerBackups() error {
+	backups, err := app.serverBackups()
+	if err != nil {
+		return err
+	}
+	keep := keptServerBackups(backups, app.backups, time.Now())
+	pruned := 0
+	for _, b := range backups {
+		if !keep[b.Name] {
+			if err := os.Remove(filepath.Join(app.backups.Dir, b.Name)); err != nil {
+				return err
+			}
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		slog.Info("pruned old server backups", "count", pruned, "kept", len(keep))
+	}
+	return nil
+}
+
+// runBackupScheduler takes a backup whenever the newest one is older than
+// the interval, so restarting the server doesn't take an extra one. It
+// returns when ctx is done, never in the middle of a backup.
+func (app *Application) runBackupScheduler(ctx context.Context, interval time.Duration) {
+	for {
+		next := time.Now()
+		if backups, err := app.serverBackups(); err == nil && len(backups) > 0 {
+			next = backups[0].CreatedAt.Add(interval)
+		}
+		if wait := time.Until(next); wait > 0 {
+			if !sleepContext(ctx, wait) {
+				return
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		err := app.metrics.runJob("backup", func() error {
+			_, err := app.takeServerBackup()
+			return err
+		})
+		if err != nil {
+			slog.Error("scheduled backup failed", "error", err)
+			// Try again later rather than on every pass
+			if !sleepContext(ctx, min(interval, time.Hour)) {
+				return
+			}
+		}
+	}
+}
+
+// ServerRestore describes a completed restore
+type ServerRestore struct {
+	Restored     string `json:"restored"`
+	SafetyBackup string `json:"safety_backup"` // Taken just before, to undo the restore
+	Tables       int    `json:"tables"`
+	Assets       int    `json:"assets"` // Files written to the assets directory
+}
+
+// restoreServerSnapshot replaces every table's rows with the backup's in one
+// transaction on the live database, after taking a safety backup. Columns
+// the backup doesn't have get their defaults. With withAssets the backup's
+// asset files are written back, overwriting files of the same name; other
+// files are left alone.
+func (app *Application) restoreServerSnapshot(name string, withAssets bool) (ServerRestore, error) {
+	app.backupMu.Lock()
+	defer app.backupMu.Unlock()
+
+	result := ServerRestore{Restored: name}
+	zr, err := zip.OpenReader(filepath.Join(app.backups.Dir, name))
+	if err != nil {
+		return result, err
+	}
+	defer zr.Close()
+
+	var database *zip.File
+	var assets []*zip.File
+	for _, f := range zr.File {
+		switch {
+		case f.Name == "clarkson.db":
+			database = f
+		case strings.HasPrefix(f.Name, "assets/") && !f.FileInfo().IsDir():
+			assets = append(assets, f)
+		}
+	}
+	if database == nil {
+		return result, fmt.Errorf("%s has no clarkson.db", name)
+	}
+
+	snapshot := filepath.Join(app.backups.Dir, ".restore-"+strings.TrimSuffix(name, ".zip")+".db")
+	defer os.Remove(snapshot)
+	if err := extractZipFile(database, snapshot, nil); err != nil {
+		return result, err
+	}
+
+	safety, err := app.writeServerBackup()
+	if err != nil {
+		return result, fmt.Errorf("safety backup failed: %v", err)
+	}
+	result.SafetyBackup = safety.Name
+
+	if result.Tables, err = app.copyTablesFrom(snapshot); err != nil {
+		return result, err
+	}
+
+	if withAssets {
+		for _, f := range assets {
+			rel := path.Clean(strings.TrimPrefix(f.Name, "assets/"))
+			if rel == "." || path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+				continue
+			}
+			target := filepath.Join(app.backups.AssetsPath, filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return result, err
+			}
+			if err := extractZipFile(f, target, nil); err != nil {
+				return result, err
+			}
+			result.Assets++
+		}
+	}
+
+	return result, nil
+}
+
+// copyTablesFrom replaces the rows of every table with those in the SQLite
+// file at path, returning the number of tables restored. ATTACH only applies
+// to one connection, so a dedicated one is used.
+func (app *Application) copyTablesFrom(path string) (int, error) {
+	sqlDB, err := app.db.DB()
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS restore", path); err != nil {
+		return 0, fmt.Errorf("can't open the backup's database: %v", err)
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE restore")
+
+	var check string
+	if err := conn.QueryRowContext(ctx, "PRAGMA restore.quick_check").Scan(&check); err != nil || check != "ok" {
+		return 0, fmt.Errorf("the backup's database is damaged")
+	}
+
+	names := func(query string, args ...interface{}) ([]string, error) {
+		rows, err := conn.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var result []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			result = append(result, name)
+		}
+		return result, rows.Err()
+	}
+	quote := func(name string) string {
+		return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+	}
+
+	tables, err := names("SELECT name FROM main.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	restored := 0
+	for _, table := range tables {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM main."+quote(table)); err != nil {
+			return 0, err
+		}
+
+		backupColumns, err := names("SELECT name FROM pragma_table_info(?, 'restore')", table)
+		if err != nil {
+			return 0, err
+		}
+		if len(backupColumns) == 0 {
+			continue // A table added since the backup was taken
+		}
+		inBackup := make(map[string]bool)
+		for _, column := range backupColumns {
+			inBackup[column] = true
+		}
+		liveColumns, err := names("SELECT name FROM pragma_table_info(?, 'main')", table)
+		if err != nil {
+			return 0, err
+		}
+		var columns []string
+		for _, column := range liveColumns {
+			if inBackup[column] {
+				columns = append(columns, quote(column))
+			}
+		}
+
+		list := strings.Join(columns, ", ")
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO main.%s (%s) SELECT %s FROM restore.%s", quote(table), list, list, quote(table))); err != nil {
+			return 0, fmt.Errorf("restoring %s failed: %v", table, err)
+		}
+		restored++
+	}
+
+	return restored, tx.Commit()
+}
+
+// serverBackupParam returns the backup named in the URL, answering 404 if
+// there is no such backup
+func (app *Application) serverBackupParam(c *gin.Context) (string, bool) {
+	name := c.Param("name")
+	if !serverBackupName.MatchString(name) {
+		c.JSON(404, gin.H{"error": "Backup not found"})
+		return "", false
+	}
+	if _, err := os.Stat(filepath.Join(app.backups.Dir, name)); err != nil {
+		c.JSON(404, gin.H{"error": "Backup not found"})
+		return "", false
+	}
+	return name, true
+}
+
+// listServerBackups lists server backups with the schedule and retention settings
+func (app *Application) listServerBackups(c *gin.Context) {
+	backups, err := app.serverBackups()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list backups"})
+		return
+	}
+
+	schedule := gin.H{
+		"interval":       app.backups.Interval.String(),
+		"keep_daily":     app.backups.KeepDaily,
+		"keep_weekly":    app.backups.KeepWeekly,
+		"keep_monthly":   app.backups.KeepMonthly,
+		"include_assets": app.backups.IncludeAssets,
+	}
+	if app.backups.Interval == 0 || !isSQLite(app.db) {
+		schedule["interval"] = ""
+	}
+	c.JSON(200, gin.H{"backups": backups, "schedule": schedule, "supported": isSQLite(app.db)})
+}
+
+// serverBackupsSupported responds 501 unless the database is SQLite
+func (app *Application) serverBackupsSupported(c *gin.Context) bool {
+	if !isSQLite(app.db) {
+		c.JSON(501, gin.H{"error": "Server backups need SQLite; back up " + app.db.Dialector.Name() + " with its own tools"})
+		return false
+	}
+	return true
+}
+
+// createServerBackup takes a server backup now
+func (app *Application) createServerBackup(c *gin.Context) {
+	if !app.serverBackupsSupported(c) {
+		return
+	}
+	backup, err := app.takeServerBackup()
+	if err != nil {
+		requestLogger(c).Error("server backup failed", "error", err)
+		c.JSON(500, gin.H{"error": "Backup failed: " + err.Error()})
+		return
+	}
+	c.JSON(201, backup)
+}
+
+// downloadServerBackup sends a server backup zip
+func (app *Application) downloadServerBackup(c *gin.Context) {
+	name, ok := app.serverBackupParam(c)
+	if !ok {
+		return
+	}
+	c.FileAttachment(filepath.Join(app.backups.Dir, name), name)
+}
+
+// restoreServerBackup restores the database, and unless ?assets=false the
+// asset files, from a server backup
+func (app *Application) restoreServerBackup(c *gin.Context) {
+	if !app.serverBackupsSupported(c) {
+		return
+	}
+	name, ok := app.serverBackupParam(c)
+	if !ok {
+		return
+	}
+
+	result, err := app.restoreServerSnapshot(name, c.Query("assets") != "false")
+	if err != nil {
+		requestLogger(c).Error("server backup restore failed", "name", name, "safety_backup", result.SafetyBackup, "error", err)
+		c.JSON(500, gin.H{"error": "Restore failed: " + err.Error(), "safety_backup": result.SafetyBackup})
+		return
+	}
+	requestLogger(c).Info("server backup restored", "name", name, "safety_backup", result.SafetyBackup)
+	c.JSON(200, result)
+}
+
+// deleteServerBackup deletes a server backup
+func (app *Application) deleteServerBackup(c *gin.Context) {
+	name, ok := app.serverBackupParam(c)
+	if !ok {
+		return
+	}
+	if err := os.Remove(filepath.Join(app.backups.Dir, name)); err != nil {
+		c.JSON(500, gin.H{"error": "Delete failed"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Deleted"})
+}
@@ -5,7 +5,6 @@ import (
 	"image"
 	"image/jpeg"
 	"image/png"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -14,23 +13,6 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-type Attachment struct {
-	ID        uint   `gorm:"primaryKey"`
-	EntryID   uint   `gorm:"not null"`
-	EntryType string `gorm:"not null"`
-	Filename  string `gorm:"not null"`
-	Path      string `gorm:"not null"`
-}
-
-func parseUint(s string) uint {
-	i, _ := strconv.ParseUint(s, 10, 64)
-	return uint(i)
-}
-
-type Application struct {
-	db *gorm.DB
-}
-
 func (app *Application) compressImage(inputPath string, outputPath string, quality int) error {
 	// Open the image
 	file, err := os.Open(inputPath)
@@ -88,9 +70,9 @@ func (app *Application) handleFileUpload(c *gin.Context) {
 		return
 	}
 
-	// Validate file size (max 10MB)
-	if file.Size > 10*1024*1024 {
-		c.JSON(400, gin.H{"error": "File too large (max 10MB)"})
+	// Validate file size
+	if file.Size > int64(app.config.MaxAttachmentMB)<<20 {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("File too large (max %dMB)", app.config.MaxAttachmentMB)})
 		return
 	}
 
@@ -107,10 +89,7 @@ func (app *Application) handleFileUpload(c *gin.Context) {
 		return
 	}
 
-	assetsPath := os.Getenv("ASSETS_PATH")
-	if assetsPath == "" {
-		assetsPath = "/assets"
-	}
+	assetsPath := app.config.AssetsPath
 
 	os.MkdirAll(assetsPath, 0755)
 
@@ -123,6 +102,7 @@ func (app *Application) handleFileUpload(c *gin.Context) {
 		c.JSON(500, gin.H{"error": "Upload failed"})
 		return
 	}
+	app.metrics.uploaded("attachment", file.Size)
 
 	// Compress image if it's a photo
 	if strings.Contains(file.Header.Get("Content-Type"), "image") {
@@ -162,10 +142,7 @@ func (app *Application) handleFileDownload(c *gin.Context) {
 		return
 	}
 
-	assetsPath := os.Getenv("ASSETS_PATH")
-	if assetsPath == "" {
-		assetsPath = "/assets"
-	}
+	assetsPath := app.config.AssetsPath
 
 	filepath := filepath.Join(assetsPath, filename)
 
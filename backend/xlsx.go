@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+)
+
+// XLSX export. The workbook opens with a summary sheet of totals and economy
+// per vehicle and per year, followed by a sheet per vehicle with its
+// fill-ups, expenses and services. Cells are typed: dates are dates and
+// amounts are numbers with the user's currency format, so they can be summed
+// and sorted as they are. Services are Maintenance expenses, so the expenses
+// section lists the other categories and nothing is counted twice.
+
+const xlsxSummarySheet = "Summary"
+
+// xlsxCurrencySymbols are the currencies shown with their symbol rather than
+// their code
+var xlsxCurrencySymbols = map[string]string{
+	"USD": "$", "EUR": "€", "GBP": "£", "JPY": "¥", "INR": "₹",
+	"AUD": "A$", "CAD": "CA$", "NZD": "NZ$",
+}
+
+// xlsxMoneyFormat is the number format for amounts in a currency
+func xlsxMoneyFormat(currency string) string {
+	if symbol, ok := xlsxCurrencySymbols[currency]; ok {
+		return fmt.Sprintf(`"%s"#,##0.00;-"%s"#,##0.00`, symbol, symbol)
+	}
+	return fmt.Sprintf(`#,##0.00 "%s";-#,##0.00 "%s"`, currency, currency)
+}
+
+// xlsxStyles are the cell styles used across the workbook
+type xlsxStyles struct {
+	title, section, header, label, date    int
+	money, distance, volume, economy       int
+	totalMoney, totalDistance, totalVolume int
+}
+
+func newXLSXStyles(f *excelize.File, currency string) (xlsxStyles, error) {
+	var s xlsxStyles
+	bold := &excelize.Font{Bold: true}
+	moneyFormat := xlsxMoneyFormat(currency)
+	dateFormat := "yyyy-mm-dd"
+	distanceFormat := "#,##0"
+	volumeFormat := "#,##0.00"
+	economyFormat := "0.0"
+
+	styles := []struct {
+		id    *int
+		style excelize.Style
+	}{
+		{&s.title, excelize.Style{Font: &excelize.Font{Bold: true, Size: 14}}},
+		{&s.section, excelize.Style{Font: &excelize.Font{Bold: true, Size: 12}}},
+		{&s.header, excelize.Style{
+			Font:   bold,
+			Fill:   excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"DDE4EE"}},
+			Border: []excelize.Border{{Type: "bottom", Color: "808080", Style: 1}},
+		}},
+		{&s.label, excelize.Style{Font: bold}},
+		{&s.date, excelize.Style{CustomNumFmt: &dateFormat}},
+		{&s.money, excelize.Style{CustomNumFmt: &moneyFormat}},
+		{&s.distance, excelize.Style{CustomNumFmt: &distanceFormat}},
+		{&s.volume, excelize.Style{CustomNumFmt: &volumeFormat}},
+		{&s.economy, excelize.Style{CustomNumFmt: &economyFormat}},
+		{&s.totalMoney, excelize.Style{Font: bold, CustomNumFmt: &moneyFormat}},
+		{&s.totalDistance, excelize.Style{Font: bold, CustomNumFmt: &distanceFormat}},
+		{&s.totalVolume, excelize.Style{Font: bold, CustomNumFmt: &volumeFormat}},
+	}
+	for _, def := range styles {
+		id, err := f.NewStyle(&def.style)
+		if err != nil {
+			return s, err
+		}
+		*def.id = id
+	}
+	return s, nil
+}
+
+func xlsxCell(style int, value interface{}) excelize.Cell {
+	return excelize.Cell{StyleID: style, Value: value}
+}
+
+// xlsxSheet appends rows to a streamed worksheet. The first error stops
+// further writes and is returned by flush.
+type xlsxSheet struct {
+	sw  *excelize.StreamWriter
+	row int
+	err error
+}
+
+func newXLSXSheet(f *excelize.File, name string, widths ...float64) (*xlsxSheet, error) {
+	sw, err := f.NewStreamWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	// Column widths have to be set before the first row
+	for i, w := range widths {
+		if err := sw.SetColWidth(i+1, i+1, w); err != nil {
+			return nil, err
+		}
+	}
+	return &xlsxSheet{sw: sw}, nil
+}
+
+func (s *xlsxSheet) add(values ...interface{}) {
+	s.row++
+	if s.err != nil {
+		return
+	}
+	cell, err := excelize.CoordinatesToCellName(1, s.row)
+	if err == nil {
+		err = s.sw.SetRow(cell, values)
+	}
+	s.err = err
+}
+
+func (s *xlsxSheet) header(style int, names ...string) {
+	values := make([]interface{}, len(names))
+	for i, name := range names {
+		values[i] = xlsxCell(style, name)
+	}
+	s.add(values...)
+}
+
+func (s *xlsxSheet) skip() {
+	s.row++
+}
+
+func (s *xlsxSheet) flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.sw.Flush()
+}
+
+// xlsxSheetName makes a vehicle's name a valid, unused sheet name: at most
+// 31 characters and none of : \ / ? * [ ]
+func xlsxSheetName(v Vehicle, used map[string]bool) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`:\/?*[]`, r) {
+			return '-'
+		}
+		return r
+	}, vehicleName(v))
+	name = strings.Trim(strings.TrimSpace(name), "'")
+	if name == "" {
+		name = fmt.Sprintf("Vehicle %d", v.ID)
+	}
+
+	base := name
+	for n := 2; ; n++ {
+		if runes := []rune(name); len(runes) > 31 {
+			name = string(runes[:31])
+		}
+		if !used[strings.ToLower(name)] {
+			break
+		}
+		suffix := fmt.Sprintf(" (%d)", n)
+		runes := []rune(base)
+		name = string(runes[:min(len(runes), 31-len(suffix))]) + suffix
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
+
+// xlsxYear is a vehicle's totals for one calendar year
+type xlsxYear struct {
+	Year            int
+	Distance        float64
+	Volume          float64
+	FuelCosts       float64
+	MaintenanceCost float64
+	OtherCosts      float64
+
+	economyVolume float64 // fuel burnt over Distance, from the fuel trend
+}
+
+func (y xlsxYear) total() float64 {
+	return y.FuelCosts + y.MaintenanceCost + y.OtherCosts
+}
+
+func (y xlsxYear) economy() float64 {
+	if y.economyVolume == 0 {
+		return 0
+	}
+	return y.Distance / y.economyVolume
+}
+
+// reportYears splits a vehicle report by calendar year. Distance and economy
+// come from the monthly fuel trend, so they are worked out the same way as in
+// the reports.
+func reportYears(report VehicleReportData) []xlsxYear {
+	years := make(map[int]*xlsxYear)
+	year := func(y int) *xlsxYear {
+		if years[y] == nil {
+			years[y] = &xlsxYear{Year: y}
+		}
+		return years[y]
+	}
+
+	for _, f := range report.FuelEntries {
+		y := year(f.Date.Year())
+		y.Volume += f.Gallons
+		y.FuelCosts += f.Price
+	}
+	for _, point := range report.FuelTrend {
+		month, err := time.Parse("2006-01", point.Month)
+		if err != nil {
+			continue
+		}
+		y := year(month.Year())
+		y.Distance += point.Distance
+		y.economyVolume += point.Gallons
+	}
+	for _, e := range report.Expenses {
+		y := year(e.Date.Year())
+		if e.Category == "Maintenance" {
+			y.MaintenanceCost += e.Amount
+		} else {
+			y.OtherCosts += e.Amount
+		}
+	}
+
+	var result []xlsxYear
+	for _, y := range years {
+		result = append(result, *y)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Year < result[j].Year })
+	return result
+}
+
+// xlsxOptional leaves zero values blank
+func xlsxOptional(f float64) interface{} {
+	if f == 0 {
+		return nil
+	}
+	return f
+}
+
+func writeXLSXSummary(s *xlsxSheet, st xlsxStyles, reports []VehicleReportData, filter reportFilter, user User, currency string) {
+	s.add(xlsxCell(st.title, "Clarkson Export"))
+	s.add(xlsxCell(st.label, "Period"), filter.describe())
+	s.add(xlsxCell(st.label, "Generated"), xlsxCell(st.date, time.Now()), "for "+user.Name)
+	s.add(xlsxCell(st.label, "Currency"), currency)
+	s.skip()
+
+	s.add(xlsxCell(st.section, "By vehicle"))
+	s.header(st.header, "Vehicle", "Distance", "Unit", "Fuel Volume", "Fuel", "Services", "Other Expenses", "Total", "Cost per Distance", "Economy", "Economy Unit")
+	var fuel, services, other, total float64
+	for _, report := range reports {
+		v := report.Vehicle
+		volume := 0.0
+		for _, f := range report.FuelEntries {
+			volume += f.Gallons
+		}
+		var perDistance interface{}
+		if report.TotalDistance > 0 {
+			perDistance = xlsxCell(st.money, report.TotalCost/report.TotalDistance)
+		}
+		s.add(
+			vehicleName(v),
+			xlsxCell(st.distance, report.TotalDistance),
+			vehicleDistanceUnit(v, "mi"),
+			xlsxCell(st.volume, volume),
+			xlsxCell(st.money, report.FuelCosts),
+			xlsxCell(st.money, report.MaintenanceCost),
+			xlsxCell(st.money, report.OtherCosts),
+			xlsxCell(st.money, report.TotalCost),
+			perDistance,
+			xlsxCell(st.economy, xlsxOptional(report.AverageMPG)),
+			economyUnit(v),
+		)
+		fuel += report.FuelCosts
+		services += report.MaintenanceCost
+		other += report.OtherCosts
+		total += report.TotalCost
+	}
+	if len(reports) == 0 {
+		s.add("No vehicles to report on.")
+	}
+	s.add(
+		xlsxCell(st.label, "All vehicles"), nil, nil, nil,
+		xlsxCell(st.totalMoney, fuel),
+		xlsxCell(st.totalMoney, services),
+		xlsxCell(st.totalMoney, other),
+		xlsxCell(st.totalMoney, total),
+	)
+	s.skip()
+
+	// Distances are in each vehicle's own unit, so only costs are totalled
+	// across vehicles
+	s.add(xlsxCell(st.section, "By year"))
+	s.header(st.header, "Vehicle", "Year", "Distance", "Unit", "Fuel Volume", "Fuel", "Services", "Other Expenses", "Total", "Economy", "Economy Unit")
+	yearTotals := make(map[int]*xlsxYear)
+	for _, report := range reports {
+		v := report.Vehicle
+		for _, y := range reportYears(report) {
+			s.add(
+				vehicleName(v),
+				y.Year,
+				xlsxCell(st.distance, y.Distance),
+				vehicleDistanceUnit(v, "mi"),
+				xlsxCell(st.volume, y.Volume),
+				xlsxCell(st.money, y.FuelCosts),
+				xlsxCell(st.money, y.MaintenanceCost),
+				xlsxCell(st.money, y.OtherCosts),
+				xlsxCell(st.money, y.total()),
+				xlsxCell(st.economy, xlsxOptional(y.economy())),
+				economyUnit(v),
+			)
+			if yearTotals[y.Year] == nil {
+				yearTotals[y.Year] = &xlsxYear{Year: y.Year}
+			}
+			yearTotals[y.Year].FuelCosts += y.FuelCosts
+			yearTotals[y.Year].MaintenanceCost += y.MaintenanceCost
+			yearTotals[y.Year].OtherCosts += y.OtherCosts
+		}
+	}
+	var years []int
+	for year := range yearTotals {
+		years = append(years, year)
+	}
+	sort.Ints(years)
+	for _, year := range years {
+		y := yearTotals[year]
+		s.add(
+			xlsxCell(st.label, "All vehicles"),
+			xlsxCell(st.label, year), nil, nil, nil,
+			xlsxCell(st.totalMoney, y.FuelCosts),
+			xlsxCell(st.totalMoney, y.MaintenanceCost),
+			xlsxCell(st.totalMoney, y.OtherCosts),
+			xlsxCell(st.totalMoney, y.total()),
+		)
+	}
+}
+
+func writeXLSXVehicle(s *xlsxSheet, st xlsxStyles, report VehicleReportData) {
+	v := report.Vehicle
+	unit := vehicleDistanceUnit(v, "mi")
+	s.add(xlsxCell(st.title, vehicleName(v)))
+	s.skip()
+
+	s.add(xlsxCell(st.section, "Fuel"))
+	s.header(st.header, "Date", "Odometer", "Distance ("+unit+")", "Volume", "Cost", "Cost per Unit", "Partial Fill", "Missed Fillup", "Location", "Notes")
+	var distance, volume, cost float64
+	for i, f := range report.FuelEntries {
+		var sincePrevious, perUnit interface{}
+		if i > 0 {
+			d := f.Odometer - report.FuelEntries[i-1].Odometer
+			sincePrevious = xlsxCell(st.distance, d)
+			distance += d
+		}
+		if f.Gallons > 0 {
+			perUnit = xlsxCell(st.money, f.Price/f.Gallons)
+		}
+		s.add(
+			xlsxCell(st.date, f.Date),
+			xlsxCell(st.distance, f.Odometer),
+			sincePrevious,
+			xlsxCell(st.volume, f.Gallons),
+			xlsxCell(st.money, f.Price),
+			perUnit,
+			f.PartialFill,
+			f.MissedFillup,
+			f.Location,
+			f.Notes,
+		)
+		volume += f.Gallons
+		cost += f.Price
+	}
+	s.add(
+		xlsxCell(st.label, "Total"), nil,
+		xlsxCell(st.totalDistance, distance),
+		xlsxCell(st.totalVolume, volume),
+		xlsxCell(st.totalMoney, cost),
+	)
+	s.skip()
+
+	s.add(xlsxCell(st.section, "Expenses"))
+	s.header(st.header, "Date", "Category", "Amount", "Notes")
+	total := 0.0
+	for _, e := range report.Expenses {
+		if e.Category == "Maintenance" {
+			continue
+		}
+		s.add(xlsxCell(st.date, e.Date), e.Category, xlsxCell(st.money, e.Amount), e.Notes)
+		total += e.Amount
+	}
+	s.add(xlsxCell(st.label, "Total"), nil, xlsxCell(st.totalMoney, total))
+	s.skip()
+
+	// The first line of a service's notes says what was done, as in the
+	// interchange export
+	s.add(xlsxCell(st.section, "Services"))
+	s.header(st.header, "Date", "Service", "Amount", "Notes")
+	total = 0.0
+	for _, e := range report.Expenses {
+		if e.Category != "Maintenance" {
+			continue
+		}
+		description, notes, _ := strings.Cut(e.Notes, "\n")
+		s.add(xlsxCell(st.date, e.Date), description, xlsxCell(st.money, e.Amount), strings.TrimSpace(notes))
+		total += e.Amount
+	}
+	s.add(xlsxCell(st.label, "Total"), nil, xlsxCell(st.totalMoney, total))
+}
+
+// renderVehiclesXLSX builds the workbook for the given vehicles
+func (app *Application) renderVehiclesXLSX(user User, vehicles []Vehicle, filter reportFilter) (*excelize.File, error) {
+	currency := user.Currency
+	if currency == "" {
+		currency = "USD"
+	}
+
+	var reports []VehicleReportData
+	for _, v := range vehicles {
+		reports = append(reports, app.loadVehicleReport(v, filter))
+	}
+
+	f := excelize.NewFile()
+	if err := f.SetSheetName(f.GetSheetName(0), xlsxSummarySheet); err != nil {
+		return f, err
+	}
+	if err := f.SetDocProps(&excelize.DocProperties{Title: "Clarkson Export", Creator: "Clarkson"}); err != nil {
+		return f, err
+	}
+	st, err := newXLSXStyles(f, currency)
+	if err != nil {
+		return f, err
+	}
+
+	summary, err := newXLSXSheet(f, xlsxSummarySheet, 30, 12, 10, 12, 14, 14, 14, 14, 16, 10, 12)
+	if err != nil {
+		return f, err
+	}
+	writeXLSXSummary(summary, st, reports, filter, user, currency)
+	if err := summary.flush(); err != nil {
+		return f, err
+	}
+
+	used := map[string]bool{strings.ToLower(xlsxSummarySheet): true}
+	for _, report := range reports {
+		name := xlsxSheetName(report.Vehicle, used)
+		if _, err := f.NewSheet(name); err != nil {
+			return f, err
+		}
+		sheet, err := newXLSXSheet(f, name, 14, 16, 14, 12, 14, 14, 12, 14, 24, 40)
+		if err != nil {
+			return f, err
+		}
+		writeXLSXVehicle(sheet, st, report)
+		if err := sheet.flush(); err != nil {
+			return f, err
+		}
+	}
+
+	return f, nil
+}
+
+// exportXLSX sends the spreadsheet export for the selected vehicles (all by
+// default). Query: from, to, vehicle_id.
+func (app *Application) exportXLSX(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := app.db.First(&user, userID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+
+	filter, err := parseReportFilter(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	vehicles, err := app.filteredVehicles(userID, filter)
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	f, err := app.renderVehiclesXLSX(user, vehicles, filter)
+	defer f.Close()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate spreadsheet"})
+		return
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate spreadsheet"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=clarkson-export-%s.xlsx", time.Now().Format("2006-01-02")))
+	c.Data(200, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", buf.Bytes())
+}